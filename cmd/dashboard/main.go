@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dashboard serves a web page showing how training is going for one
+// or more models. Everything it needs (HTML, JavaScript, CSS) is
+// compiled in, so it works on machines with no internet access.
+
+//go:embed static
+var staticFiles embed.FS
+
+type dashboard struct {
+	models          []*model
+	evaluations     *sql.DB
+	refreshInterval time.Duration
+}
+
+type evaluationRun struct {
+	ID             int64      `json:"id"`
+	Description    string     `json:"description"`
+	ModelFile      string     `json:"model_file"`
+	ModelNodeCount *int64     `json:"model_node_count"`
+	CutoffDate     *time.Time `json:"cutoff_date"`
+	DataPoints     *int64     `json:"data_points"`
+	TotalLoss      *float64   `json:"total_loss"`
+	AverageDepth   *float64   `json:"average_depth"`
+	EndTime        *time.Time `json:"end_time"`
+}
+
+func main() {
+	databases := flag.String("database", "", "Comma-separated list of model databases to show")
+	nodesTable := flag.String("nodes-table", "nodes", "Name of the nodes table")
+	evaluations := flag.String("evaluations", "", "Database with the evaluation_runs table written by evaluatemodel (optional)")
+	listen := flag.String("listen", "localhost:8080", "Address to serve the dashboard on")
+	refresh := flag.Duration("refresh", 30*time.Second, "How often the page refreshes while training is running")
+	flag.Parse()
+
+	if *databases == "" {
+		log.Fatal("--database is required")
+	}
+
+	d := &dashboard{refreshInterval: *refresh}
+	for _, path := range strings.Split(*databases, ",") {
+		path = strings.TrimSpace(path)
+		m, err := openModel(path, *nodesTable)
+		if err != nil {
+			log.Fatalf("Could not open %s: %v", path, err)
+		}
+		defer m.db.Close()
+		d.models = append(d.models, m)
+	}
+	if *evaluations != "" {
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", *evaluations))
+		if err != nil {
+			log.Fatalf("Could not open %s: %v", *evaluations, err)
+		}
+		defer db.Close()
+		d.evaluations = db
+	}
+
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatalf("Could not find the embedded files: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/api/models", d.handleModels)
+	mux.HandleFunc("/api/model", d.handleModel)
+	mux.HandleFunc("/api/evaluations", d.handleEvaluations)
+
+	log.Printf("Serving the dashboard for %d model(s) on http://%s/", len(d.models), *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Could not write response: %v", err)
+	}
+}
+
+func (d *dashboard) handleModels(w http.ResponseWriter, r *http.Request) {
+	type modelEntry struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}
+	entries := make([]modelEntry, len(d.models))
+	for i, m := range d.models {
+		entries[i] = modelEntry{ID: i, Name: m.name, Path: m.path}
+	}
+	writeJSON(w, map[string]interface{}{
+		"models":          entries,
+		"refresh_seconds": d.refreshInterval.Seconds(),
+		"has_evaluations": d.evaluations != nil,
+	})
+}
+
+func (d *dashboard) handleModel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id < 0 || id >= len(d.models) {
+		http.Error(w, "unknown model", http.StatusNotFound)
+		return
+	}
+	status, err := d.models[id].status(time.Now())
+	if err != nil {
+		log.Printf("Could not get the status of %s: %v", d.models[id].path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (d *dashboard) handleEvaluations(w http.ResponseWriter, r *http.Request) {
+	if d.evaluations == nil {
+		writeJSON(w, []evaluationRun{})
+		return
+	}
+	runs, err := latestEvaluations(d.evaluations, 20)
+	if err != nil {
+		log.Printf("Could not read evaluation_runs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, runs)
+}
+
+func latestEvaluations(db *sql.DB, limit int) ([]evaluationRun, error) {
+	rows, err := db.Query(`
+		SELECT evaluation_run_id, description, model_file, model_node_count, cutoff_date,
+		       number_of_data_points, total_loss, average_depth, evaluation_end_time
+		FROM evaluation_runs
+		ORDER BY evaluation_run_id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []evaluationRun{}
+	for rows.Next() {
+		var run evaluationRun
+		var nodeCount, dataPoints sql.NullInt64
+		var totalLoss, averageDepth sql.NullFloat64
+		var cutoff, endTime sql.NullTime
+		err := rows.Scan(&run.ID, &run.Description, &run.ModelFile, &nodeCount, &cutoff,
+			&dataPoints, &totalLoss, &averageDepth, &endTime)
+		if err != nil {
+			return nil, err
+		}
+		if nodeCount.Valid {
+			run.ModelNodeCount = &nodeCount.Int64
+		}
+		if cutoff.Valid {
+			run.CutoffDate = &cutoff.Time
+		}
+		if dataPoints.Valid {
+			run.DataPoints = &dataPoints.Int64
+		}
+		if totalLoss.Valid {
+			run.TotalLoss = &totalLoss.Float64
+		}
+		if averageDepth.Valid {
+			run.AverageDepth = &averageDepth.Float64
+		}
+		if endTime.Valid {
+			run.EndTime = &endTime.Time
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
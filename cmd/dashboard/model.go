@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// If there hasn't been a split for this long, and nothing is being
+// analysed, we assume train isn't running.
+const trainingIdleAfter = 10 * time.Minute
+
+// Long histories get thinned out to about this many points, which is
+// plenty for a chart.
+const maxChartPoints = 500
+
+type model struct {
+	name       string
+	path       string
+	nodesTable string
+	db         *sql.DB
+
+	// The history is only re-read when the nodes table changes
+	mu          sync.Mutex
+	fingerprint string
+	history     *node.History
+}
+
+type lossPoint struct {
+	Split     int       `json:"split"`
+	When      time.Time `json:"when"`
+	SumLoss   float64   `json:"sum_loss"`
+	NodeCount int       `json:"node_count"`
+}
+
+type analysedNode struct {
+	ID       int    `json:"id"`
+	Ancestry string `json:"ancestry"`
+}
+
+type contextUsage struct {
+	K     int `json:"k"`
+	Count int `json:"count"`
+}
+
+type modelStatus struct {
+	Name           string         `json:"name"`
+	Path           string         `json:"path"`
+	NodeCount      int            `json:"node_count"`
+	LeafCount      int            `json:"leaf_count"`
+	SplitCount     int            `json:"split_count"`
+	SumLoss        float64        `json:"sum_loss"`
+	LastSplit      *time.Time     `json:"last_split"`
+	SplitsLastHour int            `json:"splits_last_hour"`
+	SplitsPerHour  float64        `json:"splits_per_hour"`
+	Training       bool           `json:"training"`
+	BeingAnalysed  []analysedNode `json:"being_analysed"`
+	LossHistory    []lossPoint    `json:"loss_history"`
+	ContextUsage   []contextUsage `json:"context_usage"`
+}
+
+func openModel(path, nodesTable string) (*model, error) {
+	// Read-only, so that there's no chance of getting in train's way
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &model{
+		name:       filepath.Base(path),
+		path:       path,
+		nodesTable: nodesTable,
+		db:         db,
+	}, nil
+}
+
+func (m *model) currentHistory() (*node.History, error) {
+	var count int
+	var maxID sql.NullInt64
+	var lastSplit sql.NullString
+	query := fmt.Sprintf("SELECT count(*), max(id), max(when_children_populated) FROM %s", m.nodesTable)
+	if err := m.db.QueryRow(query).Scan(&count, &maxID, &lastSplit); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", m.nodesTable, err)
+	}
+	fingerprint := fmt.Sprintf("%d/%d/%s", count, maxID.Int64, lastSplit.String)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.history != nil && fingerprint == m.fingerprint {
+		return m.history, nil
+	}
+	history, err := node.FetchHistory(m.db, m.nodesTable)
+	if err != nil {
+		return nil, err
+	}
+	m.history = history
+	m.fingerprint = fingerprint
+	return history, nil
+}
+
+func (m *model) status(now time.Time) (*modelStatus, error) {
+	history, err := m.currentHistory()
+	if err != nil {
+		return nil, err
+	}
+	status := &modelStatus{Name: m.name, Path: m.path, SplitCount: history.Len()}
+
+	summaries := history.Summaries(history.LastSeq())
+	if len(summaries) > 0 {
+		latest := summaries[len(summaries)-1]
+		status.NodeCount = latest.NodeCount
+		status.LeafCount = latest.LeafCount
+		status.SumLoss = latest.SumLoss
+	}
+	step := 1
+	if len(summaries) > maxChartPoints {
+		step = (len(summaries) + maxChartPoints - 1) / maxChartPoints
+	}
+	for i, s := range summaries {
+		// Always include the latest point
+		if i%step == 0 || i == len(summaries)-1 {
+			status.LossHistory = append(status.LossHistory, lossPoint{s.Split, s.When, s.SumLoss, s.NodeCount})
+		}
+	}
+
+	splits := history.Splits()
+	if len(splits) > 0 {
+		last := splits[len(splits)-1].When
+		status.LastSplit = &last
+		for _, s := range splits {
+			if now.Sub(s.When) <= time.Hour {
+				status.SplitsLastHour++
+			}
+		}
+		if elapsed := last.Sub(splits[0].When).Hours(); elapsed > 0 {
+			status.SplitsPerHour = float64(len(splits)-1) / elapsed
+		}
+		status.Training = now.Sub(last) < trainingIdleAfter
+	}
+
+	status.BeingAnalysed, err = m.beingAnalysed(history)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.BeingAnalysed) > 0 {
+		status.Training = true
+	}
+
+	status.ContextUsage, err = m.contextUsage()
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (m *model) beingAnalysed(history *node.History) ([]analysedNode, error) {
+	rows, err := m.db.Query(fmt.Sprintf("SELECT id FROM %s WHERE being_analysed ORDER BY id", m.nodesTable))
+	if err != nil {
+		return nil, fmt.Errorf("could not find the nodes being analysed: %v", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// The node being analysed is a leaf of the current tree
+	current, err := history.TreeAt(history.LastSeq())
+	if err != nil {
+		return nil, err
+	}
+	var result []analysedNode
+	for _, id := range ids {
+		ancestry, err := decode.NodeAncestry(m.db, current, tree.NodeID(id))
+		if err != nil {
+			ancestry = fmt.Sprintf("(could not decode the ancestry: %v)", err)
+		}
+		result = append(result, analysedNode{ID: id, Ancestry: ancestry})
+	}
+	return result, nil
+}
+
+// contextUsage is the same histogram that contextreport records
+func (m *model) contextUsage() ([]contextUsage, error) {
+	rows, err := m.db.Query(fmt.Sprintf(`
+		SELECT contextk, COUNT(*)
+		FROM %s
+		WHERE contextk IS NOT NULL
+		GROUP BY contextk
+		ORDER BY contextk`, m.nodesTable))
+	if err != nil {
+		return nil, fmt.Errorf("could not count context usage: %v", err)
+	}
+	defer rows.Close()
+	var result []contextUsage
+	for rows.Next() {
+		var c contextUsage
+		if err := rows.Scan(&c.K, &c.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
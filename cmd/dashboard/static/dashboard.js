@@ -0,0 +1,179 @@
+// Draws the dashboard from /api/models, /api/model and /api/evaluations.
+// There are no external libraries: the charts are plain SVG.
+"use strict";
+
+const SVG = "http://www.w3.org/2000/svg";
+let refreshSeconds = 30;
+let refreshTimer = null;
+
+function el(tag, attrs, text) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    e.setAttribute(k, v);
+  }
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function svgEl(tag, attrs, text) {
+  const e = document.createElementNS(SVG, tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    e.setAttribute(k, v);
+  }
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function formatNumber(x, digits) {
+  if (x === null || x === undefined) {
+    return "-";
+  }
+  return Number(x).toLocaleString(undefined, {maximumFractionDigits: digits === undefined ? 0 : digits});
+}
+
+function formatTime(t) {
+  return t ? new Date(t).toLocaleString() : "-";
+}
+
+function stat(label, value) {
+  const div = el("div", {class: "stat"});
+  div.appendChild(el("div", {class: "value"}, value));
+  div.appendChild(el("div", {class: "label"}, label));
+  return div;
+}
+
+const WIDTH = 420, HEIGHT = 200, MARGIN = 40;
+
+function axes(svg, xMin, xMax, yMin, yMax) {
+  svg.appendChild(svgEl("line", {x1: MARGIN, y1: HEIGHT - MARGIN, x2: WIDTH - 10, y2: HEIGHT - MARGIN, stroke: "#999"}));
+  svg.appendChild(svgEl("line", {x1: MARGIN, y1: 10, x2: MARGIN, y2: HEIGHT - MARGIN, stroke: "#999"}));
+  svg.appendChild(svgEl("text", {x: MARGIN, y: HEIGHT - MARGIN + 14}, formatNumber(xMin)));
+  svg.appendChild(svgEl("text", {x: WIDTH - 10, y: HEIGHT - MARGIN + 14, "text-anchor": "end"}, formatNumber(xMax)));
+  svg.appendChild(svgEl("text", {x: MARGIN - 4, y: HEIGHT - MARGIN, "text-anchor": "end"}, formatNumber(yMin, 1)));
+  svg.appendChild(svgEl("text", {x: MARGIN - 4, y: 18, "text-anchor": "end"}, formatNumber(yMax, 1)));
+}
+
+function lineChart(title, points, xLabel) {
+  const div = el("div", {class: "chart"});
+  div.appendChild(el("h3", {}, title));
+  const svg = svgEl("svg", {width: WIDTH, height: HEIGHT});
+  if (points.length > 0) {
+    const xs = points.map(p => p[0]), ys = points.map(p => p[1]);
+    const xMin = Math.min(...xs), xMax = Math.max(...xs);
+    const yMin = Math.min(...ys), yMax = Math.max(...ys);
+    const sx = x => MARGIN + (xMax === xMin ? 0 : (x - xMin) / (xMax - xMin)) * (WIDTH - MARGIN - 10);
+    const sy = y => HEIGHT - MARGIN - (yMax === yMin ? 0 : (y - yMin) / (yMax - yMin)) * (HEIGHT - MARGIN - 10);
+    axes(svg, xMin, xMax, yMin, yMax);
+    svg.appendChild(svgEl("polyline", {class: "line", points: points.map(p => sx(p[0]) + "," + sy(p[1])).join(" ")}));
+    svg.appendChild(svgEl("text", {x: WIDTH / 2, y: HEIGHT - 8, "text-anchor": "middle"}, xLabel));
+  }
+  div.appendChild(svg);
+  return div;
+}
+
+function barChart(title, bars, xLabel) {
+  const div = el("div", {class: "chart"});
+  div.appendChild(el("h3", {}, title));
+  const svg = svgEl("svg", {width: WIDTH, height: HEIGHT});
+  if (bars.length > 0) {
+    const yMax = Math.max(...bars.map(b => b[1]));
+    const slot = (WIDTH - MARGIN - 10) / bars.length;
+    axes(svg, bars[0][0], bars[bars.length - 1][0], 0, yMax);
+    bars.forEach(([x, y], i) => {
+      const h = yMax === 0 ? 0 : y / yMax * (HEIGHT - MARGIN - 10);
+      const bar = svgEl("rect", {class: "bar", x: MARGIN + i * slot + 1, y: HEIGHT - MARGIN - h, width: Math.max(slot - 2, 1), height: h});
+      bar.appendChild(svgEl("title", {}, xLabel + " " + x + ": " + y));
+      svg.appendChild(bar);
+    });
+    svg.appendChild(svgEl("text", {x: WIDTH / 2, y: HEIGHT - 8, "text-anchor": "middle"}, xLabel));
+  }
+  div.appendChild(svg);
+  return div;
+}
+
+function renderModel(status) {
+  const section = el("section", {class: "model"});
+  section.appendChild(el("h2", {title: status.path}, status.name));
+  section.appendChild(el("p", {class: status.training ? "training" : "idle"},
+    status.training ? "Training is running" : "Training doesn't seem to be running"));
+
+  const stats = el("div", {class: "stats"});
+  stats.appendChild(stat("nodes", formatNumber(status.node_count)));
+  stats.appendChild(stat("leaves", formatNumber(status.leaf_count)));
+  stats.appendChild(stat("splits", formatNumber(status.split_count)));
+  stats.appendChild(stat("total leaf loss", formatNumber(status.sum_loss, 2)));
+  stats.appendChild(stat("splits in the last hour", formatNumber(status.splits_last_hour)));
+  stats.appendChild(stat("splits per hour (overall)", formatNumber(status.splits_per_hour, 1)));
+  stats.appendChild(stat("last split", formatTime(status.last_split)));
+  section.appendChild(stats);
+
+  const charts = el("div", {class: "charts"});
+  const history = status.loss_history || [];
+  charts.appendChild(lineChart("Total leaf loss", history.map(p => [p.split, p.sum_loss]), "split"));
+  charts.appendChild(lineChart("Node count", history.map(p => [p.split, p.node_count]), "split"));
+  charts.appendChild(barChart("Context usage", (status.context_usage || []).map(c => [c.k, c.count]), "context"));
+  section.appendChild(charts);
+
+  for (const n of status.being_analysed || []) {
+    section.appendChild(el("h3", {}, "Node " + n.id + " is being analysed"));
+    section.appendChild(el("p", {class: "ancestry"}, n.ancestry));
+  }
+  return section;
+}
+
+function renderEvaluations(runs) {
+  const section = document.getElementById("evaluations");
+  const tbody = section.querySelector("tbody");
+  tbody.replaceChildren();
+  for (const run of runs) {
+    const tr = el("tr");
+    for (const value of [run.id, formatTime(run.end_time), run.description, run.model_file,
+                         formatNumber(run.model_node_count), formatTime(run.cutoff_date),
+                         formatNumber(run.data_points), formatNumber(run.total_loss, 3),
+                         formatNumber(run.average_depth, 2)]) {
+      tr.appendChild(el("td", {}, String(value)));
+    }
+    tbody.appendChild(tr);
+  }
+  section.hidden = false;
+}
+
+async function getJSON(url) {
+  const response = await fetch(url, {cache: "no-store"});
+  if (!response.ok) {
+    throw new Error(url + ": " + response.status + " " + await response.text());
+  }
+  return response.json();
+}
+
+async function refresh() {
+  clearTimeout(refreshTimer);
+  const container = document.getElementById("models");
+  const refreshStatus = document.getElementById("refresh-status");
+  try {
+    const info = await getJSON("api/models");
+    refreshSeconds = info.refresh_seconds;
+    const statuses = await Promise.all(info.models.map(m => getJSON("api/model?id=" + m.id)));
+    container.replaceChildren(...statuses.map(renderModel));
+    if (info.has_evaluations) {
+      renderEvaluations(await getJSON("api/evaluations"));
+    }
+    if (statuses.some(s => s.training)) {
+      refreshStatus.textContent = "Updated " + new Date().toLocaleTimeString() +
+        "; refreshing every " + refreshSeconds + " seconds while training runs";
+      refreshTimer = setTimeout(refresh, refreshSeconds * 1000);
+    } else {
+      refreshStatus.textContent = "Updated " + new Date().toLocaleTimeString();
+    }
+  } catch (err) {
+    refreshStatus.textContent = "Could not update: " + err.message;
+    refreshTimer = setTimeout(refresh, refreshSeconds * 1000);
+  }
+}
+
+document.getElementById("refresh-now").addEventListener("click", refresh);
+refresh();
@@ -3,6 +3,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -11,11 +12,23 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/config"
 	"github.com/solresol/ultrametric-trees/pkg/decode"
 	"github.com/solresol/ultrametric-trees/pkg/exemplar"
 	"github.com/solresol/ultrametric-trees/pkg/inference"
+	"github.com/solresol/ultrametric-trees/pkg/modelfile"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/provenance"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
+// modelProvenance is what gets stored in evaluation_runs.training_provenance
+// (as a JSON list, one per model in the ensemble)
+type modelProvenance struct {
+	Model        string           `json:"model"`
+	TrainingRuns []provenance.Run `json:"training_runs"`
+}
+
 func main() {
 	runDescription := flag.String("run-description", "", "An informative name to describe the evaluation run")
 	modelPaths := flag.String("model", "", "Comma-separated list of paths to trained model SQLite files")
@@ -27,26 +40,30 @@ func main() {
 	limit := flag.Int64("limit", -1, "Stop after this many inferences")
 	contextLength := flag.Int64("context-length", 16, "Length of the context window")
 	timeFilterString := flag.String("model-cutoff-time", "2099-12-31 23:59:59", "Only use training nodes that are older than the given time (format: 2006-01-02 15:05:07)")
+	atSplit := flag.Int("at-split", -1, "Only use the model as it was straight after this split (overrides --model-cutoff-time)")
 	verbose := flag.Bool("verbose", false, "Enable verbose output")
+	configFlags := config.AddFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *runDescription == "" {
-		*runDescription = os.Getenv("ULTRATREE_EVAL_RUN_DESCRIPTION")
-	}
-	if *modelPaths == "" {
-		*modelPaths = os.Getenv("ULTRATREE_EVAL_MODEL_PATHS")
-	}
-	if *testdataDBPath == "" {
-		*testdataDBPath = os.Getenv("ULTRATREE_EVAL_TEST_DATA_DB_PATH")
-	}
-	if *outputDBPath == "" {
-		*outputDBPath = os.Getenv("ULTRATREE_EVAL_OUTPUT_DB_PATH")
+	// The environment variables were here before the configuration
+	// files, which is why some of them have their own names
+	settings, err := configFlags.Apply(flag.CommandLine, config.Program{
+		Name:      "evaluatemodel",
+		EnvPrefix: "ULTRATREE_EVAL_",
+		EnvAliases: map[string]string{
+			"model":              "ULTRATREE_EVAL_MODEL_PATHS",
+			"test-data-database": "ULTRATREE_EVAL_TEST_DATA_DB_PATH",
+			"output-database":    "ULTRATREE_EVAL_OUTPUT_DB_PATH",
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *timeFilterString == "2099-12-31 23:59:59" {
-		envTimeFilter := os.Getenv("ULTRATREE_EVAL_MODEL_CUTOFF_TIME")
-		if envTimeFilter != "" {
-			*timeFilterString = envTimeFilter
+	if *configFlags.Print {
+		if err := settings.Print(os.Stdout); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
 
 	if *runDescription == "" || *modelPaths == "" || *testdataDBPath == "" || *outputDBPath == "" {
@@ -67,25 +84,45 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error parsing timestamp: %v", err)
 	}
+	cutoff := node.NewCutoff(*atSplit, timeFilter)
 
 	// Initialize inference engines for all models
 	var inferenceEngines []*inference.ModelInference
+	var trainedBy []modelProvenance
 	totalModelSize := 0
 
 	for _, modelPath := range modelPathList {
 		modelPath = strings.TrimSpace(modelPath)
-		modelDB, err := sql.Open("sqlite3", modelPath)
-		if err != nil {
-			log.Fatalf("Error opening model database %s: %v", modelPath, err)
+		var engine *inference.ModelInference
+		var runs []provenance.Run
+		if modelfile.IsModelFile(modelPath) {
+			// These were frozen when they were exported, so the cutoff
+			// doesn't apply
+			engine, err = inference.OpenModelFile(modelPath)
+			if err == nil {
+				var meta modelfile.Metadata
+				meta, err = modelfile.ReadMetadata(modelPath)
+				runs = meta.TrainingRuns
+			}
+		} else {
+			var modelDB *sql.DB
+			modelDB, err = sql.Open("sqlite3", modelPath)
+			if err != nil {
+				log.Fatalf("Error opening model database %s: %v", modelPath, err)
+			}
+			defer modelDB.Close()
+			engine, err = inference.NewModelInferenceAt(modelDB, *nodesTable, cutoff)
+			if err == nil {
+				runs, err = provenance.Fetch(modelDB, *nodesTable)
+			}
 		}
-		defer modelDB.Close()
-
-		engine, err := inference.NewModelInference(modelDB, *nodesTable, timeFilter)
 		if err != nil {
 			log.Fatalf("Error initializing inference engine for %s: %v", modelPath, err)
 		}
+		defer engine.Close()
 
 		inferenceEngines = append(inferenceEngines, engine)
+		trainedBy = append(trainedBy, modelProvenance{Model: modelPath, TrainingRuns: runs})
 		totalModelSize += engine.Size()
 	}
 
@@ -112,24 +149,36 @@ func main() {
 		log.Fatalf("Error creating output table: %v", err)
 	}
 
-	// Insert evaluation run record
+	// Insert evaluation run record. Only one of cutoff_date and
+	// cutoff_split is filled in, depending on how the cutoff was given.
+	var cutoffDate sql.NullTime
+	var cutoffSplit sql.NullInt64
+	if cutoff.BySplit {
+		cutoffSplit = sql.NullInt64{Int64: int64(cutoff.Split), Valid: true}
+	} else {
+		cutoffDate = sql.NullTime{Time: timeFilter, Valid: true}
+	}
+	trainingProvenance, err := json.Marshal(trainedBy)
+	if err != nil {
+		log.Fatalf("Could not encode the training provenance: %v", err)
+	}
 	var evaluation_run_id int64
 	err = outputDB.QueryRow(`
 		insert into evaluation_runs (
 			description, model_file, model_table, model_node_count,
 			cutoff_date, context_length, validation_datafile,
-			validation_table, output_table
-		) values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			validation_table, output_table, cutoff_split, training_provenance
+		) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		returning evaluation_run_id`,
 		*runDescription, *modelPaths, *nodesTable, totalModelSize,
-		timeFilter, *contextLength, *testdataDBPath,
-		*testdataTable, *outputTable).Scan(&evaluation_run_id)
+		cutoffDate, *contextLength, *testdataDBPath,
+		*testdataTable, *outputTable, cutoffSplit, string(trainingProvenance)).Scan(&evaluation_run_id)
 	if err != nil {
 		log.Fatalf("Error inserting validation run: %v", err)
 	}
 
 	// Process validation data with ensemble model
-	totalLoss, err := processValidationData(modelPathList[0], testdataDB, outputDB, ensemble,
+	totalLoss, err := processValidationData(inferenceEngines[0].Dictionary(), testdataDB, outputDB, ensemble,
 		*testdataTable, *outputTable, int(*limit),
 		int(*contextLength), evaluation_run_id, *verbose)
 	if err != nil {
@@ -162,6 +211,21 @@ func createOutputTable(db *sql.DB, tableName string) error {
 		return err
 	}
 
+	// These were added after evaluation_runs first existed, so older
+	// output databases need them added.
+	for _, column := range []struct{ name, decl string }{
+		{"end_of_text_count", "integer"},
+		{"end_of_text_hits", "integer"},
+		{"end_of_text_false_alarms", "integer"},
+		{"end_of_text_loss", "float"},
+		{"cutoff_split", "integer"},
+		{"training_provenance", "text"},
+	} {
+		if err := addColumnIfMissing(db, "evaluation_runs", column.name, column.decl); err != nil {
+			return err
+		}
+	}
+
 	query := fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
 			id INTEGER PRIMARY KEY,
@@ -179,16 +243,36 @@ func createOutputTable(db *sql.DB, tableName string) error {
 	return err
 }
 
-func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
-	engine *inference.EnsemblingModel, testdataTable, outputTable string,
-	limit int, contextLength int, evaluation_run_id int64, verbose bool) (float64, error) {
-
-	// Open first model DB for word decoding
-	trainingDB, err := sql.Open("sqlite3", trainingDBPath)
+func addColumnIfMissing(db *sql.DB, tableName, columnName, columnDecl string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableName))
 	if err != nil {
-		return 0.0, fmt.Errorf("error opening training database for decoding: %v", err)
+		return fmt.Errorf("could not get the columns of %s: %v", tableName, err)
 	}
-	defer trainingDB.Close()
+	defer rows.Close()
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return fmt.Errorf("could not read the columns of %s: %v", tableName, err)
+		}
+		if name == columnName {
+			return nil
+		}
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, columnName, columnDecl))
+	if err != nil {
+		return fmt.Errorf("could not add column %s to %s: %v", columnName, tableName, err)
+	}
+	return nil
+}
+
+// Words are decoded using the dictionary of the first model
+func processValidationData(dictionary decode.Dictionary, testdataDB, outputDB *sql.DB,
+	engine *inference.EnsemblingModel, testdataTable, outputTable string,
+	limit int, contextLength int, evaluation_run_id int64, verbose bool) (float64, error) {
 
 	if verbose {
 		log.Printf("Running SELECT id, %s FROM %s", getContextColumns(contextLength), testdataTable)
@@ -214,6 +298,21 @@ func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
 	totalInRegionHits := 0
 	totalDataPoints := 0
 
+	// How well do we predict the end of a story? (Only possible if the
+	// test data knows what <END-OF-TEXT> looks like.)
+	endOfTextPath, err := decode.ReservedPath(testdataDB, decode.EndOfText)
+	if err != nil {
+		endOfTextPath, err = dictionary.ReservedPath(decode.EndOfText)
+		if err != nil {
+			log.Printf("No %s path available, so story endings won't be evaluated: %v", decode.EndOfText, err)
+			endOfTextPath = tree.Synsetpath{}
+		}
+	}
+	endOfTextCount := 0
+	endOfTextHits := 0
+	endOfTextFalseAlarms := 0
+	endOfTextLoss := 0.0
+
 	for rows.Next() {
 		var id int
 		var correctAnswer string
@@ -229,14 +328,20 @@ func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
 			return 0.0, fmt.Errorf("error scanning row: %v", err)
 		}
 
-		contextStrings := make([]string, 0, contextLength)
-		for _, ctx := range contexts {
-			if ctx.Valid {
-				contextStrings = append(contextStrings, ctx.String)
+		// Missing (or unparseable) context words stay in place as empty
+		// paths, so that contextK still refers to the right word.
+		contextPaths := make([]tree.Synsetpath, contextLength)
+		for i, ctx := range contexts {
+			if !ctx.Valid {
+				continue
+			}
+			contextPaths[i], err = tree.ParseSynsetpath(ctx.String)
+			if err != nil && verbose {
+				log.Printf("Treating context%d of %d as missing: %v", i+1, id, err)
 			}
 		}
 
-		contextString, err := decode.ShowContext(testdataDB, contextStrings)
+		contextString, err := decode.ShowContext(testdataDB, contextPaths)
 		if err != nil {
 			return 0.0, err
 		}
@@ -245,27 +350,26 @@ func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
 		}
 
 		// Use ensemble inference instead of single model
-		result, err := engine.InferFromEnsemble(contextStrings, verbose)
+		result, err := engine.InferFromEnsemble(contextPaths, verbose)
 		if err != nil {
 			log.Printf("Warning: ensemble inference failed for id %d: %v", id, err)
 			continue
 		}
 
-		predictionSynset, err := exemplar.ParseSynsetpath(result.PredictedPath)
-		if err != nil {
-			log.Printf("Could not turn the prediction %s into a synsetpath: %v", result.PredictedPath, err)
+		if result.PredictedPath.IsEmpty() {
+			log.Printf("Node %d has no prediction to make for %d", result.FinalNodeID, id)
 			continue
 		}
 
-		predictionWord, _ := decode.DecodePath(trainingDB, result.PredictedPath)
-		correctAnswerSynset, err := exemplar.ParseSynsetpath(correctAnswer)
+		predictionWord, _ := dictionary.DecodePath(result.PredictedPath)
+		correctAnswerSynset, err := tree.ParseSynsetpath(correctAnswer)
 		if err != nil {
 			log.Printf("Could not turn the answer %s into a synsetpath: %v", correctAnswer, err)
 			continue
 		}
 
-		answerWord, _ := decode.DecodePath(trainingDB, correctAnswer)
-		loss := exemplar.CalculateCost(predictionSynset, correctAnswerSynset)
+		answerWord, _ := dictionary.DecodePath(correctAnswerSynset)
+		loss := exemplar.CalculateCost(result.PredictedPath, correctAnswerSynset)
 
 		if verbose {
 			log.Printf("Prediction for %d was %s (%s); the correct answer was %s (%s). Loss was %f",
@@ -278,12 +382,24 @@ func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
 				predicted_path, correct_path, loss
 			) VALUES (?, ?, ?, ?, ?, ?)
 		`, outputTable), id, evaluation_run_id, result.FinalNodeID,
-			result.PredictedPath, correctAnswer, loss)
+			result.PredictedPath, correctAnswerSynset, loss)
 
 		if err != nil {
 			return 0.0, fmt.Errorf("error saving result for %d: %v", id, err)
 		}
 
+		if !endOfTextPath.IsEmpty() {
+			if correctAnswerSynset.Equal(endOfTextPath) {
+				endOfTextCount++
+				endOfTextLoss += loss
+				if result.PredictedPath.Equal(endOfTextPath) {
+					endOfTextHits++
+				}
+			} else if result.PredictedPath.Equal(endOfTextPath) {
+				endOfTextFalseAlarms++
+			}
+		}
+
 		totalLoss += loss
 		totalDepth += result.Depth
 		totalInRegionHits += result.InRegion
@@ -296,18 +412,31 @@ func processValidationData(trainingDBPath string, testdataDB, outputDB *sql.DB,
 			number_of_data_points = ?,
 			total_loss = ?,
 			average_depth = ?,
-			average_in_region_hits = ?
+			average_in_region_hits = ?,
+			end_of_text_count = ?,
+			end_of_text_hits = ?,
+			end_of_text_false_alarms = ?,
+			end_of_text_loss = ?
 		where evaluation_run_id = ?`,
 		totalDataPoints,
 		totalLoss,
 		float64(totalDepth)/float64(totalDataPoints),
 		float64(totalInRegionHits)/float64(totalDataPoints),
+		endOfTextCount,
+		endOfTextHits,
+		endOfTextFalseAlarms,
+		endOfTextLoss,
 		evaluation_run_id)
 
 	if err != nil {
 		return 0.0, fmt.Errorf("error closing off validation run %d: %v", evaluation_run_id, err)
 	}
 
+	if !endOfTextPath.IsEmpty() {
+		log.Printf("Story endings: %d in the test data, %d predicted correctly, %d predicted where there wasn't one, loss on endings %f",
+			endOfTextCount, endOfTextHits, endOfTextFalseAlarms, endOfTextLoss)
+	}
+
 	return totalLoss, nil
 }
 
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/modelfile"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+)
+
+// export writes a model file: the tree as it was at a cut-off, plus
+// the decodings, without any of the training data. generate and
+// evaluatemodel can use it in place of the training database.
+
+func main() {
+	database := flag.String("database", "", "SQLite database file the model was trained in")
+	nodesTable := flag.String("nodes-table", "nodes", "Name of the nodes table")
+	output := flag.String("output", "", "The model file to write")
+	timeFilterString := flag.String("model-cutoff-time", "2099-12-31 23:59:59", "Only export training nodes that are older than the given time (format: 2006-01-02 15:05:07)")
+	atSplit := flag.Int("at-split", -1, "Export the model as it was straight after this split (overrides --model-cutoff-time)")
+	flag.Parse()
+
+	if *database == "" || *output == "" {
+		log.Fatal("--database and --output are required")
+	}
+
+	timeFilter, err := time.Parse("2006-01-02 15:04:05", *timeFilterString)
+	if err != nil {
+		log.Fatalf("Error parsing timestamp: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", *database)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	// Write to a temporary file so that a failed export doesn't leave
+	// something that looks like a model behind
+	tmp := *output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatalf("Could not create %s: %v", tmp, err)
+	}
+	w := bufio.NewWriter(f)
+	meta, err := modelfile.Export(db, *nodesTable, node.NewCutoff(*atSplit, timeFilter), *database, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatalf("Could not export %s: %v", *nodesTable, err)
+	}
+	if err := os.Rename(tmp, *output); err != nil {
+		log.Fatalf("Could not rename %s to %s: %v", tmp, *output, err)
+	}
+
+	info, err := os.Stat(*output)
+	if err != nil {
+		log.Fatalf("Could not stat %s: %v", *output, err)
+	}
+	log.Printf("Wrote %d nodes (%s) to %s: %d bytes", meta.NodeCount, meta.Cutoff, *output, info.Size())
+}
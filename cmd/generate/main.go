@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/inference"
+	"github.com/solresol/ultrametric-trees/pkg/modelfile"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// generate continues a story from a prompt, one word at a time,
+// until it predicts <END-OF-TEXT> (or hits --max-words).
+
+func main() {
+	modelPath := flag.String("model", "", "Path to the trained model SQLite file, or a model file from bin/export")
+	nodesTable := flag.String("nodes-table", "nodes", "Name of the nodes table")
+	prompt := flag.String("prompt", "", "The beginning of the story (space separated words)")
+	maxWords := flag.Int("max-words", 50, "Stop after generating this many words")
+	stopAtEnd := flag.Bool("stop-at-end", true, "Stop when the model predicts <END-OF-TEXT>")
+	contextLength := flag.Int("context-length", 16, "Length of the context window")
+	timeFilterString := flag.String("model-cutoff-time", "2099-12-31 23:59:59", "Only use training nodes that are older than the given time (format: 2006-01-02 15:05:07)")
+	verbose := flag.Bool("verbose", false, "Enable verbose output")
+	flag.Parse()
+
+	if *modelPath == "" {
+		log.Fatal("--model is required")
+	}
+
+	timeFilter, err := time.Parse("2006-01-02 15:04:05", *timeFilterString)
+	if err != nil {
+		log.Fatalf("Error parsing timestamp: %v", err)
+	}
+
+	engine, err := openModel(*modelPath, *nodesTable, timeFilter)
+	if err != nil {
+		log.Fatalf("Error initializing inference engine for %s: %v", *modelPath, err)
+	}
+	defer engine.Close()
+	dictionary := engine.Dictionary()
+	if *stopAtEnd && engine.EndOfTextPath().IsEmpty() {
+		log.Printf("This model has no %s path, so generation will only stop at --max-words", decode.EndOfText)
+	}
+
+	context, err := encodePrompt(dictionary, *prompt, *contextLength)
+	if err != nil {
+		log.Fatalf("Could not encode the prompt: %v", err)
+	}
+
+	results, err := engine.Generate(context, *maxWords, *stopAtEnd, *verbose)
+	if err != nil {
+		log.Fatalf("Generation failed after %d words: %v", len(results), err)
+	}
+
+	words := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.EndOfText {
+			words = append(words, decode.EndOfText)
+			continue
+		}
+		word, err := dictionary.DecodePath(r.PredictedPath)
+		if err != nil {
+			word = fmt.Sprintf("<unknown:%s>", r.PredictedPath)
+		}
+		words = append(words, word)
+	}
+	fmt.Printf("%s %s\n", *prompt, strings.Join(words, " "))
+}
+
+// openModel works with both training databases and exported model
+// files. Model files are frozen when they are exported, so the cut-off
+// time doesn't apply to them.
+func openModel(path, nodesTable string, timeFilter time.Time) (*inference.ModelInference, error) {
+	if modelfile.IsModelFile(path) {
+		return inference.OpenModelFile(path)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// db stays open until generate exits
+	return inference.NewModelInference(db, nodesTable, timeFilter)
+}
+
+// encodePrompt turns the prompt into a context (most recent word
+// first), padded with <START-OF-TEXT> markers the way prepare pads the
+// beginning of a story.
+func encodePrompt(dictionary decode.Dictionary, prompt string, contextLength int) ([]tree.Synsetpath, error) {
+	startOfText, err := dictionary.ReservedPath(decode.StartOfText)
+	if err != nil {
+		return nil, err
+	}
+	context := make([]tree.Synsetpath, contextLength)
+	for i := range context {
+		context[i] = startOfText
+	}
+	for _, word := range strings.Fields(prompt) {
+		path, err := dictionary.EncodeWord(word)
+		if err != nil {
+			path, err = dictionary.EncodeWord(strings.ToLower(word))
+		}
+		if err != nil {
+			// Leave a gap, which inference treats as a missing context word
+			log.Printf("Don't know the word %q", word)
+			path = tree.Synsetpath{}
+		}
+		copy(context[1:], context[:len(context)-1])
+		context[0] = path
+	}
+	return context, nil
+}
@@ -10,12 +10,14 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 func main() {
 	database := flag.String("database", "", "SQLite database file")
 	tableName := flag.String("tablename", "nodes", "Table name for nodes")
 	timeStr := flag.String("time", "", "Optional timestamp to filter nodes")
+	atSplit := flag.Int("at-split", -1, "Optional split number to filter nodes (overrides --time)")
 	nodeId := flag.Int("node-id", 0, "Node ID to filter")
 
 	flag.Parse()
@@ -32,13 +34,16 @@ func main() {
 
 	var nodes []node.Node
 	if *nodeId != 0 {
-		individualNode, err := node.FetchNodeByID(db, *tableName, *nodeId)
+		individualNode, err := node.FetchNodeByID(db, *tableName, tree.NodeID(*nodeId))
 		if err != nil {
 			log.Fatalf("Node with ID %d not found or error occurred: %v", *nodeId, err)
 		}
 		nodes = append(nodes, individualNode)
+	} else if *atSplit >= 0 {
+		nodes, err = node.FetchNodesAtSplit(db, *tableName, *atSplit)
 	} else if *timeStr != "" {
-		timestamp, err := time.Parse(time.RFC3339, *timeStr)
+		var timestamp time.Time
+		timestamp, err = time.Parse(time.RFC3339, *timeStr)
 		if err != nil {
 			log.Fatalf("Invalid time format: %v", err)
 		}
@@ -56,24 +61,24 @@ func main() {
 			break
 		}
 		fmt.Printf("ID: %d\n", n.ID)
-		if n.ExemplarValue.Valid {
-			decodedExemplarValue, err := decode.DecodePath(db, n.ExemplarValue.String)
+		if !n.ExemplarValue.IsEmpty() {
+			decodedExemplarValue, err := decode.DecodePath(db, n.ExemplarValue)
 			if err != nil {
 				decodedExemplarValue = "<decoding failed>"
 			}
-			fmt.Printf("ExemplarValue: %s (%s)\n", n.ExemplarValue.String, decodedExemplarValue)
+			fmt.Printf("ExemplarValue: %s (%s)\n", n.ExemplarValue, decodedExemplarValue)
 		} else {
 			fmt.Printf("ExemplarValue: %v\n", n.ExemplarValue)
 		}
 		fmt.Printf("DataQuantity: %v\n", n.DataQuantity)
 		fmt.Printf("Loss: %v\n", n.Loss)
 		fmt.Printf("ContextK: %v\n", n.ContextK)
-		if n.InnerRegionPrefix.Valid {
-			decodedInnerRegionPrefix, err := decode.DecodePath(db, n.InnerRegionPrefix.String)
+		if !n.InnerRegionPrefix.IsEmpty() {
+			decodedInnerRegionPrefix, err := decode.DecodePath(db, n.InnerRegionPrefix)
 			if err != nil {
 				decodedInnerRegionPrefix = "<decoding failed>"
 			}
-			fmt.Printf("InnerRegionPrefix: %s (%s)\n", n.InnerRegionPrefix.String, decodedInnerRegionPrefix)
+			fmt.Printf("InnerRegionPrefix: %s (%s)\n", n.InnerRegionPrefix, decodedInnerRegionPrefix)
 		} else {
 			fmt.Printf("InnerRegionPrefix: %v\n", n.InnerRegionPrefix)
 		}
@@ -82,7 +87,12 @@ func main() {
 		fmt.Printf("WhenCreated: %v\n", n.WhenCreated)
 		fmt.Printf("WhenChildrenPopulated: %v\n", n.WhenChildrenPopulated)
 		fmt.Printf("HasChildren: %v\n", n.HasChildren)
+		fmt.Printf("SplitSeq: %v\n", n.SplitSeq)
 		fmt.Printf("BeingAnalysed: %v\n", n.BeingAnalysed)
+		fmt.Printf("Terminal: %v\n", n.Terminal)
+		if n.Terminal {
+			fmt.Printf("TerminalReason: %s\n", n.TerminalReason.String)
+		}
 		fmt.Printf("TableName: %s\n\n", n.TableName)
 	}
 }
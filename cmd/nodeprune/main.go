@@ -8,23 +8,35 @@ import (
 	"log"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 func main() {
 	dbPath := flag.String("database", "", "Path to the SQLite database")
 	nodeID := flag.Int("node", -1, "ID of the node to remove children from")
+	nodesTable := flag.String("node-table", "nodes", "The table where the node hierarchy is stored")
+	nodeBucketTable := flag.String("node-bucket", "node_bucket", "Table name where the mapping between rows in the training data and their current nodes is stored")
 	flag.Parse()
 
 	if *dbPath == "" || *nodeID == -1 {
 		log.Fatal("Both --database and --node arguments are required")
 	}
 
-	db, err := sql.Open("sqlite3", *dbPath)
+	// train may be running on the same database
+	db, err := exemplar.OpenShared(*dbPath)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
 
+	// The pruned node's split_seq gets cleared, so the column has to exist
+	err = node.EnsureSplitSeq(db, *nodesTable)
+	if err != nil {
+		log.Fatalf("Could not number the splits: %v", err)
+	}
+
 	// Start a transaction for the entire operation
 	tx, err := db.Begin()
 	if err != nil {
@@ -32,7 +44,7 @@ func main() {
 	}
 	defer tx.Rollback()
 
-	err = RemoveNodeChildren(tx, *nodeID)
+	err = RemoveNodeChildren(tx, *nodesTable, *nodeBucketTable, tree.NodeID(*nodeID))
 	if err != nil {
 		log.Fatalf("Error removing children: %v", err)
 	}
@@ -44,80 +56,81 @@ func main() {
 }
 
 // RemoveNodeChildren recursively removes all children of the specified node
-func RemoveNodeChildren(tx *sql.Tx, nodeID int) error {
+func RemoveNodeChildren(tx *sql.Tx, nodesTable, nodeBucketTable string, nodeID tree.NodeID) error {
 	// First, get the node's information
-	var innerNodeID, outerNodeID sql.NullInt64
-	err := tx.QueryRow(`
+	var innerNodeID, outerNodeID tree.NodeID
+	err := tx.QueryRow(fmt.Sprintf(`
 		SELECT inner_region_node_id, outer_region_node
-		FROM nodes
+		FROM %s
 		WHERE id = ?
-	`, nodeID).Scan(&innerNodeID, &outerNodeID)
+	`, nodesTable), nodeID).Scan(&innerNodeID, &outerNodeID)
 	if err != nil {
 		return fmt.Errorf("error getting node info: %v", err)
 	}
 
 	// Recursively remove children's children first
-	if innerNodeID.Valid {
-		err = RemoveNodeChildren(tx, int(innerNodeID.Int64))
+	if innerNodeID.Valid() {
+		err = RemoveNodeChildren(tx, nodesTable, nodeBucketTable, innerNodeID)
 		if err != nil {
 			return fmt.Errorf("error removing inner node children: %v", err)
 		}
 	}
 
-	if outerNodeID.Valid {
-		err = RemoveNodeChildren(tx, int(outerNodeID.Int64))
+	if outerNodeID.Valid() {
+		err = RemoveNodeChildren(tx, nodesTable, nodeBucketTable, outerNodeID)
 		if err != nil {
 			return fmt.Errorf("error removing outer node children: %v", err)
 		}
 	}
 
-	// Update node_bucket to point to parent for any rows pointing to children
-	if innerNodeID.Valid {
-		_, err = tx.Exec(`
-			UPDATE node_bucket 
+	// Update the node bucket table to point to parent for any rows pointing to children
+	if innerNodeID.Valid() {
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %s
 			SET node_id = ?
 			WHERE node_id = ?
-		`, nodeID, innerNodeID.Int64)
+		`, nodeBucketTable), nodeID, innerNodeID)
 		if err != nil {
-			return fmt.Errorf("error updating node_bucket for inner node: %v", err)
+			return fmt.Errorf("error updating %s for inner node: %v", nodeBucketTable, err)
 		}
 
 		// Delete the inner node
-		_, err = tx.Exec("DELETE FROM nodes WHERE id = ?", innerNodeID.Int64)
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", nodesTable), innerNodeID)
 		if err != nil {
 			return fmt.Errorf("error deleting inner node: %v", err)
 		}
 	}
 
-	if outerNodeID.Valid {
-		_, err = tx.Exec(`
-			UPDATE node_bucket 
+	if outerNodeID.Valid() {
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %s
 			SET node_id = ?
 			WHERE node_id = ?
-		`, nodeID, outerNodeID.Int64)
+		`, nodeBucketTable), nodeID, outerNodeID)
 		if err != nil {
-			return fmt.Errorf("error updating node_bucket for outer node: %v", err)
+			return fmt.Errorf("error updating %s for outer node: %v", nodeBucketTable, err)
 		}
 
 		// Delete the outer node
-		_, err = tx.Exec("DELETE FROM nodes WHERE id = ?", outerNodeID.Int64)
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", nodesTable), outerNodeID)
 		if err != nil {
 			return fmt.Errorf("error deleting outer node: %v", err)
 		}
 	}
 
 	// Update the parent node to remove references to children
-	_, err = tx.Exec(`
-		UPDATE nodes 
+	_, err = tx.Exec(fmt.Sprintf(`
+		UPDATE %s
 		SET has_children = false,
                         contextk = null,
 			when_children_populated = null,
 			inner_region_prefix = null,
 			inner_region_node_id = null,
 			outer_region_node = null,
-			contextk = null
+			contextk = null,
+			split_seq = null
 		WHERE id = ?
-	`, nodeID)
+	`, nodesTable), nodeID)
 	if err != nil {
 		return fmt.Errorf("error updating parent node: %v", err)
 	}
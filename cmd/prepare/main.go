@@ -7,17 +7,20 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
-	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/progress"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 type WordData struct {
 	WordID int
 	Word   string
 	Synset sql.NullString
-	Path   string
+	Path   tree.Synsetpath
 }
 
 var hashedPseudoSynsetPrefix = map[string]string{
@@ -50,17 +53,17 @@ func getPath(db *sql.DB, wordID int, word string, synset sql.NullString) (WordDa
 	// log.Printf("The synset for word %s (%d) is %v", word, wordID, synset)
 	if !synset.Valid || synset.String == "" {
 		// log.Printf("Cannot make a useful path for %s (%d) because synset is empty", word, wordID)
-		return WordData{WordID: wordID, Word: word, Synset: synset, Path: ""}, nil
+		return WordData{WordID: wordID, Word: word, Synset: synset}, nil
 	}
 	//log.Printf("The word %s (%d) does have a valid synset", word, wordID)
 
 	fields := strings.Split(synset.String, ".")
 	if len(fields) == 3 {
-		var path string
+		var path tree.Synsetpath
 		err := db.QueryRow("SELECT path FROM synset_paths WHERE synset_name = ?", synset).Scan(&path)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return WordData{}, fmt.Errorf("non-existent (but plausible) synset: %s for word %s [word_id=%d]", synset, word, wordID)
+				return WordData{}, fmt.Errorf("non-existent (but plausible) synset: %s for word %s [word_id=%d]", synset.String, word, wordID)
 			}
 			return WordData{}, err
 		}
@@ -69,7 +72,7 @@ func getPath(db *sql.DB, wordID int, word string, synset sql.NullString) (WordDa
 
 	// Handle pseudo-synsets
 	if isEnumeratedPseudoSynset(synset.String) {
-		var path string
+		var path tree.Synsetpath
 		err := db.QueryRow("SELECT path FROM synset_paths WHERE synset_name = ?", strings.ToLower(word)).Scan(&path)
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -82,10 +85,13 @@ func getPath(db *sql.DB, wordID int, word string, synset sql.NullString) (WordDa
 
 	prefix, ok := hashedPseudoSynsetPrefix[synset.String]
 	if !ok {
-		return WordData{}, fmt.Errorf("unknown pseudo-synset: %s", synset)
+		return WordData{}, fmt.Errorf("unknown pseudo-synset: %s", synset.String)
 	}
-	hashedWord := hashThing(word)
-	return WordData{WordID: wordID, Word: word, Synset: synset, Path: prefix + hashedWord}, nil
+	path, err := tree.ParseSynsetpath(prefix + hashThing(word))
+	if err != nil {
+		return WordData{}, err
+	}
+	return WordData{WordID: wordID, Word: word, Synset: synset, Path: path}, nil
 }
 
 type OutputChoice string
@@ -105,6 +111,46 @@ func IsValidOutputChoice(choice string) bool {
     }
 }
 
+// PaddingMode says what to do with the context when we hit a word
+// that has no path.
+type PaddingMode string
+
+const (
+	// PaddingClear throws the whole buffer away, so nothing is
+	// predicted until another context-length+1 resolved words have
+	// been seen. This is what prepare has always done.
+	PaddingClear PaddingMode = "clear"
+	// PaddingUnknown keeps the context going, with the unresolved word
+	// represented by the <UNKNOWN> pseudo-path. It is never used as a
+	// target word.
+	PaddingUnknown PaddingMode = "unknown"
+	// PaddingRestart refills the buffer with <START-OF-TEXT> markers,
+	// as if a new story were starting at the next word.
+	PaddingRestart PaddingMode = "restart"
+)
+
+func IsValidPaddingMode(mode string) bool {
+	switch PaddingMode(mode) {
+	case PaddingClear, PaddingUnknown, PaddingRestart:
+		return true
+	default:
+		return false
+	}
+}
+
+// unknownWord is what an unresolved word turns into in PaddingUnknown
+// mode. It is hashed into the (other.other) region ("8.") like any
+// other word without a synset, so a circle around 8. (or any prefix of
+// its path) takes in <UNKNOWN> along with those real words.
+func unknownWord(wordID int) WordData {
+	path, _ := tree.ParseSynsetpath(hashedPseudoSynsetPrefix["(other.other)"] + hashThing(decode.Unknown))
+	return WordData{
+		WordID: wordID,
+		Word:   decode.Unknown,
+		Synset: sql.NullString{Valid: true, String: "(other.other)"},
+		Path:   path,
+	}
+}
 
 // prepare's CLI arguments:
 //  --input-database
@@ -114,6 +160,12 @@ func IsValidOutputChoice(choice string) bool {
 // It has two optional CLI arguments (--modulo and --congruent). If the story number is congruent
 // to [congruent] modulo [modulo] then we use it, otherwise we ignore it.
 //
+// Alternatively (or as well), --split train=0.8,validation=0.1,test=0.1 --split-seed S
+// hashes each story ID to exactly one of the named splits and writes it to
+// [output-table]_[split name] (e.g. training_data_train). The story_splits
+// table records which story went where, so that we can check later that
+// nothing leaked between training and evaluation.
+//
 // It goes through each story in the database (or just --congurent and
 // --modulo if specified) from beginning to end. It keeps a buffer of
 // the last [context-length+1] words.
@@ -127,10 +179,14 @@ func IsValidOutputChoice(choice string) bool {
 // generally means that the buffer will be full when it reads the next
 // word).
 
-// If it hits a word with no path, then it clears the whole buffer.
+// If it hits a word with no path, then what happens depends on
+// --padding-mode: "clear" (the default) clears the whole buffer,
+// "unknown" puts an <UNKNOWN> marker into the context (but never
+// predicts it) and "restart" fills the buffer with <START-OF-TEXT>
+// markers again.
 
-// When you get to the end of a story, clear the whole buffer.
-// (Although what it should do is output an <END> marker.)
+// When you get to the end of a story, it outputs one more row with
+// <END-OF-TEXT> as the target word, and then clears the whole buffer.
 
 func main() {
 	inputDB := flag.String("input-database", "", "Path to the input SQLite database")
@@ -140,6 +196,9 @@ func main() {
 	congruent := flag.Int("congruent", 0, "Congruent value for story selection")
 	outputTable := flag.String("output-table", "training_data", "Name of the output table for training data")
 	outputChoice := flag.String("output-choice", "paths", "Whether to output paths (the experiment) or words (the baseline). Defaults to paths")
+	splitSpec := flag.String("split", "", "Assign each story to one of these splits and write each to its own table (e.g. train=0.8,validation=0.1,test=0.1)")
+	splitSeed := flag.Int64("split-seed", 0, "Seed for the story-to-split hash")
+	paddingMode := flag.String("padding-mode", "clear", "What to do with the context on an unresolved word: clear, unknown or restart")
 	flag.Parse()
 
 	if *inputDB == "" || *outputDB == "" {
@@ -150,6 +209,10 @@ func main() {
 		log.Fatal("Error: --output-choice must be one of the defined OutputChoice constants.")
 	}
 
+	if !IsValidPaddingMode(*paddingMode) {
+		log.Fatal("Error: --padding-mode must be one of clear, unknown or restart.")
+	}
+
 	inputConn, err := sql.Open("sqlite3", *inputDB)
 	if err != nil {
 		log.Fatalf("Error opening input database: %v", err)
@@ -162,9 +225,30 @@ func main() {
 	}
 	defer outputConn.Close()
 
+	var splits []Split
+	if *splitSpec != "" {
+		splits, err = ParseSplitSpec(*splitSpec)
+		if err != nil {
+			log.Fatalf("Invalid --split: %v", err)
+		}
+	}
+
 	log.Printf("Creating tables")
 
-	createOutputTables(outputConn, *contextLength, *outputTable)
+	if len(splits) == 0 {
+		createOutputTables(outputConn, *contextLength, *outputTable)
+	} else {
+		for _, s := range splits {
+			createOutputTables(outputConn, *contextLength, SplitTableName(*outputTable, s))
+		}
+		if err := createSplitManifest(outputConn); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := recordReservedPaths(inputConn, outputConn, PaddingMode(*paddingMode)); err != nil {
+		log.Fatalf("Could not record the reserved paths: %v", err)
+	}
 
 	log.Printf("Getting stories")
 
@@ -173,30 +257,51 @@ func main() {
 		log.Fatalf("Error getting stories: %v", err)
 	}
 
+	reporter := progress.New(progress.Config{
+		Program: "prepare",
+		Subject: *outputTable,
+		Unit:    "stories",
+	})
+	if err := reporter.RecordTo(outputConn); err != nil {
+		log.Fatalf("Could not record progress: %v", err)
+	}
+	log.SetOutput(reporter.LogWriter(os.Stderr))
+
 	processedCount := 0
-	startTime := time.Now()
 	newRecordCount := 0
 	overlapRecordCount := 0
 
 	for storyIteration := range storyChan {
-		percentComplete := 100.0 * float64(storyIteration.TotalStories-storyIteration.NumberLeftToCheck) / float64(storyIteration.TotalStories)
+		reporter.SetTotal(int64(storyIteration.TotalStories))
+		examined := int64(storyIteration.TotalStories - storyIteration.NumberLeftToCheck)
 		if storyIteration.StatusOnly {
-			log.Printf("Skipping stories where all words are unresolved. %d stories remaining to examine. %.2f%% complete.", storyIteration.NumberLeftToCheck, percentComplete)
+			// All of its words are unresolved, so there's nothing to do
+			reporter.Update(examined)
 			continue
 		}
 		storyID := storyIteration.StoryID
 		processedCount++
 		outputChoice := OutputChoice(*outputChoice)
-		newlyAdded, newOverlaps, err := processStory(inputConn, outputConn, storyID, *contextLength, *outputTable, outputChoice)
+		storyTable := *outputTable
+		if len(splits) > 0 {
+			split, bucket := AssignSplit(splits, *splitSeed, storyID)
+			storyTable = SplitTableName(*outputTable, split)
+			if err := recordSplit(outputConn, storyID, split, *splitSeed, bucket, storyTable); err != nil {
+				log.Fatalf("Could not assign story %d to a split: %v", storyID, err)
+			}
+		}
+		newlyAdded, newOverlaps, err := processStory(inputConn, outputConn, storyID, *contextLength, storyTable, outputChoice, PaddingMode(*paddingMode))
 		newRecordCount += newlyAdded
 		overlapRecordCount += newOverlaps
 		if err != nil {
 			log.Fatalf("Could not process story %d: %v", storyID, err)
 		}
-		elapsed := time.Since(startTime)
-		storiesPerSecond := float64(processedCount) / elapsed.Seconds()
-		log.Printf("Progress (#%d, %.2f stories/sec), %d new records, %d overlapping records, %.2f%% complete", processedCount, storiesPerSecond, newRecordCount, overlapRecordCount, percentComplete)
+		reporter.Update(examined,
+			progress.Metric{Name: "processed", Value: float64(processedCount)},
+			progress.Metric{Name: "new_records", Value: float64(newRecordCount)},
+			progress.Metric{Name: "overlapping_records", Value: float64(overlapRecordCount)})
 	}
+	reporter.Finish()
 
 	log.Printf("Data preparation completed successfully. %d new training records, %d existing training records untouched", newRecordCount, overlapRecordCount)
 }
@@ -321,7 +426,7 @@ func getStories(db *sql.DB, modulo, congruent int) (<-chan StoryIteration, error
 	return storyChannel, nil
 }
 
-func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputTable string, outputChoice OutputChoice) (int, int, error) {
+func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputTable string, outputChoice OutputChoice, paddingMode PaddingMode) (int, int, error) {
 	log.Printf("Processing story %d with context length %d into %s", storyID, contextLength, outputTable)
 	words, annotationCount, err := getWordsForStory(inputDB, storyID)
 	if err != nil {
@@ -335,24 +440,15 @@ func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputT
 
 	log.Printf("Found %d words in story %d, of which %d were annotated", len(words), storyID, annotationCount)
 
-	// Fake up a word ID for text position markers
-	startOfTextMarker := -(storyID * 2)
-	endOfTextMarker := -(storyID * 2) - 1
-	startOfText, err := getPath(inputDB, startOfTextMarker, "<START-OF-TEXT>", sql.NullString{
-		Valid:  true,
-		String: "(punctuation.other)",
-	})
+	startOfText, err := markerWord(inputDB, decode.StartOfTextWordID(storyID), decode.StartOfText)
 	if err != nil {
-		return 0, 0, fmt.Errorf("Could not get the <START-OF-TEXT> marker: %v\n", err)
+		return 0, 0, err
 	}
 	// fmt.Printf("Start of text = %s\n", startOfText.Path)
 
-	endOfText, err := getPath(inputDB, endOfTextMarker, "<END-OF-TEXT>", sql.NullString{
-		Valid:  true,
-		String: "(punctuation.other)",
-	})
+	endOfText, err := markerWord(inputDB, decode.EndOfTextWordID(storyID), decode.EndOfText)
 	if err != nil {
-		return 0, 0, fmt.Errorf("Could not get the <END-OF-TEXT> marker: %v\n", err)
+		return 0, 0, err
 	}
 
 	buffer := make([]WordData, 0, contextLength+1)
@@ -367,7 +463,7 @@ func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputT
 		if (idx%100 == 0) || (idx == len(words)-1) {
 			//log.Printf("Adding words for story %d. Progress: %d/%d", storyID, idx+1, len(words))
 		}
-		if word.Path == "" {
+		if word.Path.IsEmpty() {
 			//log.Printf("SKIPPING  %s (%d) path=%s. Buffer length %d", word.Word, word.WordID, word.Path, len(buffer))
 
 			// If we can't find the path for a word, then we can't use this
@@ -375,8 +471,22 @@ func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputT
 			// We'll have to refill the buffer from scratch
 
 			// Addendum. Is this true? Maybe the empty path is a thing
-			// we can use.
-			buffer = buffer[:0] // Clear the buffer
+			// we can use. (That's what --padding-mode=unknown does.)
+			switch paddingMode {
+			case PaddingUnknown:
+				buffer = append(buffer, unknownWord(word.WordID))
+				if len(buffer) == contextLength+1 {
+					// We don't predict <UNKNOWN>, but it stays in the context
+					buffer = buffer[1:]
+				}
+			case PaddingRestart:
+				buffer = buffer[:0]
+				for i := 0; i < contextLength; i++ {
+					buffer = append(buffer, startOfText)
+				}
+			default:
+				buffer = buffer[:0] // Clear the buffer
+			}
 			continue
 		}
 
@@ -421,6 +531,45 @@ func processStory(inputDB, outputDB *sql.DB, storyID, contextLength int, outputT
 	return newlyAddedData, overlapSize, nil
 }
 
+// markerWord makes the WordData for a <START-OF-TEXT> or <END-OF-TEXT>
+// marker. They are looked up like any other (punctuation.other) word.
+func markerWord(inputDB *sql.DB, wordID int, marker string) (WordData, error) {
+	w, err := getPath(inputDB, wordID, marker, sql.NullString{
+		Valid:  true,
+		String: "(punctuation.other)",
+	})
+	if err != nil {
+		return WordData{}, fmt.Errorf("Could not get the %s marker: %v", marker, err)
+	}
+	return w, nil
+}
+
+// recordReservedPaths notes down the paths that the markers ended up
+// with, so that decode and inference can recognise them without
+// needing the input database.
+func recordReservedPaths(inputDB, outputDB *sql.DB, paddingMode PaddingMode) error {
+	if err := decode.CreateReservedPathsTable(outputDB); err != nil {
+		return err
+	}
+	reserved := make(map[string]tree.Synsetpath)
+	for _, marker := range []string{decode.StartOfText, decode.EndOfText} {
+		w, err := markerWord(inputDB, 0, marker)
+		if err != nil {
+			return err
+		}
+		reserved[marker] = w.Path
+	}
+	if paddingMode == PaddingUnknown {
+		reserved[decode.Unknown] = unknownWord(0).Path
+	}
+	for word, path := range reserved {
+		if err := decode.RecordReservedPath(outputDB, word, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getWordsForStory(db *sql.DB, storyID int) ([]WordData, int, error) {
 	query := `
 		SELECT w.id, w.word, w.resolved_synset
@@ -452,7 +601,7 @@ func getWordsForStory(db *sql.DB, storyID int) ([]WordData, int, error) {
 			log.Printf("Error getting path for word %s (ID: %d): %v", word, wordID, err)
 			continue
 		}
-		if wordData.Path != "" {
+		if !wordData.Path.IsEmpty() {
 			annotationCount += 1
 		}
 		words = append(words, wordData)
@@ -497,7 +646,7 @@ func insertTrainingData(db *sql.DB, buffer []WordData, contextLength int, output
 		if outputChoice == OutputHashes {
 			return hashThing(wordData.Word)
 		} else if outputChoice == OutputPaths {
-			return wordData.Path
+			return wordData.Path.String()
 		}
 		return wordData.Word
 	}
@@ -523,7 +672,7 @@ func insertTrainingData(db *sql.DB, buffer []WordData, contextLength int, output
 				INSERT INTO decodings (path, word, usage_count)
 				VALUES (?, ?, 1)
 				ON CONFLICT(path, word) DO UPDATE SET usage_count = usage_count + 1
-			`, word.Path, word.Word)
+			`, word.Path.String(), word.Word)
 			if err != nil {
 				return false, fmt.Errorf("Error updating decodings: %v", err)
 			}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A Split is one named share of the stories (e.g. train=0.8). Every
+// story is hashed (along with the split seed) to a number in [0,1),
+// and it belongs to the first split whose cumulative fraction is
+// larger than that number. The same seed and the same fractions always
+// put the same story into the same split, no matter which machine
+// runs prepare or in what order the stories turn up.
+type Split struct {
+	Name     string
+	Fraction float64
+}
+
+// ParseSplitSpec turns "train=0.8,validation=0.1,test=0.1" into a
+// list of splits. The fractions have to add up to 1 (we allow a
+// little bit of floating point slop).
+func ParseSplitSpec(spec string) ([]Split, error) {
+	var splits []Split
+	seen := make(map[string]bool)
+	total := 0.0
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.SplitN(part, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("split %q should look like name=fraction", part)
+		}
+		name := strings.TrimSpace(fields[0])
+		if name == "" {
+			return nil, fmt.Errorf("split %q has no name", part)
+		}
+		for _, r := range name {
+			if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+				return nil, fmt.Errorf("split name %q can only contain letters, digits and underscores", name)
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("split %s appears more than once", name)
+		}
+		seen[name] = true
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the fraction for split %s: %v", name, err)
+		}
+		if fraction <= 0 || fraction > 1 {
+			return nil, fmt.Errorf("the fraction for split %s must be in (0, 1], not %f", name, fraction)
+		}
+		total += fraction
+		splits = append(splits, Split{Name: name, Fraction: fraction})
+	}
+	if len(splits) == 0 {
+		return nil, fmt.Errorf("no splits found in %q", spec)
+	}
+	if math.Abs(total-1.0) > 1e-6 {
+		return nil, fmt.Errorf("split fractions add up to %f, they should add up to 1", total)
+	}
+	return splits, nil
+}
+
+// storyHashFraction maps (seed, storyID) to a number in [0,1)
+func storyHashFraction(seed int64, storyID int) float64 {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d:%d", seed, storyID)))
+	// Use the top 53 bits so that the result is exactly representable as a float64
+	return float64(binary.BigEndian.Uint64(hash[:8])>>11) / float64(uint64(1)<<53)
+}
+
+// AssignSplit returns the split that storyID belongs to, and the hash
+// value that was used to decide it.
+func AssignSplit(splits []Split, seed int64, storyID int) (Split, float64) {
+	bucket := storyHashFraction(seed, storyID)
+	cumulative := 0.0
+	for _, s := range splits {
+		cumulative += s.Fraction
+		if bucket < cumulative {
+			return s, bucket
+		}
+	}
+	// Rounding errors mean that we can fall off the end. The last split gets it.
+	return splits[len(splits)-1], bucket
+}
+
+// SplitTableName is where the training data for a split goes.
+func SplitTableName(outputTable string, s Split) string {
+	return fmt.Sprintf("%s_%s", outputTable, s.Name)
+}
+
+func createSplitManifest(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS story_splits (
+			story_id INTEGER PRIMARY KEY,
+			split_name TEXT NOT NULL,
+			split_seed INTEGER NOT NULL,
+			hash_bucket REAL NOT NULL,
+			output_table TEXT NOT NULL,
+			when_assigned datetime default current_timestamp
+		)`)
+	if err != nil {
+		return fmt.Errorf("Error creating story_splits table: %v", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS story_splits_by_split ON story_splits (split_name)")
+	if err != nil {
+		return fmt.Errorf("Error creating index on story_splits.split_name: %v", err)
+	}
+	return nil
+}
+
+// recordSplit writes the story's split into the manifest. If the
+// story was already assigned to a different split (e.g. by an earlier
+// run with a different seed) that is an error, because it would leak
+// the story into two datasets.
+func recordSplit(db *sql.DB, storyID int, s Split, seed int64, bucket float64, outputTable string) error {
+	var existingSplit string
+	var existingSeed int64
+	err := db.QueryRow("SELECT split_name, split_seed FROM story_splits WHERE story_id = ?", storyID).Scan(&existingSplit, &existingSeed)
+	if err == nil {
+		if existingSplit != s.Name {
+			return fmt.Errorf("story %d was previously assigned to %s (seed %d), now it would be %s (seed %d)",
+				storyID, existingSplit, existingSeed, s.Name, seed)
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("Could not look up story %d in story_splits: %v", storyID, err)
+	}
+	_, err = db.Exec(`INSERT INTO story_splits (story_id, split_name, split_seed, hash_bucket, output_table)
+		VALUES (?, ?, ?, ?, ?)`, storyID, s.Name, seed, bucket, outputTable)
+	if err != nil {
+		return fmt.Errorf("Could not record the split for story %d: %v", storyID, err)
+	}
+	return nil
+}
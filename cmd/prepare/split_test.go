@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseSplitSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []Split
+		wantErr  bool
+	}{
+		{"train=0.8,validation=0.1,test=0.1", []Split{{"train", 0.8}, {"validation", 0.1}, {"test", 0.1}}, false},
+		{" train = 0.5 , test = 0.5 ,", []Split{{"train", 0.5}, {"test", 0.5}}, false},
+		{"all=1", []Split{{"all", 1}}, false},
+		{"train=0.8,test=0.1", nil, true},
+		{"train=0.8,test=0.3", nil, true},
+		{"train=0.5,train=0.5", nil, true},
+		{"train=0.5,=0.5", nil, true},
+		{"train=0.5,test-set=0.5", nil, true},
+		{"train=0.5,test", nil, true},
+		{"train=abc", nil, true},
+		{"train=1.5,test=-0.5", nil, true},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSplitSpec(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSplitSpec(%q) = %v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSplitSpec(%q) returned unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("ParseSplitSpec(%q) = %v, want %v", tt.spec, got, tt.expected)
+		}
+	}
+}
+
+func TestAssignSplitIsDeterministic(t *testing.T) {
+	splits := []Split{{"train", 0.8}, {"validation", 0.1}, {"test", 0.1}}
+
+	differs := false
+	for storyID := 0; storyID < 200; storyID++ {
+		first, firstBucket := AssignSplit(splits, 42, storyID)
+		second, secondBucket := AssignSplit(splits, 42, storyID)
+		if first != second || firstBucket != secondBucket {
+			t.Fatalf("Story %d was assigned to %v (%f) and then %v (%f)", storyID, first, firstBucket, second, secondBucket)
+		}
+		if firstBucket < 0 || firstBucket >= 1 {
+			t.Errorf("Story %d has bucket %f, which is outside [0,1)", storyID, firstBucket)
+		}
+		other, _ := AssignSplit(splits, 43, storyID)
+		if other != first {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Errorf("Changing the seed didn't move any stories to a different split")
+	}
+}
+
+func TestAssignSplitProportions(t *testing.T) {
+	splits := []Split{{"train", 0.8}, {"validation", 0.1}, {"test", 0.1}}
+	const stories = 20000
+	counts := make(map[string]int)
+	for storyID := 0; storyID < stories; storyID++ {
+		s, _ := AssignSplit(splits, 7, storyID)
+		counts[s.Name]++
+	}
+	for _, s := range splits {
+		got := float64(counts[s.Name]) / stories
+		// Three standard deviations of a binomial proportion
+		tolerance := 3 * math.Sqrt(s.Fraction*(1-s.Fraction)/stories)
+		if math.Abs(got-s.Fraction) > tolerance {
+			t.Errorf("%s got %.4f of the stories, want %.4f ± %.4f", s.Name, got, s.Fraction, tolerance)
+		}
+	}
+}
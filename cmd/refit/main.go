@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// Every refit is recorded here, whichever nodes table it was of
+const refitTable = "leaf_refits"
+
+type leaf struct {
+	id           tree.NodeID
+	exemplar     sql.NullString
+	loss         sql.NullFloat64
+	dataQuantity sql.NullInt64
+}
+
+type refit struct {
+	exemplar     tree.Synsetpath
+	loss         float64
+	dataQuantity int
+	// The exact loss of the exemplar the leaf had before
+	oldExemplarLoss sql.NullFloat64
+}
+
+// refit goes through the leaves of a tree and works out exactly what
+// train only estimated when it created them: how many rows each one
+// has, which exemplar is best for them, and what its loss is. It
+// updates the leaves, so that train's choice of which leaf to split
+// next is based on the real losses, and records what changed in
+// refitTable, which shows how far the estimates had drifted.
+//
+// Each leaf is claimed while it is being refitted, and the claim is
+// kept fresh, the way train claims a leaf it is splitting, so it is
+// safe to run while train is running. Leaves that are claimed by train
+// are skipped.
+func main() {
+	database := flag.String("database", "", "SQLite database file")
+	trainingDataTable := flag.String("training-data", "training_data", "Table name where the training data is stored")
+	nodeBucketTable := flag.String("node-bucket", "node_bucket", "Table name where the mapping between rows in the training data and their current nodes is stored")
+	nodesTable := flag.String("node-table", "nodes", "The table where the node hierarchy is stored")
+	nodeID := flag.Int("node-id", 0, "Only refit this leaf")
+	claimTimeout := flag.Duration("claim-timeout", 10*time.Minute, "A leaf claimed by a train process that hasn't been heard from for this long is assumed to have been abandoned")
+	dryRun := flag.Bool("dry-run", false, "Report what would change, but don't change anything")
+	flag.Parse()
+
+	if *database == "" {
+		log.Fatal("--database is required")
+	}
+
+	// train may be running on the same database
+	db, err := exemplar.OpenShared(*database)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := exemplar.EnsureClaimColumns(db, *nodesTable); err != nil {
+		log.Fatalf("Could not prepare %s for claims: %v", *nodesTable, err)
+	}
+	if !*dryRun {
+		if err := createRefitTable(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	leaves, err := fetchLeaves(db, *nodesTable, tree.NodeID(*nodeID))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *nodeID != 0 && len(leaves) == 0 {
+		log.Fatalf("Node %d is not a leaf of %s", *nodeID, *nodesTable)
+	}
+
+	hostname, _ := os.Hostname()
+	claimant := fmt.Sprintf("%s/refit-%d", hostname, os.Getpid())
+
+	refitted, skipped, compared := 0, 0, 0
+	estimatedLoss, exactLoss, estimateError := 0.0, 0.0, 0.0
+	for _, l := range leaves {
+		stopRenewing := func() {}
+		if !*dryRun {
+			err := exemplar.ClaimNode(db, *nodesTable, l.id, claimant, *claimTimeout)
+			if err == exemplar.ErrClaimLost {
+				log.Printf("Node %d is being split, so it has been skipped", int(l.id))
+				skipped++
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			stopRenewing = exemplar.HoldClaim(db, *nodesTable, l.id, claimant, *claimTimeout/4)
+		}
+		r, err := refitLeaf(db, *trainingDataTable, *nodeBucketTable, l)
+		stopRenewing()
+		if err != nil {
+			if !*dryRun {
+				exemplar.ReleaseClaim(db, *nodesTable, l.id, claimant)
+			}
+			log.Fatalf("Could not refit node %d: %v", int(l.id), err)
+		}
+		if !*dryRun {
+			err = storeRefit(db, *nodesTable, l, r, claimant)
+			if errors.Is(err, exemplar.ErrClaimLost) {
+				log.Printf("Node %d was taken over while it was being refitted, so it has been skipped", int(l.id))
+				skipped++
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Printf("Node %d: %d rows (was %d), exemplar %s (was %s), loss %f (estimated %f)",
+			int(l.id), r.dataQuantity, l.dataQuantity.Int64, r.exemplar, l.exemplar.String, r.loss, l.loss.Float64)
+		refitted++
+		estimatedLoss += l.loss.Float64
+		exactLoss += r.loss
+		if r.oldExemplarLoss.Valid && l.loss.Valid {
+			estimateError += math.Abs(r.oldExemplarLoss.Float64 - l.loss.Float64)
+			compared++
+		}
+	}
+
+	fmt.Printf("Refitted %d leaves (%d skipped)\n", refitted, skipped)
+	fmt.Printf("Total leaf loss: %f estimated, %f exact\n", estimatedLoss, exactLoss)
+	if compared > 0 {
+		fmt.Printf("Mean difference between the estimated and exact loss of the old exemplars (over %d leaves that had both): %f\n", compared, estimateError/float64(compared))
+	}
+	if *dryRun {
+		fmt.Println("(Nothing has been changed)")
+	}
+}
+
+func createRefitTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id integer primary key autoincrement,
+			nodes_table text not null,
+			node_id integer not null,
+			refitted datetime default current_timestamp,
+			old_exemplar text,
+			old_loss float,
+			old_data_quantity integer,
+			old_exemplar_loss float,
+			new_exemplar text,
+			new_loss float,
+			new_data_quantity integer,
+			loss_drift float,
+			data_quantity_drift integer
+		)`, refitTable))
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", refitTable, err)
+	}
+	return nil
+}
+
+// fetchLeaves returns every leaf of nodesTable, or just onlyID if it
+// is set (and is a leaf)
+func fetchLeaves(db *sql.DB, nodesTable string, onlyID tree.NodeID) ([]leaf, error) {
+	query := fmt.Sprintf("SELECT id, exemplar_value, loss, data_quantity FROM %s WHERE not has_children", nodesTable)
+	var args []interface{}
+	if onlyID != 0 {
+		query += " AND id = ?"
+		args = append(args, onlyID)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the leaves of %s: %v", nodesTable, err)
+	}
+	defer rows.Close()
+
+	var leaves []leaf
+	for rows.Next() {
+		var l leaf
+		if err := rows.Scan(&l.id, &l.exemplar, &l.loss, &l.dataQuantity); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, l)
+	}
+	return leaves, rows.Err()
+}
+
+func refitLeaf(db *sql.DB, trainingDataTable, nodeBucketTable string, l leaf) (refit, error) {
+	rows, err := exemplar.LoadRows(db, trainingDataTable, nodeBucketTable, l.id)
+	if err != nil {
+		return refit{}, err
+	}
+	r := refit{dataQuantity: len(rows)}
+	if len(rows) == 0 {
+		// Nothing to predict, so there's no loss whatever the exemplar
+		r.exemplar, _ = tree.ParseSynsetpath(l.exemplar.String)
+		return r, nil
+	}
+	r.exemplar, r.loss, err = exemplar.ExactBestExemplar(rows)
+	if err != nil {
+		return refit{}, err
+	}
+	if old, err := tree.ParseSynsetpath(l.exemplar.String); err == nil && l.exemplar.Valid {
+		r.oldExemplarLoss = sql.NullFloat64{Float64: exemplar.ExactLoss(rows, old), Valid: true}
+	}
+	return r, nil
+}
+
+// storeRefit updates the leaf, releases claimant's claim on it, and
+// records the change in refitTable. If claimant has lost the claim,
+// nothing is changed and it returns exemplar.ErrClaimLost.
+func storeRefit(db *sql.DB, nodesTable string, l leaf, r refit, claimant string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(fmt.Sprintf(`
+		UPDATE %s
+		SET exemplar_value = ?, loss = ?, data_quantity = ?,
+		    being_analysed = false, claimed_by = NULL, claimed_at = NULL
+		WHERE id = ? AND claimed_by = ? AND not has_children
+	`, nodesTable), r.exemplar.String(), r.loss, r.dataQuantity, l.id, claimant)
+	if err != nil {
+		return fmt.Errorf("error updating node %d: %v", int(l.id), err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return exemplar.ErrClaimLost
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`
+		INSERT INTO %s (nodes_table, node_id, old_exemplar, old_loss, old_data_quantity, old_exemplar_loss,
+			new_exemplar, new_loss, new_data_quantity, loss_drift, data_quantity_drift)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, refitTable), nodesTable, l.id, l.exemplar, l.loss, l.dataQuantity, r.oldExemplarLoss,
+		r.exemplar.String(), r.loss, r.dataQuantity, r.loss-l.loss.Float64, int64(r.dataQuantity)-l.dataQuantity.Int64)
+	if err != nil {
+		return fmt.Errorf("could not record the refit of node %d: %v", int(l.id), err)
+	}
+	return tx.Commit()
+}
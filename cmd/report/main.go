@@ -20,10 +20,11 @@ import (
 )
 
 type AnalysisResult struct {
-	Timestamp       time.Time
-	SumLoss         float64
-	NodeCount       int
-	AvgDataQuantity float64
+	Split            int
+	Timestamp        time.Time
+	SumLoss          float64
+	NodeCount        int
+	AvgDataQuantity  float64
 	TrainingDataSize int
 }
 
@@ -31,6 +32,8 @@ func main() {
 	dbPath := flag.String("db", "", "Path to the SQLite database file")
 	tableName := flag.String("table", "nodes", "Name of the nodes table")
 	outputFormat := flag.String("output", "csv", "Output format: csv or png")
+	timestamp := flag.String("time", "", "Stop the report at this time (format: 2006-01-02 15:04:05)")
+	atSplit := flag.Int("at-split", -1, "Stop the report at this split (overrides --time)")
 	flag.Parse()
 
 	if *dbPath == "" {
@@ -43,16 +46,25 @@ func main() {
 	}
 	defer db.Close()
 
-	nodes, err := node.FetchNodes(db, *tableName)
+	history, err := node.FetchHistory(db, *tableName)
 	if err != nil {
 		log.Fatalf("Error fetching nodes: %v", err)
 	}
 
-	results, err := analyzeNodes(db, *tableName, nodes)
-	if err != nil {
-		log.Fatalf("Could not analyse nodes: %v", err)
+	lastSeq := history.LastSeq()
+	if *atSplit >= 0 || *timestamp != "" {
+		var t time.Time
+		if *timestamp != "" {
+			t, err = time.Parse("2006-01-02 15:04:05", *timestamp)
+			if err != nil {
+				log.Fatalf("Error parsing timestamp: %v", err)
+			}
+		}
+		lastSeq = history.Seq(node.NewCutoff(*atSplit, t))
 	}
 
+	results := analyzeHistory(history, lastSeq)
+
 	switch *outputFormat {
 	case "csv":
 		outputCSV(results)
@@ -63,56 +75,26 @@ func main() {
 	}
 }
 
-func analyzeNodes(db *sql.DB, tableName string, nodes []node.Node) ([]AnalysisResult, error) {
-	timestamps := node.GetSignificantTimestamps(nodes)
+func analyzeHistory(history *node.History, lastSeq int) []AnalysisResult {
 	var results []AnalysisResult
-
-	for _, timestamp := range timestamps {
-		relevantNodes, err := node.FetchNodesAsOf(db, tableName, timestamp)
-		if err != nil {
-			return results, err
-		}
-		if len(relevantNodes) > 0 {
-			result := calculateResult(relevantNodes, timestamp)
-			results = append(results, result)
-		}
-	}
-
-	return results, nil
-}
-
-func calculateResult(nodes []node.Node, timestamp time.Time) AnalysisResult {
-	sumLoss := 0.0
-	sumDataQuantity := 0
-	leafNodeCount := 0
-	for _, n := range nodes {
-		if n.HasChildren {
-			continue
-		}
-		if n.Loss.Valid {
-			sumLoss += n.Loss.Float64
-		}
-		// 
-		if n.DataQuantity.Valid {
-			sumDataQuantity += int(n.DataQuantity.Int64)
-			leafNodeCount++
-		}
-	}
-	avgDataQuantity := float64(sumDataQuantity) / float64(leafNodeCount)
-	return AnalysisResult{
-		Timestamp:       timestamp,
-		SumLoss:         sumLoss,
-		NodeCount:       len(nodes),
-		AvgDataQuantity: avgDataQuantity,
-		TrainingDataSize: sumDataQuantity,
+	for _, summary := range history.Summaries(lastSeq) {
+		results = append(results, AnalysisResult{
+			Split:            summary.Split,
+			Timestamp:        summary.When,
+			SumLoss:          summary.SumLoss,
+			NodeCount:        summary.NodeCount,
+			AvgDataQuantity:  summary.AvgDataQuantity(),
+			TrainingDataSize: summary.TrainingDataSize,
+		})
 	}
+	return results
 }
 
 func outputCSV(results []AnalysisResult) {
 	w := csv.NewWriter(os.Stdout)
 	defer w.Flush()
 
-	w.Write([]string{"Timestamp", "Sum of Losses", "Number of Nodes", "Average Data Quantity", "Training Data Size"})
+	w.Write([]string{"Timestamp", "Sum of Losses", "Number of Nodes", "Average Data Quantity", "Training Data Size", "Split"})
 
 	for _, r := range results {
 		w.Write([]string{
@@ -121,6 +103,7 @@ func outputCSV(results []AnalysisResult) {
 			fmt.Sprintf("%d", r.NodeCount),
 			fmt.Sprintf("%f", r.AvgDataQuantity),
 			fmt.Sprintf("%d", r.TrainingDataSize),
+			fmt.Sprintf("%d", r.Split),
 		})
 	}
 }
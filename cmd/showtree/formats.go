@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// treeFilter keeps the output of large trees manageable. Nodes that
+// fail it are left out, along with everything underneath them.
+type treeFilter struct {
+	maxDepth        int // negative means no limit
+	minDataQuantity int64
+}
+
+func (f treeFilter) keep(n *node.Node, depth int) bool {
+	if depth == 0 {
+		// Always show the root, or there's nothing to see
+		return true
+	}
+	if f.maxDepth >= 0 && depth > f.maxDepth {
+		return false
+	}
+	return n.DataQuantity.Int64 >= f.minDataQuantity
+}
+
+// exportNode is a node with everything decoded, ready to be written
+// out as JSON, DOT or GEXF.
+type exportNode struct {
+	ID           int      `json:"id"`
+	Depth        int      `json:"depth"`
+	Exemplar     string   `json:"exemplar"`
+	ExemplarWord string   `json:"exemplar_word"`
+	Loss         *float64 `json:"loss"`
+	DataQuantity *int64   `json:"data_quantity"`
+	// Only set on leaves that won't be split, saying why
+	TerminalReason string `json:"terminal_reason,omitempty"`
+	// These are only set on nodes that have been split
+	ContextK     int    `json:"context_k,omitempty"`
+	RegionPrefix string `json:"region_prefix,omitempty"`
+	RegionWord   string `json:"region_word,omitempty"`
+	// The inner child is first. Truncated means that some children
+	// were left out by the filter.
+	Children  []*exportNode `json:"children,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	// Whether this is the inner child of its parent
+	Inner bool `json:"inner"`
+}
+
+func decodeForExport(db *sql.DB, path tree.Synsetpath) (string, error) {
+	if path.IsEmpty() {
+		return "", nil
+	}
+	exists, word, err := getWordFromPath(db, path)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return path.String(), nil
+	}
+	return word, nil
+}
+
+func buildExportTree(db *sql.DB, snapshot *node.Tree, filter treeFilter) (*exportNode, error) {
+	root, exists := snapshot.Root()
+	if !exists {
+		return nil, fmt.Errorf("there is no root node")
+	}
+	return buildExportNode(db, snapshot, root, 0, false, filter)
+}
+
+func buildExportNode(db *sql.DB, snapshot *node.Tree, n *node.Node, depth int, inner bool, filter treeFilter) (*exportNode, error) {
+	word, err := decodeForExport(db, n.ExemplarValue)
+	if err != nil {
+		return nil, err
+	}
+	e := &exportNode{
+		ID:           int(n.ID),
+		Depth:        depth,
+		Exemplar:     n.ExemplarValue.String(),
+		ExemplarWord: word,
+		Inner:        inner,
+	}
+	if n.Loss.Valid {
+		e.Loss = &n.Loss.Float64
+	}
+	if n.DataQuantity.Valid {
+		e.DataQuantity = &n.DataQuantity.Int64
+	}
+	if n.Terminal {
+		e.TerminalReason = n.TerminalReason.String
+	}
+	children := snapshot.Children(n.ID)
+	if len(children) == 0 {
+		return e, nil
+	}
+	e.ContextK = int(n.ContextK.Int64)
+	e.RegionPrefix = n.InnerRegionPrefix.String()
+	e.RegionWord, err = decodeForExport(db, n.InnerRegionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if !filter.keep(child, depth+1) {
+			e.Truncated = true
+			continue
+		}
+		c, err := buildExportNode(db, snapshot, child, depth+1, child.ID == n.InnerRegionNodeID, filter)
+		if err != nil {
+			return nil, err
+		}
+		e.Children = append(e.Children, c)
+	}
+	return e, nil
+}
+
+// walkExport visits parents before children
+func walkExport(e *exportNode, fn func(parent, child *exportNode)) {
+	fn(nil, e)
+	var visit func(parent *exportNode)
+	visit = func(parent *exportNode) {
+		for _, child := range parent.Children {
+			fn(parent, child)
+			visit(child)
+		}
+	}
+	visit(e)
+}
+
+func (e *exportNode) label() string {
+	s := fmt.Sprintf("Node %d: %s", e.ID, e.ExemplarWord)
+	if e.Loss != nil {
+		s += fmt.Sprintf("\nloss %f", *e.Loss)
+	}
+	if e.DataQuantity != nil {
+		s += fmt.Sprintf("\n%d training samples", *e.DataQuantity)
+	}
+	if e.TerminalReason != "" {
+		s += fmt.Sprintf("\nterminal: %s", e.TerminalReason)
+	}
+	return s
+}
+
+// edgeLabel describes the condition for going from parent to child
+func edgeLabel(parent, child *exportNode) string {
+	if child.Inner {
+		return fmt.Sprintf("context%d in %s", parent.ContextK, parent.RegionWord)
+	}
+	return fmt.Sprintf("context%d not in %s", parent.ContextK, parent.RegionWord)
+}
+
+func writeJSON(w io.Writer, root *exportNode) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(root)
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+func writeDOT(w io.Writer, root *exportNode) error {
+	var b strings.Builder
+	b.WriteString("digraph ultratree {\n")
+	b.WriteString("  node [shape=box];\n")
+	walkExport(root, func(parent, child *exportNode) {
+		style := ""
+		if len(child.Children) == 0 {
+			style = ", style=rounded"
+		}
+		if child.Truncated {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  n%d [label=%s%s];\n", child.ID, dotQuote(child.label()), style)
+		if parent != nil {
+			fmt.Fprintf(&b, "  n%d -> n%d [label=%s];\n", parent.ID, child.ID, dotQuote(edgeLabel(parent, child)))
+		}
+	})
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// The parts of GEXF 1.3 (https://gexf.net) that Gephi needs
+type gexfDocument struct {
+	XMLName xml.Name  `xml:"gexf"`
+	XMLNS   string    `xml:"xmlns,attr"`
+	Version string    `xml:"version,attr"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+type gexfGraph struct {
+	DefaultEdgeType string            `xml:"defaultedgetype,attr"`
+	Attributes      gexfAttributeDefs `xml:"attributes"`
+	Nodes           []gexfNode        `xml:"nodes>node"`
+	Edges           []gexfEdge        `xml:"edges>edge"`
+}
+
+type gexfAttributeDefs struct {
+	Class      string             `xml:"class,attr"`
+	Attributes []gexfAttributeDef `xml:"attribute"`
+}
+
+type gexfAttributeDef struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfNode struct {
+	ID     string          `xml:"id,attr"`
+	Label  string          `xml:"label,attr"`
+	Values []gexfAttribute `xml:"attvalues>attvalue"`
+}
+
+type gexfEdge struct {
+	ID     string `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+	Label  string `xml:"label,attr"`
+}
+
+type gexfAttribute struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
+
+func writeGEXF(w io.Writer, root *exportNode) error {
+	doc := gexfDocument{
+		XMLNS:   "http://gexf.net/1.3",
+		Version: "1.3",
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Attributes: gexfAttributeDefs{
+				Class: "node",
+				Attributes: []gexfAttributeDef{
+					{ID: "exemplar", Title: "exemplar", Type: "string"},
+					{ID: "loss", Title: "loss", Type: "double"},
+					{ID: "data_quantity", Title: "data_quantity", Type: "long"},
+					{ID: "depth", Title: "depth", Type: "integer"},
+					{ID: "region", Title: "region", Type: "string"},
+					{ID: "terminal_reason", Title: "terminal_reason", Type: "string"},
+				},
+			},
+		},
+	}
+	walkExport(root, func(parent, child *exportNode) {
+		values := []gexfAttribute{
+			{For: "exemplar", Value: child.Exemplar},
+			{For: "depth", Value: fmt.Sprint(child.Depth)},
+		}
+		if child.Loss != nil {
+			values = append(values, gexfAttribute{For: "loss", Value: fmt.Sprint(*child.Loss)})
+		}
+		if child.DataQuantity != nil {
+			values = append(values, gexfAttribute{For: "data_quantity", Value: fmt.Sprint(*child.DataQuantity)})
+		}
+		if child.RegionWord != "" {
+			values = append(values, gexfAttribute{For: "region", Value: child.RegionWord})
+		}
+		if child.TerminalReason != "" {
+			values = append(values, gexfAttribute{For: "terminal_reason", Value: child.TerminalReason})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gexfNode{
+			ID:     fmt.Sprint(child.ID),
+			Label:  child.ExemplarWord,
+			Values: values,
+		})
+		if parent != nil {
+			doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{
+				ID:     fmt.Sprintf("%d-%d", parent.ID, child.ID),
+				Source: fmt.Sprint(parent.ID),
+				Target: fmt.Sprint(child.ID),
+				Label:  edgeLabel(parent, child),
+			})
+		}
+	})
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
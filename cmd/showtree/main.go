@@ -5,19 +5,24 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
-	"github.com/solresol/ultrametric-trees/pkg/exemplar"
 	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 func main() {
 	dbPath := flag.String("database", "", "Path to the SQLite database file")
 	tableName := flag.String("table", "nodes", "Name of the nodes table")
 	timestamp := flag.String("time", "", "Timestamp to display nodes (format: 2006-01-02 15:04:05)")
+	atSplit := flag.Int("at-split", -1, "Display the tree as it was straight after this split (overrides --time)")
+	format := flag.String("format", "text", "Output format: text, json, dot (Graphviz) or gexf (Gephi)")
+	maxDepth := flag.Int("max-depth", -1, "Leave out nodes deeper than this")
+	minDataQuantity := flag.Int64("min-data-quantity", 0, "Leave out nodes with fewer training samples than this")
 	flag.Parse()
 
 	if *timestamp == "" {
@@ -40,34 +45,52 @@ func main() {
 		log.Fatalf("Error parsing timestamp: %v", err)
 	}
 
-	activeNodes, err := node.FetchNodesAsOf(db, *tableName, t)
+	snapshot, err := node.FetchTreeAtCutoff(db, *tableName, node.NewCutoff(*atSplit, t))
 	if err != nil {
 		log.Fatalf("Error fetching filtered nodes: %v", err)
 	}
-	nodeMap := make(map[int]node.Node)
-	for _, n := range activeNodes {
-		nodeMap[n.ID] = n
+
+	filter := treeFilter{maxDepth: *maxDepth, minDataQuantity: *minDataQuantity}
+	if *format == "text" {
+		err = displayTree(db, snapshot, filter)
+		if err != nil {
+			log.Fatalf("Could not displayTree: %v", err)
+		}
+		return
 	}
 
-	err = displayTree(db, nodeMap)
+	root, err := buildExportTree(db, snapshot, filter)
+	if err != nil {
+		log.Fatalf("Could not decode the tree: %v", err)
+	}
+	switch *format {
+	case "json":
+		err = writeJSON(os.Stdout, root)
+	case "dot":
+		err = writeDOT(os.Stdout, root)
+	case "gexf":
+		err = writeGEXF(os.Stdout, root)
+	default:
+		log.Fatalf("Unsupported output format: %s", *format)
+	}
 	if err != nil {
-		log.Fatalf("Could not displayTree: %v", err)
+		log.Fatalf("Could not write the tree: %v", err)
 	}
 }
 
-func displayTree(db *sql.DB, nodeMap map[int]node.Node) error {
+func displayTree(db *sql.DB, snapshot *node.Tree, filter treeFilter) error {
 	// Start the recursive display from the root node
-	// err := displayNodeAndChildren(db, 0, int(exemplar.RootNodeID), nodeMap, "", "[DEFAULT]", false)
-	err := displayNodeRecursively(db, 0, int(exemplar.RootNodeID), nodeMap, "Root node")
+	// err := displayNodeAndChildren(db, 0, tree.RootNodeID, snapshot, "", "[DEFAULT]", false)
+	err := displayNodeRecursively(db, 0, tree.RootNodeID, snapshot, "Root node", filter)
 	return err
 
 }
 
 // This almost exactly duplicates decode.DecodePath
-func getWordFromPath(db *sql.DB, path string) (bool, string, error) {
+func getWordFromPath(db *sql.DB, path tree.Synsetpath) (bool, string, error) {
 	var w string
 	var c int
-	err := db.QueryRow("select word, count(*) from decodings where path = ? group by word order by 2 desc limit 1", path).Scan(&w, &c)
+	err := db.QueryRow("select word, count(*) from decodings where path = ? group by word order by 2 desc limit 1", path.String()).Scan(&w, &c)
 	if err == sql.ErrNoRows {
 		return false, "", nil
 	}
@@ -77,57 +100,44 @@ func getWordFromPath(db *sql.DB, path string) (bool, string, error) {
 	return true, w, nil
 }
 
-func findParent(nodeMap map[int]node.Node, childId int) (int, bool) {
-	// Dreadfully inefficient
-	for nodeId, nodeObj := range nodeMap {
-		if nodeObj.InnerRegionNodeID.Valid && int(nodeObj.InnerRegionNodeID.Int64) == childId {
-			return nodeId, true
-		}
-		if nodeObj.OuterRegionNodeID.Valid && int(nodeObj.OuterRegionNodeID.Int64) == childId {
-			return nodeId, false
-		}
-	}
-	return -1, false
-}
-
 type InnerRegion struct {
-	RegionPrefix string
-	RegionNodeID int
+	RegionPrefix tree.Synsetpath
+	RegionNodeID tree.NodeID
 }
 
-func flattenDescendantsWithSameContext(nodeMap map[int]node.Node, currentNode node.Node) ([]InnerRegion, int) {
+func flattenDescendantsWithSameContext(snapshot *node.Tree, currentNode *node.Node) ([]InnerRegion, tree.NodeID) {
 	var descendants []InnerRegion
 	loopNode := currentNode
 
 	if !loopNode.ContextK.Valid {
 		// That means I have no children. I can't really start. Maybe this should be an error?
-		return descendants, -1
+		return descendants, tree.NoNodeID
 	}
 	context := currentNode.ContextK.Int64
 
 	for {
 		if !loopNode.ContextK.Valid {
-			return descendants, -1
+			return descendants, tree.NoNodeID
 		}
 		if loopNode.ContextK.Int64 != context {
 			return descendants, loopNode.ID
 		}
 
-		outerChild, exists := nodeMap[int(loopNode.OuterRegionNodeID.Int64)]
-		innerRegion := InnerRegion{RegionPrefix: loopNode.InnerRegionPrefix.String,
-			RegionNodeID: int(loopNode.InnerRegionNodeID.Int64)}
+		outerChild, exists := snapshot.Node(loopNode.OuterRegionNodeID)
+		innerRegion := InnerRegion{RegionPrefix: loopNode.InnerRegionPrefix,
+			RegionNodeID: loopNode.InnerRegionNodeID}
 		descendants = append(descendants, innerRegion)
 		if exists {
 			loopNode = outerChild
 		} else {
 			// No more descendants... outerChild doesn't exist, possibly because
 			// we have a moment-in-time snapshot
-			return descendants, -1
+			return descendants, tree.NoNodeID
 		}
 	}
 }
 
-func displayInnerDescendants(db *sql.DB, depth int, regions []InnerRegion, nodeMap map[int]node.Node, context int) error {
+func displayInnerDescendants(db *sql.DB, depth int, regions []InnerRegion, snapshot *node.Tree, context int, filter treeFilter) error {
 	prefix := strings.Repeat(" ", depth)
 	//fmt.Printf("%sTHERE ARE %d DESCENDANTS AT Depth %d,\n", prefix, len(regions), depth)
 	for _, value := range regions {
@@ -136,10 +146,10 @@ func displayInnerDescendants(db *sql.DB, depth int, regions []InnerRegion, nodeM
 			return fmt.Errorf("Failed to get word %s from path: %v", value.RegionPrefix, err)
 		}
 		if !exists {
-			region = value.RegionPrefix
+			region = value.RegionPrefix.String()
 		}
 		thisMessage := fmt.Sprintf("%sNode %d (child at Depth %d, when context%d = %s)", prefix, value.RegionNodeID, depth, context, region)
-		err = displayNodeRecursively(db, depth, value.RegionNodeID, nodeMap, thisMessage)
+		err = displayNodeRecursively(db, depth, value.RegionNodeID, snapshot, thisMessage, filter)
 		if err != nil {
 			return fmt.Errorf("Could not display inner descendant %d: %v", value.RegionNodeID, err)
 		}
@@ -147,7 +157,7 @@ func displayInnerDescendants(db *sql.DB, depth int, regions []InnerRegion, nodeM
 	return nil
 }
 
-func displayOuterDescendant(db *sql.DB, depth int, outerNodeID int, nodeMap map[int]node.Node, context int, regionsWeAreOutOf []InnerRegion) error {
+func displayOuterDescendant(db *sql.DB, depth int, outerNodeID tree.NodeID, snapshot *node.Tree, context int, regionsWeAreOutOf []InnerRegion, filter treeFilter) error {
 	prefix := strings.Repeat(" ", depth)
 	displayRegionsWeAreOutOf := ""
 	for idx, value := range regionsWeAreOutOf {
@@ -156,7 +166,7 @@ func displayOuterDescendant(db *sql.DB, depth int, outerNodeID int, nodeMap map[
 			return fmt.Errorf("Failed to get word %s from path: %v", value.RegionPrefix, err)
 		}
 		if !exists {
-			region = value.RegionPrefix
+			region = value.RegionPrefix.String()
 		}
 		if idx == 0 {
 			displayRegionsWeAreOutOf = region
@@ -165,49 +175,52 @@ func displayOuterDescendant(db *sql.DB, depth int, outerNodeID int, nodeMap map[
 		}
 	}
 	myMessage := fmt.Sprintf("%sNode %d (child at Depth %d, when context%d is not in {%s})", prefix, outerNodeID, depth, context, displayRegionsWeAreOutOf)
-	err := displayNodeRecursively(db, depth, outerNodeID, nodeMap, myMessage)
+	err := displayNodeRecursively(db, depth, outerNodeID, snapshot, myMessage, filter)
 	if err != nil {
 		return fmt.Errorf("Could not display outer descendant %d: %v", outerNodeID, err)
 	}
 	return nil
 }
 
-func displayNodeRecursively(db *sql.DB, depth int, nodeID int, nodeMap map[int]node.Node, nodeText string) error {
+func displayNodeRecursively(db *sql.DB, depth int, nodeID tree.NodeID, snapshot *node.Tree, nodeText string, filter treeFilter) error {
 	prefix := strings.Repeat(" ", depth)
-	n, exists := nodeMap[nodeID]
+	n, exists := snapshot.Node(nodeID)
 	if !exists {
 		return fmt.Errorf("%s- Node %d: Not found\n", prefix, nodeID)
 	}
-	exists, suggestion, err := getWordFromPath(db, n.ExemplarValue.String)
+	if !filter.keep(n, depth) {
+		return nil
+	}
+	exists, suggestion, err := getWordFromPath(db, n.ExemplarValue)
 	if err != nil {
-		return fmt.Errorf("Could not get word from path for %s: %v", n.ExemplarValue.String, err)
+		return fmt.Errorf("Could not get word from path for %s: %v", n.ExemplarValue, err)
 	}
 	showChildren := true
-	if !n.InnerRegionNodeID.Valid || !n.OuterRegionNodeID.Valid {
+	if !n.InnerRegionNodeID.Valid() || !n.OuterRegionNodeID.Valid() {
 		showChildren = false
 	} else {
-		_, exists = nodeMap[int(n.InnerRegionNodeID.Int64)]
+		_, exists = snapshot.Node(n.InnerRegionNodeID)
 		if !exists {
 			showChildren = false
 		}
-		_, exists = nodeMap[int(n.OuterRegionNodeID.Int64)]
+		_, exists = snapshot.Node(n.OuterRegionNodeID)
 		if !exists {
 			showChildren = false
 		}
 	}
 
 	if !showChildren {
-		fmt.Printf("%s -- predict the word *%s*, loss = %f, %d training samples\n", nodeText, suggestion, n.Loss.Float64, n.DataQuantity.Int64)
+		fmt.Printf("%s -- predict the word *%s*, loss = %f, %d training samples%s\n", nodeText, suggestion, n.Loss.Float64, n.DataQuantity.Int64, terminalNote(n))
 		return nil
 	}
 	fmt.Printf("%s -- (obsolete: predicted the word *%s*, loss = %f, %d training samples)\n", nodeText, suggestion, n.Loss.Float64, n.DataQuantity.Int64)
-	sameContextDescendants, outer := flattenDescendantsWithSameContext(nodeMap, n)
-	err = displayInnerDescendants(db, depth+1, sameContextDescendants, nodeMap, int(n.ContextK.Int64))
+	sameContextDescendants, outer := flattenDescendantsWithSameContext(snapshot, n)
+	err = displayInnerDescendants(db, depth+1, sameContextDescendants, snapshot, int(n.ContextK.Int64), filter)
 	if err != nil {
 		return fmt.Errorf("Error while displaying inner descendants: %v", err)
 	}
-	if outer != -1 {
-		err = displayOuterDescendant(db, depth+1, outer, nodeMap, int(n.ContextK.Int64), sameContextDescendants)
+	if outer.Valid() {
+		err = displayOuterDescendant(db, depth+1, outer, snapshot, int(n.ContextK.Int64), sameContextDescendants, filter)
 		if err != nil {
 			return err
 		}
@@ -215,29 +228,37 @@ func displayNodeRecursively(db *sql.DB, depth int, nodeID int, nodeMap map[int]n
 	return nil
 }
 
-func displayNodeAndChildren(db *sql.DB, depth int, nodeID int, nodeMap map[int]node.Node, insideMessage string, outsideOfMessage string, nodeWasInside bool) error {
+// terminalNote says why a leaf won't be split, if it won't
+func terminalNote(n *node.Node) string {
+	if !n.Terminal {
+		return ""
+	}
+	return fmt.Sprintf(" [terminal: %s]", n.TerminalReason.String)
+}
+
+func displayNodeAndChildren(db *sql.DB, depth int, nodeID tree.NodeID, snapshot *node.Tree, insideMessage string, outsideOfMessage string, nodeWasInside bool) error {
 	prefix := strings.Repeat(" ", depth)
-	n, exists := nodeMap[nodeID]
+	n, exists := snapshot.Node(nodeID)
 	if !exists {
 		return fmt.Errorf("%s- Node %d: Not found\n", prefix, nodeID)
 	}
-	exists, suggestion, err := getWordFromPath(db, n.ExemplarValue.String)
+	exists, suggestion, err := getWordFromPath(db, n.ExemplarValue)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		suggestion = n.ExemplarValue.String
+		suggestion = n.ExemplarValue.String()
 	}
 
 	showChildren := true
-	if !n.InnerRegionNodeID.Valid || !n.OuterRegionNodeID.Valid {
+	if !n.InnerRegionNodeID.Valid() || !n.OuterRegionNodeID.Valid() {
 		showChildren = false
 	} else {
-		_, exists = nodeMap[int(n.InnerRegionNodeID.Int64)]
+		_, exists = snapshot.Node(n.InnerRegionNodeID)
 		if !exists {
 			showChildren = false
 		}
-		_, exists = nodeMap[int(n.OuterRegionNodeID.Int64)]
+		_, exists = snapshot.Node(n.OuterRegionNodeID)
 		if !exists {
 			showChildren = false
 		}
@@ -248,27 +269,31 @@ func displayNodeAndChildren(db *sql.DB, depth int, nodeID int, nodeMap map[int]n
 	} else {
 		myMessage = outsideOfMessage
 	}
-	parent, wasInsideParent := findParent(nodeMap, nodeID)
+	parent := tree.NoNodeID
+	parentNode, wasInsideParent, _ := snapshot.Parent(nodeID)
+	if parentNode != nil {
+		parent = parentNode.ID
+	}
 	if wasInsideParent != nodeWasInside {
-		fmt.Printf("Some sort of logic error on node %d\n")
+		fmt.Printf("Some sort of logic error on node %d\n", nodeID)
 	}
 	if !showChildren {
 		fmt.Printf("%s- Depth %d, Node %d, Parent %d: suggestion is %s when %s, loss %f, %d usages\n", prefix, depth, n.ID, parent, suggestion, myMessage, n.Loss.Float64, n.DataQuantity.Int64)
 		return nil
 	}
 
-	exists, region, err := getWordFromPath(db, n.InnerRegionPrefix.String)
+	exists, region, err := getWordFromPath(db, n.InnerRegionPrefix)
 	if !exists {
-		region = n.InnerRegionPrefix.String
+		region = n.InnerRegionPrefix.String()
 	}
 	fmt.Printf("%s- Depth %d, Node %d, Parent %d: {suggested [%s] when %s, loss %f, %d usages}\n", prefix, depth, n.ID, parent, suggestion, myMessage,
 		n.Loss.Float64, n.DataQuantity.Int64)
-	sameContextDescendants, outer := flattenDescendantsWithSameContext(nodeMap, n)
-	err = displayInnerDescendants(db, depth, sameContextDescendants, nodeMap, int(n.ContextK.Int64))
+	sameContextDescendants, outer := flattenDescendantsWithSameContext(snapshot, n)
+	err = displayInnerDescendants(db, depth, sameContextDescendants, snapshot, int(n.ContextK.Int64), treeFilter{maxDepth: -1})
 	if err != nil {
 		return fmt.Errorf("Error while displaying inner descendants: %v", err)
 	}
-	err = displayOuterDescendant(db, depth, outer, nodeMap, int(n.ContextK.Int64), sameContextDescendants)
+	err = displayOuterDescendant(db, depth, outer, snapshot, int(n.ContextK.Int64), sameContextDescendants, treeFilter{maxDepth: -1})
 	grandchildAdoption := false
 
 	var outerChildMessage string
@@ -280,15 +305,15 @@ func displayNodeAndChildren(db *sql.DB, depth int, nodeID int, nodeMap map[int]n
 
 	insideChildMessage := fmt.Sprintf("context%d is inside [%s]", n.ContextK.Int64, region)
 
-	err = displayNodeAndChildren(db, depth+1, int(n.InnerRegionNodeID.Int64), nodeMap, insideChildMessage, outerChildMessage, true)
+	err = displayNodeAndChildren(db, depth+1, n.InnerRegionNodeID, snapshot, insideChildMessage, outerChildMessage, true)
 	if err != nil {
 		return err
 	}
 
 	if grandchildAdoption {
-		err = displayNodeAndChildren(db, depth, int(n.OuterRegionNodeID.Int64), nodeMap, "", outerChildMessage, false)
+		err = displayNodeAndChildren(db, depth, n.OuterRegionNodeID, snapshot, "", outerChildMessage, false)
 	} else {
-		err = displayNodeAndChildren(db, depth+1, int(n.OuterRegionNodeID.Int64), nodeMap, "", outerChildMessage, false)
+		err = displayNodeAndChildren(db, depth+1, n.OuterRegionNodeID, snapshot, "", outerChildMessage, false)
 	}
 
 	if err != nil {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/control"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// errInterrupted is returned by createGoodSplit if it was stopped
+// before it changed anything
+var errInterrupted = errors.New("interrupted")
+
+// How often the control table is checked while paused
+const pausedPollInterval = 10 * time.Second
+
+// controller handles signals and the control table. SIGINT and SIGTERM
+// cancel the context, so that the split in progress is abandoned (or
+// finished, if it is already being written) and train exits cleanly.
+// The pause and resume signals (SIGUSR1 and SIGUSR2, where there are
+// such things) set the control table, as an operator could.
+type controller struct {
+	db         *sql.DB
+	nodesTable string
+	// Wakes up anything sleeping, so that it notices a change
+	wake chan struct{}
+}
+
+func newController(db *sql.DB, nodesTable string) (*controller, error) {
+	if err := control.CreateTable(db); err != nil {
+		return nil, err
+	}
+	return &controller{db: db, nodesTable: nodesTable, wake: make(chan struct{}, 1)}, nil
+}
+
+// watchSignals calls cancel on the first SIGINT or SIGTERM; a second
+// one exits straight away.
+func (c *controller) watchSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	watched := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if pauseSignal != nil {
+		watched = append(watched, pauseSignal, resumeSignal)
+	}
+	signal.Notify(signals, watched...)
+	go func() {
+		interrupted := false
+		for sig := range signals {
+			switch {
+			case pauseSignal != nil && (sig == pauseSignal || sig == resumeSignal):
+				paused := sig == pauseSignal
+				if err := control.SetPaused(c.db, c.nodesTable, paused, sig.String()); err != nil {
+					log.Printf("Could not record %v: %v", sig, err)
+				}
+			default:
+				if interrupted {
+					log.Printf("Received %v again, exiting immediately", sig)
+					os.Exit(1)
+				}
+				interrupted = true
+				log.Printf("Received %v, stopping after cleaning up (send it again to exit immediately)", sig)
+				cancel()
+			}
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// sleep waits for d, but returns early if something changes. It
+// returns false if training should stop.
+func (c *controller) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-c.wake:
+	case <-timer.C:
+	}
+	return ctx.Err() == nil
+}
+
+// waitWhilePaused returns once training isn't paused; false means that
+// training should stop instead.
+func (c *controller) waitWhilePaused(ctx context.Context) bool {
+	announced := false
+	for {
+		paused, reason, err := control.Paused(c.db, c.nodesTable)
+		if err != nil {
+			// Better to keep training than to stop because of this
+			log.Printf("Could not check whether training is paused: %v", err)
+			return ctx.Err() == nil
+		}
+		if !paused {
+			if announced {
+				log.Printf("Resuming training")
+			}
+			return ctx.Err() == nil
+		}
+		if !announced {
+			log.Printf("Training is paused (%s)", reason)
+			announced = true
+		}
+		if !c.sleep(ctx, pausedPollInterval) {
+			return false
+		}
+	}
+}
+
+// releaseNode gives up the claim on a node, so that it can be picked
+// again next time
+func releaseNode(db *sql.DB, nodesTable string, nodeID tree.NodeID, claimant string) {
+	err := exemplar.ReleaseClaim(db, nodesTable, nodeID, claimant)
+	if err == exemplar.ErrClaimLost {
+		log.Printf("Node %d of %s had already been claimed by another process", int(nodeID), nodesTable)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not set being_analysed = false on row %d of %s: %v", int(nodeID), nodesTable, err)
+	}
+}
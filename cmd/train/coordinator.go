@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/control"
+	"github.com/solresol/ultrametric-trees/pkg/events"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// With --coordinator, train owns the model database but doesn't search
+// for splits itself. Instead it hands out the leaves to split, one job
+// at a time, to worker processes (train --worker) that ask for them
+// over HTTP. A job carries every row of the leaf, so workers don't
+// need the database. The worker checks the best split it found against
+// the stopping rules (including --significance, which can take much
+// longer than the search); if it passes, the worker sends it back and
+// the coordinator commits it, and if not, the worker releases the leaf
+// as terminal.
+//
+//	POST /jobs                 a job, 204 to ask again later, or 410 when training is over
+//	POST /jobs/{id}/heartbeat  the worker is still busy with it; 404 if it has been given up on
+//	POST /jobs/{id}/result     the best split the worker found; 409 if it has been given up on
+//	POST /jobs/{id}/release    the worker won't be finishing it
+//
+// A worker that hasn't been heard from for --claim-timeout is assumed
+// to have gone away, and its leaf is released so that another worker
+// can have it.
+
+// How long an idle worker waits before asking for a job again
+const workerPollInterval = 10 * time.Second
+
+// splitJob is what a worker needs to split a leaf. Loss is the leaf's
+// loss, which the split is checked against.
+type splitJob struct {
+	ID               int         `json:"id"`
+	NodeID           int         `json:"node_id"`
+	Loss             float64     `json:"loss"`
+	Params           splitParams `json:"params"`
+	Rules            splitRules  `json:"rules"`
+	HeartbeatSeconds float64     `json:"heartbeat_seconds"`
+	RowIDs           []int       `json:"row_ids"`
+	Targets          []string    `json:"targets"`
+	// Contexts[k-1][i] is context k of the row RowIDs[i]
+	Contexts [][]string `json:"contexts"`
+}
+
+// splitRules are the stoppingRules that a worker checks a split
+// against before sending it back
+type splitRules struct {
+	MinImprovement         float64 `json:"min_improvement,omitempty"`
+	MinRelativeImprovement float64 `json:"min_relative_improvement,omitempty"`
+	Significance           float64 `json:"significance,omitempty"`
+	SignificanceTrials     int     `json:"significance_trials,omitempty"`
+}
+
+// splitResult is the best split that a worker found. The coordinator
+// works out which rows go where for itself.
+type splitResult struct {
+	ContextK        int     `json:"context_k"`
+	Region          string  `json:"region"`
+	InsideExemplar  string  `json:"inside_exemplar"`
+	OutsideExemplar string  `json:"outside_exemplar"`
+	InsideSize      int     `json:"inside_size"`
+	OutsideSize     int     `json:"outside_size"`
+	InsideLoss      float64 `json:"inside_loss"`
+	OutsideLoss     float64 `json:"outside_loss"`
+}
+
+// jobRequest is sent by a worker asking for a job
+type jobRequest struct {
+	Worker string `json:"worker"`
+}
+
+// jobRelease is sent by a worker giving a job back. Error says what
+// went wrong, if anything did. Terminal is set if the leaf can't be
+// split at all, for TerminalReason, in which case it is marked as
+// terminal; otherwise it is just released for someone else to try.
+type jobRelease struct {
+	Error          string `json:"error,omitempty"`
+	Terminal       bool   `json:"terminal,omitempty"`
+	TerminalReason string `json:"terminal_reason,omitempty"`
+}
+
+type activeJob struct {
+	id        int
+	nodeID    tree.NodeID
+	loss      float64
+	claimant  string
+	worker    string
+	started   time.Time
+	lastHeard time.Time
+}
+
+type coordinator struct {
+	db                *sql.DB
+	nodesTable        string
+	trainingDataTable string
+	nodeBucketTable   string
+	params            splitParams
+	minSize           int
+	selector          exemplar.LeafSelector
+	rules             stoppingRules
+	rng               *rand.Rand
+	stopAfter         int
+	claimant          string
+	claimTimeout      time.Duration
+	gate              *powerGate
+	eventLog          *events.Logger
+	reportProgress    func(splitsDone int)
+
+	// mu guards the fields below. It isn't held while talking to the
+	// database or searching, so requests don't wait for each other.
+	mu         sync.Mutex
+	jobs       map[int]*activeJob
+	lastJobID  int
+	splitsDone int
+	// Jobs that are being handed out or committed; they aren't in jobs
+	// but their leaves are claimed
+	pending int
+	// Closed when training is over, for reason (or because of failure)
+	finished chan struct{}
+	reason   string
+	failure  error
+}
+
+// run serves workers on addr until training is over or ctx is
+// cancelled
+func (c *coordinator) run(ctx context.Context, addr string) error {
+	c.jobs = map[int]*activeJob{}
+	c.finished = make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", c.handleJob)
+	mux.HandleFunc("POST /jobs/{id}/heartbeat", c.handleHeartbeat)
+	mux.HandleFunc("POST /jobs/{id}/result", c.handleResult)
+	mux.HandleFunc("POST /jobs/{id}/release", c.handleRelease)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Coordinator stopped serving: %v", err)
+		}
+	}()
+	log.Printf("Waiting for workers on %s", listener.Addr())
+
+	expiryCtx, stopExpiry := context.WithCancel(ctx)
+	defer stopExpiry()
+	go c.expireJobs(expiryCtx)
+
+	select {
+	case <-ctx.Done():
+	case <-c.finished:
+		// Give idle workers the chance to find out that there is
+		// nothing more to do
+		select {
+		case <-ctx.Done():
+		case <-time.After(workerPollInterval + 5*time.Second):
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+
+	c.mu.Lock()
+	abandoned := make([]*activeJob, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		abandoned = append(abandoned, job)
+	}
+	c.jobs = map[int]*activeJob{}
+	splitsDone, reason, failure := c.splitsDone, c.reason, c.failure
+	c.mu.Unlock()
+	for _, job := range abandoned {
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+	}
+	if reason == "" {
+		reason = "interrupted"
+	}
+	log.Printf("Stopped after %d splits (%s)", splitsDone, reason)
+	recordEvent(c.eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: reason})
+	return failure
+}
+
+// finish ends training; c.mu must be held
+func (c *coordinator) finish(reason string, failure error) {
+	select {
+	case <-c.finished:
+		return
+	default:
+	}
+	c.reason = reason
+	c.failure = failure
+	close(c.finished)
+}
+
+// inFlight is how many jobs have been started and not finished; c.mu
+// must be held
+func (c *coordinator) inFlight() int {
+	return len(c.jobs) + c.pending
+}
+
+// newRNG gives a request random numbers of its own, since c.rng can't
+// be shared between goroutines; c.mu must be held
+func (c *coordinator) newRNG() *rand.Rand {
+	return rand.New(rand.NewSource(c.rng.Int63()))
+}
+
+func (c *coordinator) isFinished() bool {
+	select {
+	case <-c.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+func tryAgainLater(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(workerPollInterval.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not send a response: %v", err)
+	}
+}
+
+func (c *coordinator) handleJob(w http.ResponseWriter, r *http.Request) {
+	var request jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only the bookkeeping is done with c.mu held; the job is counted
+	// as pending while its leaf is found and loaded, so that other
+	// requests don't hand out more than --stop-after allows.
+	c.mu.Lock()
+	if c.isFinished() {
+		reason := c.reason
+		c.mu.Unlock()
+		http.Error(w, reason, http.StatusGone)
+		return
+	}
+	if c.stopAfter > 0 && c.splitsDone+c.inFlight() >= c.stopAfter {
+		c.mu.Unlock()
+		tryAgainLater(w)
+		return
+	}
+	c.pending++
+	c.lastJobID++
+	job := &activeJob{
+		id:       c.lastJobID,
+		claimant: fmt.Sprintf("%s/job-%d", c.claimant, c.lastJobID),
+		worker:   request.Worker,
+		started:  time.Now(),
+	}
+	job.lastHeard = job.started
+	others := c.inFlight() - 1
+	splitsBefore := c.splitsDone
+	rng := c.newRNG()
+	c.mu.Unlock()
+	handedOut := false
+	defer func() {
+		if !handedOut {
+			c.mu.Lock()
+			c.pending--
+			c.mu.Unlock()
+		}
+	}()
+
+	paused, _, err := control.Paused(c.db, c.nodesTable)
+	if err != nil {
+		// Better to keep training than to stop because of this
+		log.Printf("Could not check whether training is paused: %v", err)
+	}
+	if paused || !c.gate.hasPower(r.Context()) {
+		tryAgainLater(w)
+		return
+	}
+	reason, err := c.rules.trainingOver(c.db, c.nodesTable, others)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		// Let the workers finish what they have started
+		c.finishUnlessBusy(w, reason, splitsBefore)
+		return
+	}
+
+	for {
+		job.nodeID, job.loss, err = exemplar.ClaimLeaf(r.Context(), c.db, c.nodesTable, c.selector, c.minSize, job.claimant, c.claimTimeout, rng)
+		if err != nil || job.nodeID == tree.NoNodeID {
+			break
+		}
+		var terminal terminalLeaf
+		err = c.rules.checkLeaf(c.db, c.nodesTable, job.nodeID)
+		if !errors.As(err, &terminal) {
+			break
+		}
+		markTerminal(c.db, c.nodesTable, job.nodeID, job.claimant, terminal.reason, c.eventLog)
+	}
+	if err != nil {
+		if job.nodeID != tree.NoNodeID {
+			releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		}
+		log.Printf("Could not find a node to work on: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if job.nodeID == tree.NoNodeID {
+		// Other processes' splits may leave leaves to split
+		claimed, err := exemplar.ActiveClaims(c.db, c.nodesTable, c.claimTimeout)
+		if err != nil {
+			log.Printf("Could not count the nodes being split: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if claimed > 0 {
+			tryAgainLater(w)
+			return
+		}
+		c.finishUnlessBusy(w, "no leaves left to split", splitsBefore)
+		return
+	}
+
+	body, err := c.loadJob(job)
+	if err != nil {
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		log.Printf("Could not load the rows of node %d: %v", int(job.nodeID), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = announceLeaf(c.db, c.nodesTable, job.nodeID, job.loss, c.eventLog)
+	if err != nil {
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		log.Print(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Job %d: node %d (%d rows) goes to %s", job.id, int(job.nodeID), len(body.RowIDs), job.worker)
+	// The job has to be known before the worker can hear about it
+	c.mu.Lock()
+	c.pending--
+	c.jobs[job.id] = job
+	handedOut = true
+	c.mu.Unlock()
+	writeJSON(w, body)
+}
+
+// finishUnlessBusy ends training for reason, unless other jobs are
+// still being worked on or splits have been committed since this
+// request started (either of which might change the answer), in which
+// case the worker is asked to come back later
+func (c *coordinator) finishUnlessBusy(w http.ResponseWriter, reason string, splitsBefore int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inFlight() > 1 || c.splitsDone != splitsBefore {
+		tryAgainLater(w)
+		return
+	}
+	c.finish(reason, nil)
+	http.Error(w, c.reason, http.StatusGone)
+}
+
+func (c *coordinator) loadJob(job *activeJob) (splitJob, error) {
+	body := splitJob{
+		ID:               job.id,
+		NodeID:           int(job.nodeID),
+		Loss:             job.loss,
+		Params:           c.params,
+		Rules:            c.rules.forWorkers(),
+		HeartbeatSeconds: (c.claimTimeout / 4).Seconds(),
+	}
+	targets, err := exemplar.LoadRows(c.db, c.trainingDataTable, c.nodeBucketTable, job.nodeID)
+	if err != nil {
+		return body, err
+	}
+	for _, row := range targets {
+		body.RowIDs = append(body.RowIDs, row.RowID)
+		body.Targets = append(body.Targets, row.TargetWord.String())
+	}
+	for k := 1; k <= c.params.ContextLength; k++ {
+		rows, err := exemplar.LoadContextNWithinNode(c.db, c.trainingDataTable, c.nodeBucketTable, job.nodeID, k, c.params.ContextLength)
+		if err != nil {
+			return body, err
+		}
+		if len(rows) != len(targets) {
+			return body, fmt.Errorf("node %d has %d rows but %d of them have context %d", int(job.nodeID), len(targets), len(rows), k)
+		}
+		context := make([]string, len(rows))
+		for i, row := range rows {
+			context[i] = row.TargetWord.String()
+		}
+		body.Contexts = append(body.Contexts, context)
+	}
+	return body, nil
+}
+
+// lookupJob finds the job named in the URL; c.mu must be held
+func (c *coordinator) lookupJob(r *http.Request) (*activeJob, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return nil, false
+	}
+	job, ok := c.jobs[id]
+	return job, ok
+}
+
+func (c *coordinator) hasJob(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.jobs[id]
+	return ok
+}
+
+func (c *coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.lookupJob(r)
+	if !ok {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	job.lastHeard = time.Now()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	var result splitResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	job, ok := c.lookupJob(r)
+	if !ok {
+		c.mu.Unlock()
+		http.Error(w, "that job has been given to someone else", http.StatusConflict)
+		return
+	}
+	delete(c.jobs, job.id)
+	c.pending++
+	c.mu.Unlock()
+	counted := false
+	defer func() {
+		if !counted {
+			c.mu.Lock()
+			c.pending--
+			c.mu.Unlock()
+		}
+	}()
+
+	split, err := c.rebuildSplit(job, result)
+	if err != nil {
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		log.Printf("Job %d from %s: %v", job.id, job.worker, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	// The worker has already checked it against the stopping rules
+	committed, err := commitSplit(c.db, c.nodesTable, c.trainingDataTable, c.nodeBucketTable, job.nodeID, job.claimant, split)
+	if errors.Is(err, exemplar.ErrClaimLost) {
+		log.Printf("Another process took over node %d; the split from job %d has been discarded", int(job.nodeID), job.id)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		c.mu.Lock()
+		c.finish("", fmt.Errorf("could not split node %d: %v", int(job.nodeID), err))
+		c.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The split stops being pending and is counted in one step, so
+	// that nothing sees it as neither
+	c.mu.Lock()
+	c.pending--
+	c.splitsDone++
+	counted = true
+	splitsDone := c.splitsDone
+	if c.stopAfter > 0 && c.splitsDone >= c.stopAfter {
+		c.finish("stop-after", nil)
+	}
+	c.mu.Unlock()
+	recordSplit(c.eventLog, committed, splitsDone, job.loss, time.Since(job.started))
+	c.reportProgress(splitsDone)
+	w.WriteHeader(http.StatusOK)
+}
+
+// rebuildSplit turns a worker's result back into the split that it
+// found, by dividing up the leaf's rows again
+func (c *coordinator) rebuildSplit(job *activeJob, result splitResult) (foundSplit, error) {
+	if result.ContextK < 1 || result.ContextK > c.params.ContextLength {
+		return foundSplit{}, fmt.Errorf("context %d is out of range", result.ContextK)
+	}
+	split := foundSplit{
+		contextK:    result.ContextK,
+		insideLoss:  result.InsideLoss,
+		outsideLoss: result.OutsideLoss,
+	}
+	var err error
+	if split.circle, err = tree.ParseSynsetpath(result.Region); err != nil {
+		return foundSplit{}, fmt.Errorf("bad region: %v", err)
+	}
+	if split.insideExemplar, err = tree.ParseSynsetpath(result.InsideExemplar); err != nil {
+		return foundSplit{}, fmt.Errorf("bad inside exemplar: %v", err)
+	}
+	if split.outsideExemplar, err = tree.ParseSynsetpath(result.OutsideExemplar); err != nil {
+		return foundSplit{}, fmt.Errorf("bad outside exemplar: %v", err)
+	}
+	data := dbSplitData{db: c.db, trainingDataTable: c.trainingDataTable, nodeBucketTable: c.nodeBucketTable, nodeID: job.nodeID, contextLength: c.params.ContextLength}
+	sourceRows, err := data.contextRows(result.ContextK)
+	if err != nil {
+		return foundSplit{}, err
+	}
+	targetRows, err := data.targetRows()
+	if err != nil {
+		return foundSplit{}, err
+	}
+	split.insideRows, split.outsideRows = exemplar.SplitByFilter(sourceRows, targetRows, split.circle)
+	split.insideSize, split.outsideSize = len(split.insideRows), len(split.outsideRows)
+	if split.insideSize != result.InsideSize || split.outsideSize != result.OutsideSize {
+		return foundSplit{}, fmt.Errorf("the split divides node %d into %d and %d rows, not %d and %d",
+			int(job.nodeID), split.insideSize, split.outsideSize, result.InsideSize, result.OutsideSize)
+	}
+	return split, nil
+}
+
+func (c *coordinator) handleRelease(w http.ResponseWriter, r *http.Request) {
+	var release jobRelease
+	if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	job, ok := c.lookupJob(r)
+	if ok {
+		delete(c.jobs, job.id)
+	}
+	c.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch {
+	case release.Terminal:
+		// Another worker wouldn't do any better
+		log.Printf("%s could not split node %d", job.worker, int(job.nodeID))
+		markTerminal(c.db, c.nodesTable, job.nodeID, job.claimant, release.TerminalReason, c.eventLog)
+	case release.Error != "":
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		log.Printf("%s gave back job %d (node %d) after an error: %s", job.worker, job.id, int(job.nodeID), release.Error)
+	default:
+		releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		log.Printf("%s gave back job %d (node %d)", job.worker, job.id, int(job.nodeID))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// expireJobs gives away the leaves of workers that have stopped
+// sending heartbeats, and renews the claims on all the others
+func (c *coordinator) expireJobs(ctx context.Context) {
+	ticker := time.NewTicker(c.claimTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var expired, live []*activeJob
+		c.mu.Lock()
+		for id, job := range c.jobs {
+			if time.Since(job.lastHeard) > c.claimTimeout {
+				log.Printf("Nothing has been heard from %s since %s, so job %d (node %d) goes to someone else",
+					job.worker, job.lastHeard.Format(time.RFC3339), id, int(job.nodeID))
+				delete(c.jobs, id)
+				expired = append(expired, job)
+				continue
+			}
+			live = append(live, job)
+		}
+		c.mu.Unlock()
+		for _, job := range expired {
+			releaseNode(c.db, c.nodesTable, job.nodeID, job.claimant)
+		}
+		for _, job := range live {
+			err := exemplar.RenewClaim(c.db, c.nodesTable, job.nodeID, job.claimant)
+			if errors.Is(err, exemplar.ErrClaimLost) && !c.hasJob(job.id) {
+				// It was committed or given back in the meantime
+				continue
+			}
+			if err != nil {
+				log.Printf("Could not renew the claim on node %d: %v", int(job.nodeID), err)
+			}
+		}
+	}
+}
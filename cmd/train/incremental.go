@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/inference"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// addNewRows is for when prepare has appended stories to a training
+// data table that a tree has already been grown from. Each row that
+// isn't in nodeBucketTable yet goes down the tree the way inference
+// would send it, and into the leaf that it ends up in. The leaves that
+// got new rows then have their exemplar, loss and data_quantity
+// estimated again, so that training carries on from where it was with
+// the new data in place. It returns how many rows were added.
+//
+// It refuses to run while other train processes hold claims on the
+// tree, because a leaf could be split underneath it.
+func addNewRows(db *sql.DB,
+	trainingDataTable, nodeBucketTable, nodesTable string,
+	contextLength, exemplarGuesses, costGuesses int,
+	claimTimeout time.Duration,
+	rng *rand.Rand) (int, error) {
+
+	active, err := exemplar.ActiveClaims(db, nodesTable, claimTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if active > 0 {
+		return 0, fmt.Errorf("%d leaves of %s are being split by other train processes; stop them before adding new rows", active, nodesTable)
+	}
+
+	// Incremental training only copes with rows being added
+	var removed int
+	query := fmt.Sprintf("SELECT count(*) FROM %s b WHERE NOT EXISTS (SELECT 1 FROM %s t WHERE t.id = b.id)", nodeBucketTable, trainingDataTable)
+	if err := db.QueryRow(query).Scan(&removed); err != nil {
+		return 0, fmt.Errorf("Could not compare %s with %s: %v", nodeBucketTable, trainingDataTable, err)
+	}
+	if removed > 0 {
+		return 0, fmt.Errorf("%d rows in %s are no longer in %s, so the tree can't be extended; it has to be trained again", removed, nodeBucketTable, trainingDataTable)
+	}
+
+	snapshot, err := node.FetchTree(db, nodesTable)
+	if err != nil {
+		return 0, fmt.Errorf("Could not load the tree in %s: %v", nodesTable, err)
+	}
+	model := inference.NewModelInferenceFrom(snapshot, decode.DatabaseDictionary{DB: db})
+
+	leafRows, err := routeNewRows(db, model, trainingDataTable, nodeBucketTable, contextLength)
+	if err != nil {
+		return 0, err
+	}
+	if len(leafRows) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("Error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (id, node_id) VALUES (?, ?)", nodeBucketTable))
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+	added := 0
+	for leaf, rowIDs := range leafRows {
+		for _, rowID := range rowIDs {
+			if _, err := insert.Exec(rowID, leaf); err != nil {
+				return 0, fmt.Errorf("Could not put row %d into node %d: %v", rowID, int(leaf), err)
+			}
+			added++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("Error committing transaction: %v", err)
+	}
+
+	// In order, so that a seeded run is repeatable
+	leaves := make([]tree.NodeID, 0, len(leafRows))
+	for leaf := range leafRows {
+		leaves = append(leaves, leaf)
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i] < leaves[j] })
+	for _, leaf := range leaves {
+		log.Printf("Node %d got %d new rows", int(leaf), len(leafRows[leaf]))
+		if err := reestimateLeaf(db, trainingDataTable, nodeBucketTable, nodesTable, leaf, exemplarGuesses, costGuesses, rng); err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// routeNewRows finds the leaf for each row of trainingDataTable that
+// isn't in nodeBucketTable
+func routeNewRows(db *sql.DB, model *inference.ModelInference, trainingDataTable, nodeBucketTable string, contextLength int) (map[tree.NodeID][]int, error) {
+	columns := make([]string, contextLength)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("t.context%d", i+1)
+	}
+	query := fmt.Sprintf("SELECT t.id, %s FROM %s t WHERE NOT EXISTS (SELECT 1 FROM %s b WHERE b.id = t.id) ORDER BY t.id",
+		strings.Join(columns, ", "), trainingDataTable, nodeBucketTable)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find the new rows in %s: %v", trainingDataTable, err)
+	}
+	defer rows.Close()
+
+	leafRows := map[tree.NodeID][]int{}
+	for rows.Next() {
+		var id int
+		contexts := make([]sql.NullString, contextLength)
+		scanArgs := make([]interface{}, contextLength+1)
+		scanArgs[0] = &id
+		for i := range contexts {
+			scanArgs[i+1] = &contexts[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+		// prepare never leaves a context NULL, and training can't cope
+		// with one (LoadContextNWithinNode fails on it). Here, though,
+		// a NULL context is routed the way inference routes missing
+		// context: as an empty path, which is outside every region. So
+		// a row like that is put in a leaf now, but the leaf can't be
+		// split later until the row is fixed.
+		contextPaths := make([]tree.Synsetpath, contextLength)
+		for i, context := range contexts {
+			if !context.Valid {
+				continue
+			}
+			contextPaths[i], err = tree.ParseSynsetpath(context.String)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing context%d of row %d: %v", i+1, id, err)
+			}
+		}
+		result, err := model.InferSingle(contextPaths, false)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find a leaf for row %d: %v", id, err)
+		}
+		leafRows[result.FinalNodeID] = append(leafRows[result.FinalNodeID], id)
+	}
+	return leafRows, rows.Err()
+}
+
+// reestimateLeaf finds an exemplar for all the rows that a leaf now
+// has, the way initializeFirstLeaf does for the root. If the leaf was
+// terminal, it isn't any more: with the new rows, it might have more
+// than one target word, or a split that is good enough. (A leaf at
+// --max-depth is marked as terminal again as soon as it is picked.)
+func reestimateLeaf(db *sql.DB,
+	trainingDataTable, nodeBucketTable, nodesTable string,
+	leaf tree.NodeID,
+	exemplarGuesses, costGuesses int,
+	rng *rand.Rand) error {
+
+	rows, err := exemplar.LoadRows(db, trainingDataTable, nodeBucketTable, leaf)
+	if err != nil {
+		return fmt.Errorf("Error loading rows of node %d: %v", int(leaf), err)
+	}
+	bestExemplar, bestLoss, err := exemplar.FindBestExemplar(rows, exemplarGuesses, costGuesses, rng)
+	if err != nil {
+		return fmt.Errorf("Could not get best exemplar for node %d: %v", int(leaf), err)
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+		UPDATE %s
+		SET exemplar_value = ?, loss = ?, data_quantity = ?, terminal = false, terminal_reason = NULL
+		WHERE id = ? AND NOT has_children
+	`, nodesTable), bestExemplar.String(), bestLoss, len(rows), leaf)
+	if err != nil {
+		return fmt.Errorf("Error updating node %d: %v", int(leaf), err)
+	}
+	log.Printf("Updated node %d with exemplar %s, loss %f, and data quantity %d", int(leaf), bestExemplar.String(), bestLoss, len(rows))
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/inference"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// incrementalFixture is a tree that splits on whether context1 is in
+// 1.2, grown from rows 1 to 4. Node 2 is at --max-depth and node 3 has
+// only ever seen one target word, so both are terminal. Rows 5 to 7
+// have been appended since.
+func incrementalFixture(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	// Every connection to :memory: is a different database
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+		CREATE TABLE nodes (id integer primary key autoincrement, exemplar_value text, data_quantity integer,
+			loss float, contextk int, inner_region_prefix text, inner_region_node_id integer,
+			outer_region_node integer, when_created datetime default current_timestamp,
+			when_children_populated datetime, has_children bool default false,
+			being_analysed bool default false, split_seq integer, claimed_by text, claimed_at datetime,
+			depth integer, terminal bool default false, terminal_reason text);
+		INSERT INTO nodes (id, exemplar_value, data_quantity, loss, contextk, inner_region_prefix,
+			inner_region_node_id, outer_region_node, when_children_populated, has_children, split_seq, depth) VALUES
+			(1, '5.1', 4, 1.5, 1, '1.2', 2, 3, current_timestamp, true, 1, 0);
+		INSERT INTO nodes (id, exemplar_value, data_quantity, loss, depth, terminal, terminal_reason) VALUES
+			(2, '5.1', 2, 0.5, 1, true, 'at --max-depth 1'),
+			(3, '5.2', 2, 0, 1, true, 'every row has the same target word');
+
+		CREATE TABLE training_data (id integer primary key, targetword text, context1 text, context2 text);
+		INSERT INTO training_data (id, targetword, context1, context2) VALUES
+			(1, '5.1', '1.2.5', '1.3'),
+			(2, '5.1.1', '1.2', '1.3'),
+			(3, '5.2', '1.3', '1.2'),
+			(4, '5.2', '1.4.1', '1.2.5'),
+			(5, '5.3.7', '1.23.4', '1.2'),
+			(6, '5.2', '1.2.8', '1.3'),
+			(7, '5.3.8', '1.3.1', '1.2');
+
+		CREATE TABLE node_bucket (id integer, node_id integer, primary key (id, node_id));
+		INSERT INTO node_bucket (id, node_id) VALUES (1, 2), (2, 2), (3, 3), (4, 3);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating the fixture: %v", err)
+	}
+	return db
+}
+
+func TestAddNewRowsReopensTerminalLeaves(t *testing.T) {
+	db := incrementalFixture(t)
+	defer db.Close()
+
+	// Only node 3 gets new rows, and they give it more than one target
+	if _, err := db.Exec("DELETE FROM training_data WHERE id = 6"); err != nil {
+		t.Fatal(err)
+	}
+	added, err := addNewRows(db, "training_data", "node_bucket", "nodes", 2, 10, 10, time.Minute, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("addNewRows: %v", err)
+	}
+	if added != 2 {
+		t.Errorf("addNewRows added %d rows, want 2", added)
+	}
+
+	for _, tt := range []struct {
+		id           int
+		terminal     bool
+		reason       sql.NullString
+		dataQuantity int
+	}{
+		{2, true, sql.NullString{String: "at --max-depth 1", Valid: true}, 2},
+		{3, false, sql.NullString{}, 4},
+	} {
+		var terminal bool
+		var reason sql.NullString
+		var dataQuantity int
+		err := db.QueryRow("SELECT terminal, terminal_reason, data_quantity FROM nodes WHERE id = ?", tt.id).Scan(&terminal, &reason, &dataQuantity)
+		if err != nil {
+			t.Fatalf("Error reading node %d: %v", tt.id, err)
+		}
+		if terminal != tt.terminal || reason != tt.reason || dataQuantity != tt.dataQuantity {
+			t.Errorf("Node %d has terminal = %v (%v) and %d rows, want %v (%v) and %d rows",
+				tt.id, terminal, reason, dataQuantity, tt.terminal, tt.reason, tt.dataQuantity)
+		}
+	}
+}
+
+func TestRouteNewRows(t *testing.T) {
+	db := incrementalFixture(t)
+	defer db.Close()
+
+	snapshot, err := node.FetchTree(db, "nodes")
+	if err != nil {
+		t.Fatalf("FetchTree: %v", err)
+	}
+	model := inference.NewModelInferenceFrom(snapshot, decode.DatabaseDictionary{DB: db})
+	leafRows, err := routeNewRows(db, model, "training_data", "node_bucket", 2)
+	if err != nil {
+		t.Fatalf("routeNewRows: %v", err)
+	}
+	// 1.23.4 isn't in 1.2
+	want := map[tree.NodeID][]int{2: {6}, 3: {5, 7}}
+	if !reflect.DeepEqual(leafRows, want) {
+		t.Errorf("routeNewRows = %v, want %v", leafRows, want)
+	}
+
+	if _, err := addNewRows(db, "training_data", "node_bucket", "nodes", 2, 10, 10, time.Minute, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatalf("addNewRows: %v", err)
+	}
+	rows, err := db.Query("SELECT id, node_id FROM node_bucket ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var placed [][2]int
+	for rows.Next() {
+		var id, nodeID int
+		if err := rows.Scan(&id, &nodeID); err != nil {
+			t.Fatal(err)
+		}
+		placed = append(placed, [2]int{id, nodeID})
+	}
+	wantPlaced := [][2]int{{1, 2}, {2, 2}, {3, 3}, {4, 3}, {5, 3}, {6, 2}, {7, 3}}
+	if !reflect.DeepEqual(placed, wantPlaced) {
+		t.Errorf("node_bucket = %v, want %v", placed, wantPlaced)
+	}
+	var quantities string
+	if err := db.QueryRow("SELECT group_concat(data_quantity) FROM (SELECT data_quantity FROM nodes ORDER BY id)").Scan(&quantities); err != nil {
+		t.Fatal(err)
+	}
+	if quantities != "4,3,4" {
+		t.Errorf("data_quantity of nodes 1, 2 and 3 = %s, want 4,3,4 (the root isn't re-estimated)", quantities)
+	}
+
+	// Nothing is new the second time
+	if added, err := addNewRows(db, "training_data", "node_bucket", "nodes", 2, 10, 10, time.Minute, rand.New(rand.NewSource(1))); err != nil || added != 0 {
+		t.Errorf("addNewRows again = %d, %v; want 0", added, err)
+	}
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
-	"net/http"
+	"os"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/config"
 	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/events"
 	"github.com/solresol/ultrametric-trees/pkg/exemplar"
 	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/power"
+	"github.com/solresol/ultrametric-trees/pkg/progress"
+	"github.com/solresol/ultrametric-trees/pkg/provenance"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 // Initialises a table of node-mapping-to-row with
-// exemplar.RootNodeID.  It then uses a probabilistic estimate to find
+// tree.RootNodeID.  It then uses a probabilistic estimate to find
 // a good exemplar for that root node. It then updates the
 // node-mapping-to-row table (nodeBucketTable) for that split (setting
 // exemplar_value to the exemplar, loss to the estimated loss and
@@ -30,7 +36,7 @@ func initializeFirstLeaf(db *sql.DB,
 	rng *rand.Rand) error {
 
 	// Create a table for the nodes hierarchy
-	query := fmt.Sprintf("create table if not exists %s (id integer primary key autoincrement, exemplar_value text, data_quantity integer, loss float, contextk int, inner_region_prefix text, inner_region_node_id integer, outer_region_node integer, when_created datetime default current_timestamp, when_children_populated datetime, has_children bool default false, being_analysed bool default false)", nodesTable)
+	query := fmt.Sprintf("create table if not exists %s (id integer primary key autoincrement, exemplar_value text, data_quantity integer, loss float, contextk int, inner_region_prefix text, inner_region_node_id integer, outer_region_node integer, when_created datetime default current_timestamp, when_children_populated datetime, has_children bool default false, being_analysed bool default false, split_seq integer, claimed_by text, claimed_at datetime, depth integer, terminal bool default false, terminal_reason text)", nodesTable)
 	_, err := db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("Cannot create a table of nodes called %s: %v", nodesTable, err)
@@ -46,14 +52,14 @@ func initializeFirstLeaf(db *sql.DB,
 
 	// Populate it with the first row. We could do this later, but it's nice to have the half-ready
 	// state visible.
-	query = fmt.Sprintf("insert or ignore into %s (id) values (%d)", nodesTable, int(exemplar.RootNodeID))
+	query = fmt.Sprintf("insert or ignore into %s (id, depth) values (%d, 0)", nodesTable, int(tree.RootNodeID))
 	_, err = db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("Could not create the root node in %s: %v", nodesTable, err)
 	}
 
 	// Create the node-mapping-to-row table
-	query = fmt.Sprintf("create table if not exists %s (id integer references %s (id), node_id integer references nodes(id), primary key (id, node_id))", nodeBucketTable, trainingDataTable)
+	query = fmt.Sprintf("create table if not exists %s (id integer references %s (id), node_id integer references %s(id), primary key (id, node_id))", nodeBucketTable, trainingDataTable, nodesTable)
 	_, err = db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("Cannot create a table called %s: %v", nodeBucketTable, err)
@@ -61,7 +67,7 @@ func initializeFirstLeaf(db *sql.DB,
 
 	// Populate the node-mapping-to-row table
 	query = fmt.Sprintf("insert or ignore into %s (id, node_id) select id, %d from %s",
-		nodeBucketTable, int(exemplar.RootNodeID), trainingDataTable)
+		nodeBucketTable, int(tree.RootNodeID), trainingDataTable)
 	_, err = db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("Could not populate the table %s with records from %s: %v",
@@ -84,7 +90,7 @@ func initializeFirstLeaf(db *sql.DB,
 	// The tables are in reasonable shape, so now it's very much like the back-half of an
 	// exemplar choosing process. Let's get the data we need. rows is a large in-memory array
 	// of synsets
-	rows, err := exemplar.LoadRows(db, trainingDataTable, nodeBucketTable, exemplar.RootNodeID)
+	rows, err := exemplar.LoadRows(db, trainingDataTable, nodeBucketTable, tree.RootNodeID)
 	if err != nil {
 		return fmt.Errorf("Error loading rows: %v", err)
 	}
@@ -98,21 +104,25 @@ func initializeFirstLeaf(db *sql.DB,
 
 	// Great: now our top-level nodes table has an exemplar, a loss and a quantity. We're
 	// just about ready for the recursive training process to start.
-	_, err = db.Exec(`
-		UPDATE nodes
+	_, err = db.Exec(fmt.Sprintf(`
+		UPDATE %s
 		SET exemplar_value = ?, loss = ?, data_quantity = ?
 		WHERE id = ?
-	`, bestExemplar.String(), bestLoss, len(rows), exemplar.RootNodeID)
+	`, nodesTable), bestExemplar.String(), bestLoss, len(rows), tree.RootNodeID)
 	if err != nil {
-		return fmt.Errorf("Error updating nodes table: %v", err)
+		return fmt.Errorf("Error updating %s: %v", nodesTable, err)
 	}
 
-	log.Printf("Updated node %d with exemplar %s, loss %f, and data quantity %d\n", exemplar.RootNodeID, bestExemplar.String(), bestLoss, len(rows))
+	log.Printf("Updated node %d with exemplar %s, loss %f, and data quantity %d\n", tree.RootNodeID, bestExemplar.String(), bestLoss, len(rows))
 
 	return nil
 }
 
-func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, nodesTable string) (bool, error) {
+// initialisationRequired says whether the tree has to be started
+// again from a single root. If incremental is set, rows that have been
+// added to the training data since the tree was started don't force
+// that (addNewRows finds homes for them instead).
+func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, nodesTable string, incremental bool) (bool, error) {
 	trainingDataExists, err := exemplar.TableExists(db, trainingDataTable)
 	if err != nil {
 		return true, fmt.Errorf("Could not detect whether %s exists: %v", trainingDataTable, err)
@@ -156,8 +166,11 @@ func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, node
 		return true, fmt.Errorf("Could not compare the sizes of %s and %s: %v", trainingDataTable, nodeBucketTable, err)
 	}
 	if !sameSize {
-		log.Printf("The trainingDataTable %s and the nodeBucketTable %s are not the same size", trainingDataTable, nodeBucketTable)
-		return true, nil
+		if !incremental {
+			log.Printf("The trainingDataTable %s and the nodeBucketTable %s are not the same size (use --incremental if rows have been added to %s)", trainingDataTable, nodeBucketTable, trainingDataTable)
+			return true, nil
+		}
+		log.Printf("The trainingDataTable %s has rows that aren't in the nodeBucketTable %s yet", trainingDataTable, nodeBucketTable)
 	}
 
 	nodesIsEmpty, err := exemplar.IsTableEmpty(db, nodesTable)
@@ -172,7 +185,7 @@ func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, node
 	return false, nil
 }
 
-//  How createGoodSplit works: it iterates [split-count-try]
+//  How findGoodSplit works: it iterates [split-count-try]
 //  times... each iteration consists of randomly picking a k for
 //  LoadContextNWithinNode, then it gets all the possible synsets that
 //  it returns; then it iterates [num-circles-per-split] times picking
@@ -183,7 +196,7 @@ func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, node
 // In the end, it will have a contextK, a bestCircle, a total loss, a
 // best inside exemplar, the number of elements on the inside array, a
 // best outside exemplar and the number of elements on the outside
-// array. It creates two new nodes in the nodes table.
+// array. commitSplit then creates two new nodes in the nodes table.
 //
 // * An "inner" node, where the exemplar_value is the best inside
 // exemplar, data_quantity = the size of the inner array, loss = the
@@ -198,42 +211,106 @@ func initialisationRequired(db *sql.DB, trainingDataTable, nodeBucketTable, node
 // * inner_region_prefix = bestCircle
 // * inner_region_node = (the newly created inner node id)
 // * outer_region_node = (the newly created outer node id)
+//
+// but only if claimant still has the parent claimed; otherwise it
+// returns exemplar.ErrClaimLost and changes nothing.
+
+// splitParams say how hard to look for a good split. A coordinator
+// sends them to its workers with each job.
+type splitParams struct {
+	SplitCountTry      int `json:"split_count_try"`
+	NumCirclesPerSplit int `json:"num_circles_per_split"`
+	ExemplarGuesses    int `json:"exemplar_guesses"`
+	CostGuesses        int `json:"cost_guesses"`
+	ContextLength      int `json:"context_length"`
+}
 
-func createGoodSplit(db *sql.DB,
-	nodesTable string,
-	nodeID exemplar.NodeID,
-	trainingDataTable string,
-	nodeBucketTable string,
-	splitCountTry int,
-	numCirclesPerSplit int,
-	exemplarGuesses int,
-	costGuesses int,
-	contextLength int,
-	rng *rand.Rand) (float64, error) {
-
-	var bestContextK int
-	var bestCircle exemplar.Synsetpath
+// prescan is a tenth of the effort, for a quick look at whether a node
+// is worth splitting
+func (p splitParams) prescan() splitParams {
+	p.SplitCountTry = max(1, p.SplitCountTry/10)
+	p.ExemplarGuesses = max(1, p.ExemplarGuesses/10)
+	p.CostGuesses = max(1, p.CostGuesses/10)
+	return p
+}
+
+// splitData is where the rows of the node being split come from: the
+// database when training locally, or a job from the coordinator
+type splitData interface {
+	targetRows() ([]exemplar.DataFrameRow, error)
+	contextRows(k int) ([]exemplar.DataFrameRow, error)
+}
+
+type dbSplitData struct {
+	db                *sql.DB
+	trainingDataTable string
+	nodeBucketTable   string
+	nodeID            tree.NodeID
+	contextLength     int
+}
+
+func (d dbSplitData) targetRows() ([]exemplar.DataFrameRow, error) {
+	return exemplar.LoadRows(d.db, d.trainingDataTable, d.nodeBucketTable, d.nodeID)
+}
+
+func (d dbSplitData) contextRows(k int) ([]exemplar.DataFrameRow, error) {
+	return exemplar.LoadContextNWithinNode(d.db, d.trainingDataTable, d.nodeBucketTable, d.nodeID, k, d.contextLength)
+}
+
+// foundSplit is the best split that findGoodSplit came across. A
+// streamed split doesn't have the rows, only how many there are.
+type foundSplit struct {
+	contextK        int
+	circle          tree.Synsetpath
+	insideExemplar  tree.Synsetpath
+	outsideExemplar tree.Synsetpath
+	insideRows      []exemplar.DataFrameRow
+	outsideRows     []exemplar.DataFrameRow
+	insideSize      int
+	outsideSize     int
+	insideLoss      float64
+	outsideLoss     float64
+}
+
+func (s foundSplit) totalLoss() float64 {
+	return s.insideLoss + s.outsideLoss
+}
+
+func findGoodSplit(ctx context.Context,
+	data splitData,
+	nodeID tree.NodeID,
+	params splitParams,
+	rng *rand.Rand,
+	eventLog *events.Logger) (foundSplit, error) {
+
+	var best foundSplit
 	bestTotalLoss := float64(1<<63 - 1) // Initialize with max float64 value
-	var insideLossOfBest, outsideLossOfBest float64
-	var bestInsideExemplar, bestOutsideExemplar exemplar.Synsetpath
-	var bestInsideRows, bestOutsideRows []exemplar.DataFrameRow
 
 	foundSomethingToDo := false
-	for i := 0; i < splitCountTry; i++ {
-		k := rng.Intn(contextLength) + 1
-		sourceRows, err := exemplar.LoadContextNWithinNode(db, trainingDataTable, nodeBucketTable, nodeID, k, contextLength)
+	for i := 0; i < params.SplitCountTry; i++ {
+		if ctx.Err() != nil {
+			return foundSplit{}, errInterrupted
+		}
+		k := rng.Intn(params.ContextLength) + 1
+		sourceRows, err := data.contextRows(k)
 		if err != nil {
-			return 0.0, fmt.Errorf("Error loading context rows: %v", err)
+			return foundSplit{}, fmt.Errorf("Error loading context rows: %v", err)
 		}
 
-		targetRows, err := exemplar.LoadRows(db, trainingDataTable, nodeBucketTable, nodeID)
+		targetRows, err := data.targetRows()
 		if err != nil {
-			return 0.0, fmt.Errorf("Error loading target rows: %v", err)
+			return foundSplit{}, fmt.Errorf("Error loading target rows: %v", err)
+		}
+		if sameTarget(targetRows) {
+			return foundSplit{}, errOneTarget
 		}
 
 		possibleSynsets := exemplar.GetAllPossibleSynsets(sourceRows)
 
-		for j := 0; j < numCirclesPerSplit; j++ {
+		for j := 0; j < params.NumCirclesPerSplit; j++ {
+			if ctx.Err() != nil {
+				return foundSplit{}, errInterrupted
+			}
 			randomSynset := possibleSynsets[rng.Intn(len(possibleSynsets))]
 			inside, outside := exemplar.SplitByFilter(sourceRows, targetRows, randomSynset)
 
@@ -241,174 +318,269 @@ func createGoodSplit(db *sql.DB,
 				// Wasn't a good choice
 				continue
 			}
-			insideExemplar, insideLoss, err := exemplar.FindBestExemplar(inside, exemplarGuesses, costGuesses, rng)
+			insideExemplar, insideLoss, err := exemplar.FindBestExemplar(inside, params.ExemplarGuesses, params.CostGuesses, rng)
 			if err != nil {
 				log.Printf("Error finding inside exemplar: %v", err)
 				continue
 			}
 
-			outsideExemplar, outsideLoss, err := exemplar.FindBestExemplar(outside, exemplarGuesses, costGuesses, rng)
+			outsideExemplar, outsideLoss, err := exemplar.FindBestExemplar(outside, params.ExemplarGuesses, params.CostGuesses, rng)
 			if err != nil {
 				log.Printf("Error finding outside exemplar: %v", err)
 				continue
 			}
 
 			totalLoss := insideLoss + outsideLoss
+			recordCandidate(eventLog, events.CandidateScoredEvent{
+				NodeID:      int(nodeID),
+				Attempt:     i*params.NumCirclesPerSplit + j + 1,
+				ContextK:    k,
+				Region:      randomSynset.String(),
+				InsideSize:  len(inside),
+				OutsideSize: len(outside),
+				InsideLoss:  insideLoss,
+				OutsideLoss: outsideLoss,
+				TotalLoss:   totalLoss,
+			})
 
 			if totalLoss < bestTotalLoss {
 				foundSomethingToDo = true
 				bestTotalLoss = totalLoss
-				bestContextK = k
-				bestCircle = randomSynset
-				bestInsideExemplar = insideExemplar
-				bestOutsideExemplar = outsideExemplar
-				bestInsideRows = inside
-				bestOutsideRows = outside
-				insideLossOfBest = insideLoss
-				outsideLossOfBest = outsideLoss
+				best = foundSplit{
+					contextK:        k,
+					circle:          randomSynset,
+					insideExemplar:  insideExemplar,
+					outsideExemplar: outsideExemplar,
+					insideRows:      inside,
+					outsideRows:     outside,
+					insideSize:      len(inside),
+					outsideSize:     len(outside),
+					insideLoss:      insideLoss,
+					outsideLoss:     outsideLoss,
+				}
 			}
 		}
 	}
 
 	if !foundSomethingToDo {
-		return 0.0, fmt.Errorf("Errors prevented any forward progress")
+		return foundSplit{}, errNoDivision
+	}
+	return best, nil
+}
+
+// createGoodSplit finds a split for a node and commits it, unless it
+// breaks one of rules, in which case it returns a terminalLeaf error.
+// lossBefore is the node's loss.
+func createGoodSplit(ctx context.Context,
+	db *sql.DB,
+	nodesTable string,
+	nodeID tree.NodeID,
+	lossBefore float64,
+	claimant string,
+	trainingDataTable string,
+	nodeBucketTable string,
+	params splitParams,
+	rules stoppingRules,
+	maxMemory int64,
+	rng *rand.Rand,
+	eventLog *events.Logger) (events.SplitCommittedEvent, error) {
+
+	if err := rules.checkLeaf(db, nodesTable, nodeID); err != nil {
+		return events.SplitCommittedEvent{}, err
+	}
+	split, err := findSplitInDatabase(ctx, db, nodesTable, nodeID, trainingDataTable, nodeBucketTable, params, maxMemory, rng, eventLog)
+	if err != nil {
+		return events.SplitCommittedEvent{}, err
+	}
+	data := dbSplitData{db: db, trainingDataTable: trainingDataTable, nodeBucketTable: nodeBucketTable, nodeID: nodeID, contextLength: params.ContextLength}
+	if err := rules.checkSplit(ctx, data, nodeID, split, lossBefore, rng); err != nil {
+		return events.SplitCommittedEvent{}, err
+	}
+	return commitSplit(db, nodesTable, trainingDataTable, nodeBucketTable, nodeID, claimant, split)
+}
+
+// findSplitInDatabase is findGoodSplit for a node in the database. If
+// loading the node's rows would take more than maxMemory bytes, it
+// streams through them instead.
+func findSplitInDatabase(ctx context.Context,
+	db *sql.DB,
+	nodesTable string,
+	nodeID tree.NodeID,
+	trainingDataTable string,
+	nodeBucketTable string,
+	params splitParams,
+	maxMemory int64,
+	rng *rand.Rand,
+	eventLog *events.Logger) (foundSplit, error) {
+
+	data := dbSplitData{db: db, trainingDataTable: trainingDataTable, nodeBucketTable: nodeBucketTable, nodeID: nodeID, contextLength: params.ContextLength}
+	streaming, err := needsStreaming(db, nodesTable, nodeID, maxMemory)
+	if err != nil {
+		return foundSplit{}, err
+	}
+	if streaming {
+		return findGoodSplitStreaming(ctx, data, nodeID, params, maxMemory, rng, eventLog)
 	}
+	return findGoodSplit(ctx, data, nodeID, params, rng, eventLog)
+}
+
+func commitSplit(db *sql.DB,
+	nodesTable string,
+	trainingDataTable string,
+	nodeBucketTable string,
+	nodeID tree.NodeID,
+	claimant string,
+	split foundSplit) (events.SplitCommittedEvent, error) {
 
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
-		fmt.Errorf("Error starting transaction: %v", err)
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error starting transaction: %v", err)
 	}
 	defer tx.Rollback()
 
 	// Create inner node
 	var innerNodeID int64
-	err = tx.QueryRow(`
-		INSERT INTO nodes (exemplar_value, data_quantity, loss)
-		VALUES (?, ?, ?)
+	err = tx.QueryRow(fmt.Sprintf(`
+		INSERT INTO %s (exemplar_value, data_quantity, loss, depth)
+		VALUES (?, ?, ?, (SELECT depth + 1 FROM %s WHERE id = ?))
 		RETURNING id
-	`, bestInsideExemplar.String(), len(bestInsideRows), insideLossOfBest).Scan(&innerNodeID)
+	`, nodesTable, nodesTable), split.insideExemplar.String(), split.insideSize, split.insideLoss, nodeID).Scan(&innerNodeID)
 	if err != nil {
-		fmt.Errorf("Error creating inner node: %v", err)
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error creating inner node: %v", err)
 	}
 
 	// Create outer node
 	var outerNodeID int64
-	err = tx.QueryRow(`
-		INSERT INTO nodes (exemplar_value, data_quantity, loss)
-		VALUES (?, ?, ?)
+	err = tx.QueryRow(fmt.Sprintf(`
+		INSERT INTO %s (exemplar_value, data_quantity, loss, depth)
+		VALUES (?, ?, ?, (SELECT depth + 1 FROM %s WHERE id = ?))
 		RETURNING id
-	`, bestOutsideExemplar.String(), len(bestOutsideRows), outsideLossOfBest).Scan(&outerNodeID)
+	`, nodesTable, nodesTable), split.outsideExemplar.String(), split.outsideSize, split.outsideLoss, nodeID).Scan(&outerNodeID)
 	if err != nil {
-		fmt.Errorf("Error creating outer node: %v", err)
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error creating outer node: %v", err)
 	}
 
-	// Update parent node
-	_, err = tx.Exec(`
-		UPDATE nodes
+	// Update parent node, which is no longer being analysed. If
+	// another process has taken it over, the whole split is rolled back.
+	result, err := tx.Exec(fmt.Sprintf(`
+		UPDATE %s
 		SET contextk = ?, inner_region_prefix = ?, inner_region_node_id = ?, outer_region_node = ?,
-		    when_children_populated = current_timestamp, has_children = true
-		WHERE id = ?
-	`, bestContextK, bestCircle.String(), innerNodeID, outerNodeID, nodeID)
+		    when_children_populated = current_timestamp, has_children = true,
+		    split_seq = %s,
+		    being_analysed = false, claimed_by = NULL, claimed_at = NULL
+		WHERE id = ? AND claimed_by = ? AND not has_children
+	`, nodesTable, node.NextSplitSeqSQL(nodesTable)), split.contextK, split.circle.String(), innerNodeID, outerNodeID, nodeID, claimant)
 	if err != nil {
-		fmt.Errorf("Error updating parent node: %v", err)
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error updating parent node: %v", err)
 	}
-	query := fmt.Sprintf("update %s set being_analysed = false where id = %d", nodesTable, nodeID)
-	_, err = db.Exec(query)
-	if err != nil {
-		fmt.Errorf("Could not record that we are no longer analysing %d on table %s: %v",
-			nodeID, nodesTable, err)
+	if updated, err := result.RowsAffected(); err != nil {
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error updating parent node: %v", err)
+	} else if updated == 0 {
+		return events.SplitCommittedEvent{}, exemplar.ErrClaimLost
+	}
+
+	if split.insideRows == nil {
+		// A streamed split: the database works out which rows go where
+		inside, outside, err := exemplar.UpdateNodeIDsByRegion(tx, trainingDataTable, nodeBucketTable, nodeID, split.contextK, split.circle, tree.NodeID(innerNodeID), tree.NodeID(outerNodeID))
+		if err != nil {
+			return events.SplitCommittedEvent{}, fmt.Errorf("Error updating node IDs: %v", err)
+		}
+		if inside != split.insideSize || outside != split.outsideSize {
+			return events.SplitCommittedEvent{}, fmt.Errorf("Expected to move %d rows inside and %d outside, but moved %d and %d",
+				split.insideSize, split.outsideSize, inside, outside)
+		}
 	}
 
 	// Update node_id for inside rows
-	insideIDs := make([]int, len(bestInsideRows))
-	for i, row := range bestInsideRows {
+	insideIDs := make([]int, len(split.insideRows))
+	for i, row := range split.insideRows {
 		insideIDs[i] = row.RowID
 	}
-	if err := exemplar.UpdateNodeIDs(tx, nodeBucketTable, insideIDs, exemplar.NodeID(innerNodeID)); err != nil {
-		fmt.Errorf("Error updating inside node IDs: %v", err)
+	if err := exemplar.UpdateNodeIDs(tx, nodeBucketTable, insideIDs, tree.NodeID(innerNodeID)); err != nil {
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error updating inside node IDs: %v", err)
 	}
 
 	// Update node_id for outside rows
-	outsideIDs := make([]int, len(bestOutsideRows))
-	for i, row := range bestOutsideRows {
+	outsideIDs := make([]int, len(split.outsideRows))
+	for i, row := range split.outsideRows {
 		outsideIDs[i] = row.RowID
 	}
-	if err := exemplar.UpdateNodeIDs(tx, nodeBucketTable, outsideIDs, exemplar.NodeID(outerNodeID)); err != nil {
-		fmt.Errorf("Error updating outside node IDs: %v", err)
+	if err := exemplar.UpdateNodeIDs(tx, nodeBucketTable, outsideIDs, tree.NodeID(outerNodeID)); err != nil {
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error updating outside node IDs: %v", err)
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		fmt.Errorf("Error committing transaction: %v", err)
+		return events.SplitCommittedEvent{}, fmt.Errorf("Error committing transaction: %v", err)
 	}
 
-	decodedCircle, err := decode.DecodePath(db, bestCircle.String())
-	decodedInnerExemplar, err := decode.DecodePath(db, bestInsideExemplar.String())
-	decodedOuterExemplar, err := decode.DecodePath(db, bestOutsideExemplar.String())
+	decodedCircle, _ := decode.DecodePath(db, split.circle)
+	decodedInnerExemplar, _ := decode.DecodePath(db, split.insideExemplar)
+	decodedOuterExemplar, _ := decode.DecodePath(db, split.outsideExemplar)
 
 	log.Printf("Step completed successfully: Context K=%d BestCircle=%s (%s) TotalLoss=%f [InnerNodeID=%d Exemplar=%s (%s) Size=%d] [OuterNodeID=%d Exemplar=%s (%s) Size=%d]",
-		bestContextK,
-		bestCircle.String(),
+		split.contextK,
+		split.circle.String(),
 		decodedCircle,
-		bestTotalLoss,
-		innerNodeID, bestInsideExemplar.String(), decodedInnerExemplar, len(bestInsideRows),
-		outerNodeID, bestOutsideExemplar.String(), decodedOuterExemplar, len(bestOutsideRows))
-	return bestTotalLoss, nil
-}
-
-type SolarData struct {
-	Production  []ProductionData `json:"production"`
-	Consumption []ProductionData `json:"consumption"`
+		split.totalLoss(),
+		innerNodeID, split.insideExemplar.String(), decodedInnerExemplar, split.insideSize,
+		outerNodeID, split.outsideExemplar.String(), decodedOuterExemplar, split.outsideSize)
+	return events.SplitCommittedEvent{
+		NodeID:        int(nodeID),
+		ContextK:      split.contextK,
+		Region:        split.circle.String(),
+		RegionWord:    decodedCircle,
+		InnerNodeID:   int(innerNodeID),
+		InnerExemplar: split.insideExemplar.String(),
+		InnerSize:     split.insideSize,
+		InnerLoss:     split.insideLoss,
+		OuterNodeID:   int(outerNodeID),
+		OuterExemplar: split.outsideExemplar.String(),
+		OuterSize:     split.outsideSize,
+		OuterLoss:     split.outsideLoss,
+		LossAfter:     split.totalLoss(),
+	}, nil
 }
 
-type ProductionData struct {
-	WNow float64 `json:"wNow,float64"`
-}
-
-func getNetCurrentSolarProduction(solarMonitor string) (float64, error) {
-	if solarMonitor == "" {
-		return 0, fmt.Errorf("solar monitor hostname not provided")
-	}
-
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	// Construct URL and make request
-	url := fmt.Sprintf("http://%s/production.json", solarMonitor)
-	resp, err := client.Get(url)
+// announceLeaf says which leaf is about to be split, and why
+func announceLeaf(db *sql.DB, nodesTable string, nodeID tree.NodeID, loss float64, eventLog *events.Logger) error {
+	ancestors, err := node.FetchAncestorTree(db, nodesTable, nodeID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to fetch solar data: %v", err)
+		return fmt.Errorf("could not fetch the ancestors of node %d from %s: %v", int(nodeID), nodesTable, err)
 	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	ancestryDisplay, err := decode.NodeAncestry(db, ancestors, nodeID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read response body: %v", err)
+		log.Printf("Could not get ancestry for node: %v", err)
+		// But carry on anyway, it's not terrible
 	}
+	log.Printf("Because its current cost is %f I will split node ID %d. Ancestry: (. %s .)\n", loss, int(nodeID), ancestryDisplay)
+	recordEvent(eventLog, events.LeafChosenEvent{NodeID: int(nodeID), Loss: loss, Ancestry: ancestryDisplay})
+	return nil
+}
 
-	//log.Printf("%s", string(body))
+// recordSplit logs a split that has been committed, the split'th of
+// this run
+func recordSplit(eventLog *events.Logger, committed events.SplitCommittedEvent, split int, lossBefore float64, elapsed time.Duration) {
+	improvement := lossBefore - committed.LossAfter
+	log.Printf("Split %d: total loss reduced by %f in %v\n", split, improvement, elapsed)
+	committed.Split = split
+	committed.LossBefore = lossBefore
+	committed.Seconds = elapsed.Seconds()
+	recordEvent(eventLog, committed)
+}
 
-	// Parse JSON response
-	var data SolarData
-	if err := json.Unmarshal(body, &data); err != nil {
-		return 0, fmt.Errorf("failed to parse JSON response: %v", err)
+func recordEvent(eventLog *events.Logger, p events.Payload) {
+	// A broken event log isn't a reason to stop training
+	if err := eventLog.Log(p); err != nil {
+		log.Printf("Could not record event: %v", err)
 	}
+}
 
-	// Verify we have both production and consumption data
-	if len(data.Production) < 2 || len(data.Consumption) == 0 {
-		return 0, fmt.Errorf("incomplete solar data received")
+func recordCandidate(eventLog *events.Logger, c events.CandidateScoredEvent) {
+	if err := eventLog.Candidate(c); err != nil {
+		log.Printf("Could not record event: %v", err)
 	}
-
-	// Calculate net production (production - consumption)
-	// Production is at index 1 as per requirement
-	production := data.Production[1].WNow
-	consumption := data.Consumption[0].WNow
-
-	return production - consumption, nil
 }
 
 func main() {
@@ -424,99 +596,406 @@ func main() {
 	numCirclesPerSplit := flag.Int("num-circles-per-split", 10, "Number of circles to try per split")
 	nodeSplittingThreshold := flag.Int("node-splitting-threshold", 1, "If a node is smaller than this, don't try to split it")
 	stopAfter := flag.Int("stop-after", -1, "Stop after this number of splits")
-	solarMonitor := flag.String("solar-monitor", "", "Hostname of the Enphase/Envoy system to query to see if there is spare power available for training")
+	solarMonitor := flag.String("solar-monitor", "", "Hostname of the Enphase/Envoy system to query to see if there is spare power available for training (short for --power envoy:HOST)")
+	powerSpec := flag.String("power", "", "When there is power to train, e.g. \"envoy:HOST or tariff:22:00-07:00\" (see pkg/power)")
+	powerStartAbove := flag.Float64("power-start-above", 0, "Net production (watts) that a meter has to show before training starts")
+	powerStopBelow := flag.Float64("power-stop-below", 0, "Net production (watts) that a meter has to drop below before training stops (no higher than --power-start-above)")
+	eventLogPath := flag.String("event-log", "", "Append structured training events to this file, one JSON object per line")
+	eventTable := flag.String("event-table", events.DefaultTable, "Table to record structured training events in (empty to not record them in the database)")
+	candidateSample := flag.Int("event-candidate-sample", 100, "Record one in this many scored candidate splits as events (0 for none)")
+	claimTimeout := flag.Duration("claim-timeout", 10*time.Minute, "A leaf claimed by a train process that hasn't been heard from for this long is assumed to have been abandoned")
+	coordinatorAddr := flag.String("coordinator", "", "Listen on this address (e.g. :8470) and hand out leaves to split to --worker processes, instead of splitting them here")
+	workerURL := flag.String("worker", "", "Split leaves for the coordinator at this URL (e.g. http://localhost:8470) instead of training a database here")
+	maxMemoryFlag := flag.String("max-memory", "", "Stream through nodes whose rows would take more than this much memory (e.g. 4GB) instead of loading them; empty means always load them")
+	strategy := flag.String("strategy", exemplar.Strategies[0], fmt.Sprintf("How to choose the next leaf to split: one of %v", exemplar.Strategies))
+	maxDepth := flag.Int("max-depth", 0, "Don't split leaves this deep (0 for no limit); they are marked as terminal")
+	minLeafSize := flag.Int("min-leaf-size", 0, "With --strategy limited, don't split leaves with fewer rows than this")
+	prescanLeaves := flag.Int("prescan-leaves", 10, "With --strategy improvement, how many of the leaves with the largest loss to pre-scan for the best split")
+	maxNodes := flag.Int("max-nodes", 0, "Stop training before the tree has more nodes than this (0 for no limit)")
+	maxTime := flag.Duration("max-time", 0, "Stop training after this long (e.g. 12h; 0 for no limit)")
+	minImprovement := flag.Float64("min-improvement", 0, "Mark a leaf as terminal instead of splitting it if the best split reduces the loss by less than this (0 for no minimum)")
+	minRelativeImprovement := flag.Float64("min-relative-improvement", 0, "Mark a leaf as terminal instead of splitting it if the best split reduces the loss by less than this fraction of it (e.g. 0.01; 0 for no minimum)")
+	significance := flag.Float64("significance", 0, "Mark a leaf as terminal instead of splitting it if the best split isn't better than random splits at this level (e.g. 0.05; 0 for no test)")
+	significanceTrials := flag.Int("significance-trials", 19, "How many times to search shuffled data for a split to compare each split with, for --significance (each one takes as long as finding a split)")
+	incremental := flag.Bool("incremental", false, "Add rows that have been appended to the training data to the existing tree, instead of starting the tree again")
+	force := flag.Bool("force", false, "Resume training even if the parameters are different from the last run on this nodes table")
+	configFlags := config.AddFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	settings, err := configFlags.Apply(flag.CommandLine, config.Program{Name: "train", EnvPrefix: "ULTRATREE_TRAIN_"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *configFlags.Print {
+		if err := settings.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *workerURL != "" {
+		if *coordinatorAddr != "" {
+			log.Fatal("Use either --coordinator or --worker, not both")
+		}
+		runWorker(*workerURL, *seed, *eventLogPath, *candidateSample)
+		return
+	}
+
+	maxMemory, err := parseMemory(*maxMemoryFlag)
+	if err != nil {
+		log.Fatalf("Invalid --max-memory: %v", err)
+	}
+	params := splitParams{
+		SplitCountTry:      *splitCountTry,
+		NumCirclesPerSplit: *numCirclesPerSplit,
+		ExemplarGuesses:    *exemplarGuesses,
+		CostGuesses:        *costGuesses,
+		ContextLength:      *contextLength,
+	}
 	splitsDone := 0
 
 	if *database == "" {
 		log.Fatal("--database is required")
 	}
+	if *claimTimeout < time.Minute {
+		log.Fatal("--claim-timeout has to be at least a minute")
+	}
 
-	db, err := sql.Open("sqlite3", *database)
+	// Other train processes may be working on the same database
+	db, err := exemplar.OpenShared(*database)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
 
 	rng := rand.New(rand.NewSource(*seed))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	selector, err := exemplar.NewLeafSelector(*strategy, exemplar.SelectorOptions{
+		MaxDepth:    *maxDepth,
+		MinLeafSize: *minLeafSize,
+		Shortlist:   *prescanLeaves,
+		// The coordinator chooses leaves for several workers at once,
+		// so a scan uses the ctx and rng of the request it is for
+		Scan: func(ctx context.Context, l exemplar.Leaf, rng *rand.Rand) (float64, error) {
+			split, err := findSplitInDatabase(ctx, db, *nodesTable, l.ID, *trainingDataTable, *nodeBucketTable, params.prescan(), maxMemory, rng, nil)
+			if errors.Is(err, errInterrupted) {
+				return 0, err
+			}
+			if err != nil {
+				// It won't be any easier to split properly
+				log.Printf("Pre-scan of node %d found nothing: %v", int(l.ID), err)
+				return 0, nil
+			}
+			return l.Loss - split.totalLoss(), nil
+		},
+	})
+	if err != nil {
+		log.Fatalf("Invalid --strategy: %v", err)
+	}
 
-	needsInit, err := initialisationRequired(db, *trainingDataTable, *nodeBucketTable, *nodesTable)
+	needsInit, err := initialisationRequired(db, *trainingDataTable, *nodeBucketTable, *nodesTable, *incremental)
 	if err != nil {
 		log.Fatalf("Initialisation checks failed: %v", err)
 	}
+
+	started := time.Now()
+	rules := stoppingRules{
+		maxDepth:               *maxDepth,
+		maxNodes:               *maxNodes,
+		minImprovement:         *minImprovement,
+		minRelativeImprovement: *minRelativeImprovement,
+		significance:           *significance,
+		significanceTrials:     *significanceTrials,
+		params:                 params,
+	}
+	if *maxTime > 0 {
+		rules.deadline = started.Add(*maxTime)
+	}
+	if *significance > 0 && 1/float64(*significanceTrials+1) > *significance {
+		log.Fatalf("--significance-trials %d is too few for a split ever to be significant at %g", *significanceTrials, *significance)
+	}
+	if *significance > 0 && maxMemory > 0 {
+		// The test shuffles every target word of a leaf
+		log.Fatal("--significance doesn't work with --max-memory, because the significance test needs all of a leaf's target words in memory")
+	}
+	runID := events.NewRunID(started)
+	hostname, _ := os.Hostname()
+	run := provenance.Run{
+		NodesTable:             *nodesTable,
+		Started:                started,
+		Resumed:                !needsInit,
+		Forced:                 *force,
+		Hostname:               hostname,
+		CodeVersion:            provenance.CodeVersion(),
+		Database:               *database,
+		TrainingDataTable:      *trainingDataTable,
+		NodeBucketTable:        *nodeBucketTable,
+		Seed:                   *seed,
+		ContextLength:          *contextLength,
+		ExemplarGuesses:        *exemplarGuesses,
+		CostGuesses:            *costGuesses,
+		SplitCountTry:          *splitCountTry,
+		NumCirclesPerSplit:     *numCirclesPerSplit,
+		NodeSplittingThreshold: *nodeSplittingThreshold,
+		Strategy:               selector.String(),
+		MaxDepth:               *maxDepth,
+		MinImprovement:         *minImprovement,
+		MinRelativeImprovement: *minRelativeImprovement,
+		Significance:           *significance,
+		SignificanceTrials:     *significanceTrials,
+		MaxNodes:               *maxNodes,
+		MaxTimeSeconds:         maxTime.Seconds(),
+		MaxMemory:              maxMemory,
+	}
+	if !needsInit {
+		previous, err := provenance.Latest(db, *nodesTable)
+		if err != nil {
+			log.Fatalf("Could not find out how %s was trained: %v", *nodesTable, err)
+		}
+		if previous != nil {
+			if conflicts := run.Conflicts(*previous); len(conflicts) > 0 {
+				for _, conflict := range conflicts {
+					log.Printf("Different from training run %d: %s", previous.ID, conflict)
+				}
+				if !*force {
+					log.Fatalf("Refusing to resume training %s with different parameters (use --force to do it anyway)", *nodesTable)
+				}
+				log.Printf("Leaves that were marked as terminal before stay terminal, whatever the rules are now")
+			}
+		}
+	}
 	if needsInit {
 		err = initializeFirstLeaf(db, *trainingDataTable, *nodeBucketTable, *nodesTable, *exemplarGuesses, *costGuesses, rng)
 		if err != nil {
 			log.Fatalf("Could not initialize first leaf: %v", err)
 		}
 	}
+	// Models trained before claims existed need the columns for them
+	err = exemplar.EnsureClaimColumns(db, *nodesTable)
+	if err != nil {
+		log.Fatalf("Could not prepare %s for claims: %v", *nodesTable, err)
+	}
+	// Models trained before split_seq existed need it added
+	err = node.EnsureSplitSeq(db, *nodesTable)
+	if err != nil {
+		log.Fatalf("Could not number the splits in %s: %v", *nodesTable, err)
+	}
+	// Some strategies need to know how deep each leaf is
+	err = node.EnsureDepth(db, *nodesTable)
+	if err != nil {
+		log.Fatalf("Could not work out the depths of the nodes in %s: %v", *nodesTable, err)
+	}
+	// Announcing a leaf looks up its ancestors
+	err = node.EnsureChildIndexes(db, *nodesTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *incremental && !needsInit {
+		added, err := addNewRows(db, *trainingDataTable, *nodeBucketTable, *nodesTable, *contextLength, *exemplarGuesses, *costGuesses, *claimTimeout, rng)
+		if err != nil {
+			log.Fatalf("Could not add the new rows of %s: %v", *trainingDataTable, err)
+		}
+		log.Printf("Added %d new rows to the leaves of %s", added, *nodesTable)
+	}
+
+	query := fmt.Sprintf("SELECT coalesce(max(split_seq), 0) FROM %s", *nodesTable)
+	if err := db.QueryRow(query).Scan(&run.StartSplit); err != nil {
+		log.Fatalf("Could not count the splits in %s: %v", *nodesTable, err)
+	}
+	query = fmt.Sprintf("SELECT count(*) FROM %s", *trainingDataTable)
+	if err := db.QueryRow(query).Scan(&run.TrainingDataRows); err != nil {
+		log.Fatalf("Could not count the rows of %s: %v", *trainingDataTable, err)
+	}
+	if *eventTable != "" || *eventLogPath != "" {
+		run.EventRun = runID
+	}
+	if err := provenance.Record(db, &run); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Recorded this as training run %d (code version %s)", run.ID, run.CodeVersion)
 
-	nextSolarCheck := time.Now()
+	reporter := progress.New(progress.Config{
+		Program: "train",
+		Subject: *nodesTable,
+		Unit:    "splits",
+		RatePer: time.Hour,
+	})
+	if *stopAfter > 0 {
+		reporter.SetTotal(int64(*stopAfter))
+	}
+	if err := reporter.RecordTo(db); err != nil {
+		log.Fatalf("Could not record progress: %v", err)
+	}
+	log.SetOutput(reporter.LogWriter(os.Stderr))
+	defer reporter.Finish()
+	reportProgress := func(splitsDone int) {
+		splittable, totalLoss, err := exemplar.LeafStatistics(db, *nodesTable, *nodeSplittingThreshold)
+		if err != nil {
+			log.Printf("Could not get the leaf statistics: %v", err)
+			return
+		}
+		reporter.Update(int64(splitsDone),
+			progress.Metric{Name: "splittable_leaves", Value: float64(splittable)},
+			progress.Metric{Name: "total_leaf_loss", Value: totalLoss})
+	}
+	reportProgress(splitsDone)
+
+	var eventDB *sql.DB
+	if *eventTable != "" {
+		eventDB = db
+	}
+	var eventLog *events.Logger
+	if eventDB != nil || *eventLogPath != "" {
+		eventLog, err = events.Open(runID, *eventLogPath, eventDB, *eventTable, *candidateSample)
+		if err != nil {
+			log.Fatalf("Could not start the event log: %v", err)
+		}
+		defer eventLog.Close()
+	}
+	flagValues := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flagValues[f.Name] = f.Value.String()
+	})
+	recordEvent(eventLog, events.RunStartedEvent{Flags: flagValues, Hostname: hostname, PID: os.Getpid()})
+	// Identifies this process's claims on leaves
+	claimant := hostname + "/" + runID
+
+	if *solarMonitor != "" {
+		if *powerSpec != "" {
+			log.Fatal("Use either --solar-monitor or --power, not both")
+		}
+		*powerSpec = "envoy:" + *solarMonitor
+	}
+	var powerPolicy power.Policy
+	if *powerSpec != "" {
+		powerPolicy, err = power.Parse(*powerSpec, *powerStartAbove, *powerStopBelow)
+		if err != nil {
+			log.Fatalf("Invalid --power: %v", err)
+		}
+	}
+	gate := newPowerGate(powerPolicy, eventLog)
+
+	controller, err := newController(db, *nodesTable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	controller.watchSignals(cancel)
+
+	if *coordinatorAddr != "" {
+		if maxMemory > 0 {
+			// Jobs carry all of a node's rows
+			log.Fatal("--max-memory doesn't work with --coordinator yet")
+		}
+		c := &coordinator{
+			db:                db,
+			nodesTable:        *nodesTable,
+			trainingDataTable: *trainingDataTable,
+			nodeBucketTable:   *nodeBucketTable,
+			params:            params,
+			minSize:           *nodeSplittingThreshold,
+			selector:          selector,
+			rules:             rules,
+			rng:               rng,
+			stopAfter:         *stopAfter,
+			claimant:          claimant,
+			claimTimeout:      *claimTimeout,
+			gate:              gate,
+			eventLog:          eventLog,
+			reportProgress:    reportProgress,
+		}
+		if err := c.run(ctx, *coordinatorAddr); err != nil {
+			log.Fatalf("Could not train %s: %v", *nodesTable, err)
+		}
+		return
+	}
 
 	for {
+		if !controller.waitWhilePaused(ctx) {
+			log.Printf("Stopped after %d splits", splitsDone)
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: "interrupted"})
+			return
+		}
 		if *stopAfter > 0 && splitsDone >= *stopAfter {
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: "stop-after"})
 			break
 		}
-		if *solarMonitor != "" {
-			if nextSolarCheck.Before(time.Now()) {
-				netProduction, err := getNetCurrentSolarProduction(*solarMonitor)
-				if err != nil {
-					log.Printf("Could not get solar production: %v", err)
-					// Just assume that we have power. This is a false
-					// assumption, but it's better than all the alternatives
-					nextSolarCheck = time.Now().Add(1 * time.Minute)
-				} else {
-					if netProduction < 0.0 {
-						log.Printf("Net solar production = %.2f watts. Not enough power to run computations. Sleeping for 5 minutes", netProduction)
-						time.Sleep(5 * time.Minute)
-						continue
-					}
-					log.Printf("Net solar production = %.2f watts, let's use it!", netProduction)
-					nextSolarCheck = time.Now().Add(5 * time.Minute)
-				}
-			}
+		reason, err := rules.trainingOver(db, *nodesTable, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reason != "" {
+			log.Printf("Stopped after %d splits (%s)", splitsDone, reason)
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: reason})
+			return
+		}
+		if !gate.hasPower(ctx) {
+			// Signals and the control table are still noticed
+			// while sleeping
+			controller.sleep(ctx, powerCheckInterval)
+			continue
 		}
 		splitStartTime := time.Now()
-		nextNodeID, currentCost, err := exemplar.MostUrgentToImprove(db, *nodesTable, *nodeSplittingThreshold)
+		nextNodeID, currentCost, err := exemplar.ClaimLeaf(ctx, db, *nodesTable, selector, *nodeSplittingThreshold, claimant, *claimTimeout, rng)
+		if errors.Is(err, errInterrupted) {
+			log.Printf("Stopped after %d splits", splitsDone)
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: "interrupted"})
+			return
+		}
 		if err != nil {
 			log.Fatalf("Could not find the most urgent node to work ing: %v", err)
 		}
-		if nextNodeID == exemplar.NoNodeID {
+		if nextNodeID == tree.NoNodeID {
+			// Other processes' splits may leave leaves to split
+			others, err := exemplar.ActiveClaims(db, *nodesTable, *claimTimeout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if others > 0 {
+				log.Printf("Nothing to split until other processes finish the %d nodes they are working on", others)
+				controller.sleep(ctx, 30*time.Second)
+				continue
+			}
 			log.Printf("Training is complete")
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: "no leaves left to split"})
 			return
 		}
-		nextNode, err := node.FetchNodeByID(db, *nodesTable, int(nextNodeID))
+		err = announceLeaf(db, *nodesTable, nextNodeID, currentCost, eventLog)
 		if err != nil {
-			log.Fatalf("Could not fetch the node %d: %v", nextNodeID, err)
+			releaseNode(db, *nodesTable, nextNodeID, claimant)
+			log.Fatal(err)
 		}
-		ancestryDisplay, err := decode.NodeAncestry(db, nextNode)
-		if err != nil {
-			log.Printf("Could not get ancestry for node: %v", err)
-			// But carry on anyway, it's not terrible
+
+		stopRenewing := exemplar.HoldClaim(db, *nodesTable, nextNodeID, claimant, *claimTimeout/4)
+		committed, err := createGoodSplit(ctx, db, *nodesTable, nextNodeID, currentCost, claimant, *trainingDataTable, *nodeBucketTable, params, rules, maxMemory, rng, eventLog)
+		stopRenewing()
+		var terminal terminalLeaf
+		if errors.As(err, &terminal) {
+			markTerminal(db, *nodesTable, nextNodeID, claimant, terminal.reason, eventLog)
+			continue
 		}
-		log.Printf("Because its current cost is %f I will split node ID %d. Ancestry: (. %s .)\n", currentCost, int(nextNodeID), ancestryDisplay)
-		query := fmt.Sprintf("update %s set being_analysed = true where id = %d", *nodesTable, nextNodeID)
-		_, err = db.Exec(query)
-		if err != nil {
-			log.Fatalf("Could not set being_analysed = true on row %d of %s", int(nextNodeID), *nodesTable)
+		if err == errInterrupted {
+			// Nothing has been written, so the node just needs to be
+			// made available again
+			releaseNode(db, *nodesTable, nextNodeID, claimant)
+			log.Printf("Abandoned the split of node %d. Stopped after %d splits", int(nextNodeID), splitsDone)
+			recordEvent(eventLog, events.TrainingCompleteEvent{Splits: splitsDone, Reason: "interrupted"})
+			return
+		}
+		if err == exemplar.ErrClaimLost {
+			log.Printf("Another process took over node %d (perhaps this one was too slow to renew its claim); its split has been discarded", int(nextNodeID))
+			continue
 		}
-
-		newLoss, err := createGoodSplit(db, *nodesTable, nextNodeID, *trainingDataTable, *nodeBucketTable, *splitCountTry, *numCirclesPerSplit, *exemplarGuesses, *costGuesses, *contextLength, rng)
 		if err != nil {
+			releaseNode(db, *nodesTable, nextNodeID, claimant)
 			log.Fatalf("Could not split %s on node %d using training data in %s and node bucket information in %s (splitCountTry=%d, contextLength=%d because: %v", *nodesTable, int(nextNodeID), *trainingDataTable, *nodeBucketTable, *splitCountTry, *contextLength, err)
 		}
 
-		query = fmt.Sprintf("update %s set being_analysed = false where id = %d", *nodesTable, int(nextNodeID))
-		_, err = db.Exec(query)
-		if err != nil {
-			log.Fatalf("Could not set being_analysed = false on row %d of %s", int(nextNodeID), *nodesTable)
-		}
-		improvement := currentCost - newLoss
-		elapsed := time.Since(splitStartTime)
 		splitsDone++
-		log.Printf("Split %d: total loss reduced by %f in %v\n", splitsDone, improvement, elapsed)
+		recordSplit(eventLog, committed, splitsDone, currentCost, time.Since(splitStartTime))
+		reportProgress(splitsDone)
 		// Perhaps I should check whether the improvement was positive
 		// On the other hand, the a negative improvement is just an illusion caused
 		// by inaccurate loss estimation, I think.
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/events"
+	"github.com/solresol/ultrametric-trees/pkg/power"
+)
+
+// How long a power decision lasts before the policy is asked again
+const (
+	powerCheckInterval      = 5 * time.Minute
+	powerCheckRetryInterval = 1 * time.Minute
+)
+
+// powerGate says whether there is power to train. It only asks the
+// policy every so often, because meters don't like being polled
+// constantly. A nil powerGate always has power.
+type powerGate struct {
+	policy   power.Policy
+	eventLog *events.Logger
+
+	mu        sync.Mutex
+	nextCheck time.Time
+	allowed   bool
+	paused    bool
+}
+
+func newPowerGate(policy power.Policy, eventLog *events.Logger) *powerGate {
+	if policy == nil {
+		return nil
+	}
+	return &powerGate{policy: policy, eventLog: eventLog}
+}
+
+// hasPower returns false if training should wait for more power
+func (g *powerGate) hasPower(ctx context.Context) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Before(g.nextCheck) {
+		return g.allowed
+	}
+	decision, err := g.policy.Decide(ctx, now)
+	if err != nil {
+		log.Printf("Could not find out whether there is power: %v", err)
+		// Just assume that we have power. This is a false
+		// assumption, but it's better than all the alternatives
+		g.allowed = true
+		g.nextCheck = now.Add(powerCheckRetryInterval)
+		return true
+	}
+	g.allowed = decision.Allowed
+	g.nextCheck = now.Add(powerCheckInterval)
+	if !decision.Allowed {
+		log.Printf("Not enough power to run computations because %s. Waiting for %v", decision.Reason, powerCheckInterval)
+		recordEvent(g.eventLog, events.SolarPausedEvent{NetProduction: decision.Watts, Reason: decision.Reason, SleepSeconds: powerCheckInterval.Seconds()})
+		g.paused = true
+		return false
+	}
+	log.Printf("There is power to use because %s, let's use it!", decision.Reason)
+	if g.paused {
+		recordEvent(g.eventLog, events.SolarResumedEvent{NetProduction: decision.Watts, Reason: decision.Reason})
+		g.paused = false
+	}
+	return true
+}
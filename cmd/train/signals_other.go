@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// There are no pause and resume signals here; use the control table
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/events"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// stoppingRules limit how far train grows the tree, beyond
+// --stop-after and --node-splitting-threshold. maxNodes and deadline
+// stop training altogether; the others are about one leaf, which is
+// marked as terminal if it breaks them, so that it isn't tried again.
+// A zero value means there is no limit.
+type stoppingRules struct {
+	maxDepth int
+	maxNodes int
+	deadline time.Time
+	// How much a split has to reduce the leaf's loss by, in total and
+	// as a fraction of the leaf's loss
+	minImprovement         float64
+	minRelativeImprovement float64
+	// The largest p-value that a split can have and still be committed,
+	// from significanceTrials searches of shuffled data with params
+	significance       float64
+	significanceTrials int
+	params             splitParams
+}
+
+// forWorkers returns the rules that checkSplit applies, for a job
+func (s stoppingRules) forWorkers() splitRules {
+	return splitRules{
+		MinImprovement:         s.minImprovement,
+		MinRelativeImprovement: s.minRelativeImprovement,
+		Significance:           s.significance,
+		SignificanceTrials:     s.significanceTrials,
+	}
+}
+
+// withParams turns a job's rules back into stoppingRules that
+// checkSplit can use
+func (r splitRules) withParams(params splitParams) stoppingRules {
+	return stoppingRules{
+		minImprovement:         r.MinImprovement,
+		minRelativeImprovement: r.MinRelativeImprovement,
+		significance:           r.Significance,
+		significanceTrials:     r.SignificanceTrials,
+		params:                 params,
+	}
+}
+
+// terminalLeaf is the error for a leaf that should never be split
+type terminalLeaf struct {
+	reason string
+}
+
+func (t terminalLeaf) Error() string {
+	return t.reason
+}
+
+// Leaves that can't be split at all, whatever the rules are
+var (
+	errNoDivision = terminalLeaf{"none of the regions that were tried divided its rows in two"}
+	errOneTarget  = terminalLeaf{"every row has the same target word"}
+)
+
+// sameTarget says whether all the rows have the same target word, in
+// which case there's nothing that a split could improve
+func sameTarget(rows []exemplar.DataFrameRow) bool {
+	for _, row := range rows {
+		if !row.TargetWord.Equal(rows[0].TargetWord) {
+			return false
+		}
+	}
+	return true
+}
+
+// trainingOver returns why training should stop without starting
+// another split, or "" if it shouldn't. pending is how many splits
+// have been started but not committed.
+func (s stoppingRules) trainingOver(db *sql.DB, nodesTable string, pending int) (string, error) {
+	if !s.deadline.IsZero() && time.Now().After(s.deadline) {
+		return "max-time", nil
+	}
+	if s.maxNodes > 0 {
+		var nodes int
+		err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", nodesTable)).Scan(&nodes)
+		if err != nil {
+			return "", fmt.Errorf("could not count the nodes in %s: %v", nodesTable, err)
+		}
+		// Each split adds two nodes
+		if nodes+2*(pending+1) > s.maxNodes {
+			return "max-nodes", nil
+		}
+	}
+	return "", nil
+}
+
+// checkLeaf returns a terminalLeaf error if nodeID shouldn't be split
+// whatever split is found for it
+func (s stoppingRules) checkLeaf(db *sql.DB, nodesTable string, nodeID tree.NodeID) error {
+	if s.maxDepth <= 0 {
+		return nil
+	}
+	var depth int
+	err := db.QueryRow(fmt.Sprintf("SELECT coalesce(depth, 0) FROM %s WHERE id = ?", nodesTable), nodeID).Scan(&depth)
+	if err != nil {
+		return fmt.Errorf("could not look up the depth of node %d: %v", int(nodeID), err)
+	}
+	if depth >= s.maxDepth {
+		return terminalLeaf{fmt.Sprintf("at --max-depth %d", s.maxDepth)}
+	}
+	return nil
+}
+
+// checkSplit returns a terminalLeaf error if split isn't good enough
+// to commit. data is the rows of the leaf nodeID that split was found
+// in, and lossBefore is the leaf's loss.
+func (s stoppingRules) checkSplit(ctx context.Context, data splitData, nodeID tree.NodeID, split foundSplit, lossBefore float64, rng *rand.Rand) error {
+	improvement := lossBefore - split.totalLoss()
+	if s.minImprovement > 0 && improvement < s.minImprovement {
+		return terminalLeaf{fmt.Sprintf("the best split only improves the loss by %f (--min-improvement %g)", improvement, s.minImprovement)}
+	}
+	if s.minRelativeImprovement > 0 && lossBefore > 0 && improvement/lossBefore < s.minRelativeImprovement {
+		return terminalLeaf{fmt.Sprintf("the best split only improves the loss by %.2f%% (--min-relative-improvement %g)",
+			100*improvement/lossBefore, s.minRelativeImprovement)}
+	}
+	if s.significance > 0 {
+		p, err := s.permutationTest(ctx, data, nodeID, split, rng)
+		if err != nil {
+			return err
+		}
+		if p > s.significance {
+			return terminalLeaf{fmt.Sprintf("the best split is no better than chance (p = %.3f, --significance %g)", p, s.significance)}
+		}
+	}
+	return nil
+}
+
+// shuffledSplitData is data with its target words moved between its
+// rows. The contexts come from data as the search asks for them, so a
+// permutation test holds no more of them in memory than the search
+// that found the split did.
+type shuffledSplitData struct {
+	splitData
+	targets []exemplar.DataFrameRow
+}
+
+func (d shuffledSplitData) targetRows() ([]exemplar.DataFrameRow, error) {
+	return d.targets, nil
+}
+
+// permutationTest returns the p-value of split: how often (roughly)
+// the same search that found it, run again on the leaf's rows with
+// their target words shuffled between them, finds a split that is at
+// least as good. The search tries many circles and keeps the best, so
+// the shuffled data gets exactly as many tries as the real data did.
+// Every target word of the leaf is in memory while it runs, which is
+// why --significance can't be used with --max-memory.
+func (s stoppingRules) permutationTest(ctx context.Context, data splitData, nodeID tree.NodeID, split foundSplit, rng *rand.Rand) (float64, error) {
+	targets, err := data.targetRows()
+	if err != nil {
+		return 0, err
+	}
+	shuffled := shuffledSplitData{splitData: data, targets: append([]exemplar.DataFrameRow(nil), targets...)}
+
+	asGood := 0
+	for i := 0; i < s.significanceTrials; i++ {
+		// The rows keep their contexts; only the targets move
+		rng.Shuffle(len(shuffled.targets), func(a, b int) {
+			shuffled.targets[a].TargetWord, shuffled.targets[b].TargetWord = shuffled.targets[b].TargetWord, shuffled.targets[a].TargetWord
+		})
+		best, err := findGoodSplit(ctx, shuffled, nodeID, s.params, rng, nil)
+		if err == errNoDivision {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if best.totalLoss() <= split.totalLoss() {
+			asGood++
+		}
+	}
+	return float64(asGood+1) / float64(s.significanceTrials+1), nil
+}
+
+// markTerminal gives up the claim on nodeID and makes sure that it is
+// never split, because of reason
+func markTerminal(db *sql.DB, nodesTable string, nodeID tree.NodeID, claimant string, reason string, eventLog *events.Logger) {
+	err := exemplar.MarkTerminal(db, nodesTable, nodeID, claimant, reason)
+	if errors.Is(err, exemplar.ErrClaimLost) {
+		log.Printf("Node %d of %s had already been claimed by another process", int(nodeID), nodesTable)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not mark node %d of %s as terminal: %v", int(nodeID), nodesTable, err)
+		releaseNode(db, nodesTable, nodeID, claimant)
+		return
+	}
+	log.Printf("Node %d won't be split: %s", int(nodeID), reason)
+	recordEvent(eventLog, events.LeafTerminalEvent{NodeID: int(nodeID), Reason: reason})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// testSplitData makes a leaf with one context from the contexts and
+// targets of its rows
+func testSplitData(t *testing.T, contexts, targets []string) jobSplitData {
+	t.Helper()
+	var data jobSplitData
+	var contextRows []exemplar.DataFrameRow
+	for i := range contexts {
+		context, err := tree.ParseSynsetpath(contexts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, err := tree.ParseSynsetpath(targets[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		contextRows = append(contextRows, exemplar.DataFrameRow{RowID: i + 1, TargetWord: context})
+		data.targets = append(data.targets, exemplar.DataFrameRow{RowID: i + 1, TargetWord: target})
+	}
+	data.contexts = [][]exemplar.DataFrameRow{contextRows}
+	return data
+}
+
+var testParams = splitParams{SplitCountTry: 5, NumCirclesPerSplit: 10, ExemplarGuesses: 50, CostGuesses: 50, ContextLength: 1}
+
+func TestCheckSplit(t *testing.T) {
+	// Reduces a loss of 10 to 8
+	split := foundSplit{insideLoss: 3, outsideLoss: 5}
+	tests := []struct {
+		name       string
+		rules      stoppingRules
+		lossBefore float64
+		wantReason string
+	}{
+		{"no rules", stoppingRules{}, 10, ""},
+		{"enough improvement", stoppingRules{minImprovement: 2}, 10, ""},
+		{"not enough improvement", stoppingRules{minImprovement: 2.5}, 10, "--min-improvement 2.5"},
+		{"worse", stoppingRules{minImprovement: 0.1}, 7, "--min-improvement 0.1"},
+		{"enough relative improvement", stoppingRules{minRelativeImprovement: 0.2}, 10, ""},
+		{"not enough relative improvement", stoppingRules{minRelativeImprovement: 0.25}, 10, "--min-relative-improvement 0.25"},
+		{"no loss to improve on", stoppingRules{minRelativeImprovement: 0.25}, 0, ""},
+		{"both", stoppingRules{minImprovement: 1, minRelativeImprovement: 0.1}, 10, ""},
+	}
+	for _, tt := range tests {
+		err := tt.rules.checkSplit(context.Background(), nil, 1, split, tt.lossBefore, rand.New(rand.NewSource(1)))
+		if tt.wantReason == "" {
+			if err != nil {
+				t.Errorf("%s: checkSplit = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var terminal terminalLeaf
+		if !errors.As(err, &terminal) || !strings.Contains(terminal.reason, tt.wantReason) {
+			t.Errorf("%s: checkSplit = %v, want a terminal leaf because of %s", tt.name, err, tt.wantReason)
+		}
+	}
+}
+
+func TestCheckSplitSignificance(t *testing.T) {
+	var contexts, related, unrelated []string
+	for i := 0; i < 24; i++ {
+		region := 1 + i/12
+		contexts = append(contexts, fmt.Sprintf("1.%d.%d", region, i%3))
+		// The target word depends on the context, or doesn't
+		related = append(related, fmt.Sprintf("%d.%d", 4+region, region))
+		unrelated = append(unrelated, fmt.Sprintf("%d.%d", 5+i%2, 1+i%2))
+	}
+	rules := stoppingRules{significance: 0.1, significanceTrials: 19, params: testParams}
+
+	for _, tt := range []struct {
+		name        string
+		targets     []string
+		significant bool
+	}{
+		{"related", related, true},
+		{"unrelated", unrelated, false},
+	} {
+		data := testSplitData(t, contexts, tt.targets)
+		rng := rand.New(rand.NewSource(1))
+		split, err := findGoodSplit(context.Background(), data, 1, testParams, rng, nil)
+		if err != nil {
+			t.Fatalf("%s: findGoodSplit: %v", tt.name, err)
+		}
+		err = rules.checkSplit(context.Background(), data, 1, split, 100, rng)
+		var terminal terminalLeaf
+		if tt.significant && err != nil {
+			t.Errorf("%s: checkSplit = %v, want nil", tt.name, err)
+		}
+		if !tt.significant && (!errors.As(err, &terminal) || !strings.Contains(terminal.reason, "no better than chance")) {
+			t.Errorf("%s: checkSplit = %v, want a terminal leaf that is no better than chance", tt.name, err)
+		}
+
+		// The test doesn't disturb the data it was given
+		for i, row := range data.targets {
+			if row.TargetWord.String() != tt.targets[i] {
+				t.Fatalf("%s: the target of row %d is now %s", tt.name, row.RowID, row.TargetWord)
+			}
+		}
+	}
+}
+
+func TestFindGoodSplitTerminalLeaves(t *testing.T) {
+	tests := []struct {
+		name     string
+		contexts []string
+		targets  []string
+		want     error
+	}{
+		{"one target", []string{"1.1", "1.2", "2.1"}, []string{"5.1", "5.1", "5.1"}, errOneTarget},
+		{"one context", []string{"1.1", "1.1", "1.1"}, []string{"5.1", "5.2", "6.1"}, errNoDivision},
+	}
+	for _, tt := range tests {
+		data := testSplitData(t, tt.contexts, tt.targets)
+		_, err := findGoodSplit(context.Background(), data, 1, testParams, rand.New(rand.NewSource(1)), nil)
+		var terminal terminalLeaf
+		if err != tt.want || !errors.As(err, &terminal) {
+			t.Errorf("%s: findGoodSplit = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckLeaf(t *testing.T) {
+	db := incrementalFixture(t)
+	defer db.Close()
+
+	for _, tt := range []struct {
+		maxDepth int
+		nodeID   tree.NodeID
+		terminal bool
+	}{
+		{0, 2, false},
+		{1, 1, false},
+		{1, 2, true},
+		{2, 3, false},
+	} {
+		err := stoppingRules{maxDepth: tt.maxDepth}.checkLeaf(db, "nodes", tt.nodeID)
+		var terminal terminalLeaf
+		if errors.As(err, &terminal) != tt.terminal || (err != nil && !tt.terminal) {
+			t.Errorf("checkLeaf(%d) with --max-depth %d = %v, want terminal = %v", int(tt.nodeID), tt.maxDepth, err, tt.terminal)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/solresol/ultrametric-trees/pkg/events"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/sketch"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// Roughly what one loaded row costs: the DataFrameRow, and a synset
+// path of typical depth
+const estimatedRowBytes = 160
+
+// findGoodSplit holds a node's target rows, one context's rows, and
+// the inside and outside copies of them
+const loadedCopiesPerRow = 4
+
+// How many of the distinct prefixes of a context the streaming search
+// chooses its circles from, for each circle it tries
+const distinctPrefixesPerCircle = 16
+
+const countMinDepth = 4
+
+// How often (in rows) a stream checks whether training has been
+// interrupted
+const streamCheckEvery = 10000
+
+// parseMemory turns "4GB" (or 512MB, 100K, 12345...) into a number of
+// bytes, counting in 1024s. An empty string is 0, meaning no limit.
+func parseMemory(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	number := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := 1.0
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			number = number[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not an amount of memory", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// needsStreaming says whether loading the rows of nodeID would take
+// more than maxMemory
+func needsStreaming(db *sql.DB, nodesTable string, nodeID tree.NodeID, maxMemory int64) (bool, error) {
+	if maxMemory <= 0 {
+		return false, nil
+	}
+	var dataQuantity int64
+	query := fmt.Sprintf("SELECT coalesce(data_quantity, 0) FROM %s WHERE id = ?", nodesTable)
+	if err := db.QueryRow(query, nodeID).Scan(&dataQuantity); err != nil {
+		return false, fmt.Errorf("Could not get the size of node %d: %v", int(nodeID), err)
+	}
+	return dataQuantity*estimatedRowBytes*loadedCopiesPerRow > maxMemory, nil
+}
+
+func (d dbSplitData) stream(ctx context.Context, k int, fn func(rowID int, context, target tree.Synsetpath)) error {
+	n := 0
+	return exemplar.StreamContextNWithinNode(d.db, d.trainingDataTable, d.nodeBucketTable, d.nodeID, k, d.contextLength,
+		func(rowID int, context, target tree.Synsetpath) error {
+			n++
+			if n%streamCheckEvery == 0 && ctx.Err() != nil {
+				return errInterrupted
+			}
+			fn(rowID, context, target)
+			return nil
+		})
+}
+
+// streamCandidate is a circle being tried in findGoodSplitStreaming
+type streamCandidate struct {
+	circle  tree.Synsetpath
+	inside  *sketch.Reservoir[exemplar.DataFrameRow]
+	outside *sketch.Reservoir[exemplar.DataFrameRow]
+}
+
+// findGoodSplitStreaming searches for a split the way findGoodSplit
+// does, but never holds more than a sample of the node's rows. For
+// each context k it tries, it makes two passes over the rows:
+//
+//  1. a bottom-k sample of the distinct prefixes of context k, which
+//     is where the circles come from (findGoodSplit picks them
+//     uniformly from all the distinct prefixes), and a count-min
+//     sketch of how often each prefix occurs, so that circles that
+//     contain every row can be skipped without another look;
+//  2. for each circle, exact counts of the rows inside and outside it,
+//     and a reservoir sample of each side's target words.
+//
+// The exemplars are found from the samples, and their losses
+// extrapolated to the exact counts. The split that is returned has no
+// rows; commitSplit lets the database move them.
+func findGoodSplitStreaming(ctx context.Context,
+	data dbSplitData,
+	nodeID tree.NodeID,
+	params splitParams,
+	maxMemory int64,
+	rng *rand.Rand,
+	eventLog *events.Logger) (foundSplit, error) {
+
+	// A quarter of the memory for the sketch, the rest for the samples
+	countMinWidth := int(maxMemory / 4 / int64(sketch.CountMinBytes(1, countMinDepth)))
+	reservoirSize := int(maxMemory * 3 / 4 / int64(2*params.NumCirclesPerSplit*estimatedRowBytes))
+	if reservoirSize < 1 {
+		return foundSplit{}, fmt.Errorf("--max-memory is too small to sample %d circles", params.NumCirclesPerSplit)
+	}
+	log.Printf("Streaming through node %d, sampling up to %d rows on each side of each circle", int(nodeID), reservoirSize)
+
+	var best foundSplit
+	bestTotalLoss := float64(1<<63 - 1) // Initialize with max float64 value
+
+	foundSomethingToDo := false
+	for i := 0; i < params.SplitCountTry; i++ {
+		if ctx.Err() != nil {
+			return foundSplit{}, errInterrupted
+		}
+		k := rng.Intn(params.ContextLength) + 1
+
+		prefixes := sketch.NewBottomK(params.NumCirclesPerSplit*distinctPrefixesPerCircle, rng)
+		counts := sketch.NewCountMin(countMinWidth, countMinDepth, rng)
+		rowCount := 0
+		var firstTarget tree.Synsetpath
+		oneTarget := true
+		err := data.stream(ctx, k, func(rowID int, context, target tree.Synsetpath) {
+			if rowCount == 0 {
+				firstTarget = target
+			} else if oneTarget && !target.Equal(firstTarget) {
+				oneTarget = false
+			}
+			rowCount++
+			for n := 1; n <= len(context.Path); n++ {
+				prefix := context.Truncate(n).String()
+				prefixes.Add(prefix)
+				counts.Add(prefix)
+			}
+		})
+		if err != nil {
+			return foundSplit{}, err
+		}
+		if oneTarget {
+			return foundSplit{}, errOneTarget
+		}
+		possibleSynsets := prefixes.Keys()
+		if len(possibleSynsets) == 0 {
+			continue
+		}
+
+		candidates := make([]*streamCandidate, params.NumCirclesPerSplit)
+		var tried []*streamCandidate
+		for j := range candidates {
+			chosen := possibleSynsets[rng.Intn(len(possibleSynsets))]
+			if counts.Estimate(chosen) >= rowCount {
+				// Everything is (probably) inside it, so it wasn't a
+				// good choice
+				continue
+			}
+			circle, err := tree.ParseSynsetpath(chosen)
+			if err != nil {
+				return foundSplit{}, err
+			}
+			candidates[j] = &streamCandidate{
+				circle:  circle,
+				inside:  sketch.NewReservoir[exemplar.DataFrameRow](reservoirSize, rng),
+				outside: sketch.NewReservoir[exemplar.DataFrameRow](reservoirSize, rng),
+			}
+			tried = append(tried, candidates[j])
+		}
+		if len(tried) == 0 {
+			continue
+		}
+
+		err = data.stream(ctx, k, func(rowID int, context, target tree.Synsetpath) {
+			row := exemplar.DataFrameRow{RowID: rowID, TargetWord: target}
+			for _, c := range tried {
+				if c.circle.Contains(context) {
+					c.inside.Add(row)
+				} else {
+					c.outside.Add(row)
+				}
+			}
+		})
+		if err != nil {
+			return foundSplit{}, err
+		}
+
+		for j, c := range candidates {
+			if ctx.Err() != nil {
+				return foundSplit{}, errInterrupted
+			}
+			if c == nil || c.inside.Seen() == 0 || c.outside.Seen() == 0 {
+				// Wasn't a good choice
+				continue
+			}
+			insideExemplar, insideLoss, err := exemplar.FindBestExemplarInSample(c.inside.Items(), c.inside.Seen(), params.ExemplarGuesses, params.CostGuesses, rng)
+			if err != nil {
+				log.Printf("Error finding inside exemplar: %v", err)
+				continue
+			}
+			outsideExemplar, outsideLoss, err := exemplar.FindBestExemplarInSample(c.outside.Items(), c.outside.Seen(), params.ExemplarGuesses, params.CostGuesses, rng)
+			if err != nil {
+				log.Printf("Error finding outside exemplar: %v", err)
+				continue
+			}
+
+			totalLoss := insideLoss + outsideLoss
+			recordCandidate(eventLog, events.CandidateScoredEvent{
+				NodeID:      int(nodeID),
+				Attempt:     i*params.NumCirclesPerSplit + j + 1,
+				ContextK:    k,
+				Region:      c.circle.String(),
+				InsideSize:  c.inside.Seen(),
+				OutsideSize: c.outside.Seen(),
+				InsideLoss:  insideLoss,
+				OutsideLoss: outsideLoss,
+				TotalLoss:   totalLoss,
+			})
+
+			if totalLoss < bestTotalLoss {
+				foundSomethingToDo = true
+				bestTotalLoss = totalLoss
+				best = foundSplit{
+					contextK:        k,
+					circle:          c.circle,
+					insideExemplar:  insideExemplar,
+					outsideExemplar: outsideExemplar,
+					insideSize:      c.inside.Seen(),
+					outsideSize:     c.outside.Seen(),
+					insideLoss:      insideLoss,
+					outsideLoss:     outsideLoss,
+				}
+			}
+		}
+	}
+
+	if !foundSomethingToDo {
+		return foundSplit{}, errNoDivision
+	}
+	return best, nil
+}
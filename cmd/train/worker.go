@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/events"
+	"github.com/solresol/ultrametric-trees/pkg/exemplar"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// A worker gives up if it can't reach the coordinator for this long
+const coordinatorUnreachableLimit = 5 * time.Minute
+
+// errTrainingOver is returned when the coordinator has no more jobs to
+// hand out, ever
+var errTrainingOver = errors.New("training is over")
+
+// jobSplitData is the rows of a leaf held in memory, as sent by the
+// coordinator
+type jobSplitData struct {
+	targets  []exemplar.DataFrameRow
+	contexts [][]exemplar.DataFrameRow
+}
+
+func (d jobSplitData) targetRows() ([]exemplar.DataFrameRow, error) {
+	return d.targets, nil
+}
+
+func (d jobSplitData) contextRows(k int) ([]exemplar.DataFrameRow, error) {
+	if k < 1 || k > len(d.contexts) {
+		return nil, fmt.Errorf("k must be between 1 and %d", len(d.contexts))
+	}
+	return d.contexts[k-1], nil
+}
+
+func newJobSplitData(job splitJob) (jobSplitData, error) {
+	rows := func(paths []string) ([]exemplar.DataFrameRow, error) {
+		if len(paths) != len(job.RowIDs) {
+			return nil, fmt.Errorf("job %d has %d rows but %d paths", job.ID, len(job.RowIDs), len(paths))
+		}
+		result := make([]exemplar.DataFrameRow, len(paths))
+		for i, path := range paths {
+			synsetpath, err := tree.ParseSynsetpath(path)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing synsetpath for row %d: %v", job.RowIDs[i], err)
+			}
+			result[i] = exemplar.DataFrameRow{RowID: job.RowIDs[i], TargetWord: synsetpath}
+		}
+		return result, nil
+	}
+	var data jobSplitData
+	var err error
+	if data.targets, err = rows(job.Targets); err != nil {
+		return data, err
+	}
+	for _, context := range job.Contexts {
+		contextRows, err := rows(context)
+		if err != nil {
+			return data, err
+		}
+		data.contexts = append(data.contexts, contextRows)
+	}
+	return data, nil
+}
+
+type worker struct {
+	url      string
+	name     string
+	client   *http.Client
+	rng      *rand.Rand
+	eventLog *events.Logger
+}
+
+// runWorker splits leaves for the coordinator at coordinatorURL until
+// it says that training is over, or until SIGINT or SIGTERM
+func runWorker(coordinatorURL string, seed int64, eventLogPath string, candidateSample int) {
+	hostname, _ := os.Hostname()
+	w := &worker{
+		url:    strings.TrimRight(coordinatorURL, "/"),
+		name:   fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		client: &http.Client{},
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+	if eventLogPath != "" {
+		var err error
+		w.eventLog, err = events.Open(events.NewRunID(time.Now()), eventLogPath, nil, "", candidateSample)
+		if err != nil {
+			log.Fatalf("Could not start the event log: %v", err)
+		}
+		defer w.eventLog.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second signal exits straight away
+		stop()
+	}()
+
+	log.Printf("Working as %s for %s", w.name, w.url)
+	var unreachableSince time.Time
+	for ctx.Err() == nil {
+		job, err := w.fetchJob(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err == errTrainingOver {
+			log.Printf("The coordinator says that training is over")
+			return
+		}
+		if err != nil {
+			if unreachableSince.IsZero() {
+				unreachableSince = time.Now()
+			}
+			if time.Since(unreachableSince) > coordinatorUnreachableLimit {
+				log.Fatalf("Giving up on the coordinator: %v", err)
+			}
+			log.Printf("Could not get a job: %v", err)
+			sleepContext(ctx, workerPollInterval)
+			continue
+		}
+		unreachableSince = time.Time{}
+		if job == nil {
+			sleepContext(ctx, workerPollInterval)
+			continue
+		}
+		w.work(ctx, *job)
+	}
+	log.Printf("Stopped")
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// post sends v (as JSON) to path on the coordinator, and returns the
+// response, which the caller has to close
+func (w *worker) post(ctx context.Context, path string, v any) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return w.client.Do(request)
+}
+
+func responseError(response *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+}
+
+// fetchJob returns nil if there is nothing to do for now
+func (w *worker) fetchJob(ctx context.Context) (*splitJob, error) {
+	response, err := w.post(ctx, "/jobs", jobRequest{Worker: w.name})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		var job splitJob
+		if err := json.NewDecoder(response.Body).Decode(&job); err != nil {
+			return nil, fmt.Errorf("could not read the job: %v", err)
+		}
+		return &job, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusGone:
+		return nil, errTrainingOver
+	default:
+		return nil, responseError(response)
+	}
+}
+
+// work does one job. Whatever happens, the coordinator hears about it
+// (if it can be reached).
+func (w *worker) work(ctx context.Context, job splitJob) {
+	started := time.Now()
+	log.Printf("Job %d: splitting node %d (%d rows)", job.ID, job.NodeID, len(job.RowIDs))
+	jobCtx, cancelJob := context.WithCancel(ctx)
+	defer cancelJob()
+	stopHeartbeat := w.heartbeat(jobCtx, cancelJob, job)
+
+	var split foundSplit
+	data, err := newJobSplitData(job)
+	if err == nil {
+		split, err = findGoodSplit(jobCtx, data, tree.NodeID(job.NodeID), job.Params, w.rng, w.eventLog)
+	}
+	if err == nil {
+		// Here rather than on the coordinator, so that the heartbeat
+		// keeps the job alive however long a significance test takes
+		err = job.Rules.withParams(job.Params).checkSplit(jobCtx, data, tree.NodeID(job.NodeID), split, job.Loss, w.rng)
+	}
+	stopHeartbeat()
+
+	// Whatever happened to ctx, the coordinator still needs to be told
+	replyCtx, cancelReply := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelReply()
+	if err == errInterrupted {
+		if ctx.Err() == nil {
+			// The coordinator gave the job to someone else
+			return
+		}
+		w.release(replyCtx, job, jobRelease{})
+		return
+	}
+	if err != nil {
+		log.Printf("Job %d: %v", job.ID, err)
+		release := jobRelease{Error: err.Error()}
+		var terminal terminalLeaf
+		if errors.As(err, &terminal) {
+			release.Terminal = true
+			release.TerminalReason = terminal.reason
+		}
+		w.release(replyCtx, job, release)
+		return
+	}
+
+	response, err := w.post(replyCtx, "/jobs/"+strconv.Itoa(job.ID)+"/result", splitResult{
+		ContextK:        split.contextK,
+		Region:          split.circle.String(),
+		InsideExemplar:  split.insideExemplar.String(),
+		OutsideExemplar: split.outsideExemplar.String(),
+		InsideSize:      split.insideSize,
+		OutsideSize:     split.outsideSize,
+		InsideLoss:      split.insideLoss,
+		OutsideLoss:     split.outsideLoss,
+	})
+	if err != nil {
+		log.Printf("Job %d: could not send the result: %v", job.ID, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Printf("Job %d: the coordinator didn't take the result: %v", job.ID, responseError(response))
+		return
+	}
+	log.Printf("Job %d: node %d split into %d and %d rows, loss %f, in %v", job.ID, job.NodeID,
+		split.insideSize, split.outsideSize, split.totalLoss(), time.Since(started))
+}
+
+// heartbeat tells the coordinator every so often that the job is still
+// being worked on, and cancels it if the coordinator has given it to
+// someone else. Call the returned function to stop.
+func (w *worker) heartbeat(ctx context.Context, cancelJob context.CancelFunc, job splitJob) func() {
+	every := time.Duration(job.HeartbeatSeconds * float64(time.Second))
+	if every <= 0 {
+		every = workerPollInterval
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			response, err := w.post(ctx, "/jobs/"+strconv.Itoa(job.ID)+"/heartbeat", struct{}{})
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Job %d: could not send a heartbeat: %v", job.ID, err)
+				}
+				continue
+			}
+			response.Body.Close()
+			if response.StatusCode == http.StatusNotFound {
+				log.Printf("Job %d: the coordinator has given node %d to someone else", job.ID, job.NodeID)
+				cancelJob()
+				return
+			}
+		}
+	}()
+	return func() {
+		cancelJob()
+		<-stopped
+	}
+}
+
+func (w *worker) release(ctx context.Context, job splitJob, release jobRelease) {
+	response, err := w.post(ctx, "/jobs/"+strconv.Itoa(job.ID)+"/release", release)
+	if err != nil {
+		log.Printf("Job %d: could not give it back: %v", job.ID, err)
+		return
+	}
+	response.Body.Close()
+}
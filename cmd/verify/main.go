@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/inference"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// verify replays every row of the node bucket table through the tree
+// the way inference would, and reports every row that ends up in a
+// different leaf from the one that training put it in. If training and
+// inference agree about what's inside a region, there won't be any.
+
+func main() {
+	database := flag.String("database", "", "SQLite database file")
+	trainingDataTable := flag.String("training-data", "training_data", "Table name where the training data is stored")
+	nodeBucketTable := flag.String("node-bucket", "node_bucket", "Table name where the mapping between rows in the training data and their current nodes is stored")
+	nodesTable := flag.String("node-table", "nodes", "The table where the node hierarchy is stored")
+	contextLength := flag.Int("context-length", 16, "Context length")
+	limit := flag.Int("limit", -1, "Only check this many rows")
+	flag.Parse()
+
+	if *database == "" {
+		log.Fatal("--database is required")
+	}
+
+	db, err := sql.Open("sqlite3", *database)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	// All the nodes, including the ones created a moment ago
+	engine, err := inference.NewModelInference(db, *nodesTable, time.Now().Add(24*time.Hour))
+	if err != nil {
+		log.Fatalf("Error loading the tree from %s: %v", *nodesTable, err)
+	}
+
+	checked, mismatches, err := verifyRows(db, engine, *trainingDataTable, *nodeBucketTable, *contextLength, *limit)
+	if err != nil {
+		log.Fatalf("Verification stopped after %d rows: %v", checked, err)
+	}
+	log.Printf("Checked %d rows of %s against %d nodes: %d rows would be routed to a different leaf by inference",
+		checked, *nodeBucketTable, engine.Size(), mismatches)
+	if mismatches > 0 {
+		log.Fatalf("Training and inference disagree")
+	}
+}
+
+func verifyRows(db *sql.DB, engine *inference.ModelInference, trainingDataTable, nodeBucketTable string, contextLength int, limit int) (int, int, error) {
+	cols := make([]string, contextLength)
+	for i := 1; i <= contextLength; i++ {
+		cols[i-1] = fmt.Sprintf("context%d", i)
+	}
+	query := fmt.Sprintf("SELECT id, node_id, %s FROM %s JOIN %s USING (id) ORDER BY id",
+		strings.Join(cols, ", "), trainingDataTable, nodeBucketTable)
+	if limit > 0 {
+		query = fmt.Sprintf("%s LIMIT %d", query, limit)
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error querying %s: %v", trainingDataTable, err)
+	}
+	defer rows.Close()
+
+	checked := 0
+	mismatches := 0
+	for rows.Next() {
+		var id int
+		var bucketNodeID tree.NodeID
+		context := make([]tree.Synsetpath, contextLength)
+		scanArgs := make([]interface{}, contextLength+2)
+		scanArgs[0] = &id
+		scanArgs[1] = &bucketNodeID
+		for i := range context {
+			scanArgs[i+2] = &context[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return checked, mismatches, fmt.Errorf("error scanning row: %v", err)
+		}
+		checked++
+
+		result, err := engine.InferSingle(context, false)
+		if err != nil {
+			mismatches++
+			fmt.Printf("Row %d: training put it in node %d, inference failed: %v\n", id, bucketNodeID, err)
+			continue
+		}
+		if result.FinalNodeID != bucketNodeID {
+			mismatches++
+			fmt.Printf("Row %d: training put it in node %d, inference routes it to node %d\n", id, bucketNodeID, result.FinalNodeID)
+		}
+	}
+	return checked, mismatches, rows.Err()
+}
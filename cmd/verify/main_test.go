@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/solresol/ultrametric-trees/pkg/inference"
+)
+
+// verifyFixture is a tree with one split, on whether context1 is in
+// 1.2, and the rows that training put on each side of it. 1.23.4 is
+// the case that a string prefix test gets wrong.
+func verifyFixture(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE nodes (id integer primary key autoincrement, exemplar_value text, data_quantity integer,
+			loss float, contextk int, inner_region_prefix text, inner_region_node_id integer,
+			outer_region_node integer, when_created datetime default current_timestamp,
+			when_children_populated datetime, has_children bool default false,
+			being_analysed bool default false, split_seq integer);
+		INSERT INTO nodes (id, exemplar_value, data_quantity, contextk, inner_region_prefix,
+			inner_region_node_id, outer_region_node, when_children_populated, has_children, split_seq) VALUES
+			(1, '5.1', 5, 1, '1.2', 2, 3, current_timestamp, true, 1);
+		INSERT INTO nodes (id, exemplar_value, data_quantity) VALUES
+			(2, '5.1', 2),
+			(3, '5.2', 3);
+
+		CREATE TABLE training_data (id integer primary key, targetword text, context1 text, context2 text);
+		INSERT INTO training_data (id, targetword, context1, context2) VALUES
+			(1, '5.1', '1.2.5', '1.23.4'),
+			(2, '5.2', '1.23.4', '1.2'),
+			(3, '5.1', '1.2', NULL),
+			(4, '5.2', NULL, '1.2.5'),
+			(5, '5.2', '1.3', '1.2');
+
+		CREATE TABLE node_bucket (id integer, node_id integer, primary key (id, node_id));
+		INSERT INTO node_bucket (id, node_id) VALUES (1, 2), (2, 3), (3, 2), (4, 3), (5, 3);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating the fixture: %v", err)
+	}
+	return db
+}
+
+func TestVerifyRows(t *testing.T) {
+	db := verifyFixture(t)
+	defer db.Close()
+	engine, err := inference.NewModelInference(db, "nodes", time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("NewModelInference: %v", err)
+	}
+
+	checked, mismatches, err := verifyRows(db, engine, "training_data", "node_bucket", 2, -1)
+	if err != nil {
+		t.Fatalf("verifyRows: %v", err)
+	}
+	if checked != 5 || mismatches != 0 {
+		t.Errorf("verifyRows checked %d rows and found %d mismatches, want 5 and 0", checked, mismatches)
+	}
+
+	// If training had used a string prefix, 1.23.4 would have gone inside
+	if _, err := db.Exec("UPDATE node_bucket SET node_id = 2 WHERE id = 2"); err != nil {
+		t.Fatalf("Error moving row 2: %v", err)
+	}
+	checked, mismatches, err = verifyRows(db, engine, "training_data", "node_bucket", 2, -1)
+	if err != nil {
+		t.Fatalf("verifyRows: %v", err)
+	}
+	if checked != 5 || mismatches != 1 {
+		t.Errorf("verifyRows checked %d rows and found %d mismatches, want 5 and 1", checked, mismatches)
+	}
+}
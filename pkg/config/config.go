@@ -0,0 +1,376 @@
+// Package config lets train and evaluatemodel take their flags from a
+// YAML file of named experiment profiles, and from environment
+// variables, instead of long hand-assembled command lines.
+//
+// A configuration file has a section per program, giving values for
+// its flags (by their command-line names), and a set of profiles, each
+// of which can inherit from others:
+//
+//	train:
+//	  solar-monitor: envoy.cassia.ifost.org.au
+//	profiles:
+//	  careful:
+//	    train:
+//	      exemplar-guesses: 100
+//	      cost-guesses: 100
+//	  careful10000:
+//	    inherits: careful
+//	    train:
+//	      database: /ultratree/language-model/careful10000.sqlite
+//	      exemplar-guesses: 10000
+//
+// The top-level sections apply to every profile. A flag given on the
+// command line beats an environment variable, which beats the profile,
+// which beats the profiles it inherits from, which beat the top-level
+// sections, which beat the flag's default.
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Values are flag values by flag name
+type Values map[string]string
+
+// A Profile is a named set of values for each program
+type Profile struct {
+	Inherits []string
+	Programs map[string]Values
+}
+
+type File struct {
+	Programs map[string]Values
+	Profiles map[string]Profile
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+func Parse(data []byte) (*File, error) {
+	var top map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return nil, err
+	}
+	f := &File{Programs: map[string]Values{}, Profiles: map[string]Profile{}}
+	for key, value := range top {
+		if key != "profiles" {
+			values, err := parseValues(&value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			f.Programs[key] = values
+			continue
+		}
+		var profiles map[string]yaml.Node
+		if err := value.Decode(&profiles); err != nil {
+			return nil, fmt.Errorf("profiles: %v", err)
+		}
+		for name, body := range profiles {
+			p, err := parseProfile(&body)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %v", name, err)
+			}
+			f.Profiles[name] = p
+		}
+	}
+	return f, nil
+}
+
+func parseProfile(n *yaml.Node) (Profile, error) {
+	var sections map[string]yaml.Node
+	if err := n.Decode(&sections); err != nil {
+		return Profile{}, err
+	}
+	p := Profile{Programs: map[string]Values{}}
+	for key, value := range sections {
+		if key == "inherits" {
+			// Either one name or a list of them
+			var parent string
+			if err := value.Decode(&parent); err == nil {
+				p.Inherits = []string{parent}
+				continue
+			}
+			if err := value.Decode(&p.Inherits); err != nil {
+				return Profile{}, fmt.Errorf("inherits should be a profile name or a list of them")
+			}
+			continue
+		}
+		values, err := parseValues(&value)
+		if err != nil {
+			return Profile{}, fmt.Errorf("%s: %v", key, err)
+		}
+		p.Programs[key] = values
+	}
+	return p, nil
+}
+
+// parseValues reads a section of flag values. They're kept as the
+// strings that were written, because they'll be handed to flag.Set.
+func parseValues(n *yaml.Node) (Values, error) {
+	var raw map[string]yaml.Node
+	if err := n.Decode(&raw); err != nil {
+		return nil, err
+	}
+	values := Values{}
+	for name, value := range raw {
+		if value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("the value of %s should be a single value", name)
+		}
+		values[name] = value.Value
+	}
+	return values, nil
+}
+
+// Resolve works out the values for program in a profile (or just the
+// top-level section, if profile is empty), following inheritance.
+func (f *File) Resolve(profile, program string) (Values, error) {
+	result := Values{}
+	for name, value := range f.Programs[program] {
+		result[name] = value
+	}
+	if profile == "" {
+		return result, nil
+	}
+	if err := f.resolveProfile(profile, program, result, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *File) resolveProfile(name, program string, into Values, seen []string) error {
+	for _, s := range seen {
+		if s == name {
+			return fmt.Errorf("profile %s inherits from itself (%s)", name, strings.Join(append(seen, name), " -> "))
+		}
+	}
+	p, exists := f.Profiles[name]
+	if !exists {
+		return fmt.Errorf("there is no profile called %s (there are: %s)", name, strings.Join(f.ProfileNames(), ", "))
+	}
+	// Later parents beat earlier ones, and the profile beats them all
+	for _, parent := range p.Inherits {
+		if err := f.resolveProfile(parent, program, into, append(seen, name)); err != nil {
+			return err
+		}
+	}
+	for flagName, value := range p.Programs[program] {
+		into[flagName] = value
+	}
+	return nil
+}
+
+// ProfileNames are the profiles in the file, in alphabetical order
+func (f *File) ProfileNames() []string {
+	var names []string
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Program describes how a program's flags are configured
+type Program struct {
+	// Name is the section of the configuration file to use
+	Name string
+	// EnvPrefix is put in front of a flag's name (upper-cased, with -
+	// turned into _) to get its environment variable, e.g.
+	// ULTRATREE_TRAIN_ gives ULTRATREE_TRAIN_CONTEXT_LENGTH
+	EnvPrefix string
+	// EnvAliases are environment variables for flags that don't follow
+	// that pattern (for backwards compatibility)
+	EnvAliases map[string]string
+}
+
+func (p Program) envVar(flagName string) string {
+	if alias, exists := p.EnvAliases[flagName]; exists {
+		return alias
+	}
+	return p.EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// lookupEnv treats an empty variable as if it weren't set, which is
+// what the programs did before there were configuration files
+func lookupEnv(name string) (string, bool) {
+	value := os.Getenv(name)
+	return value, value != ""
+}
+
+// Flags are the flags that control configuration itself
+type Flags struct {
+	Path    *string
+	Profile *string
+	Print   *bool
+}
+
+// AddFlags adds --config, --profile and --print-config to fs
+func AddFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		Path:    fs.String("config", "", "YAML file of settings and experiment profiles"),
+		Profile: fs.String("profile", "", "Which profile in the --config file to use"),
+		Print:   fs.Bool("print-config", false, "Print the settings that would be used (and where each came from), and exit"),
+	}
+}
+
+func (c *Flags) isOwn(name string) bool {
+	return name == "config" || name == "profile" || name == "print-config"
+}
+
+// Effective records where each flag's value came from
+type Effective struct {
+	program Program
+	fs      *flag.FlagSet
+	own     *Flags
+	sources map[string]string
+}
+
+// Apply fills in the flags of fs that weren't given on the command
+// line from the environment and the configuration file. Call it after
+// fs.Parse.
+func (c *Flags) Apply(fs *flag.FlagSet, program Program) (*Effective, error) {
+	e := &Effective{program: program, fs: fs, own: c, sources: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		e.sources[f.Name] = "command line"
+	})
+
+	// --config and --profile can come from the environment too
+	for _, name := range []string{"config", "profile"} {
+		if _, set := e.sources[name]; set {
+			continue
+		}
+		if value, exists := lookupEnv(program.envVar(name)); exists {
+			if err := fs.Set(name, value); err != nil {
+				return nil, err
+			}
+			e.sources[name] = "$" + program.envVar(name)
+		}
+	}
+
+	if *c.Path != "" {
+		file, err := Load(*c.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the configuration: %v", err)
+		}
+		values, err := file.Resolve(*c.Profile, program.Name)
+		if err != nil {
+			return nil, err
+		}
+		source := *c.Path
+		if *c.Profile != "" {
+			source += " (profile " + *c.Profile + ")"
+		}
+		for _, name := range sortedKeys(values) {
+			if fs.Lookup(name) == nil || c.isOwn(name) {
+				return nil, fmt.Errorf("%s: %s has no --%s flag", source, program.Name, name)
+			}
+			if _, set := e.sources[name]; set {
+				continue
+			}
+			if err := fs.Set(name, values[name]); err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q for %s: %v", source, values[name], name, err)
+			}
+			e.sources[name] = source
+		}
+	} else if *c.Profile != "" {
+		return nil, fmt.Errorf("--profile needs --config")
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || c.isOwn(f.Name) || e.sources[f.Name] == "command line" {
+			return
+		}
+		envVar := program.envVar(f.Name)
+		value, exists := lookupEnv(envVar)
+		if !exists {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q in %s: %v", value, envVar, setErr)
+			return
+		}
+		e.sources[f.Name] = "$" + envVar
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Source says where a flag's value came from
+func (e *Effective) Source(name string) string {
+	if source, exists := e.sources[name]; exists {
+		return source
+	}
+	return "default"
+}
+
+// Print writes the settings as a configuration file (that could be
+// used with --config), noting where each value came from.
+func (e *Effective) Print(w io.Writer) error {
+	section := &yaml.Node{Kind: yaml.MappingNode}
+	e.fs.VisitAll(func(f *flag.Flag) {
+		if e.own.isOwn(f.Name) {
+			return
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: f.Value.String(), LineComment: e.Source(f.Name)}
+		// Keep numbers and booleans unquoted, and quote anything that
+		// YAML would otherwise read as something else
+		value.Tag = "!!str"
+		if tag := (&yaml.Node{Kind: yaml.ScalarNode, Value: f.Value.String()}).ShortTag(); tag != "!!str" && isNonString(f) {
+			value.Tag = tag
+		}
+		section.Content = append(section.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, value)
+	})
+	doc := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: e.program.Name}, section,
+	}}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// isNonString is true for flags whose values aren't strings (ints,
+// floats, booleans, durations)
+func isNonString(f *flag.Flag) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	_, isString := getter.Get().(string)
+	return !isString
+}
+
+func sortedKeys(values Values) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const experiments = `
+train:
+  solar-monitor: envoy.example
+  seed: 1
+profiles:
+  careful:
+    train:
+      exemplar-guesses: 100
+      cost-guesses: 100
+  careful10000:
+    inherits: careful
+    train:
+      exemplar-guesses: 10000
+  seed2:
+    train:
+      seed: 2
+  careful-seed2:
+    inherits: [careful10000, seed2]
+    evaluatemodel:
+      run-description: careful, seed 2
+  loop:
+    inherits: loop2
+  loop2:
+    inherits: loop
+`
+
+func TestResolve(t *testing.T) {
+	f, err := Parse([]byte(experiments))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	tests := []struct {
+		profile, program string
+		want             Values
+	}{
+		{"", "train", Values{"solar-monitor": "envoy.example", "seed": "1"}},
+		{"careful10000", "train", Values{"solar-monitor": "envoy.example", "seed": "1", "exemplar-guesses": "10000", "cost-guesses": "100"}},
+		{"careful-seed2", "train", Values{"solar-monitor": "envoy.example", "seed": "2", "exemplar-guesses": "10000", "cost-guesses": "100"}},
+		{"careful-seed2", "evaluatemodel", Values{"run-description": "careful, seed 2"}},
+	}
+	for _, tt := range tests {
+		got, err := f.Resolve(tt.profile, tt.program)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q): %v", tt.profile, tt.program, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Resolve(%q, %q) = %v, want %v", tt.profile, tt.program, got, tt.want)
+		}
+	}
+
+	if _, err := f.Resolve("loop", "train"); err == nil {
+		t.Error("Resolve of a profile that inherits from itself should return an error")
+	}
+	if _, err := f.Resolve("nonexistent", "train"); err == nil {
+		t.Error("Resolve of a missing profile should return an error")
+	}
+}
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "experiments.yaml")
+	if err := os.WriteFile(path, []byte(experiments), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ULTRATREE_TRAIN_COST_GUESSES", "7")
+	t.Setenv("ULTRATREE_TRAIN_SOLAR_MONITOR", "from-the-environment")
+	// Empty is the same as not set
+	t.Setenv("ULTRATREE_TRAIN_EXEMPLAR_GUESSES", "")
+
+	fs := flag.NewFlagSet("train", flag.ContinueOnError)
+	seed := fs.Int64("seed", 0, "")
+	exemplarGuesses := fs.Int("exemplar-guesses", 1000, "")
+	costGuesses := fs.Int("cost-guesses", 1000, "")
+	solarMonitor := fs.String("solar-monitor", "", "")
+	splitCountTry := fs.Int("split-count-try", 100, "")
+	own := AddFlags(fs)
+	err := fs.Parse([]string{"--config", path, "--profile", "careful10000", "--solar-monitor", "from-the-command-line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := own.Apply(fs, Program{Name: "train", EnvPrefix: "ULTRATREE_TRAIN_"})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if *seed != 1 || *exemplarGuesses != 10000 || *costGuesses != 7 || *solarMonitor != "from-the-command-line" || *splitCountTry != 100 {
+		t.Errorf("Got seed=%d exemplar-guesses=%d cost-guesses=%d solar-monitor=%s split-count-try=%d",
+			*seed, *exemplarGuesses, *costGuesses, *solarMonitor, *splitCountTry)
+	}
+	for name, want := range map[string]string{
+		"seed":             path + " (profile careful10000)",
+		"cost-guesses":     "$ULTRATREE_TRAIN_COST_GUESSES",
+		"solar-monitor":    "command line",
+		"split-count-try":  "default",
+		"exemplar-guesses": path + " (profile careful10000)",
+	} {
+		if got := e.Source(name); got != want {
+			t.Errorf("Source(%s) = %q, want %q", name, got, want)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := e.Print(&out); err != nil {
+		t.Fatalf("Print: %v", err)
+	}
+	printed := out.String()
+	for _, want := range []string{"train:\n", "  cost-guesses: 7 # $ULTRATREE_TRAIN_COST_GUESSES\n", "  solar-monitor: from-the-command-line # command line\n"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("Print output doesn't contain %q:\n%s", want, printed)
+		}
+	}
+	// What's printed can be read back in
+	f, err := Parse(out.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse the printed configuration: %v", err)
+	}
+	if f.Programs["train"]["exemplar-guesses"] != "10000" {
+		t.Errorf("Printed configuration has %v", f.Programs["train"])
+	}
+}
+
+func TestApplyUnknownFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "typo.yaml")
+	if err := os.WriteFile(path, []byte("train:\n  exemplar-guess: 10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("train", flag.ContinueOnError)
+	fs.Int("exemplar-guesses", 1000, "")
+	own := AddFlags(fs)
+	if err := fs.Parse([]string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := own.Apply(fs, Program{Name: "train", EnvPrefix: "ULTRATREE_TRAIN_"}); err == nil {
+		t.Error("Apply should reject settings for flags that don't exist")
+	}
+}
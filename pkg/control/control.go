@@ -0,0 +1,56 @@
+// Package control lets an operator pause and resume train without
+// stopping it, through a table in the model database:
+//
+//	sqlite3 model.sqlite "insert or replace into training_control (nodes_table, paused, reason, updated) values ('nodes', true, 'maintenance', current_timestamp)"
+//
+// train checks it between splits.
+package control
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const Table = "training_control"
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			nodes_table text primary key,
+			paused bool not null default false,
+			reason text,
+			updated timestamp
+		)`, Table))
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", Table, err)
+	}
+	return nil
+}
+
+// SetPaused pauses (or resumes) training on nodesTable
+func SetPaused(db *sql.DB, nodesTable string, paused bool, reason string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		INSERT INTO %s (nodes_table, paused, reason, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (nodes_table) DO UPDATE SET
+			paused = excluded.paused, reason = excluded.reason, updated = excluded.updated`, Table),
+		nodesTable, paused, reason, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("could not update %s: %v", Table, err)
+	}
+	return nil
+}
+
+// Paused says whether training on nodesTable has been paused, and why
+func Paused(db *sql.DB, nodesTable string) (bool, string, error) {
+	var paused bool
+	var reason sql.NullString
+	err := db.QueryRow(fmt.Sprintf("SELECT paused, reason FROM %s WHERE nodes_table = ?", Table), nodesTable).Scan(&paused, &reason)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("could not read %s: %v", Table, err)
+	}
+	return paused, reason.String, nil
+}
@@ -0,0 +1,43 @@
+package control
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	if err := CreateTable(db); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+
+	// Nothing recorded means not paused
+	if paused, _, err := Paused(db, "nodes"); err != nil || paused {
+		t.Fatalf("Paused before anything was set = %v, %v", paused, err)
+	}
+
+	if err := SetPaused(db, "nodes", true, "maintenance"); err != nil {
+		t.Fatalf("SetPaused: %v", err)
+	}
+	paused, reason, err := Paused(db, "nodes")
+	if err != nil || !paused || reason != "maintenance" {
+		t.Errorf("Paused = %v, %q, %v; want true, maintenance", paused, reason, err)
+	}
+	// Other models aren't affected
+	if paused, _, _ := Paused(db, "model2"); paused {
+		t.Error("Pausing nodes paused model2")
+	}
+
+	if err := SetPaused(db, "nodes", false, "done"); err != nil {
+		t.Fatalf("SetPaused: %v", err)
+	}
+	if paused, _, _ := Paused(db, "nodes"); paused {
+		t.Error("Still paused after resuming")
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 	"log"
 )
 
 // DecodePath looks up a synset path in the decodings table and returns the most common word
-func DecodePath(db *sql.DB, path string) (string, error) {
+func DecodePath(db *sql.DB, path tree.Synsetpath) (string, error) {
 	var word string
 	var count int
 	err := db.QueryRow(`
@@ -18,7 +19,7 @@ func DecodePath(db *sql.DB, path string) (string, error) {
 		GROUP BY word 
 		ORDER BY count DESC 
 		LIMIT 1
-	`, path).Scan(&word, &count)
+	`, path.String()).Scan(&word, &count)
 
 	if err == sql.ErrNoRows {
 		return "", fmt.Errorf("no word found for path: %s", path)
@@ -31,7 +32,7 @@ func DecodePath(db *sql.DB, path string) (string, error) {
 }
 
 // ShowContext takes a context array and prints each element decoded to its word form
-func ShowContext(db *sql.DB, context []string) (string, error) {
+func ShowContext(db *sql.DB, context []tree.Synsetpath) (string, error) {
 	s := ""
 	for _, path := range context {
 		word, err := DecodePath(db, path)
@@ -43,35 +44,149 @@ func ShowContext(db *sql.DB, context []string) (string, error) {
 	return s, nil
 }
 
-func NodeAncestry(db *sql.DB, n node.Node) (string, error) {
-	ancestors, err := node.FetchAncestry(db, n)
+// NodeAncestry describes the chain of decisions that leads from the
+// root of t down to the node nodeID.
+func NodeAncestry(db *sql.DB, t *node.Tree, nodeID tree.NodeID) (string, error) {
+	ancestors, err := t.Ancestry(nodeID)
 	if err != nil {
 		return "", err
 	}
 	display := "{} -> "
-	log.Printf("There were %d ancestors for node %d", len(ancestors), n.ID)
+	log.Printf("There were %d ancestors for node %d", len(ancestors)-1, nodeID)
 	for idx, a := range ancestors {
 		if idx == len(ancestors)-1 {
 			// Then we just show this node.
-			decodedExemplar, err := DecodePath(db, a.ExemplarValue.String)
+			decodedExemplar, err := DecodePath(db, a.ExemplarValue)
 			if err != nil {
 				return display, fmt.Errorf("Failed to decode final descendant: %v", err)
 			}
-			display = fmt.Sprintf("%s [Node %d says 'predict %s (%s)']", display, a.ID, a.ExemplarValue.String, decodedExemplar)
+			display = fmt.Sprintf("%s [Node %d says 'predict %s (%s)']", display, a.ID, a.ExemplarValue, decodedExemplar)
 			continue
 		}
 		nextAncestor := ancestors[idx+1]
-		decodedRegion, err := DecodePath(db, a.InnerRegionPrefix.String)
+		decodedRegion, err := DecodePath(db, a.InnerRegionPrefix)
 		if err != nil {
-			// log.Printf("Couldn't decode %s: %v", a.InnerRegionPrefix.String, err)
+			// log.Printf("Couldn't decode %s: %v", a.InnerRegionPrefix, err)
 			// We'll just assume we're OK
-			decodedRegion = fmt.Sprintf("<%s>", a.InnerRegionPrefix.String)
+			decodedRegion = fmt.Sprintf("<%s>", a.InnerRegionPrefix)
 		}
-		if nextAncestor.ID == int(a.InnerRegionNodeID.Int64) {
-			display = fmt.Sprintf("%s [Node %d] if context%d is inside %s (%s) AND ", display, a.ID, a.ContextK.Int64, a.InnerRegionPrefix.String, decodedRegion)
+		if nextAncestor.ID == a.InnerRegionNodeID {
+			display = fmt.Sprintf("%s [Node %d] if context%d is inside %s (%s) AND ", display, a.ID, a.ContextK.Int64, a.InnerRegionPrefix, decodedRegion)
 		} else {
-			display = fmt.Sprintf("%s [Node %d] if context%d is outside %s (%s) AND ", display, a.ID, a.ContextK.Int64, a.InnerRegionPrefix.String, decodedRegion)
+			display = fmt.Sprintf("%s [Node %d] if context%d is outside %s (%s) AND ", display, a.ID, a.ContextK.Int64, a.InnerRegionPrefix, decodedRegion)
 		}
 	}
 	return display, nil
 }
+
+// Reserved words are the pseudo-words that prepare inserts around the
+// real words of a story. They go through getPath like any
+// (punctuation.other) word, so their paths depend on the synset_paths
+// table of the input database; prepare records them in the
+// reserved_paths table of the dataframe so that everything downstream
+// can find them again.
+const (
+	StartOfText = "<START-OF-TEXT>"
+	EndOfText   = "<END-OF-TEXT>"
+	Unknown     = "<UNKNOWN>"
+)
+
+// Markers don't have a row in the words table, so prepare gives them
+// negative word IDs: story N's start marker is -(N*MarkersPerStory) and
+// its end marker is one less than that. They need to be unique per story
+// because training_data.targetword_id must be unique.
+const MarkersPerStory = 2
+
+func StartOfTextWordID(storyID int) int {
+	return -(storyID * MarkersPerStory)
+}
+
+func EndOfTextWordID(storyID int) int {
+	return -(storyID * MarkersPerStory) - 1
+}
+
+func CreateReservedPathsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS reserved_paths (
+			word TEXT PRIMARY KEY,
+			path TEXT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("Error creating reserved_paths table: %v", err)
+	}
+	return nil
+}
+
+func RecordReservedPath(db *sql.DB, word string, path tree.Synsetpath) error {
+	_, err := db.Exec(`
+		INSERT INTO reserved_paths (word, path) VALUES (?, ?)
+		ON CONFLICT(word) DO UPDATE SET path = excluded.path`, word, path.String())
+	if err != nil {
+		return fmt.Errorf("Could not record the path for %s: %v", word, err)
+	}
+	return nil
+}
+
+// ReservedPath finds the path of a reserved word. Databases made
+// before reserved_paths existed only have it in decodings, so that's
+// where we look if there's no reserved_paths table.
+func ReservedPath(db *sql.DB, word string) (tree.Synsetpath, error) {
+	var path tree.Synsetpath
+	err := db.QueryRow("SELECT path FROM reserved_paths WHERE word = ?", word).Scan(&path)
+	if err == nil {
+		return path, nil
+	}
+	err = db.QueryRow(`
+		SELECT path FROM decodings WHERE word = ?
+		ORDER BY usage_count DESC LIMIT 1`, word).Scan(&path)
+	if err == sql.ErrNoRows {
+		return path, fmt.Errorf("no path recorded for %s", word)
+	}
+	if err != nil {
+		return path, fmt.Errorf("error looking up the path for %s: %v", word, err)
+	}
+	return path, nil
+}
+
+// EncodeWord is the opposite of DecodePath: it finds the path that
+// word was most often annotated with.
+func EncodeWord(db *sql.DB, word string) (tree.Synsetpath, error) {
+	var path tree.Synsetpath
+	err := db.QueryRow(`
+		SELECT path FROM decodings WHERE word = ?
+		ORDER BY usage_count DESC LIMIT 1`, word).Scan(&path)
+	if err == sql.ErrNoRows {
+		return path, fmt.Errorf("no path found for word: %s", word)
+	}
+	if err != nil {
+		return path, fmt.Errorf("error encoding word: %v", err)
+	}
+	return path, nil
+}
+
+// A Dictionary translates between words and paths. A training
+// database is one (see DatabaseDictionary), and so is an exported
+// model file.
+type Dictionary interface {
+	DecodePath(path tree.Synsetpath) (string, error)
+	EncodeWord(word string) (tree.Synsetpath, error)
+	ReservedPath(word string) (tree.Synsetpath, error)
+}
+
+// DatabaseDictionary looks words up in the decodings (and
+// reserved_paths) tables of a database
+type DatabaseDictionary struct {
+	DB *sql.DB
+}
+
+func (d DatabaseDictionary) DecodePath(path tree.Synsetpath) (string, error) {
+	return DecodePath(d.DB, path)
+}
+
+func (d DatabaseDictionary) EncodeWord(word string) (tree.Synsetpath, error) {
+	return EncodeWord(d.DB, word)
+}
+
+func (d DatabaseDictionary) ReservedPath(word string) (tree.Synsetpath, error) {
+	return ReservedPath(d.DB, word)
+}
@@ -0,0 +1,133 @@
+package decode
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// testDictionary has a couple of real words, a hashed word (from the
+// (other.other) region, which is "8.") and the reserved words.
+func testDictionary(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE decodings (
+			path TEXT,
+			word TEXT,
+			usage_count INTEGER,
+			PRIMARY KEY (path, word)
+		)`)
+	if err != nil {
+		t.Fatalf("Error creating decodings table: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO decodings (path, word, usage_count) VALUES
+		('1.4.2', 'cat', 10),
+		('1.4.2', 'kitty', 2),
+		('1.4.3', 'dog', 7),
+		('8.3735928559', 'zyzzyva', 1),
+		('7.1.1', '<START-OF-TEXT>', 5),
+		('7.1.2', '<END-OF-TEXT>', 5)`)
+	if err != nil {
+		t.Fatalf("Error populating decodings: %v", err)
+	}
+	return db
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	db := testDictionary(t)
+	defer db.Close()
+
+	for _, word := range []string{"cat", "dog", "zyzzyva", EndOfText} {
+		path, err := EncodeWord(db, word)
+		if err != nil {
+			t.Errorf("EncodeWord(%s): %v", word, err)
+			continue
+		}
+		decoded, err := DecodePath(db, path)
+		if err != nil {
+			t.Errorf("DecodePath(%s): %v", path, err)
+			continue
+		}
+		if decoded != word {
+			t.Errorf("%s encoded to %s, which decoded to %s", word, path, decoded)
+		}
+	}
+
+	path, err := EncodeWord(db, "zyzzyva")
+	if err != nil || path.String() != "8.3735928559" {
+		t.Errorf("EncodeWord(zyzzyva) = %s, %v; want 8.3735928559", path, err)
+	}
+	if _, err := EncodeWord(db, "aardvark"); err == nil {
+		t.Errorf("EncodeWord should fail for a word that isn't in decodings")
+	}
+}
+
+func TestReservedPath(t *testing.T) {
+	db := testDictionary(t)
+	defer db.Close()
+
+	// Without a reserved_paths table, decodings is used instead
+	path, err := ReservedPath(db, EndOfText)
+	if err != nil || path.String() != "7.1.2" {
+		t.Errorf("ReservedPath(%s) before reserved_paths existed = %s, %v; want 7.1.2", EndOfText, path, err)
+	}
+
+	if err := CreateReservedPathsTable(db); err != nil {
+		t.Fatalf("CreateReservedPathsTable: %v", err)
+	}
+	recorded, err := tree.ParseSynsetpath("8.2045")
+	if err != nil {
+		t.Fatalf("ParseSynsetpath: %v", err)
+	}
+	if err := RecordReservedPath(db, Unknown, recorded); err != nil {
+		t.Fatalf("RecordReservedPath: %v", err)
+	}
+	path, err = ReservedPath(db, Unknown)
+	if err != nil || !path.Equal(recorded) {
+		t.Errorf("ReservedPath(%s) = %s, %v; want %s", Unknown, path, err, recorded)
+	}
+
+	// Recording it again replaces the old path
+	replacement, _ := tree.ParseSynsetpath("8.2046")
+	if err := RecordReservedPath(db, Unknown, replacement); err != nil {
+		t.Fatalf("RecordReservedPath: %v", err)
+	}
+	if path, err := ReservedPath(db, Unknown); err != nil || !path.Equal(replacement) {
+		t.Errorf("ReservedPath(%s) after re-recording = %s, %v; want %s", Unknown, path, err, replacement)
+	}
+
+	// reserved_paths takes precedence over decodings
+	override, _ := tree.ParseSynsetpath("7.9")
+	if err := RecordReservedPath(db, EndOfText, override); err != nil {
+		t.Fatalf("RecordReservedPath: %v", err)
+	}
+	if path, err := ReservedPath(db, EndOfText); err != nil || !path.Equal(override) {
+		t.Errorf("ReservedPath(%s) = %s, %v; want %s", EndOfText, path, err, override)
+	}
+
+	if _, err := ReservedPath(db, "<NOT-RESERVED>"); err == nil {
+		t.Errorf("ReservedPath should fail for a word that was never recorded")
+	}
+}
+
+func TestMarkerWordIDs(t *testing.T) {
+	seen := make(map[int]bool)
+	for storyID := 1; storyID <= 100; storyID++ {
+		for _, id := range []int{StartOfTextWordID(storyID), EndOfTextWordID(storyID)} {
+			if id >= 0 {
+				t.Errorf("Story %d has a marker with non-negative word ID %d", storyID, id)
+			}
+			if seen[id] {
+				t.Errorf("Word ID %d is used by more than one marker", id)
+			}
+			seen[id] = true
+		}
+	}
+}
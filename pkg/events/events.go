@@ -0,0 +1,186 @@
+// Package events defines the structured events that train records as
+// it goes, so that scripts and dashboards don't have to parse log
+// messages. Each event is written as one line of JSON (to the file
+// given by train --event-log) and/or as a row of a table in the model
+// database; Read and Fetch turn them back into Go values.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type Type string
+
+const (
+	RunStarted       Type = "run_started"
+	LeafChosen       Type = "leaf_chosen"
+	CandidateScored  Type = "candidate_scored"
+	SplitCommitted   Type = "split_committed"
+	LeafTerminal     Type = "leaf_terminal"
+	SolarPaused      Type = "solar_paused"
+	SolarResumed     Type = "solar_resumed"
+	TrainingComplete Type = "training_complete"
+)
+
+// DefaultTable is where train records events unless told otherwise
+const DefaultTable = "training_events"
+
+// A Payload is the body of one of the event types
+type Payload interface {
+	EventType() Type
+}
+
+// RunStartedEvent is recorded once when train starts (or resumes)
+type RunStartedEvent struct {
+	// Every command-line flag, including the ones left at their defaults
+	Flags    map[string]string `json:"flags"`
+	Hostname string            `json:"hostname"`
+	PID      int               `json:"pid"`
+}
+
+// LeafChosenEvent is recorded when train picks the next leaf to split
+type LeafChosenEvent struct {
+	NodeID   int     `json:"node_id"`
+	Loss     float64 `json:"loss"`
+	Ancestry string  `json:"ancestry,omitempty"`
+}
+
+// CandidateScoredEvent is a candidate split that was tried. There are
+// a great many of these, so only a sample of them are recorded.
+type CandidateScoredEvent struct {
+	NodeID      int     `json:"node_id"`
+	Attempt     int     `json:"attempt"`
+	ContextK    int     `json:"context_k"`
+	Region      string  `json:"region"`
+	InsideSize  int     `json:"inside_size"`
+	OutsideSize int     `json:"outside_size"`
+	InsideLoss  float64 `json:"inside_loss"`
+	OutsideLoss float64 `json:"outside_loss"`
+	TotalLoss   float64 `json:"total_loss"`
+}
+
+// SplitCommittedEvent is recorded after a split has been written to
+// the database
+type SplitCommittedEvent struct {
+	// The number of splits this run has made, including this one
+	Split         int     `json:"split"`
+	NodeID        int     `json:"node_id"`
+	ContextK      int     `json:"context_k"`
+	Region        string  `json:"region"`
+	RegionWord    string  `json:"region_word,omitempty"`
+	InnerNodeID   int     `json:"inner_node_id"`
+	InnerExemplar string  `json:"inner_exemplar"`
+	InnerSize     int     `json:"inner_size"`
+	InnerLoss     float64 `json:"inner_loss"`
+	OuterNodeID   int     `json:"outer_node_id"`
+	OuterExemplar string  `json:"outer_exemplar"`
+	OuterSize     int     `json:"outer_size"`
+	OuterLoss     float64 `json:"outer_loss"`
+	LossBefore    float64 `json:"loss_before"`
+	LossAfter     float64 `json:"loss_after"`
+	Seconds       float64 `json:"seconds"`
+}
+
+// LeafTerminalEvent is recorded when train decides never to split a
+// leaf
+type LeafTerminalEvent struct {
+	NodeID int    `json:"node_id"`
+	Reason string `json:"reason"`
+}
+
+// SolarPausedEvent is recorded each time train goes to sleep because
+// there isn't enough spare power
+type SolarPausedEvent struct {
+	// Zero if the policy didn't involve a meter
+	NetProduction float64 `json:"net_production"`
+	Reason        string  `json:"reason,omitempty"`
+	SleepSeconds  float64 `json:"sleep_seconds"`
+}
+
+// SolarResumedEvent is recorded when there is enough power again
+type SolarResumedEvent struct {
+	NetProduction float64 `json:"net_production"`
+	Reason        string  `json:"reason,omitempty"`
+}
+
+// TrainingCompleteEvent is recorded when train stops of its own accord
+type TrainingCompleteEvent struct {
+	Splits int    `json:"splits"`
+	Reason string `json:"reason"`
+}
+
+func (RunStartedEvent) EventType() Type       { return RunStarted }
+func (LeafChosenEvent) EventType() Type       { return LeafChosen }
+func (CandidateScoredEvent) EventType() Type  { return CandidateScored }
+func (SplitCommittedEvent) EventType() Type   { return SplitCommitted }
+func (LeafTerminalEvent) EventType() Type     { return LeafTerminal }
+func (SolarPausedEvent) EventType() Type      { return SolarPaused }
+func (SolarResumedEvent) EventType() Type     { return SolarResumed }
+func (TrainingCompleteEvent) EventType() Type { return TrainingComplete }
+
+// Event is how every event is stored: the payload is kept as raw JSON
+// until Decode is called, so that tools can skip the types they don't
+// care about (or don't know about yet).
+type Event struct {
+	Time time.Time       `json:"time"`
+	Run  string          `json:"run"`
+	Type Type            `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func newEvent(when time.Time, run string, p Payload) (Event, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return Event{}, fmt.Errorf("could not encode %s event: %v", p.EventType(), err)
+	}
+	return Event{Time: when, Run: run, Type: p.EventType(), Data: data}, nil
+}
+
+// Decode returns the payload as one of the *Event structs in this
+// package (not a pointer)
+func (e Event) Decode() (Payload, error) {
+	var p Payload
+	var err error
+	switch e.Type {
+	case RunStarted:
+		var v RunStartedEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case LeafChosen:
+		var v LeafChosenEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case CandidateScored:
+		var v CandidateScoredEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case SplitCommitted:
+		var v SplitCommittedEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case LeafTerminal:
+		var v LeafTerminalEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case SolarPaused:
+		var v SolarPausedEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case SolarResumed:
+		var v SolarResumedEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	case TrainingComplete:
+		var v TrainingCompleteEvent
+		err = json.Unmarshal(e.Data, &v)
+		p = v
+	default:
+		return nil, fmt.Errorf("unknown event type %q", e.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s event: %v", e.Type, err)
+	}
+	return p, nil
+}
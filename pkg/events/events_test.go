@@ -0,0 +1,107 @@
+package events
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRoundTrip(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := Open("run1", path, db, DefaultTable, 2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	when := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return when }
+
+	logged := []Payload{
+		RunStartedEvent{Flags: map[string]string{"seed": "1"}, Hostname: "h", PID: 7},
+		LeafChosenEvent{NodeID: 3, Loss: 1.5},
+		SplitCommittedEvent{Split: 1, NodeID: 3, ContextK: 2, Region: "1.2", InnerNodeID: 4, OuterNodeID: 5},
+		LeafTerminalEvent{NodeID: 4, Reason: "max-depth"},
+		TrainingCompleteEvent{Splits: 1, Reason: "stop-after"},
+	}
+	for _, p := range logged[:2] {
+		if err := l.Log(p); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	// Only the second and fourth candidates are sampled
+	for i := 1; i <= 5; i++ {
+		if err := l.Candidate(CandidateScoredEvent{NodeID: 3, Attempt: i}); err != nil {
+			t.Fatalf("Candidate: %v", err)
+		}
+	}
+	for _, p := range logged[2:] {
+		if err := l.Log(p); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := []Payload{logged[0], logged[1],
+		CandidateScoredEvent{NodeID: 3, Attempt: 2}, CandidateScoredEvent{NodeID: 3, Attempt: 4},
+		logged[2], logged[3], logged[4]}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open the event log: %v", err)
+	}
+	defer f.Close()
+	fromFile, err := Read(f)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	fromTable, err := Fetch(db, DefaultTable, "run1")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	for name, got := range map[string][]Event{"file": fromFile, "table": fromTable} {
+		if len(got) != len(want) {
+			t.Fatalf("Got %d events from the %s, want %d", len(got), name, len(want))
+		}
+		for i, e := range got {
+			if e.Run != "run1" || !e.Time.Equal(when) {
+				t.Errorf("Event %d from the %s has run %q and time %v", i, name, e.Run, e.Time)
+			}
+			p, err := e.Decode()
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(p, want[i]) {
+				t.Errorf("Event %d from the %s is %#v, want %#v", i, name, p, want[i])
+			}
+		}
+	}
+}
+
+func TestDecodeUnknownType(t *testing.T) {
+	e := Event{Type: "something_new", Data: []byte("{}")}
+	if _, err := e.Decode(); err == nil {
+		t.Error("Decode of an unknown type should return an error")
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	if err := l.Log(LeafChosenEvent{NodeID: 1}); err != nil {
+		t.Errorf("Log on a nil Logger: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("Close on a nil Logger: %v", err)
+	}
+}
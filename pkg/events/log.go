@@ -0,0 +1,192 @@
+package events
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger writes events to a JSONL file, a database table, or both.
+// A nil *Logger is valid and discards everything, so callers don't
+// need to check whether event logging was asked for.
+type Logger struct {
+	run   string
+	file  *os.File
+	w     *bufio.Writer
+	db    *sql.DB
+	table string
+	now   func() time.Time
+
+	// Only one in candidateEvery CandidateScored events is recorded
+	candidateEvery int
+
+	// Events can come from more than one goroutine
+	mu         sync.Mutex
+	candidates int
+}
+
+// NewRunID makes an identifier for a run of a program that is unique
+// enough to tell runs on the same database apart.
+func NewRunID(started time.Time) string {
+	return fmt.Sprintf("%s-%d", started.UTC().Format("20060102T150405"), os.Getpid())
+}
+
+// Open starts logging the events of run. Events are appended to path
+// (if it isn't empty) and inserted into table in db (if db isn't nil).
+// candidateEvery says how many scored candidates there are for each one
+// that gets recorded; 0 means none of them.
+func Open(run, path string, db *sql.DB, table string, candidateEvery int) (*Logger, error) {
+	l := &Logger{run: run, now: time.Now, candidateEvery: candidateEvery}
+	if db != nil {
+		if err := CreateTable(db, table); err != nil {
+			return nil, err
+		}
+		l.db = db
+		l.table = table
+	}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the event log: %v", err)
+		}
+		l.file = f
+		l.w = bufio.NewWriter(f)
+	}
+	return l, nil
+}
+
+func CreateTable(db *sql.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id integer primary key autoincrement,
+			run text not null,
+			event_time timestamp not null,
+			event_type text not null,
+			data text not null
+		)`, table))
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", table, err)
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_by_type ON %s (event_type)", table, table))
+	if err != nil {
+		return fmt.Errorf("could not index %s: %v", table, err)
+	}
+	return nil
+}
+
+// Log records an event. The file is flushed after every event, so that
+// anything tailing it sees events as they happen.
+func (l *Logger) Log(p Payload) error {
+	if l == nil {
+		return nil
+	}
+	e, err := newEvent(l.now(), l.run, p)
+	if err != nil {
+		return err
+	}
+	if l.w != nil {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("could not encode %s event: %v", e.Type, err)
+		}
+		l.mu.Lock()
+		l.w.Write(line)
+		l.w.WriteByte('\n')
+		err = l.w.Flush()
+		l.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("could not write to the event log: %v", err)
+		}
+	}
+	if l.db != nil {
+		_, err := l.db.Exec(fmt.Sprintf("INSERT INTO %s (run, event_time, event_type, data) VALUES (?, ?, ?, ?)", l.table),
+			e.Run, e.Time.UTC(), string(e.Type), string(e.Data))
+		if err != nil {
+			return fmt.Errorf("could not insert %s event into %s: %v", e.Type, l.table, err)
+		}
+	}
+	return nil
+}
+
+// Candidate records a scored candidate, if it's one of the ones that
+// gets sampled
+func (l *Logger) Candidate(c CandidateScoredEvent) error {
+	if l == nil || l.candidateEvery <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	l.candidates++
+	sampled := l.candidates%l.candidateEvery == 0
+	l.mu.Unlock()
+	if !sampled {
+		return nil
+	}
+	return l.Log(c)
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read reads a JSONL event log
+func Read(r io.Reader) ([]Event, error) {
+	var result []Event
+	scanner := bufio.NewScanner(r)
+	// The flags in a run_started event can make for a long line
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d of the event log: %v", lineNumber, err)
+		}
+		result = append(result, e)
+	}
+	return result, scanner.Err()
+}
+
+// Fetch reads the events from a table, oldest first. If run isn't
+// empty, only that run's events are returned.
+func Fetch(db *sql.DB, table, run string) ([]Event, error) {
+	query := fmt.Sprintf("SELECT run, event_time, event_type, data FROM %s", table)
+	var args []interface{}
+	if run != "" {
+		query += " WHERE run = ?"
+		args = append(args, run)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", table, err)
+	}
+	defer rows.Close()
+	var result []Event
+	for rows.Next() {
+		var e Event
+		var eventType, data string
+		if err := rows.Scan(&e.Run, &e.Time, &eventType, &data); err != nil {
+			return nil, err
+		}
+		e.Type = Type(eventType)
+		e.Data = json.RawMessage(data)
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,180 @@
+package exemplar
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/node"
+)
+
+// Several train processes can work on the same tree. Each one claims
+// the leaf it is going to split by setting being_analysed, claimed_by
+// and claimed_at in a single statement, so no two processes can pick
+// the same leaf. While it is working, a process keeps renewing its
+// claim; a claim that hasn't been renewed for a while belongs to a
+// process that died, and the leaf can be claimed again.
+
+// ErrClaimLost means that another process has taken over the leaf
+var ErrClaimLost = errors.New("claim lost to another process")
+
+// How long a writer waits for another one to finish before giving up
+const sharedBusyTimeout = 2 * time.Minute
+
+// OpenShared opens a model database so that several processes can
+// train in it at once: in WAL mode, readers don't block the process
+// that is writing a split, and writers queue up for each other instead
+// of failing with "database is locked".
+func OpenShared(path string) (*sql.DB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	dsn := fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate",
+		path, separator, sharedBusyTimeout.Milliseconds())
+	return sql.Open("sqlite3", dsn)
+}
+
+// EnsureClaimColumns adds claimed_by, claimed_at, terminal and
+// terminal_reason to a nodes table that was created before they existed
+func EnsureClaimColumns(db *sql.DB, nodesTable string) error {
+	for _, column := range []string{"claimed_by text", "claimed_at datetime", "terminal bool default false", "terminal_reason text"} {
+		if err := node.AddColumn(db, nodesTable, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleSQL is true for a claim that hasn't been renewed within
+// staleAfter (the argument is staleArg(staleAfter)). Leaves that were
+// marked as being_analysed before there were claims have no
+// claimed_at, and count as stale.
+const staleSQL = "(claimed_at IS NULL OR claimed_at < datetime('now', ?))"
+
+func staleArg(staleAfter time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int(staleAfter.Seconds()))
+}
+
+// ClaimMostUrgent claims the leaf that MostUrgentToImprove would pick,
+// also considering leaves whose claims are stale. It returns NoNodeID
+// if there is nothing to claim.
+func ClaimMostUrgent(db *sql.DB, nodesTable string, minSizeToConsider int, claimant string, staleAfter time.Duration) (NodeID, float64, error) {
+	return claimOrdered(db, nodesTable, LargestLoss{}, minSizeToConsider, claimant, staleAfter)
+}
+
+// ClaimNode claims one particular leaf, if nobody else has a claim on
+// it that is fresher than staleAfter. It returns ErrClaimLost if it
+// can't.
+func ClaimNode(db *sql.DB, nodesTable string, nodeID NodeID, claimant string, staleAfter time.Duration) error {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET being_analysed = true, claimed_by = ?, claimed_at = current_timestamp
+		WHERE id = ? AND not has_children AND (not being_analysed OR %s)
+	`, nodesTable, staleSQL)
+	result, err := db.Exec(query, claimant, nodeID, staleArg(staleAfter))
+	if err != nil {
+		return fmt.Errorf("could not claim node %d: %v", nodeID, err)
+	}
+	return claimedRow(result)
+}
+
+// RenewClaim stops claimant's claim on nodeID from going stale
+func RenewClaim(db *sql.DB, nodesTable string, nodeID NodeID, claimant string) error {
+	query := fmt.Sprintf(`
+		UPDATE %s SET claimed_at = current_timestamp
+		WHERE id = ? AND claimed_by = ? AND being_analysed AND not has_children
+	`, nodesTable)
+	result, err := db.Exec(query, nodeID, claimant)
+	if err != nil {
+		return fmt.Errorf("could not renew the claim on node %d: %v", nodeID, err)
+	}
+	return claimedRow(result)
+}
+
+// HoldClaim renews the claim on a node every so often, so that other
+// processes don't think it has been abandoned. Call the returned
+// function once the node has been split or released.
+func HoldClaim(db *sql.DB, nodesTable string, nodeID NodeID, claimant string, every time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := RenewClaim(db, nodesTable, nodeID, claimant); err != nil {
+					// If the claim really has been lost, the claimant
+					// will notice when it tries to commit
+					log.Printf("Could not renew the claim on node %d: %v", int(nodeID), err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// ReleaseClaim gives up claimant's claim on nodeID without splitting it
+func ReleaseClaim(db *sql.DB, nodesTable string, nodeID NodeID, claimant string) error {
+	query := fmt.Sprintf(`
+		UPDATE %s SET being_analysed = false, claimed_by = NULL, claimed_at = NULL
+		WHERE id = ? AND claimed_by = ?
+	`, nodesTable)
+	result, err := db.Exec(query, nodeID, claimant)
+	if err != nil {
+		return fmt.Errorf("could not release node %d: %v", nodeID, err)
+	}
+	return claimedRow(result)
+}
+
+// MarkTerminal gives up claimant's claim on nodeID and marks it as a
+// leaf that should never be split, for reason. Nothing claims a
+// terminal leaf again.
+func MarkTerminal(db *sql.DB, nodesTable string, nodeID NodeID, claimant string, reason string) error {
+	query := fmt.Sprintf(`
+		UPDATE %s SET terminal = true, terminal_reason = ?,
+		    being_analysed = false, claimed_by = NULL, claimed_at = NULL
+		WHERE id = ? AND claimed_by = ? AND not has_children
+	`, nodesTable)
+	result, err := db.Exec(query, reason, nodeID, claimant)
+	if err != nil {
+		return fmt.Errorf("could not mark node %d as terminal: %v", nodeID, err)
+	}
+	return claimedRow(result)
+}
+
+// claimedRow turns an update that matched nothing into ErrClaimLost
+func claimedRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// ActiveClaims counts the leaves that other processes are working on
+// (and haven't abandoned), whose children may need splitting later
+func ActiveClaims(db *sql.DB, nodesTable string, staleAfter time.Duration) (int, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) FROM %s
+		WHERE not has_children AND being_analysed AND NOT %s
+	`, nodesTable, staleSQL)
+	var n int
+	if err := db.QueryRow(query, staleArg(staleAfter)).Scan(&n); err != nil {
+		return 0, fmt.Errorf("could not count the claimed nodes in %s: %v", nodesTable, err)
+	}
+	return n, nil
+}
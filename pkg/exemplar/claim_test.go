@@ -0,0 +1,201 @@
+package exemplar
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createClaimNodes(t *testing.T, db *sql.DB) {
+	_, err := db.Exec(`
+		CREATE TABLE nodes (
+			id integer primary key,
+			loss float,
+			data_quantity integer,
+			has_children bool default false,
+			being_analysed bool default false
+		);
+		INSERT INTO nodes (id, loss, data_quantity) VALUES
+			(1, 10.0, 100),
+			(2, 8.0, 100),
+			(3, 6.0, 100);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating nodes: %v", err)
+	}
+	if err := EnsureClaimColumns(db, "nodes"); err != nil {
+		t.Fatalf("EnsureClaimColumns: %v", err)
+	}
+	// Doing it twice is harmless
+	if err := EnsureClaimColumns(db, "nodes"); err != nil {
+		t.Fatalf("EnsureClaimColumns again: %v", err)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	createClaimNodes(t, db)
+
+	first, loss, err := ClaimMostUrgent(db, "nodes", 1, "a", time.Hour)
+	if err != nil || first != 1 || loss != 10.0 {
+		t.Fatalf("First claim = %d, %f, %v; want 1, 10", first, loss, err)
+	}
+	second, _, err := ClaimMostUrgent(db, "nodes", 1, "b", time.Hour)
+	if err != nil || second != 2 {
+		t.Fatalf("Second claim = %d, %v; want 2", second, err)
+	}
+	if n, err := ActiveClaims(db, "nodes", time.Hour); err != nil || n != 2 {
+		t.Errorf("ActiveClaims = %d, %v; want 2", n, err)
+	}
+
+	if err := RenewClaim(db, "nodes", first, "a"); err != nil {
+		t.Errorf("RenewClaim by the claimant: %v", err)
+	}
+	if err := RenewClaim(db, "nodes", first, "b"); err != ErrClaimLost {
+		t.Errorf("RenewClaim by someone else = %v, want ErrClaimLost", err)
+	}
+
+	// a's process dies, and its claim goes stale
+	if _, err := db.Exec("UPDATE nodes SET claimed_at = datetime('now', '-2 hours') WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := ActiveClaims(db, "nodes", time.Hour); n != 1 {
+		t.Errorf("ActiveClaims with a stale claim = %d, want 1", n)
+	}
+	taken, _, err := ClaimMostUrgent(db, "nodes", 1, "c", time.Hour)
+	if err != nil || taken != 1 {
+		t.Fatalf("Claim after the stale claim = %d, %v; want 1", taken, err)
+	}
+	if err := RenewClaim(db, "nodes", first, "a"); err != ErrClaimLost {
+		t.Errorf("RenewClaim on a stolen claim = %v, want ErrClaimLost", err)
+	}
+	if err := ReleaseClaim(db, "nodes", first, "a"); err != ErrClaimLost {
+		t.Errorf("ReleaseClaim on a stolen claim = %v, want ErrClaimLost", err)
+	}
+
+	if err := ReleaseClaim(db, "nodes", second, "b"); err != nil {
+		t.Errorf("ReleaseClaim: %v", err)
+	}
+	again, _, err := ClaimMostUrgent(db, "nodes", 1, "d", time.Hour)
+	if err != nil || again != 2 {
+		t.Errorf("Claim after release = %d, %v; want 2", again, err)
+	}
+
+	if err := ClaimNode(db, "nodes", again, "x", time.Hour); err != ErrClaimLost {
+		t.Errorf("ClaimNode on a claimed node = %v, want ErrClaimLost", err)
+	}
+
+	third, _, _ := ClaimMostUrgent(db, "nodes", 1, "e", time.Hour)
+	if third != 3 {
+		t.Errorf("Third claim = %d, want 3", third)
+	}
+	none, _, err := ClaimMostUrgent(db, "nodes", 1, "f", time.Hour)
+	if err != nil || none != NoNodeID {
+		t.Errorf("Claim with everything taken = %d, %v; want NoNodeID", none, err)
+	}
+	if err := ReleaseClaim(db, "nodes", third, "e"); err != nil {
+		t.Errorf("ReleaseClaim: %v", err)
+	}
+	if err := ClaimNode(db, "nodes", third, "x", time.Hour); err != nil {
+		t.Errorf("ClaimNode on a released node: %v", err)
+	}
+}
+
+func TestTerminalLeavesAreNotClaimed(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	createClaimNodes(t, db)
+
+	first, _, err := ClaimMostUrgent(db, "nodes", 1, "a", time.Hour)
+	if err != nil || first != 1 {
+		t.Fatalf("First claim = %d, %v; want 1", first, err)
+	}
+	if err := MarkTerminal(db, "nodes", first, "b", "not b's"); err != ErrClaimLost {
+		t.Errorf("MarkTerminal by someone else = %v, want ErrClaimLost", err)
+	}
+	if err := MarkTerminal(db, "nodes", first, "a", "too deep"); err != nil {
+		t.Fatalf("MarkTerminal: %v", err)
+	}
+	var reason string
+	if err := db.QueryRow("SELECT terminal_reason FROM nodes WHERE id = 1 AND terminal AND claimed_by IS NULL").Scan(&reason); err != nil || reason != "too deep" {
+		t.Errorf("Terminal reason = %q, %v; want \"too deep\" with no claim", reason, err)
+	}
+	if n, _ := ActiveClaims(db, "nodes", time.Hour); n != 0 {
+		t.Errorf("ActiveClaims after MarkTerminal = %d, want 0", n)
+	}
+
+	// Every other way of claiming leaves it alone
+	if _, err := db.Exec("ALTER TABLE nodes ADD COLUMN depth integer"); err != nil {
+		t.Fatal(err)
+	}
+	next, _, err := ClaimMostUrgent(db, "nodes", 1, "c", time.Hour)
+	if err != nil || next != 2 {
+		t.Errorf("Claim after MarkTerminal = %d, %v; want 2", next, err)
+	}
+	claimed, _, err := ClaimLeaf(context.Background(), db, "nodes", WeightedRandom{}, 1, "d", time.Hour, rand.New(rand.NewSource(1)))
+	if err != nil || claimed != 3 {
+		t.Errorf("ClaimLeaf = %d, %v; want 3", claimed, err)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.sqlite")
+	setup, err := OpenShared(path)
+	if err != nil {
+		t.Fatalf("OpenShared: %v", err)
+	}
+	defer setup.Close()
+	createClaimNodes(t, setup)
+	var mode string
+	if err := setup.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode = %q, %v; want wal", mode, err)
+	}
+
+	// Each claimant has its own connection, as separate processes would
+	const claimants = 6
+	claimed := make([]NodeID, claimants)
+	var wg sync.WaitGroup
+	for i := 0; i < claimants; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db, err := OpenShared(path)
+			if err != nil {
+				t.Errorf("OpenShared: %v", err)
+				return
+			}
+			defer db.Close()
+			id, _, err := ClaimMostUrgent(db, "nodes", 1, string(rune('a'+i)), time.Hour)
+			if err != nil {
+				t.Errorf("ClaimMostUrgent: %v", err)
+			}
+			claimed[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[NodeID]bool{}
+	for _, id := range claimed {
+		if id == NoNodeID {
+			continue
+		}
+		if seen[id] {
+			t.Errorf("Node %d was claimed twice: %v", id, claimed)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Claimed %v, want each of the 3 nodes once", claimed)
+	}
+}
@@ -0,0 +1,70 @@
+package exemplar
+
+import (
+	"fmt"
+	"math"
+)
+
+// ExactLoss is the loss of predicting exemplar for every one of rows:
+// the sum of CalculateCost over all of them, rather than the estimate
+// that FindBestExemplar makes from a sample.
+func ExactLoss(rows []DataFrameRow, exemplar Synsetpath) float64 {
+	loss := 0.0
+	for _, row := range rows {
+		loss += CalculateCost(exemplar, row.TargetWord)
+	}
+	return loss
+}
+
+// ExactBestExemplar is FindBestExemplar without the guessing: it tries
+// every distinct target word in rows as the exemplar, and returns the
+// one with the smallest ExactLoss (the first of them, in row order, if
+// there's a tie) along with that loss.
+//
+// Trying each one against every row would take time proportional to
+// the square of the number of rows, so it counts how many rows start
+// with each prefix instead. If the exemplar is p_L with prefixes p_0
+// (nothing) ... p_L, the rows that have exactly j components in common
+// with it are the ones that start with p_j but not p_{j+1}, and each
+// of them costs 2^{-j}. The ones that start with p_L cost 2^{-L},
+// except for the ones that are the exemplar, which cost nothing.
+func ExactBestExemplar(rows []DataFrameRow) (Synsetpath, float64, error) {
+	if len(rows) == 0 {
+		return Synsetpath{}, 0, fmt.Errorf("no rows provided to ExactBestExemplar")
+	}
+
+	prefixCounts := make(map[string]int)
+	exactCounts := make(map[string]int)
+	for _, row := range rows {
+		exactCounts[row.TargetWord.String()]++
+		for n := 1; n <= len(row.TargetWord.Path); n++ {
+			prefixCounts[row.TargetWord.Truncate(n).String()]++
+		}
+	}
+
+	bestExemplar := Synsetpath{}
+	bestLoss := math.Inf(1)
+	tried := make(map[string]bool)
+	for _, row := range rows {
+		key := row.TargetWord.String()
+		if tried[key] {
+			continue
+		}
+		tried[key] = true
+
+		loss := 0.0
+		withPrefix := len(rows)
+		for j := 0; j < len(row.TargetWord.Path); j++ {
+			withLongerPrefix := prefixCounts[row.TargetWord.Truncate(j+1).String()]
+			loss += float64(withPrefix-withLongerPrefix) * math.Pow(2, -float64(j))
+			withPrefix = withLongerPrefix
+		}
+		loss += float64(withPrefix-exactCounts[key]) * math.Pow(2, -float64(len(row.TargetWord.Path)))
+
+		if loss < bestLoss {
+			bestExemplar = row.TargetWord
+			bestLoss = loss
+		}
+	}
+	return bestExemplar, bestLoss, nil
+}
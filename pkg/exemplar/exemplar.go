@@ -5,18 +5,20 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"strconv"
 	"strings"
+
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
-type NodeID int
+// NodeID and Synsetpath used to live here. They are now in pkg/tree,
+// which everything else shares; these aliases mean that code written
+// against exemplar keeps working.
+type NodeID = tree.NodeID
 
-const RootNodeID NodeID = 1
-const NoNodeID NodeID = -1
+const RootNodeID = tree.RootNodeID
+const NoNodeID = tree.NoNodeID
 
-type Synsetpath struct {
-	Path []int
-}
+type Synsetpath = tree.Synsetpath
 
 type DataFrameRow struct {
 	RowID      int
@@ -24,27 +26,7 @@ type DataFrameRow struct {
 }
 
 func ParseSynsetpath(s string) (Synsetpath, error) {
-	parts := strings.Split(s, ".")
-	path := make([]int, len(parts))
-	for i, part := range parts {
-		num, err := strconv.Atoi(part)
-		if err != nil {
-			return Synsetpath{}, fmt.Errorf("invalid synsetpath: %s", s)
-		}
-		if num < 0 {
-			return Synsetpath{}, fmt.Errorf("negative number not allowed in synsetpath: %s", s)
-		}
-		path[i] = num
-	}
-	return Synsetpath{Path: path}, nil
-}
-
-func (sp Synsetpath) String() string {
-	parts := make([]string, len(sp.Path))
-	for i, num := range sp.Path {
-		parts[i] = strconv.Itoa(num)
-	}
-	return strings.Join(parts, ".")
+	return tree.ParseSynsetpath(s)
 }
 
 func LoadRows(db *sql.DB, dataframeTable string, nodeBucketTable string, nodeID NodeID) ([]DataFrameRow, error) {
@@ -105,6 +87,43 @@ func LoadContextNWithinNode(db *sql.DB, dataframeTable string, nodeBucketTable s
 	return result, nil
 }
 
+// StreamContextNWithinNode calls fn with context k and the target
+// word of every row in a node, in ID order, without loading them all
+// at once. It stops at the first error from fn.
+func StreamContextNWithinNode(db *sql.DB, dataframeTable string, nodeBucketTable string, nodeID NodeID, k int, contextLength int, fn func(rowID int, context, target Synsetpath) error) error {
+	if k < 1 || k > contextLength {
+		return fmt.Errorf("k must be between 1 and %d", contextLength)
+	}
+
+	query := fmt.Sprintf("SELECT id, context%d, targetword FROM %s JOIN %s USING (id) WHERE node_id = ? ORDER BY id", k, dataframeTable, nodeBucketTable)
+
+	rows, err := db.Query(query, nodeID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rowID int
+		var contextWordStr, targetWordStr string
+		if err := rows.Scan(&rowID, &contextWordStr, &targetWordStr); err != nil {
+			return err
+		}
+		context, err := ParseSynsetpath(contextWordStr)
+		if err != nil {
+			return fmt.Errorf("error parsing synsetpath for row %d: %v", rowID, err)
+		}
+		target, err := ParseSynsetpath(targetWordStr)
+		if err != nil {
+			return fmt.Errorf("error parsing synsetpath for row %d: %v", rowID, err)
+		}
+		if err := fn(rowID, context, target); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 // GetAllPossibleSynsets returns all possible synsets and synset
 // truncations from an array of DataFrameRows. If it were given
 // {1.2.3, 1.4, 2.3.4, 2.3.3} it will return {1, 1.2, 1.2.3, 1.4, 2,
@@ -117,7 +136,7 @@ func GetAllPossibleSynsets(rows []DataFrameRow) []Synsetpath {
 
 	for _, row := range rows {
 		for i := 1; i <= len(row.TargetWord.Path); i++ {
-			truncated := Synsetpath{Path: row.TargetWord.Path[:i]}
+			truncated := row.TargetWord.Truncate(i)
 			synsetMap[truncated.String()] = truncated
 		}
 	}
@@ -134,17 +153,16 @@ func GetAllPossibleSynsets(rows []DataFrameRow) []Synsetpath {
 // which are the same length) and a synset (synset_filter) and returns
 // an "inside" array and an "outside" array. It iterates over (source
 // and target zipped), and if the current element from source is equal
-// to synset_filter, or synset_filter is a truncation of it, then
-// we'll call that "in" (put the current target element on to the end
-// of the "inside" array) , otherwise "out" (put it onto the "outside"
-// array).
+// to synset_filter, or synset_filter is a truncation of it (that is,
+// synsetFilter.Contains(it)), then we'll call that "in" (put the
+// current target element on to the end of the "inside" array) ,
+// otherwise "out" (put it onto the "outside" array).
 
 func SplitByFilter(source, target []DataFrameRow, synsetFilter Synsetpath) ([]DataFrameRow, []DataFrameRow) {
 	var inside, outside []DataFrameRow
 
 	for i, src := range source {
-		if len(src.TargetWord.Path) >= len(synsetFilter.Path) &&
-			strings.HasPrefix(src.TargetWord.String(), synsetFilter.String()) {
+		if synsetFilter.Contains(src.TargetWord) {
 			inside = append(inside, target[i])
 		} else {
 			outside = append(outside, target[i])
@@ -166,20 +184,10 @@ func SplitByFilter(source, target []DataFrameRow, synsetFilter Synsetpath) ([]Da
 // There is a small bug here. It should 
 
 func CalculateCost(exemplar, comparator Synsetpath) float64 {
-	commonPrefixLength := 0
-	foundDifference := false
-	for i := 0; i < len(exemplar.Path) && i < len(comparator.Path); i++ {
-		if exemplar.Path[i] != comparator.Path[i] {
-			foundDifference = true
-			break
-		}
-		commonPrefixLength++
-	}
-	if !foundDifference && (len(exemplar.Path) == len(comparator.Path)) {
+	if exemplar.Equal(comparator) {
 		return 0
 	}
-
-	return math.Pow(2, -float64(commonPrefixLength))
+	return math.Pow(2, -float64(exemplar.CommonPrefixLen(comparator)))
 }
 
 //  FindBestExemplar iterates [exemplarGuesses] number of times, picking a random
@@ -197,6 +205,12 @@ func CalculateCost(exemplar, comparator Synsetpath) float64 {
 // that exemplar.
 
 func FindBestExemplar(rows []DataFrameRow, exemplarGuesses, costGuesses int, rng *rand.Rand) (Synsetpath, float64, error) {
+	return FindBestExemplarInSample(rows, len(rows), exemplarGuesses, costGuesses, rng)
+}
+
+// FindBestExemplarInSample is FindBestExemplar when rows are a uniform
+// sample of population rows: the loss is extrapolated to all of them.
+func FindBestExemplarInSample(rows []DataFrameRow, population int, exemplarGuesses, costGuesses int, rng *rand.Rand) (Synsetpath, float64, error) {
 	if len(rows) == 0 {
 		return Synsetpath{}, 0, fmt.Errorf("no rows provided to FindBestExemplar")
 	}
@@ -219,7 +233,7 @@ func FindBestExemplar(rows []DataFrameRow, exemplarGuesses, costGuesses int, rng
 			totalCost += CalculateCost(exemplar, comparator)
 		}
 
-		estimatedLoss := totalCost / float64(costGuesses) * float64(len(rows))
+		estimatedLoss := totalCost / float64(costGuesses) * float64(population)
 		if estimatedLoss < bestLoss {
 			bestExemplar = exemplar
 			bestLoss = estimatedLoss
@@ -275,6 +289,39 @@ func UpdateNodeIDs(tx *sql.Tx, table string, rowIDs []int, newNodeID NodeID) err
 	return nil
 }
 
+// UpdateNodeIDsByRegion moves the rows of nodeID to innerNodeID if
+// their context k is inside region, and to outerNodeID otherwise,
+// without needing a list of them. It returns how many rows went each
+// way.
+func UpdateNodeIDsByRegion(tx *sql.Tx, dataframeTable string, nodeBucketTable string, nodeID NodeID, k int, region Synsetpath, innerNodeID, outerNodeID NodeID) (int, int, error) {
+	// The same test as Synsetpath.Contains, on the text of the path
+	query := fmt.Sprintf(`
+		UPDATE %s SET node_id = ?
+		WHERE node_id = ? AND id IN (
+			SELECT id FROM %s JOIN %s USING (id)
+			WHERE node_id = ? AND (context%d = ? OR context%d LIKE ?)
+		)`, nodeBucketTable, dataframeTable, nodeBucketTable, k, k)
+	result, err := tx.Exec(query, innerNodeID, nodeID, nodeID, region.String(), region.String()+".%")
+	if err != nil {
+		return 0, 0, err
+	}
+	inside, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET node_id = ? WHERE node_id = ?", nodeBucketTable)
+	result, err = tx.Exec(query, outerNodeID, nodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	outside, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(inside), int(outside), nil
+}
+
 func CompareTableRowCounts(db *sql.DB, table1, table2 string) (bool, error) {
 	query := fmt.Sprintf(`
 		SELECT
@@ -317,19 +364,25 @@ func IsTableEmpty(db *sql.DB, tableName string) (bool, error) {
 	return !exists, nil
 }
 
+// MostUrgentToImprove returns the leaf that LargestLoss would pick:
+// the one with the largest loss that nobody is working on, isn't
+// terminal, and has at least minSizeToConsider rows. Unlike ClaimLeaf,
+// it doesn't claim it.
 func MostUrgentToImprove(db *sql.DB, nodesTable string, minSizeToConsider int) (NodeID, float64, error) {
+	condition, order, conditionArgs := LargestLoss{}.sql()
 	query := fmt.Sprintf(`
 		SELECT id, loss
 		FROM %s
-		WHERE not has_children AND not being_analysed
-		AND data_quantity >= ?
-		ORDER BY loss DESC
+		WHERE not has_children AND not being_analysed AND not terminal
+		AND data_quantity >= ? AND %s
+		ORDER BY %s
 		LIMIT 1
-	`, nodesTable)
+	`, nodesTable, condition, order)
 
 	var id int
 	var loss float64
-	err := db.QueryRow(query, minSizeToConsider).Scan(&id, &loss)
+	args := append([]interface{}{minSizeToConsider}, conditionArgs...)
+	err := db.QueryRow(query, args...).Scan(&id, &loss)
 	if err == sql.ErrNoRows {
 		return NoNodeID, 0.0, nil
 	}
@@ -339,3 +392,23 @@ func MostUrgentToImprove(db *sql.DB, nodesTable string, minSizeToConsider int) (
 
 	return NodeID(id), loss, nil
 }
+
+// LeafStatistics counts the leaves that MostUrgentToImprove could
+// still pick (ignoring being_analysed), and adds up the loss over all
+// the leaves, terminal or not.
+func LeafStatistics(db *sql.DB, nodesTable string, minSizeToConsider int) (int, float64, error) {
+	query := fmt.Sprintf(`
+		SELECT coalesce(sum(CASE WHEN data_quantity >= ? AND not terminal THEN 1 ELSE 0 END), 0),
+		       coalesce(sum(loss), 0)
+		FROM %s
+		WHERE not has_children
+	`, nodesTable)
+
+	var splittable int
+	var totalLoss float64
+	err := db.QueryRow(query, minSizeToConsider).Scan(&splittable, &totalLoss)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting the leaves of %s: %v", nodesTable, err)
+	}
+	return splittable, totalLoss, nil
+}
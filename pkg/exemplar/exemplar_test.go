@@ -3,6 +3,8 @@ package exemplar
 import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
+	"math"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -59,6 +61,36 @@ func TestParseSynsetpathError(t *testing.T) {
 	}
 }
 
+func TestSplitByFilter(t *testing.T) {
+	paths := []string{"1.2", "1.2.3", "1.23", "1.23.4", "2.1.2"}
+	var source, target []DataFrameRow
+	for i, p := range paths {
+		sp, err := ParseSynsetpath(p)
+		if err != nil {
+			t.Fatalf("ParseSynsetpath(%q) returned unexpected error: %v", p, err)
+		}
+		source = append(source, DataFrameRow{RowID: i, TargetWord: sp})
+		target = append(target, DataFrameRow{RowID: i, TargetWord: sp})
+	}
+	filter, _ := ParseSynsetpath("1.2")
+
+	inside, outside := SplitByFilter(source, target, filter)
+
+	var insideIDs, outsideIDs []int
+	for _, r := range inside {
+		insideIDs = append(insideIDs, r.RowID)
+	}
+	for _, r := range outside {
+		outsideIDs = append(outsideIDs, r.RowID)
+	}
+	if !reflect.DeepEqual(insideIDs, []int{0, 1}) {
+		t.Errorf("SplitByFilter put rows %v inside 1.2, want [0 1]", insideIDs)
+	}
+	if !reflect.DeepEqual(outsideIDs, []int{2, 3, 4}) {
+		t.Errorf("SplitByFilter put rows %v outside 1.2, want [2 3 4]", outsideIDs)
+	}
+}
+
 func TestTableExists(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -200,7 +232,8 @@ func TestMostUrgentToImprove(t *testing.T) {
 			inner_region_node_id INTEGER,
 			outer_region_node INTEGER,
 			has_children bool,
-			being_analysed bool
+			being_analysed bool,
+			terminal bool default false
 		);
 		INSERT INTO nodes (id, loss, data_quantity, inner_region_node_id, outer_region_node, has_children, being_analysed) VALUES
 			(1, 0.5, 100, NULL, NULL, false, true),
@@ -208,6 +241,8 @@ func TestMostUrgentToImprove(t *testing.T) {
 			(3, 0.3, 50, 4, 5, true, false),
 			(4, 0.6, 750, NULL, NULL, false, false),
 			(5, 0.9, 25, NULL, NULL, false, true);
+		INSERT INTO nodes (id, loss, data_quantity, has_children, being_analysed, terminal) VALUES
+			(6, 0.95, 1000, false, false, true);
 	`)
 	if err != nil {
 		t.Fatalf("Error creating test table: %v", err)
@@ -264,3 +299,172 @@ func TestMostUrgentToImprove(t *testing.T) {
 		t.Errorf("MostUrgentToImprove with empty table did not return %d", NoNodeID)
 	}
 }
+
+func TestLeafStatistics(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE nodes (
+			id INTEGER PRIMARY KEY,
+			loss FLOAT,
+			data_quantity INTEGER,
+			has_children bool,
+			being_analysed bool,
+			terminal bool default false
+		);
+		INSERT INTO nodes (id, loss, data_quantity, has_children, being_analysed, terminal) VALUES
+			(1, 1.5, 300, true, false, false),
+			(2, 0.5, 200, false, true, false),
+			(3, 0.25, 100, false, false, false),
+			(4, 0.125, 400, false, false, true);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating test table: %v", err)
+	}
+
+	splittable, totalLoss, err := LeafStatistics(db, "nodes", 150)
+	if err != nil {
+		t.Fatalf("LeafStatistics returned unexpected error: %v", err)
+	}
+	if splittable != 1 {
+		t.Errorf("LeafStatistics returned %d splittable leaves, want 1", splittable)
+	}
+	if totalLoss != 0.875 {
+		t.Errorf("LeafStatistics returned total loss %v, want 0.875", totalLoss)
+	}
+}
+
+func TestStreamingAgreesWithLoading(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE training_data (id integer primary key, context1 text, targetword text);
+		CREATE TABLE node_bucket (id integer, node_id integer);
+		INSERT INTO training_data VALUES
+			(1, '1.2', '5.1'), (2, '1.2.3', '5.2'), (3, '1.23', '5.3'),
+			(4, '1.23.4', '5.4'), (5, '2.1.2', '5.5'), (6, '1.2.9', '5.6');
+		INSERT INTO node_bucket VALUES (1, 7), (2, 7), (3, 7), (4, 7), (5, 7), (6, 8);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+
+	source, err := LoadContextNWithinNode(db, "training_data", "node_bucket", 7, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := LoadRows(db, "training_data", "node_bucket", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	err = StreamContextNWithinNode(db, "training_data", "node_bucket", 7, 1, 1, func(rowID int, context, targetWord Synsetpath) error {
+		if rowID != source[i].RowID || !context.Equal(source[i].TargetWord) || !targetWord.Equal(target[i].TargetWord) {
+			t.Errorf("Streamed row %d (%s, %s), loaded row %d (%s, %s)", rowID, context, targetWord, source[i].RowID, source[i].TargetWord, target[i].TargetWord)
+		}
+		i++
+		return nil
+	})
+	if err != nil || i != len(source) {
+		t.Fatalf("Streamed %d rows (%v), loaded %d", i, err, len(source))
+	}
+
+	region, _ := ParseSynsetpath("1.2")
+	inside, outside := SplitByFilter(source, target, region)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	in, out, err := UpdateNodeIDsByRegion(tx, "training_data", "node_bucket", 7, 1, region, 10, 11)
+	if err != nil {
+		t.Fatalf("UpdateNodeIDsByRegion: %v", err)
+	}
+	if in != len(inside) || out != len(outside) {
+		t.Errorf("UpdateNodeIDsByRegion moved %d in and %d out; SplitByFilter says %d and %d", in, out, len(inside), len(outside))
+	}
+	for _, r := range inside {
+		var nodeID int
+		tx.QueryRow("SELECT node_id FROM node_bucket WHERE id = ?", r.RowID).Scan(&nodeID)
+		if nodeID != 10 {
+			t.Errorf("Row %d went to node %d, want 10", r.RowID, nodeID)
+		}
+	}
+	// Rows of other nodes stay where they are
+	var nodeID int
+	tx.QueryRow("SELECT node_id FROM node_bucket WHERE id = 6").Scan(&nodeID)
+	if nodeID != 8 {
+		t.Errorf("Row 6 was moved from node 8 to %d", nodeID)
+	}
+}
+
+func TestFindBestExemplarInSample(t *testing.T) {
+	a, _ := ParseSynsetpath("1.2")
+	b, _ := ParseSynsetpath("3.4")
+	var rows []DataFrameRow
+	for i := 0; i < 100; i++ {
+		path := a
+		if i%4 == 0 {
+			path = b
+		}
+		rows = append(rows, DataFrameRow{RowID: i, TargetWord: path})
+	}
+	_, whole, err := FindBestExemplar(rows, 1000, 1000, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	best, sampled, err := FindBestExemplarInSample(rows, 1000, 1000, 1000, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !best.Equal(a) {
+		t.Errorf("Best exemplar is %s, want %s", best, a)
+	}
+	// The same sample standing for ten times as many rows
+	if math.Abs(sampled-10*whole) > 1e-9 {
+		t.Errorf("Loss for a population of 1000 is %f, want 10 times %f", sampled, whole)
+	}
+}
+
+func TestExactBestExemplar(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var rows []DataFrameRow
+	for i := 0; i < 300; i++ {
+		// Paths of different depths that share prefixes, including
+		// some that are prefixes of others
+		path := Synsetpath{Path: []int{1 + rng.Intn(2)}}
+		for depth := rng.Intn(4); depth > 0; depth-- {
+			path.Path = append(path.Path, rng.Intn(3))
+		}
+		rows = append(rows, DataFrameRow{RowID: i, TargetWord: path})
+	}
+
+	best, loss, err := ExactBestExemplar(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compare with trying every target word against every row
+	bruteBest := math.Inf(1)
+	for _, candidate := range rows {
+		bruteBest = math.Min(bruteBest, ExactLoss(rows, candidate.TargetWord))
+	}
+	if math.Abs(loss-bruteBest) > 1e-9 {
+		t.Errorf("ExactBestExemplar found loss %f, but the best is %f", loss, bruteBest)
+	}
+	if math.Abs(ExactLoss(rows, best)-loss) > 1e-9 {
+		t.Errorf("ExactBestExemplar says %s has loss %f, but ExactLoss says %f", best, loss, ExactLoss(rows, best))
+	}
+
+	if _, _, err := ExactBestExemplar(nil); err == nil {
+		t.Errorf("ExactBestExemplar of no rows should be an error")
+	}
+}
@@ -0,0 +1,403 @@
+package exemplar
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Leaf is one of the leaves that train could split next
+type Leaf struct {
+	ID           NodeID
+	Loss         float64
+	DataQuantity int
+	// How many splits there are between it and the root
+	Depth int
+}
+
+// A LeafSelector decides which leaf train splits next. Different
+// selectors grow differently shaped trees.
+type LeafSelector interface {
+	// Choose picks one of leaves, or returns NoNodeID if none of them
+	// should be split. leaves are the leaves that nobody else is
+	// working on, in no particular order. It may be called from
+	// several goroutines at once, each with its own rng.
+	Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error)
+	// String says what the selector does, for the training_runs table
+	String() string
+}
+
+// orderedSelector is a LeafSelector that the database can apply by
+// itself, so that the leaf can be chosen and claimed in one statement
+// without loading every leaf. condition and order are SQL over the
+// columns of the nodes table; order has to put the leaf that Choose
+// would pick first.
+type orderedSelector interface {
+	LeafSelector
+	sql() (condition string, order string, args []interface{})
+}
+
+// Strategies are the names of the selectors that NewLeafSelector
+// knows, for --strategy. The first is the default.
+var Strategies = []string{"loss", "breadth-first", "mean-loss", "improvement", "limited", "random"}
+
+// SelectorOptions are what some of the selectors need
+type SelectorOptions struct {
+	// For "limited": leaves at this depth or deeper aren't split (0
+	// for no limit), and nor are leaves with fewer rows than
+	// MinLeafSize
+	MaxDepth    int
+	MinLeafSize int
+	// For "improvement": how many of the leaves with the largest loss
+	// to pre-scan, and how to do it
+	Shortlist int
+	Scan      func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error)
+}
+
+// NewLeafSelector returns the selector called name (one of Strategies)
+func NewLeafSelector(name string, options SelectorOptions) (LeafSelector, error) {
+	switch name {
+	case "", "loss":
+		return LargestLoss{}, nil
+	case "breadth-first":
+		return ShallowestFirst{}, nil
+	case "mean-loss":
+		return LargestMeanLoss{}, nil
+	case "improvement":
+		if options.Scan == nil {
+			return nil, fmt.Errorf("the improvement strategy needs a way of scanning leaves")
+		}
+		return NewExpectedImprovement(options.Shortlist, options.Scan), nil
+	case "limited":
+		if options.MaxDepth <= 0 && options.MinLeafSize <= 0 {
+			return nil, fmt.Errorf("the limited strategy needs a maximum depth or a minimum leaf size")
+		}
+		return DepthLimited{MaxDepth: options.MaxDepth, MinLeafSize: options.MinLeafSize}, nil
+	case "random":
+		return WeightedRandom{}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q (try one of %v)", name, Strategies)
+}
+
+// best returns the ID of the leaf that less puts first, or NoNodeID
+// if there aren't any
+func best(leaves []Leaf, less func(a, b Leaf) bool) NodeID {
+	if len(leaves) == 0 {
+		return NoNodeID
+	}
+	chosen := leaves[0]
+	for _, l := range leaves[1:] {
+		if less(l, chosen) {
+			chosen = l
+		}
+	}
+	return chosen.ID
+}
+
+// LargestLoss splits the leaf with the largest total loss (see also
+// MostUrgentToImprove). Big leaves tend to win, because loss grows
+// with the number of rows.
+type LargestLoss struct{}
+
+func (LargestLoss) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	return best(leaves, func(a, b Leaf) bool { return a.Loss > b.Loss }), nil
+}
+
+func (LargestLoss) String() string { return "loss" }
+
+func (LargestLoss) sql() (string, string, []interface{}) {
+	return "true", "loss DESC", nil
+}
+
+// ShallowestFirst splits every leaf at one depth before any leaf at
+// the next (the one with the largest loss first), so the tree grows
+// breadth-first.
+type ShallowestFirst struct{}
+
+func (ShallowestFirst) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	return best(leaves, func(a, b Leaf) bool {
+		if a.Depth != b.Depth {
+			return a.Depth < b.Depth
+		}
+		return a.Loss > b.Loss
+	}), nil
+}
+
+func (ShallowestFirst) String() string { return "breadth-first" }
+
+func (ShallowestFirst) sql() (string, string, []interface{}) {
+	return "true", "coalesce(depth, 0) ASC, loss DESC", nil
+}
+
+// LargestMeanLoss splits the leaf whose rows are worst predicted on
+// average, however few of them there are
+type LargestMeanLoss struct{}
+
+func (LargestMeanLoss) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	var withRows []Leaf
+	for _, l := range leaves {
+		if l.DataQuantity > 0 {
+			withRows = append(withRows, l)
+		}
+	}
+	return best(withRows, func(a, b Leaf) bool {
+		return a.Loss/float64(a.DataQuantity) > b.Loss/float64(b.DataQuantity)
+	}), nil
+}
+
+func (LargestMeanLoss) String() string { return "mean-loss" }
+
+func (LargestMeanLoss) sql() (string, string, []interface{}) {
+	return "data_quantity > 0", "loss / data_quantity DESC", nil
+}
+
+// DepthLimited is LargestLoss, except that it never splits a leaf that
+// is MaxDepth deep (if MaxDepth isn't 0) or has fewer than MinLeafSize
+// rows. Training stops when every leaf is at one of the limits.
+type DepthLimited struct {
+	MaxDepth    int
+	MinLeafSize int
+}
+
+func (d DepthLimited) allows(l Leaf) bool {
+	return (d.MaxDepth <= 0 || l.Depth < d.MaxDepth) && l.DataQuantity >= d.MinLeafSize
+}
+
+func (d DepthLimited) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	var allowed []Leaf
+	for _, l := range leaves {
+		if d.allows(l) {
+			allowed = append(allowed, l)
+		}
+	}
+	return LargestLoss{}.Choose(ctx, allowed, rng)
+}
+
+func (d DepthLimited) String() string {
+	return fmt.Sprintf("limited (max-depth %d, min-leaf-size %d)", d.MaxDepth, d.MinLeafSize)
+}
+
+func (d DepthLimited) sql() (string, string, []interface{}) {
+	condition := "data_quantity >= ?"
+	args := []interface{}{d.MinLeafSize}
+	if d.MaxDepth > 0 {
+		condition += " AND coalesce(depth, 0) < ?"
+		args = append(args, d.MaxDepth)
+	}
+	return condition, "loss DESC", args
+}
+
+// WeightedRandom picks a leaf at random, with the chance of each leaf
+// proportional to its loss. Leaves with no loss are never picked.
+type WeightedRandom struct{}
+
+func (WeightedRandom) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	total := 0.0
+	for _, l := range leaves {
+		if l.Loss > 0 {
+			total += l.Loss
+		}
+	}
+	if total <= 0 {
+		return NoNodeID, nil
+	}
+	// The leaves come in no particular order, so put them into one
+	// for a seeded run to be repeatable
+	sorted := append([]Leaf(nil), leaves...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	point := rng.Float64() * total
+	for _, l := range sorted {
+		if l.Loss <= 0 {
+			continue
+		}
+		point -= l.Loss
+		if point < 0 {
+			return l.ID, nil
+		}
+	}
+	// Rounding
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if sorted[i].Loss > 0 {
+			return sorted[i].ID, nil
+		}
+	}
+	return NoNodeID, nil
+}
+
+func (WeightedRandom) String() string { return "random" }
+
+// ExpectedImprovement pre-scans the Shortlist leaves with the largest
+// loss, using Scan (which should be a quick, rough search for a split
+// that returns how much it would reduce the loss), and splits the one
+// that is expected to improve the most. If none of them is expected to
+// improve at all, it falls back to LargestLoss. A leaf is only scanned
+// once, unless its loss or size changes. Calls to Choose take turns, so
+// that two of them don't scan the same leaf.
+type ExpectedImprovement struct {
+	Shortlist int
+	Scan      func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error)
+	// mu guards scanned
+	mu      sync.Mutex
+	scanned map[NodeID]scannedLeaf
+}
+
+type scannedLeaf struct {
+	leaf        Leaf
+	improvement float64
+}
+
+func NewExpectedImprovement(shortlist int, scan func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error)) *ExpectedImprovement {
+	if shortlist < 1 {
+		shortlist = 1
+	}
+	return &ExpectedImprovement{Shortlist: shortlist, Scan: scan, scanned: map[NodeID]scannedLeaf{}}
+}
+
+func (e *ExpectedImprovement) Choose(ctx context.Context, leaves []Leaf, rng *rand.Rand) (NodeID, error) {
+	shortlist := append([]Leaf(nil), leaves...)
+	sort.Slice(shortlist, func(i, j int) bool {
+		if shortlist[i].Loss != shortlist[j].Loss {
+			return shortlist[i].Loss > shortlist[j].Loss
+		}
+		return shortlist[i].ID < shortlist[j].ID
+	})
+	if len(shortlist) > e.Shortlist {
+		shortlist = shortlist[:e.Shortlist]
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Forget the leaves that have been split (or have fallen off the
+	// shortlist)
+	current := make(map[NodeID]bool, len(shortlist))
+	for _, l := range shortlist {
+		current[l.ID] = true
+	}
+	for id := range e.scanned {
+		if !current[id] {
+			delete(e.scanned, id)
+		}
+	}
+
+	// Only a positive improvement counts
+	chosen := NoNodeID
+	bestImprovement := 0.0
+	for _, l := range shortlist {
+		s, ok := e.scanned[l.ID]
+		if !ok || s.leaf != l {
+			improvement, err := e.Scan(ctx, l, rng)
+			if err != nil {
+				return NoNodeID, fmt.Errorf("could not pre-scan node %d: %w", l.ID, err)
+			}
+			s = scannedLeaf{leaf: l, improvement: improvement}
+			e.scanned[l.ID] = s
+		}
+		if s.improvement > bestImprovement {
+			chosen = l.ID
+			bestImprovement = s.improvement
+		}
+	}
+	if chosen == NoNodeID {
+		// The scans are rough, so the leaves are still worth trying
+		return LargestLoss{}.Choose(ctx, shortlist, rng)
+	}
+	return chosen, nil
+}
+
+func (e *ExpectedImprovement) String() string {
+	return fmt.Sprintf("improvement (shortlist %d)", e.Shortlist)
+}
+
+// ClaimableLeaves are the leaves with at least minSizeToConsider rows
+// that nobody has a claim on that is fresher than staleAfter
+func ClaimableLeaves(db *sql.DB, nodesTable string, minSizeToConsider int, staleAfter time.Duration) ([]Leaf, error) {
+	query := fmt.Sprintf(`
+		SELECT id, coalesce(loss, 0), coalesce(data_quantity, 0), coalesce(depth, 0)
+		FROM %s
+		WHERE not has_children AND not terminal AND (not being_analysed OR %s)
+		AND data_quantity >= ?
+	`, nodesTable, staleSQL)
+	rows, err := db.Query(query, staleArg(staleAfter), minSizeToConsider)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the leaves of %s: %v", nodesTable, err)
+	}
+	defer rows.Close()
+	var leaves []Leaf
+	for rows.Next() {
+		var l Leaf
+		if err := rows.Scan(&l.ID, &l.Loss, &l.DataQuantity, &l.Depth); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, l)
+	}
+	return leaves, rows.Err()
+}
+
+// ClaimLeaf claims the leaf that selector chooses, the way
+// ClaimMostUrgent does. It returns NoNodeID if there is nothing to
+// claim. The nodes table needs a depth column (see node.EnsureDepth).
+// ctx and rng are passed on to the selector.
+func ClaimLeaf(ctx context.Context, db *sql.DB, nodesTable string, selector LeafSelector, minSizeToConsider int, claimant string, staleAfter time.Duration, rng *rand.Rand) (NodeID, float64, error) {
+	if ordered, ok := selector.(orderedSelector); ok {
+		return claimOrdered(db, nodesTable, ordered, minSizeToConsider, claimant, staleAfter)
+	}
+	for {
+		leaves, err := ClaimableLeaves(db, nodesTable, minSizeToConsider, staleAfter)
+		if err != nil {
+			return 0, 0, err
+		}
+		chosen, err := selector.Choose(ctx, leaves, rng)
+		if err != nil || chosen == NoNodeID {
+			return chosen, 0, err
+		}
+		err = ClaimNode(db, nodesTable, chosen, claimant, staleAfter)
+		if err == ErrClaimLost {
+			// Someone else got there first; choose again
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, l := range leaves {
+			if l.ID == chosen {
+				return chosen, l.Loss, nil
+			}
+		}
+		return 0, 0, fmt.Errorf("chose node %d, which wasn't one of the leaves", chosen)
+	}
+}
+
+func claimOrdered(db *sql.DB, nodesTable string, selector orderedSelector, minSizeToConsider int, claimant string, staleAfter time.Duration) (NodeID, float64, error) {
+	condition, order, conditionArgs := selector.sql()
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET being_analysed = true, claimed_by = ?, claimed_at = current_timestamp
+		WHERE id = (
+			SELECT id
+			FROM %s
+			WHERE not has_children AND not terminal AND (not being_analysed OR %s)
+			AND data_quantity >= ? AND %s
+			ORDER BY %s
+			LIMIT 1
+		)
+		RETURNING id, loss
+	`, nodesTable, nodesTable, staleSQL, condition, order)
+
+	args := []interface{}{claimant, staleArg(staleAfter), minSizeToConsider}
+	args = append(args, conditionArgs...)
+	var id int
+	var loss float64
+	err := db.QueryRow(query, args...).Scan(&id, &loss)
+	if err == sql.ErrNoRows {
+		return NoNodeID, 0.0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error claiming the next node to split (%s): %v", selector, err)
+	}
+	return NodeID(id), loss, nil
+}
@@ -0,0 +1,179 @@
+package exemplar
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sampleLeaves() []Leaf {
+	return []Leaf{
+		{ID: 2, Loss: 10, DataQuantity: 100, Depth: 1},
+		{ID: 4, Loss: 30, DataQuantity: 300, Depth: 2},
+		{ID: 5, Loss: 8, DataQuantity: 10, Depth: 2},
+		{ID: 6, Loss: 20, DataQuantity: 400, Depth: 3},
+	}
+}
+
+func TestSelectorsAgreeWithTheDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE nodes (
+			id integer primary key,
+			loss float,
+			data_quantity integer,
+			depth integer,
+			has_children bool default false,
+			being_analysed bool default false,
+			terminal bool default false,
+			claimed_by text,
+			claimed_at datetime
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selector LeafSelector
+		want     NodeID
+	}{
+		{LargestLoss{}, 4},
+		{ShallowestFirst{}, 2},
+		{LargestMeanLoss{}, 5},
+		{DepthLimited{MaxDepth: 2}, 2},
+		{DepthLimited{MinLeafSize: 350}, 6},
+		{DepthLimited{MaxDepth: 1}, NoNodeID},
+	}
+	for _, tc := range tests {
+		chosen, err := tc.selector.Choose(context.Background(), sampleLeaves(), nil)
+		if err != nil || chosen != tc.want {
+			t.Errorf("%s chose %d, %v; want %d", tc.selector, chosen, err, tc.want)
+		}
+
+		// Claiming in the database has to pick the same leaf
+		if _, err := db.Exec("DELETE FROM nodes"); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range sampleLeaves() {
+			_, err := db.Exec("INSERT INTO nodes (id, loss, data_quantity, depth) VALUES (?, ?, ?, ?)", l.ID, l.Loss, l.DataQuantity, l.Depth)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		claimed, _, err := ClaimLeaf(context.Background(), db, "nodes", tc.selector, 1, "test", time.Hour, nil)
+		if err != nil || claimed != tc.want {
+			t.Errorf("ClaimLeaf with %s claimed %d, %v; want %d", tc.selector, claimed, err, tc.want)
+		}
+	}
+
+	// Selectors that choose in Go claim what they choose
+	improvement := NewExpectedImprovement(2, func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error) {
+		// Node 2 would improve the most, but it isn't on the shortlist
+		return map[NodeID]float64{2: 10, 4: 2, 6: 1}[l.ID], nil
+	})
+	claimed, loss, err := ClaimLeaf(context.Background(), db, "nodes", improvement, 1, "test", time.Hour, rand.New(rand.NewSource(1)))
+	if err != nil || claimed != 4 || loss != 30 {
+		t.Errorf("ClaimLeaf with %s = %d, %f, %v; want 4, 30", improvement, claimed, loss, err)
+	}
+	if leaves, _ := ClaimableLeaves(db, "nodes", 1, time.Hour); len(leaves) != 3 {
+		t.Errorf("%d leaves are claimable after a claim, want 3", len(leaves))
+	}
+}
+
+func TestExpectedImprovementScansOnce(t *testing.T) {
+	scans := map[NodeID]int{}
+	e := NewExpectedImprovement(3, func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error) {
+		scans[l.ID]++
+		return 1 / float64(l.DataQuantity), nil
+	})
+	leaves := sampleLeaves()
+	for i := 0; i < 3; i++ {
+		chosen, err := e.Choose(context.Background(), leaves, nil)
+		if err != nil || chosen != 2 {
+			t.Fatalf("Chose %d, %v; want 2", chosen, err)
+		}
+	}
+	if scans[2] != 1 || scans[4] != 1 || scans[6] != 1 || scans[5] != 0 {
+		t.Errorf("Scans = %v, want each of the top 3 once", scans)
+	}
+	// A leaf that has changed is scanned again
+	leaves[0].Loss = 25
+	e.Choose(context.Background(), leaves, nil)
+	if scans[2] != 2 {
+		t.Errorf("Node 2 was scanned %d times after it changed, want 2", scans[2])
+	}
+}
+
+func TestExpectedImprovementConcurrentChoose(t *testing.T) {
+	var mu sync.Mutex
+	scans := map[NodeID]int{}
+	e := NewExpectedImprovement(3, func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error) {
+		rng.Float64()
+		mu.Lock()
+		scans[l.ID]++
+		mu.Unlock()
+		return 1 / float64(l.DataQuantity), nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			chosen, err := e.Choose(context.Background(), sampleLeaves(), rand.New(rand.NewSource(seed)))
+			if err != nil || chosen != 2 {
+				t.Errorf("Chose %d, %v; want 2", chosen, err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	if scans[2] != 1 || scans[4] != 1 || scans[6] != 1 {
+		t.Errorf("Scans = %v, want each of the top 3 once", scans)
+	}
+}
+
+func TestExpectedImprovementFallsBackToLoss(t *testing.T) {
+	// Nothing on the shortlist is expected to improve
+	e := NewExpectedImprovement(3, func(ctx context.Context, l Leaf, rng *rand.Rand) (float64, error) {
+		return map[NodeID]float64{2: -1, 4: -5, 6: 0}[l.ID], nil
+	})
+	chosen, err := e.Choose(context.Background(), sampleLeaves(), nil)
+	want, _ := LargestLoss{}.Choose(context.Background(), sampleLeaves(), nil)
+	if err != nil || chosen != want {
+		t.Errorf("Chose %d, %v; want %d, the leaf with the largest loss", chosen, err, want)
+	}
+}
+
+func TestWeightedRandomFollowsLoss(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	leaves := sampleLeaves()
+	leaves = append(leaves, Leaf{ID: 7, Loss: 0, DataQuantity: 5})
+	total := 0.0
+	for _, l := range leaves {
+		total += l.Loss
+	}
+	const trials = 20000
+	picked := map[NodeID]int{}
+	for i := 0; i < trials; i++ {
+		chosen, err := WeightedRandom{}.Choose(context.Background(), leaves, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[chosen]++
+	}
+	if picked[7] != 0 {
+		t.Errorf("A leaf with no loss was picked %d times", picked[7])
+	}
+	for _, l := range leaves[:4] {
+		expected := trials * l.Loss / total
+		if got := float64(picked[l.ID]); got < expected*0.9 || got > expected*1.1 {
+			t.Errorf("Node %d was picked %.0f times, expected about %.0f", l.ID, got, expected)
+		}
+	}
+}
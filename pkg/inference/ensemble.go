@@ -4,6 +4,7 @@ import (
     "fmt"
     "math"
     "github.com/solresol/ultrametric-trees/pkg/exemplar"
+    "github.com/solresol/ultrametric-trees/pkg/tree"
 )
 
 // EnsemblingModel represents a collection of ModelInference structures
@@ -21,29 +22,23 @@ func NewEnsemblingModel(models []*ModelInference) *EnsemblingModel {
 
 // InferFromEnsemble performs inference using all models in the ensemble and
 // selects the best prediction based on consensus
-func (em *EnsemblingModel) InferFromEnsemble(context []string, verbose bool) (*InferenceResult, error) {
+func (em *EnsemblingModel) InferFromEnsemble(context []tree.Synsetpath, verbose bool) (*InferenceResult, error) {
     if len(em.models) == 0 {
         return nil, fmt.Errorf("no models in ensemble")
     }
 
     // Get predictions from all models
     predictions := make([]InferenceResult, 0, len(em.models))
-    synsetPaths := make([]exemplar.Synsetpath, 0, len(em.models))
+    synsetPaths := make([]tree.Synsetpath, 0, len(em.models))
 
     for _, model := range em.models {
         prediction, err := model.InferSingle(context, verbose)
         if err != nil {
             return nil, fmt.Errorf("error getting prediction from model: %v", err)
         }
-        
-        // Parse the predicted path into a Synsetpath
-        synsetpath, err := exemplar.ParseSynsetpath(prediction.PredictedPath)
-        if err != nil {
-            return nil, fmt.Errorf("error parsing synsetpath: %v", err)
-        }
 
         predictions = append(predictions, *prediction)
-        synsetPaths = append(synsetPaths, synsetpath)
+        synsetPaths = append(synsetPaths, prediction.PredictedPath)
     }
 
     // Find the Synsetpath with lowest total cost against all others
@@ -4,55 +4,110 @@ package inference
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/modelfile"
 	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
 	"log"
-	"strings"
 	"time"
 )
 
 // InferenceResult represents the output of inference on a single context
 type InferenceResult struct {
-	FinalNodeID   int
-	PredictedPath string
+	FinalNodeID   tree.NodeID
+	PredictedPath tree.Synsetpath
 	Depth         int
 	InRegion      int
+	EndOfText     bool
+}
+
+// NodeSource is the part of a tree that inference needs. Both
+// node.Tree and modelfile.Model provide it.
+type NodeSource interface {
+	Node(id tree.NodeID) (*node.Node, bool)
+	Root() (*node.Node, bool)
+	Size() int
 }
 
 // ModelInference handles the inference process for a trained model
 type ModelInference struct {
-	db         *sql.DB
-	nodesTable string
-	nodes      []node.Node
-	nodesTableLookup map[int]*node.Node
+	dictionary    decode.Dictionary
+	tree          NodeSource
+	endOfTextPath tree.Synsetpath
+	closer        io.Closer
 }
 
 // NewModelInference creates a new inference engine from a trained model
 func NewModelInference(db *sql.DB, nodesTable string, timeFilter time.Time) (*ModelInference, error) {
-	nodes, err := node.FetchNodesAsOf(db, nodesTable, timeFilter)
+	return NewModelInferenceAt(db, nodesTable, node.AsOf(timeFilter))
+}
+
+// NewModelInferenceAt is NewModelInference for a model as it was at
+// a cutoff (which can be a split number rather than a time)
+func NewModelInferenceAt(db *sql.DB, nodesTable string, cutoff node.Cutoff) (*ModelInference, error) {
+	snapshot, err := node.FetchTreeAtCutoff(db, nodesTable, cutoff)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch nodes: %v", err)
 	}
+	return NewModelInferenceFrom(snapshot, decode.DatabaseDictionary{DB: db}), nil
+}
 
-	nodesTableLookup := make(map[int]*node.Node)
-	for i := range nodes {
-		nodesTableLookup[nodes[i].ID] = &nodes[i]
+// NewModelInferenceFrom creates an inference engine for a tree that
+// has already been loaded
+func NewModelInferenceFrom(nodes NodeSource, dictionary decode.Dictionary) *ModelInference {
+	// Older models might not know about <END-OF-TEXT>. That's OK, we
+	// just won't be able to say when a prediction is the end of a story.
+	endOfTextPath, err := dictionary.ReservedPath(decode.EndOfText)
+	if err != nil {
+		endOfTextPath = tree.Synsetpath{}
 	}
-
 	return &ModelInference{
-		db:         db,
-		nodesTable: nodesTable,
-		nodes:      nodes,
-		nodesTableLookup: nodesTableLookup,
-	}, nil
+		dictionary:    dictionary,
+		tree:          nodes,
+		endOfTextPath: endOfTextPath,
+	}
+}
+
+// OpenModelFile creates an inference engine from a file written by
+// cmd/export. It has to be closed afterwards.
+func OpenModelFile(path string) (*ModelInference, error) {
+	model, err := modelfile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	m := NewModelInferenceFrom(model, model)
+	m.closer = model
+	return m, nil
+}
+
+// Close releases the model file, if there is one
+func (m *ModelInference) Close() error {
+	if m.closer == nil {
+		return nil
+	}
+	return m.closer.Close()
+}
+
+// Dictionary is where the model's words come from
+func (m *ModelInference) Dictionary() decode.Dictionary {
+	return m.dictionary
+}
+
+// EndOfTextPath is the path that this model uses for <END-OF-TEXT>, or
+// the empty path if it doesn't have one.
+func (m *ModelInference) EndOfTextPath() tree.Synsetpath {
+	return m.endOfTextPath
 }
 
 func (m *ModelInference) Size() int {
-	return len(m.nodes)
+	return m.tree.Size()
 }
 
-// InferSingle performs inference on a single context
-func (m *ModelInference) InferSingle(context []string, verbose bool) (*InferenceResult, error) {
+// InferSingle performs inference on a single context. context[0] is
+// context1 (the word immediately before the one being predicted). An
+// empty path marks a context word that is missing.
+func (m *ModelInference) InferSingle(context []tree.Synsetpath, verbose bool) (*InferenceResult, error) {
 	currentNode := m.findRootNode()
 	if currentNode == nil {
 		return nil, fmt.Errorf("could not find root node")
@@ -80,56 +135,98 @@ func (m *ModelInference) InferSingle(context []string, verbose bool) (*Inference
 	// Return the prediction from the leaf node
 	return &InferenceResult{
 		FinalNodeID:   currentNode.ID,
-		PredictedPath: currentNode.ExemplarValue.String,
+		PredictedPath: currentNode.ExemplarValue,
 		Depth:         depth,
 		InRegion:      matches,
+		EndOfText:     !m.endOfTextPath.IsEmpty() && currentNode.ExemplarValue.Equal(m.endOfTextPath),
 		// Loss:    1.0 - currentNode.Loss.Float64,
 	}, nil
 }
 
+// Generate predicts up to maxWords words, one at a time, feeding each
+// prediction back in as context1 for the next one. If stopAtEndOfText
+// is set, it stops as soon as it predicts <END-OF-TEXT> (which is
+// included in the results).
+func (m *ModelInference) Generate(context []tree.Synsetpath, maxWords int, stopAtEndOfText bool, verbose bool) ([]InferenceResult, error) {
+	var results []InferenceResult
+	current := make([]tree.Synsetpath, len(context))
+	copy(current, context)
+	for i := 0; i < maxWords; i++ {
+		result, err := m.InferSingle(current, verbose)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *result)
+		if stopAtEndOfText && result.EndOfText {
+			break
+		}
+		if len(current) > 0 {
+			copy(current[1:], current[:len(current)-1])
+			current[0] = result.PredictedPath
+		}
+	}
+	return results, nil
+}
+
 func (m *ModelInference) findRootNode() *node.Node {
-	return m.nodesTableLookup[1] // Root node ID is 1
-	return nil
+	root, _ := m.tree.Root()
+	return root
 }
 
-func (m *ModelInference) traverseNode(current *node.Node, context []string, verbose bool) (*node.Node, bool, error) {
+func (m *ModelInference) traverseNode(current *node.Node, context []tree.Synsetpath, verbose bool) (*node.Node, bool, error) {
 	if !current.ContextK.Valid {
 		return nil, false, fmt.Errorf("invalid context index in node %d", current.ID)
 	}
 	contextIdx := int(current.ContextK.Int64 - 1) // Convert from 1-based to 0-based
-	if contextIdx >= len(context) {
-		return nil, false, fmt.Errorf("context index %d out of range", contextIdx)
+	if contextIdx < 0 {
+		return nil, false, fmt.Errorf("context index %d in node %d is not valid", contextIdx, current.ID)
+	}
+	// A context that is shorter than the node wants (e.g. near the
+	// beginning of a story), or which has a gap where a word couldn't
+	// be resolved, can't be inside any circle, so it goes to the outer
+	// region.
+	if contextIdx >= len(context) || context[contextIdx].IsEmpty() {
+		if verbose {
+			log.Printf("Node %d wanted context%d, but it is missing. Treating it as outside %s", current.ID, current.ContextK.Int64, current.InnerRegionPrefix)
+		}
+		n, err := m.findNodeByID(current.OuterRegionNodeID)
+		if err != nil {
+			return nil, false, fmt.Errorf("Could not find outer node %d: %v", current.OuterRegionNodeID, err)
+		}
+		return n, false, nil
 	}
 	// Check if the context matches the inner region
 	contextValue := context[contextIdx]
 
-	if strings.HasPrefix(current.InnerRegionPrefix.String, contextValue) {
+	// This must be the same test that exemplar.SplitByFilter used
+	// when training put the rows into the inner node.
+	if current.InnerRegionPrefix.Contains(contextValue) {
 		if verbose {
-			decodedValue, _ := decode.DecodePath(m.db, contextValue)
-			decodedRegion, _ := decode.DecodePath(m.db, current.InnerRegionPrefix.String)
-			decodedExemplar, _ := decode.DecodePath(m.db, current.ExemplarValue.String)
-			log.Printf("Node %d matched. It wanted context%d which is `%s' (%s) to be in %s (%s), which suggests predicting %s (%s)", current.ID, current.ContextK.Int64, decodedValue, contextValue, current.InnerRegionPrefix.String, decodedRegion, current.ExemplarValue.String, decodedExemplar)
-			//log.Printf("It is inside that, so we will go to %d", current.InnerRegionNodeID.Int64)
+			decodedValue, _ := m.dictionary.DecodePath(contextValue)
+			decodedRegion, _ := m.dictionary.DecodePath(current.InnerRegionPrefix)
+			decodedExemplar, _ := m.dictionary.DecodePath(current.ExemplarValue)
+			log.Printf("Node %d matched. It wanted context%d which is `%s' (%s) to be in %s (%s), which suggests predicting %s (%s)", current.ID, current.ContextK.Int64, decodedValue, contextValue, current.InnerRegionPrefix, decodedRegion, current.ExemplarValue, decodedExemplar)
+			//log.Printf("It is inside that, so we will go to %d", current.InnerRegionNodeID)
 		}
-		n, err := m.findNodeByID(int(current.InnerRegionNodeID.Int64))
+		n, err := m.findNodeByID(current.InnerRegionNodeID)
 		if err != nil {
-			return nil, false, fmt.Errorf("Could not find inner node %d: %v", current.InnerRegionNodeID.Int64, err)
+			return nil, false, fmt.Errorf("Could not find inner node %d: %v", current.InnerRegionNodeID, err)
 		}
 		return n, true, nil
 	}
 
 	// If not in inner region, go to outer region
-	//log.Printf("It is outside that, so we will go to %d", current.OuterRegionNodeID.Int64)
-	n, err := m.findNodeByID(int(current.OuterRegionNodeID.Int64))
+	//log.Printf("It is outside that, so we will go to %d", current.OuterRegionNodeID)
+	n, err := m.findNodeByID(current.OuterRegionNodeID)
 	if err != nil {
-		return nil, false, fmt.Errorf("Could not find outer node %d: %v", current.InnerRegionNodeID.Int64, err)
+		return nil, false, fmt.Errorf("Could not find outer node %d: %v", current.OuterRegionNodeID, err)
 	}
 	return n, false, nil
 }
 
-func (m *ModelInference) findNodeByID(id int) (*node.Node, error) {
-	if node, exists := m.nodesTableLookup[id]; exists {
-		return node, nil
+func (m *ModelInference) findNodeByID(id tree.NodeID) (*node.Node, error) {
+	if n, exists := m.tree.Node(id); exists {
+		return n, nil
 	}
 	return nil, fmt.Errorf("node %d not found", id)
 }
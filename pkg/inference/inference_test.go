@@ -0,0 +1,151 @@
+package inference
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// mapDictionary is a decode.Dictionary that doesn't need a database
+type mapDictionary map[string]tree.Synsetpath
+
+func (d mapDictionary) DecodePath(path tree.Synsetpath) (string, error) {
+	for word, p := range d {
+		if p.Equal(path) {
+			return word, nil
+		}
+	}
+	return "", fmt.Errorf("no word found for path: %s", path)
+}
+
+func (d mapDictionary) EncodeWord(word string) (tree.Synsetpath, error) {
+	if p, ok := d[word]; ok {
+		return p, nil
+	}
+	return tree.Synsetpath{}, fmt.Errorf("no path found for word: %s", word)
+}
+
+func (d mapDictionary) ReservedPath(word string) (tree.Synsetpath, error) {
+	return d.EncodeWord(word)
+}
+
+func mustParse(t *testing.T, s string) tree.Synsetpath {
+	t.Helper()
+	sp, err := tree.ParseSynsetpath(s)
+	if err != nil {
+		t.Fatalf("ParseSynsetpath(%q) returned unexpected error: %v", s, err)
+	}
+	return sp
+}
+
+// sampleModel predicts cat after anything except cat or dog, dog after
+// cat and <END-OF-TEXT> after dog:
+//
+//	1: is context1 in 1.4.2 (cat)?  yes -> 2 (dog), no -> 3
+//	3: is context1 in 1.4.3 (dog)?  yes -> 4 (<END-OF-TEXT>), no -> 5 (cat)
+func sampleModel(t *testing.T) (*ModelInference, mapDictionary) {
+	t.Helper()
+	dictionary := mapDictionary{
+		"cat":              mustParse(t, "1.4.2"),
+		"dog":              mustParse(t, "1.4.3"),
+		decode.StartOfText: mustParse(t, "7.1.1"),
+		decode.EndOfText:   mustParse(t, "7.1.2"),
+	}
+	contextOne := sql.NullInt64{Int64: 1, Valid: true}
+	nodes := []node.Node{
+		{ID: 1, ExemplarValue: dictionary["cat"], ContextK: contextOne, InnerRegionPrefix: dictionary["cat"],
+			InnerRegionNodeID: 2, OuterRegionNodeID: 3, HasChildren: true},
+		{ID: 2, ExemplarValue: dictionary["dog"], InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+		{ID: 3, ExemplarValue: dictionary["cat"], ContextK: contextOne, InnerRegionPrefix: dictionary["dog"],
+			InnerRegionNodeID: 4, OuterRegionNodeID: 5, HasChildren: true},
+		{ID: 4, ExemplarValue: dictionary[decode.EndOfText], InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+		{ID: 5, ExemplarValue: dictionary["cat"], InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+	}
+	return NewModelInferenceFrom(node.NewTree(nodes), dictionary), dictionary
+}
+
+func words(t *testing.T, dictionary mapDictionary, results []InferenceResult) []string {
+	t.Helper()
+	var result []string
+	for _, r := range results {
+		word, err := dictionary.DecodePath(r.PredictedPath)
+		if err != nil {
+			t.Fatalf("Could not decode %s: %v", r.PredictedPath, err)
+		}
+		result = append(result, word)
+	}
+	return result
+}
+
+func sameWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGenerateStopsAtEndOfText(t *testing.T) {
+	model, dictionary := sampleModel(t)
+	context := []tree.Synsetpath{dictionary[decode.StartOfText], {}}
+
+	results, err := model.Generate(context, 10, true, false)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := []string{"cat", "dog", decode.EndOfText}
+	if got := words(t, dictionary, results); !sameWords(got, want) {
+		t.Fatalf("Generate = %v, want %v", got, want)
+	}
+	for i, r := range results {
+		if r.EndOfText != (i == len(results)-1) {
+			t.Errorf("Result %d has EndOfText = %v", i, r.EndOfText)
+		}
+	}
+	if results[1].FinalNodeID != 2 || results[1].Depth != 1 || results[1].InRegion != 1 {
+		t.Errorf("dog came from node %d at depth %d (%d inside), want node 2 at depth 1 (1 inside)",
+			results[1].FinalNodeID, results[1].Depth, results[1].InRegion)
+	}
+
+	// The caller's context isn't changed
+	if !context[0].Equal(dictionary[decode.StartOfText]) || !context[1].IsEmpty() {
+		t.Errorf("Generate modified its context argument: %v", context)
+	}
+}
+
+func TestGenerateKeepsGoing(t *testing.T) {
+	model, dictionary := sampleModel(t)
+
+	results, err := model.Generate([]tree.Synsetpath{dictionary["dog"]}, 4, false, false)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := []string{decode.EndOfText, "cat", "dog", decode.EndOfText}
+	if got := words(t, dictionary, results); !sameWords(got, want) {
+		t.Errorf("Generate = %v, want %v", got, want)
+	}
+}
+
+func TestInferSingleWithMissingContext(t *testing.T) {
+	model, dictionary := sampleModel(t)
+
+	// No context at all, and a gap where context1 should be, both go
+	// to the outer regions
+	for _, context := range [][]tree.Synsetpath{nil, {{}}} {
+		result, err := model.InferSingle(context, false)
+		if err != nil {
+			t.Fatalf("InferSingle(%v): %v", context, err)
+		}
+		if result.FinalNodeID != 5 || !result.PredictedPath.Equal(dictionary["cat"]) || result.InRegion != 0 {
+			t.Errorf("InferSingle(%v) = %+v, want node 5 (cat) with nothing inside", context, *result)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package modelfile reads and writes exported models: a frozen tree
+// plus the decodings it needs, in one file that doesn't depend on the
+// training database.
+//
+// All integers are little-endian. The file starts with a header:
+//
+//	magic        [8]byte  "ULTRTREE"
+//	version      uint32
+//	sections     uint32   (number of entries in the section table)
+//	checksum     uint32   (CRC-32 of everything after the section table)
+//	reserved     uint32
+//	section table: one (offset uint64, length uint64) per section
+//
+// and then the sections, each starting on an 8-byte boundary:
+//
+//	metadata     JSON (see Metadata)
+//	path index   (start uint32, length uint32) per path, into the
+//	             path components; paths are sorted so they can be
+//	             binary searched
+//	components   int64 per path component
+//	nodes        nodeRecordSize bytes per node, sorted by id
+//	decodings    decodingRecordSize bytes per (path, word), sorted by
+//	             path and then by usage count (most used first)
+//	word index   uint32 per decoding, sorted by word and then by usage
+//	             count, for going from words to paths
+//	strings      the words, back to back
+//	reserved     reservedRecordSize bytes per reserved word
+//	             (<START-OF-TEXT> etc.)
+//
+// Everything is fixed-size records that are looked up in place, so the
+// file can be memory-mapped and used without being parsed first.
+package modelfile
+
+import (
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/provenance"
+)
+
+const (
+	Magic   = "ULTRTREE"
+	Version = 1
+
+	headerSize   = 24
+	sectionEntry = 16
+
+	// noPath marks a missing exemplar or region prefix
+	noPath = 0xFFFFFFFF
+
+	pathIndexRecordSize = 8
+	componentSize       = 8
+	nodeRecordSize      = 56
+	decodingRecordSize  = 24
+	wordIndexRecordSize = 4
+	reservedRecordSize  = 12
+
+	// flags in a node record
+	hasLoss         = 1
+	hasDataQuantity = 2
+)
+
+const (
+	sectionMetadata = iota
+	sectionPathIndex
+	sectionComponents
+	sectionNodes
+	sectionDecodings
+	sectionWordIndex
+	sectionStrings
+	sectionReserved
+	sectionCount
+)
+
+// Metadata records where a model file came from
+type Metadata struct {
+	Source     string    `json:"source"`
+	NodesTable string    `json:"nodes_table"`
+	Cutoff     string    `json:"cutoff"`
+	Split      int       `json:"split"`
+	NodeCount  int       `json:"node_count"`
+	Exported   time.Time `json:"exported"`
+	// How the model was trained, if that was recorded
+	TrainingRuns []provenance.Run `json:"training_runs,omitempty"`
+}
+
+func tableOffset() int {
+	return headerSize
+}
+
+func bodyOffset() int {
+	return align(headerSize + sectionCount*sectionEntry)
+}
+
+func align(n int) int {
+	return (n + 7) &^ 7
+}
@@ -0,0 +1,151 @@
+package modelfile
+
+import (
+	"bytes"
+	"database/sql"
+	"hash/crc32"
+	"testing"
+
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+func path(s string) tree.Synsetpath {
+	p, err := tree.ParseSynsetpath(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func sampleModel(t *testing.T) []byte {
+	nodes := []node.Node{
+		{ID: 1, ExemplarValue: path("1.2"), ContextK: sql.NullInt64{Int64: 3, Valid: true},
+			InnerRegionPrefix: path("1.3.2176202712"), InnerRegionNodeID: 2, OuterRegionNodeID: 3, HasChildren: true,
+			Loss: sql.NullFloat64{Float64: 10.5, Valid: true}, DataQuantity: sql.NullInt64{Int64: 20, Valid: true}},
+		{ID: 2, ExemplarValue: path("1.3.2176202712"), InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID,
+			Loss: sql.NullFloat64{Float64: 1.25, Valid: true}, DataQuantity: sql.NullInt64{Int64: 5, Valid: true}},
+		{ID: 3, ExemplarValue: path("1.2"), InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+	}
+	decodings := []Decoding{
+		{Path: path("1.2"), Word: "cat", UsageCount: 3},
+		{Path: path("1.2"), Word: "kitten", UsageCount: 7},
+		{Path: path("1.3.2176202712"), Word: "Bob", UsageCount: 2},
+		{Path: path("5.1"), Word: "cat", UsageCount: 1},
+	}
+	reserved := map[string]tree.Synsetpath{"<END-OF-TEXT>": path("7.3")}
+	var buf bytes.Buffer
+	if err := Write(&buf, node.NewTree(nodes), decodings, reserved, Metadata{NodesTable: "nodes"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	m, err := Parse(sampleModel(t))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if m.Size() != 3 || m.Metadata().NodeCount != 3 {
+		t.Errorf("Size() = %d, NodeCount = %d, want 3", m.Size(), m.Metadata().NodeCount)
+	}
+	root, exists := m.Root()
+	if !exists {
+		t.Fatalf("no root")
+	}
+	if !root.HasChildren || root.InnerRegionNodeID != 2 || root.OuterRegionNodeID != 3 || root.ContextK.Int64 != 3 {
+		t.Errorf("root came back wrong: %+v", root)
+	}
+	if !root.InnerRegionPrefix.Equal(path("1.3.2176202712")) || root.Loss.Float64 != 10.5 || root.DataQuantity.Int64 != 20 {
+		t.Errorf("root came back wrong: %+v", root)
+	}
+	leaf, _ := m.Node(3)
+	if leaf.HasChildren || leaf.Loss.Valid || !leaf.InnerRegionPrefix.IsEmpty() {
+		t.Errorf("leaf came back wrong: %+v", leaf)
+	}
+	if _, exists := m.Node(4); exists {
+		t.Errorf("found a node that doesn't exist")
+	}
+
+	if word, err := m.DecodePath(path("1.2")); err != nil || word != "kitten" {
+		t.Errorf("DecodePath(1.2) = %q, %v, want the most used word", word, err)
+	}
+	if _, err := m.DecodePath(path("9")); err == nil {
+		t.Errorf("expected an error decoding an unknown path")
+	}
+	if p, err := m.EncodeWord("cat"); err != nil || !p.Equal(path("1.2")) {
+		t.Errorf("EncodeWord(cat) = %s, %v, want 1.2", p, err)
+	}
+	if p, err := m.ReservedPath("<END-OF-TEXT>"); err != nil || !p.Equal(path("7.3")) {
+		t.Errorf("ReservedPath = %s, %v", p, err)
+	}
+}
+
+func TestDamagedFile(t *testing.T) {
+	data := sampleModel(t)
+	data[len(data)-1] ^= 0xFF
+	if _, err := Parse(data); err == nil {
+		t.Errorf("expected a checksum error")
+	}
+	if _, err := Parse(data[:10]); err == nil {
+		t.Errorf("expected an error for a truncated file")
+	}
+}
+
+// sectionAt is where section starts in data
+func sectionAt(data []byte, section int) int {
+	return int(le.Uint64(data[tableOffset()+section*sectionEntry:]))
+}
+
+// resign fixes the checksum after data has been changed, so that
+// Parse gets past it to the records
+func resign(data []byte) {
+	le.PutUint32(data[16:], crc32.ChecksumIEEE(data[bodyOffset():]))
+}
+
+func TestCorruptRecords(t *testing.T) {
+	corruptions := []struct {
+		name    string
+		corrupt func(data []byte)
+	}{
+		{"section offset that overflows", func(data []byte) {
+			entry := tableOffset() + sectionNodes*sectionEntry
+			le.PutUint64(data[entry:], ^uint64(0)-7)
+			le.PutUint64(data[entry+8:], 16)
+		}},
+		{"section that runs off the end", func(data []byte) {
+			le.PutUint64(data[tableOffset()+sectionNodes*sectionEntry+8:], uint64(len(data)))
+		}},
+		{"partial node record", func(data []byte) {
+			entry := tableOffset() + sectionNodes*sectionEntry + 8
+			le.PutUint64(data[entry:], le.Uint64(data[entry:])-1)
+		}},
+		{"path past the components", func(data []byte) {
+			le.PutUint32(data[sectionAt(data, sectionPathIndex)+4:], 1<<30)
+			resign(data)
+		}},
+		{"node exemplar that isn't a path", func(data []byte) {
+			le.PutUint32(data[sectionAt(data, sectionNodes)+24:], 1000)
+			resign(data)
+		}},
+		{"word past the strings", func(data []byte) {
+			le.PutUint32(data[sectionAt(data, sectionDecodings)+4:], 0xFFFFFFF0)
+			resign(data)
+		}},
+		{"word index past the decodings", func(data []byte) {
+			le.PutUint32(data[sectionAt(data, sectionWordIndex):], 1000)
+			resign(data)
+		}},
+		{"reserved word past the strings", func(data []byte) {
+			le.PutUint32(data[sectionAt(data, sectionReserved)+4:], 1<<20)
+			resign(data)
+		}},
+	}
+	for _, c := range corruptions {
+		data := sampleModel(t)
+		c.corrupt(data)
+		if _, err := Parse(data); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package modelfile
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+var le = binary.LittleEndian
+
+// A Model is an opened model file. Lookups are done directly on the
+// file's bytes, which are memory-mapped where the platform allows it.
+type Model struct {
+	data     []byte
+	sections [sectionCount][]byte
+	meta     Metadata
+	release  func() error
+}
+
+// IsModelFile is true if the file at path starts with the model file
+// magic number (as opposed to being a SQLite database).
+func IsModelFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == Magic
+}
+
+// Open maps a model file into memory. Call Close when finished with it.
+func Open(path string) (*Model, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	m, err := Parse(data)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("%s is not a usable model file: %v", path, err)
+	}
+	m.release = release
+	return m, nil
+}
+
+// ReadMetadata is the metadata of the model file at path
+func ReadMetadata(path string) (Metadata, error) {
+	m, err := Open(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer m.Close()
+	return m.Metadata(), nil
+}
+
+// Parse checks the header, checksum and records of a model file that
+// is already in memory. The Model refers to data rather than copying it.
+func Parse(data []byte) (*Model, error) {
+	if len(data) < bodyOffset() || string(data[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("bad magic number")
+	}
+	if version := le.Uint32(data[8:]); version != Version {
+		return nil, fmt.Errorf("version %d files aren't supported (this program understands version %d)", version, Version)
+	}
+	if count := le.Uint32(data[12:]); count != sectionCount {
+		return nil, fmt.Errorf("expected %d sections, found %d", sectionCount, count)
+	}
+	if crc32.ChecksumIEEE(data[bodyOffset():]) != le.Uint32(data[16:]) {
+		return nil, fmt.Errorf("checksum mismatch (the file is damaged or truncated)")
+	}
+	m := &Model{data: data}
+	for i := range m.sections {
+		offset := le.Uint64(data[tableOffset()+i*sectionEntry:])
+		length := le.Uint64(data[tableOffset()+i*sectionEntry+8:])
+		if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+			return nil, fmt.Errorf("section %d runs past the end of the file", i)
+		}
+		m.sections[i] = data[offset : offset+length]
+	}
+	if err := json.Unmarshal(m.sections[sectionMetadata], &m.meta); err != nil {
+		return nil, fmt.Errorf("could not read metadata: %v", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validate checks that every record refers to something inside the
+// file, so that a file that was written wrongly (the checksum only
+// catches damage after it was written) can't make a lookup go out of
+// bounds.
+func (m *Model) validate() error {
+	recordSizes := []struct {
+		section int
+		size    int
+		name    string
+	}{
+		{sectionPathIndex, pathIndexRecordSize, "path index"},
+		{sectionComponents, componentSize, "path components"},
+		{sectionNodes, nodeRecordSize, "nodes"},
+		{sectionDecodings, decodingRecordSize, "decodings"},
+		{sectionWordIndex, wordIndexRecordSize, "word index"},
+		{sectionReserved, reservedRecordSize, "reserved words"},
+	}
+	for _, r := range recordSizes {
+		if len(m.sections[r.section])%r.size != 0 {
+			return fmt.Errorf("the %s section isn't a whole number of records", r.name)
+		}
+	}
+
+	components := uint64(len(m.sections[sectionComponents]) / componentSize)
+	for i := 0; i < m.pathCount(); i++ {
+		rec := m.sections[sectionPathIndex][i*pathIndexRecordSize:]
+		if uint64(le.Uint32(rec[0:]))+uint64(le.Uint32(rec[4:])) > components {
+			return fmt.Errorf("path %d runs past the end of the path components", i)
+		}
+	}
+	validPath := func(index uint32) bool {
+		return index == noPath || int64(index) < int64(m.pathCount())
+	}
+	validString := func(offset, length uint32) bool {
+		return uint64(offset)+uint64(length) <= uint64(len(m.sections[sectionStrings]))
+	}
+	for i := 0; i < m.Size(); i++ {
+		rec := m.sections[sectionNodes][i*nodeRecordSize:]
+		if !validPath(le.Uint32(rec[24:])) || !validPath(le.Uint32(rec[28:])) {
+			return fmt.Errorf("node record %d refers to a path that isn't in the file", i)
+		}
+	}
+	for i := 0; i < m.decodingCount(); i++ {
+		rec := m.sections[sectionDecodings][i*decodingRecordSize:]
+		if index := le.Uint32(rec[0:]); index == noPath || !validPath(index) {
+			return fmt.Errorf("decoding %d refers to a path that isn't in the file", i)
+		}
+		if !validString(le.Uint32(rec[4:]), le.Uint32(rec[8:])) {
+			return fmt.Errorf("the word for decoding %d runs past the end of the strings", i)
+		}
+	}
+	wordIndex := m.sections[sectionWordIndex]
+	for i := 0; i < len(wordIndex); i += wordIndexRecordSize {
+		if int64(le.Uint32(wordIndex[i:])) >= int64(m.decodingCount()) {
+			return fmt.Errorf("word index entry %d refers to a decoding that isn't in the file", i/wordIndexRecordSize)
+		}
+	}
+	reserved := m.sections[sectionReserved]
+	for i := 0; i < len(reserved); i += reservedRecordSize {
+		if !validString(le.Uint32(reserved[i:]), le.Uint32(reserved[i+4:])) || !validPath(le.Uint32(reserved[i+8:])) {
+			return fmt.Errorf("reserved word %d refers to something that isn't in the file", i/reservedRecordSize)
+		}
+	}
+	return nil
+}
+
+func (m *Model) Close() error {
+	if m.release == nil {
+		return nil
+	}
+	release := m.release
+	m.release = nil
+	m.data = nil
+	return release()
+}
+
+func (m *Model) Metadata() Metadata {
+	return m.meta
+}
+
+// Size is the number of nodes in the model
+func (m *Model) Size() int {
+	return len(m.sections[sectionNodes]) / nodeRecordSize
+}
+
+func (m *Model) pathCount() int {
+	return len(m.sections[sectionPathIndex]) / pathIndexRecordSize
+}
+
+func (m *Model) path(index uint32) tree.Synsetpath {
+	if index == noPath || int(index) >= m.pathCount() {
+		return tree.Synsetpath{}
+	}
+	rec := m.sections[sectionPathIndex][int(index)*pathIndexRecordSize:]
+	start := uint64(le.Uint32(rec[0:]))
+	length := uint64(le.Uint32(rec[4:]))
+	stored := m.sections[sectionComponents]
+	if start+length > uint64(len(stored)/componentSize) {
+		return tree.Synsetpath{}
+	}
+	components := make([]int, length)
+	for i := range components {
+		components[i] = int(int64(le.Uint64(stored[(int(start)+i)*componentSize:])))
+	}
+	return tree.Synsetpath{Path: components}
+}
+
+// findPath is the index of a path, or noPath if the model doesn't
+// have it.
+func (m *Model) findPath(path tree.Synsetpath) uint32 {
+	if path.IsEmpty() {
+		return noPath
+	}
+	n := m.pathCount()
+	i := sort.Search(n, func(i int) bool {
+		return comparePaths(m.path(uint32(i)).Path, path.Path) >= 0
+	})
+	if i < n && m.path(uint32(i)).Equal(path) {
+		return uint32(i)
+	}
+	return noPath
+}
+
+func (m *Model) str(offset, length uint32) string {
+	stored := m.sections[sectionStrings]
+	if uint64(offset)+uint64(length) > uint64(len(stored)) {
+		return ""
+	}
+	return string(stored[offset : offset+length])
+}
+
+func (m *Model) nodeAt(i int) *node.Node {
+	rec := m.sections[sectionNodes][i*nodeRecordSize:]
+	flags := le.Uint32(rec[36:])
+	n := &node.Node{
+		ID:                tree.NodeID(int64(le.Uint64(rec[0:]))),
+		InnerRegionNodeID: tree.NodeID(int64(le.Uint64(rec[8:]))),
+		OuterRegionNodeID: tree.NodeID(int64(le.Uint64(rec[16:]))),
+		ExemplarValue:     m.path(le.Uint32(rec[24:])),
+		InnerRegionPrefix: m.path(le.Uint32(rec[28:])),
+		Loss:              sql.NullFloat64{Float64: math.Float64frombits(le.Uint64(rec[40:])), Valid: flags&hasLoss != 0},
+		DataQuantity:      sql.NullInt64{Int64: int64(le.Uint64(rec[48:])), Valid: flags&hasDataQuantity != 0},
+		TableName:         m.meta.NodesTable,
+	}
+	if contextK := int32(le.Uint32(rec[32:])); contextK > 0 {
+		n.ContextK = sql.NullInt64{Int64: int64(contextK), Valid: true}
+	}
+	n.HasChildren = n.InnerRegionNodeID.Valid() && n.OuterRegionNodeID.Valid()
+	return n
+}
+
+// Node looks up a node by id. The result is built afresh each time, so
+// it's safe to modify.
+func (m *Model) Node(id tree.NodeID) (*node.Node, bool) {
+	n := m.Size()
+	i := sort.Search(n, func(i int) bool {
+		return tree.NodeID(int64(le.Uint64(m.sections[sectionNodes][i*nodeRecordSize:]))) >= id
+	})
+	if i >= n || tree.NodeID(int64(le.Uint64(m.sections[sectionNodes][i*nodeRecordSize:]))) != id {
+		return nil, false
+	}
+	return m.nodeAt(i), true
+}
+
+func (m *Model) Root() (*node.Node, bool) {
+	return m.Node(tree.RootNodeID)
+}
+
+// Tree copies all of the nodes into a node.Tree
+func (m *Model) Tree() *node.Tree {
+	nodes := make([]node.Node, m.Size())
+	for i := range nodes {
+		nodes[i] = *m.nodeAt(i)
+	}
+	return node.NewTree(nodes)
+}
+
+func (m *Model) decodingCount() int {
+	return len(m.sections[sectionDecodings]) / decodingRecordSize
+}
+
+func (m *Model) decodingAt(i int) (uint32, string) {
+	if i < 0 || i >= m.decodingCount() {
+		return noPath, ""
+	}
+	rec := m.sections[sectionDecodings][i*decodingRecordSize:]
+	return le.Uint32(rec[0:]), m.str(le.Uint32(rec[4:]), le.Uint32(rec[8:]))
+}
+
+// DecodePath finds the word that path was most often used for
+func (m *Model) DecodePath(path tree.Synsetpath) (string, error) {
+	index := m.findPath(path)
+	if index != noPath {
+		n := m.decodingCount()
+		i := sort.Search(n, func(i int) bool {
+			p, _ := m.decodingAt(i)
+			return p >= index
+		})
+		if i < n {
+			if p, word := m.decodingAt(i); p == index {
+				return word, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no word found for path: %s", path)
+}
+
+// EncodeWord finds the path that word was most often annotated with
+func (m *Model) EncodeWord(word string) (tree.Synsetpath, error) {
+	wordIndex := m.sections[sectionWordIndex]
+	n := len(wordIndex) / wordIndexRecordSize
+	decodingFor := func(i int) (uint32, string) {
+		return m.decodingAt(int(le.Uint32(wordIndex[i*wordIndexRecordSize:])))
+	}
+	i := sort.Search(n, func(i int) bool {
+		_, w := decodingFor(i)
+		return w >= word
+	})
+	if i < n {
+		if p, w := decodingFor(i); w == word {
+			return m.path(p), nil
+		}
+	}
+	return tree.Synsetpath{}, fmt.Errorf("no path found for word: %s", word)
+}
+
+// ReservedPath finds the path of a reserved word such as <END-OF-TEXT>
+func (m *Model) ReservedPath(word string) (tree.Synsetpath, error) {
+	reserved := m.sections[sectionReserved]
+	for i := 0; i+reservedRecordSize <= len(reserved); i += reservedRecordSize {
+		if m.str(le.Uint32(reserved[i:]), le.Uint32(reserved[i+4:])) == word {
+			return m.path(le.Uint32(reserved[i+8:])), nil
+		}
+	}
+	return tree.Synsetpath{}, fmt.Errorf("no path recorded for %s", word)
+}
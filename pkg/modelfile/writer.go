@@ -0,0 +1,293 @@
+package modelfile
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/decode"
+	"github.com/solresol/ultrametric-trees/pkg/node"
+	"github.com/solresol/ultrametric-trees/pkg/provenance"
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// A Decoding is one row of the decodings table
+type Decoding struct {
+	Path       tree.Synsetpath
+	Word       string
+	UsageCount int64
+}
+
+// Export writes the tree in nodesTable as it was at the cutoff, along
+// with the decodings table, to w.
+func Export(db *sql.DB, nodesTable string, cutoff node.Cutoff, source string, w io.Writer) (Metadata, error) {
+	history, err := node.FetchHistory(db, nodesTable)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("could not read %s: %v", nodesTable, err)
+	}
+	seq := history.Seq(cutoff)
+	snapshot, err := history.TreeAt(seq)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	decodings, err := loadDecodings(db)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	reserved := make(map[string]tree.Synsetpath)
+	for _, word := range []string{decode.StartOfText, decode.EndOfText, decode.Unknown} {
+		// Older databases won't have all of these
+		path, err := decode.ReservedPath(db, word)
+		if err == nil {
+			reserved[word] = path
+		}
+	}
+
+	runs, err := provenance.Fetch(db, nodesTable)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta := Metadata{
+		Source:       source,
+		NodesTable:   nodesTable,
+		Cutoff:       cutoff.String(),
+		Split:        seq,
+		NodeCount:    snapshot.Size(),
+		Exported:     time.Now().UTC(),
+		TrainingRuns: runs,
+	}
+	return meta, Write(w, snapshot, decodings, reserved, meta)
+}
+
+func loadDecodings(db *sql.DB) ([]Decoding, error) {
+	rows, err := db.Query("SELECT path, word, usage_count FROM decodings")
+	if err != nil {
+		return nil, fmt.Errorf("could not read decodings: %v", err)
+	}
+	defer rows.Close()
+	var decodings []Decoding
+	for rows.Next() {
+		var d Decoding
+		var usage sql.NullInt64
+		if err := rows.Scan(&d.Path, &d.Word, &usage); err != nil {
+			return nil, fmt.Errorf("could not read decodings: %v", err)
+		}
+		if d.Path.IsEmpty() {
+			continue
+		}
+		d.UsageCount = usage.Int64
+		decodings = append(decodings, d)
+	}
+	return decodings, rows.Err()
+}
+
+// pathTable interns paths, so that each one is only stored once
+type pathTable struct {
+	paths []tree.Synsetpath
+	index map[string]uint32
+}
+
+func (pt *pathTable) add(path tree.Synsetpath) {
+	if path.IsEmpty() {
+		return
+	}
+	if _, exists := pt.index[path.String()]; exists {
+		return
+	}
+	pt.index[path.String()] = 0
+	pt.paths = append(pt.paths, path)
+}
+
+func (pt *pathTable) lookup(path tree.Synsetpath) uint32 {
+	if path.IsEmpty() {
+		return noPath
+	}
+	return pt.index[path.String()]
+}
+
+// Write writes a model file. Only the nodes reachable from the root of
+// snapshot are included.
+func Write(w io.Writer, snapshot *node.Tree, decodings []Decoding, reserved map[string]tree.Synsetpath, meta Metadata) error {
+	var nodes []*node.Node
+	snapshot.Walk(func(n *node.Node, depth int) error {
+		nodes = append(nodes, n)
+		return nil
+	})
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	meta.NodeCount = len(nodes)
+
+	paths := &pathTable{index: make(map[string]uint32)}
+	for _, n := range nodes {
+		paths.add(n.ExemplarValue)
+		paths.add(n.InnerRegionPrefix)
+	}
+	for _, d := range decodings {
+		paths.add(d.Path)
+	}
+	for _, p := range reserved {
+		paths.add(p)
+	}
+	sort.Slice(paths.paths, func(i, j int) bool { return comparePaths(paths.paths[i].Path, paths.paths[j].Path) < 0 })
+	for i, p := range paths.paths {
+		paths.index[p.String()] = uint32(i)
+	}
+
+	var sections [sectionCount]bytes.Buffer
+	le := binary.LittleEndian
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	sections[sectionMetadata].Write(metaJSON)
+
+	start := uint32(0)
+	for _, p := range paths.paths {
+		var rec [pathIndexRecordSize]byte
+		le.PutUint32(rec[0:], start)
+		le.PutUint32(rec[4:], uint32(len(p.Path)))
+		sections[sectionPathIndex].Write(rec[:])
+		for _, c := range p.Path {
+			var comp [componentSize]byte
+			le.PutUint64(comp[:], uint64(int64(c)))
+			sections[sectionComponents].Write(comp[:])
+		}
+		start += uint32(len(p.Path))
+	}
+
+	for _, n := range nodes {
+		var rec [nodeRecordSize]byte
+		le.PutUint64(rec[0:], uint64(int64(n.ID)))
+		inner, outer := tree.NoNodeID, tree.NoNodeID
+		if !snapshot.IsLeaf(n.ID) {
+			inner, outer = n.InnerRegionNodeID, n.OuterRegionNodeID
+		}
+		le.PutUint64(rec[8:], uint64(int64(inner)))
+		le.PutUint64(rec[16:], uint64(int64(outer)))
+		le.PutUint32(rec[24:], paths.lookup(n.ExemplarValue))
+		prefix := uint32(noPath)
+		contextK := int32(0)
+		if !snapshot.IsLeaf(n.ID) {
+			prefix = paths.lookup(n.InnerRegionPrefix)
+			contextK = int32(n.ContextK.Int64)
+		}
+		le.PutUint32(rec[28:], prefix)
+		le.PutUint32(rec[32:], uint32(contextK))
+		flags := uint32(0)
+		if n.Loss.Valid {
+			flags |= hasLoss
+		}
+		if n.DataQuantity.Valid {
+			flags |= hasDataQuantity
+		}
+		le.PutUint32(rec[36:], flags)
+		le.PutUint64(rec[40:], math.Float64bits(n.Loss.Float64))
+		le.PutUint64(rec[48:], uint64(n.DataQuantity.Int64))
+		sections[sectionNodes].Write(rec[:])
+	}
+
+	var blob bytes.Buffer
+	addString := func(s string) (uint32, uint32) {
+		offset := uint32(blob.Len())
+		blob.WriteString(s)
+		return offset, uint32(len(s))
+	}
+
+	sorted := make([]Decoding, len(decodings))
+	copy(sorted, decodings)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, pj := paths.lookup(sorted[i].Path), paths.lookup(sorted[j].Path)
+		if pi != pj {
+			return pi < pj
+		}
+		return sorted[i].UsageCount > sorted[j].UsageCount
+	})
+	for _, d := range sorted {
+		var rec [decodingRecordSize]byte
+		offset, length := addString(d.Word)
+		le.PutUint32(rec[0:], paths.lookup(d.Path))
+		le.PutUint32(rec[4:], offset)
+		le.PutUint32(rec[8:], length)
+		le.PutUint64(rec[16:], uint64(d.UsageCount))
+		sections[sectionDecodings].Write(rec[:])
+	}
+
+	byWord := make([]int, len(sorted))
+	for i := range byWord {
+		byWord[i] = i
+	}
+	sort.SliceStable(byWord, func(i, j int) bool {
+		a, b := sorted[byWord[i]], sorted[byWord[j]]
+		if a.Word != b.Word {
+			return a.Word < b.Word
+		}
+		return a.UsageCount > b.UsageCount
+	})
+	for _, i := range byWord {
+		var rec [wordIndexRecordSize]byte
+		le.PutUint32(rec[:], uint32(i))
+		sections[sectionWordIndex].Write(rec[:])
+	}
+
+	reservedWords := make([]string, 0, len(reserved))
+	for word := range reserved {
+		reservedWords = append(reservedWords, word)
+	}
+	sort.Strings(reservedWords)
+	for _, word := range reservedWords {
+		var rec [reservedRecordSize]byte
+		offset, length := addString(word)
+		le.PutUint32(rec[0:], offset)
+		le.PutUint32(rec[4:], length)
+		le.PutUint32(rec[8:], paths.lookup(reserved[word]))
+		sections[sectionReserved].Write(rec[:])
+	}
+	sections[sectionStrings].Write(blob.Bytes())
+
+	// Now lay it all out
+	header := make([]byte, bodyOffset())
+	copy(header[0:], Magic)
+	le.PutUint32(header[8:], Version)
+	le.PutUint32(header[12:], sectionCount)
+	var body bytes.Buffer
+	offset := bodyOffset()
+	for i := range sections {
+		le.PutUint64(header[tableOffset()+i*sectionEntry:], uint64(offset))
+		le.PutUint64(header[tableOffset()+i*sectionEntry+8:], uint64(sections[i].Len()))
+		body.Write(sections[i].Bytes())
+		padding := align(sections[i].Len()) - sections[i].Len()
+		body.Write(make([]byte, padding))
+		offset += sections[i].Len() + padding
+	}
+	le.PutUint32(header[16:], crc32.ChecksumIEEE(body.Bytes()))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// comparePaths orders paths component by component, with prefixes
+// before the paths they are a prefix of
+func comparePaths(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
@@ -0,0 +1,303 @@
+package node
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// A Split is one step in the training of a tree: a leaf (Parent)
+// being divided into an Inner and an Outer child. Seq is the split_seq
+// that train gave it, which counts up from 1. There can be gaps where
+// nodeprune has removed splits.
+type Split struct {
+	Seq    int
+	When   time.Time
+	Parent *Node
+	Inner  *Node
+	Outer  *Node
+}
+
+// A History is the whole nodes table, loaded once, from which the
+// tree as it was after any number of splits can be rebuilt without
+// going back to the database.
+//
+// Splits are ordered by split_seq rather than by
+// when_children_populated, which only has second resolution. Tables
+// from before split_seq existed are ordered by the id of the first
+// child each split created: train creates both children and marks the
+// parent in one transaction, so the ids give the real order too.
+type History struct {
+	tableName string
+	nodes     map[tree.NodeID]*Node
+	splits    []Split
+	// splitOf[parentID] is the Seq of the split that gave that node
+	// its children
+	splitOf map[tree.NodeID]int
+}
+
+// FetchHistory reads the nodes table once.
+func FetchHistory(db *sql.DB, tableName string) (*History, error) {
+	nodes, err := FetchNodes(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return NewHistory(tableName, nodes), nil
+}
+
+// NewHistory works out the sequence of splits from the final state of
+// a nodes table. The nodes are copied.
+func NewHistory(tableName string, nodes []Node) *History {
+	h := &History{
+		tableName: tableName,
+		nodes:     make(map[tree.NodeID]*Node, len(nodes)),
+		splitOf:   make(map[tree.NodeID]int),
+	}
+	for i := range nodes {
+		n := nodes[i]
+		h.nodes[n.ID] = &n
+	}
+	for _, n := range h.nodes {
+		if !n.HasChildren {
+			continue
+		}
+		inner, innerExists := h.nodes[n.InnerRegionNodeID]
+		outer, outerExists := h.nodes[n.OuterRegionNodeID]
+		if !innerExists || !outerExists {
+			// Half-pruned, or otherwise damaged. There's nothing
+			// sensible we can say about when it happened.
+			continue
+		}
+		h.splits = append(h.splits, Split{
+			When:   n.WhenChildrenPopulated.Time,
+			Parent: n,
+			Inner:  inner,
+			Outer:  outer,
+		})
+	}
+	// Splits recorded before split_seq existed go first, in the order
+	// of their children's ids, and are numbered the same way that
+	// EnsureSplitSeq would number them.
+	sort.Slice(h.splits, func(i, j int) bool {
+		a, b := h.splits[i].Parent.SplitSeq, h.splits[j].Parent.SplitSeq
+		if a.Valid != b.Valid {
+			return !a.Valid
+		}
+		if a.Valid && a.Int64 != b.Int64 {
+			return a.Int64 < b.Int64
+		}
+		return firstChild(h.splits[i]) < firstChild(h.splits[j])
+	})
+	previous := 0
+	for i := range h.splits {
+		seq := previous + 1
+		if recorded := h.splits[i].Parent.SplitSeq; recorded.Valid && int(recorded.Int64) > previous {
+			seq = int(recorded.Int64)
+		}
+		h.splits[i].Seq = seq
+		h.splitOf[h.splits[i].Parent.ID] = seq
+		previous = seq
+	}
+	return h
+}
+
+func firstChild(s Split) tree.NodeID {
+	if s.Inner.ID < s.Outer.ID {
+		return s.Inner.ID
+	}
+	return s.Outer.ID
+}
+
+// Len is the number of splits.
+func (h *History) Len() int {
+	return len(h.splits)
+}
+
+// LastSeq is the Seq of the most recent split (0 if there haven't
+// been any). TreeAt(LastSeq()) is the current tree.
+func (h *History) LastSeq() int {
+	if len(h.splits) == 0 {
+		return 0
+	}
+	return h.splits[len(h.splits)-1].Seq
+}
+
+// Splits returns the splits in the order they happened. Together with
+// Root() this is enough to follow how the leaves changed over time
+// without building a Tree for every step.
+func (h *History) Splits() []Split {
+	return h.splits
+}
+
+// Root is the root node as it is now (i.e. possibly with children).
+func (h *History) Root() (*Node, bool) {
+	n, exists := h.nodes[tree.RootNodeID]
+	return n, exists
+}
+
+// SeqAsOf converts a moment in time into the Seq of the last split
+// that had happened by then.
+func (h *History) SeqAsOf(timestamp time.Time) int {
+	seq := 0
+	for _, s := range h.splits {
+		if s.When.After(timestamp) {
+			break
+		}
+		seq = s.Seq
+	}
+	return seq
+}
+
+// NodesAt returns the nodes that existed straight after split seq,
+// with any node that was split later on reset to look like the leaf it
+// was at the time.
+func (h *History) NodesAt(seq int) ([]Node, error) {
+	if seq < 0 || seq > h.LastSeq() {
+		return nil, fmt.Errorf("split %d is out of range: the last split in %s is %d", seq, h.tableName, h.LastSeq())
+	}
+	var nodes []Node
+	root, exists := h.Root()
+	if !exists {
+		return nodes, nil
+	}
+	nodes = append(nodes, h.asAt(root, seq))
+	for _, s := range h.splits {
+		if s.Seq > seq {
+			break
+		}
+		nodes = append(nodes, h.asAt(s.Inner, seq), h.asAt(s.Outer, seq))
+	}
+	return nodes, nil
+}
+
+func (h *History) asAt(n *Node, seq int) Node {
+	result := *n
+	if splitSeq, wasSplit := h.splitOf[n.ID]; wasSplit && splitSeq <= seq {
+		return result
+	}
+	result.HasChildren = false
+	result.WhenChildrenPopulated.Valid = false
+	result.OuterRegionNodeID = tree.NoNodeID
+	result.InnerRegionNodeID = tree.NoNodeID
+	result.InnerRegionPrefix = tree.Synsetpath{}
+	result.ContextK.Valid = false
+	result.SplitSeq.Valid = false
+	return result
+}
+
+// TreeAt is the tree straight after split seq. TreeAt(0) is just the
+// root.
+func (h *History) TreeAt(seq int) (*Tree, error) {
+	nodes, err := h.NodesAt(seq)
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(nodes), nil
+}
+
+// TreeAsOf is the tree as it was at a moment in time.
+func (h *History) TreeAsOf(timestamp time.Time) *Tree {
+	t, _ := h.TreeAt(h.SeqAsOf(timestamp))
+	return t
+}
+
+// A Cutoff is a point in the history of a tree, given either as a
+// split number or as a time. Times are converted to split numbers
+// using when_children_populated, so they are only as precise as that.
+type Cutoff struct {
+	Split int
+	Time  time.Time
+	// BySplit says which of the two to use
+	BySplit bool
+}
+
+func AtSplit(seq int) Cutoff {
+	return Cutoff{Split: seq, BySplit: true}
+}
+
+func AsOf(timestamp time.Time) Cutoff {
+	return Cutoff{Time: timestamp}
+}
+
+// NewCutoff is for command-line tools that have both --at-split and a
+// time flag. A negative atSplit means --at-split wasn't given.
+func NewCutoff(atSplit int, timestamp time.Time) Cutoff {
+	if atSplit >= 0 {
+		return AtSplit(atSplit)
+	}
+	return AsOf(timestamp)
+}
+
+func (c Cutoff) String() string {
+	if c.BySplit {
+		return fmt.Sprintf("split %d", c.Split)
+	}
+	return c.Time.Format("2006-01-02 15:04:05")
+}
+
+// Seq is the split number that the cutoff corresponds to in h.
+func (h *History) Seq(c Cutoff) int {
+	if c.BySplit {
+		return c.Split
+	}
+	return h.SeqAsOf(c.Time)
+}
+
+// TreeAtCutoff is TreeAt or TreeAsOf, depending on the cutoff
+func (h *History) TreeAtCutoff(c Cutoff) (*Tree, error) {
+	return h.TreeAt(h.Seq(c))
+}
+
+// FetchTreeAtCutoff reads the nodes table and returns the tree as it
+// was at the cutoff.
+func FetchTreeAtCutoff(db *sql.DB, tableName string, c Cutoff) (*Tree, error) {
+	h, err := FetchHistory(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return h.TreeAtCutoff(c)
+}
+
+// EnsureSplitSeq adds the split_seq column to a nodes table that was
+// created before it existed, and numbers any splits that don't have
+// one yet in the order that History works out for them.
+func EnsureSplitSeq(db *sql.DB, tableName string) error {
+	err := AddColumn(db, tableName, "split_seq integer")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_split_seq ON %s (split_seq)", tableName, tableName))
+	if err != nil {
+		return fmt.Errorf("could not index split_seq on %s: %v", tableName, err)
+	}
+
+	h, err := FetchHistory(db, tableName)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range h.Splits() {
+		if s.Parent.SplitSeq.Valid {
+			continue
+		}
+		query := fmt.Sprintf("UPDATE %s SET split_seq = ? WHERE id = ?", tableName)
+		if _, err := tx.Exec(query, s.Seq, s.Parent.ID); err != nil {
+			return fmt.Errorf("could not number the split of node %d: %v", s.Parent.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// NextSplitSeqSQL is a subquery for the split_seq of a split that is
+// about to be recorded. It has to run inside the same transaction as
+// the update that uses it.
+func NextSplitSeqSQL(tableName string) string {
+	return fmt.Sprintf("(SELECT coalesce(max(split_seq), 0) + 1 FROM %s)", tableName)
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestHistorySameSecondSplits(t *testing.T) {
+	// Both splits happen in the same second; only the ids say which
+	// came first.
+	when := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	nodes := sampleNodes()
+	nodes[0].WhenChildrenPopulated = sql.NullTime{Time: when, Valid: true}
+	nodes[2].WhenChildrenPopulated = sql.NullTime{Time: when, Valid: true}
+	h := NewHistory("nodes", nodes)
+
+	if h.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", h.Len())
+	}
+	if h.Splits()[0].Parent.ID != 1 || h.Splits()[1].Parent.ID != 3 {
+		t.Errorf("splits are in the wrong order: %d then %d", h.Splits()[0].Parent.ID, h.Splits()[1].Parent.ID)
+	}
+	if seq := h.SeqAsOf(when.Add(-time.Second)); seq != 0 {
+		t.Errorf("SeqAsOf(before) = %d, want 0", seq)
+	}
+	if seq := h.SeqAsOf(when); seq != 2 {
+		t.Errorf("SeqAsOf(when) = %d, want 2", seq)
+	}
+
+	for seq, wantLeaves := range []int{1, 2, 3} {
+		snapshot, err := h.TreeAt(seq)
+		if err != nil {
+			t.Fatalf("TreeAt(%d): %v", seq, err)
+		}
+		if got := len(snapshot.Leaves()); got != wantLeaves {
+			t.Errorf("TreeAt(%d) has %d leaves, want %d", seq, got, wantLeaves)
+		}
+	}
+	snapshot, _ := h.TreeAt(1)
+	n, _ := snapshot.Node(3)
+	if n.HasChildren || n.InnerRegionNodeID.Valid() {
+		t.Errorf("node 3 should look unsplit after the first split")
+	}
+	if _, err := h.TreeAt(3); err == nil {
+		t.Errorf("expected an error for a split that hasn't happened")
+	}
+}
+
+func TestHistoryRecordedSplitSeq(t *testing.T) {
+	// Node 3 was split first according to split_seq, and there's a gap
+	// where a split was pruned.
+	nodes := sampleNodes()
+	nodes[0].SplitSeq = sql.NullInt64{Int64: 5, Valid: true}
+	nodes[2].SplitSeq = sql.NullInt64{Int64: 2, Valid: true}
+	h := NewHistory("nodes", nodes)
+
+	if h.Splits()[0].Parent.ID != 3 || h.Splits()[0].Seq != 2 || h.Splits()[1].Seq != 5 {
+		t.Errorf("splits weren't ordered by split_seq")
+	}
+	if h.LastSeq() != 5 {
+		t.Errorf("LastSeq() = %d, want 5", h.LastSeq())
+	}
+	snapshot, err := h.TreeAtCutoff(AtSplit(4))
+	if err != nil {
+		t.Fatalf("TreeAtCutoff: %v", err)
+	}
+	// Node 3's children exist, but they aren't reachable until the root
+	// has been split.
+	if got := len(snapshot.Leaves()); got != 1 {
+		t.Errorf("TreeAt(4) has %d reachable leaves, want 1", got)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	nodes := sampleNodes()
+	losses := []float64{10, 2, 6, 1, 3}
+	quantities := []int64{10, 4, 6, 2, 4}
+	for i := range nodes {
+		nodes[i].Loss = sql.NullFloat64{Float64: losses[i], Valid: true}
+		nodes[i].DataQuantity = sql.NullInt64{Int64: quantities[i], Valid: true}
+	}
+	summaries := NewHistory("nodes", nodes).Summaries(2)
+	if len(summaries) != 3 {
+		t.Fatalf("got %d summaries, want 3", len(summaries))
+	}
+	last := summaries[2]
+	// The leaves are 2, 4 and 5
+	if last.SumLoss != 6 || last.LeafCount != 3 || last.NodeCount != 5 || last.TrainingDataSize != 10 {
+		t.Errorf("last summary = %+v", last)
+	}
+	if summaries[1].SumLoss != 8 {
+		t.Errorf("after the first split, the leaf loss should be 8, not %f", summaries[1].SumLoss)
+	}
+}
@@ -3,98 +3,170 @@ package node
 import (
 	"database/sql"
 	"fmt"
-	"sort"
+	"strings"
 	"time"
-)
 
-// I'd like to change the type of these nodes from int to a nodeID type
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
 
+// Empty paths (ExemplarValue.IsEmpty(), InnerRegionPrefix.IsEmpty())
+// and NoNodeID are what NULLs in the nodes table turn into.
 type Node struct {
-	ID                    int
-	ExemplarValue         sql.NullString
+	ID                    tree.NodeID
+	ExemplarValue         tree.Synsetpath
 	DataQuantity          sql.NullInt64
 	Loss                  sql.NullFloat64
 	ContextK              sql.NullInt64
-	InnerRegionPrefix     sql.NullString
-	InnerRegionNodeID     sql.NullInt64
-	OuterRegionNodeID     sql.NullInt64
+	InnerRegionPrefix     tree.Synsetpath
+	InnerRegionNodeID     tree.NodeID
+	OuterRegionNodeID     tree.NodeID
 	WhenCreated           time.Time
 	WhenChildrenPopulated sql.NullTime
 	HasChildren           bool
 	BeingAnalysed         bool
-	TableName             string
+	// SplitSeq numbers the splits in the order they happened. It is
+	// only set on nodes that have children.
+	SplitSeq sql.NullInt64
+	// Terminal leaves are never split, for TerminalReason
+	Terminal       bool
+	TerminalReason sql.NullString
+	TableName      string
 }
 
-func FetchNodeByID(db *sql.DB, tableName string, nodeID int) (Node, error) {
-	var n Node
-	query := fmt.Sprintf("SELECT * from %s WHERE ID = %d", tableName, nodeID)
-	err := db.QueryRow(query).Scan(
-		&n.ID, &n.ExemplarValue, &n.DataQuantity, &n.Loss, &n.ContextK,
-		&n.InnerRegionPrefix, &n.InnerRegionNodeID, &n.OuterRegionNodeID, &n.WhenCreated,
-		&n.WhenChildrenPopulated, &n.HasChildren, &n.BeingAnalysed,
-	)
-	n.TableName = tableName
+const nodeColumns = "id, exemplar_value, data_quantity, loss, contextk, inner_region_prefix, " +
+	"inner_region_node_id, outer_region_node, when_created, when_children_populated, has_children, being_analysed"
+
+// selectColumns copes with nodes tables from before split_seq and
+// terminal existed
+func selectColumns(db *sql.DB, tableName string) (string, error) {
+	columns := nodeColumns
+	exists, err := HasColumn(db, tableName, "split_seq")
 	if err != nil {
-		return n, fmt.Errorf("Could not retrieve node %d from %s: %v", nodeID, tableName, err)
+		return "", err
 	}
-	return n, nil
+	if exists {
+		columns += ", split_seq"
+	} else {
+		columns += ", NULL"
+	}
+	exists, err = HasColumn(db, tableName, "terminal")
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		columns += ", coalesce(terminal, false), terminal_reason"
+	} else {
+		columns += ", false, NULL"
+	}
+	return columns, nil
 }
 
-func FetchParent(db *sql.DB, node Node) (Node, bool, error) {
-	// Open to SQL injection attacks if you can set node.TableName
-	query := fmt.Sprintf("SELECT ID from %s where inner_region_node_id = %d or outer_region_node = %d", node.TableName, node.ID, node.ID)
-	var parentID int
-	var parentNode Node
-	err := db.QueryRow(query).Scan(&parentID)
-	if err == sql.ErrNoRows {
-		return parentNode, false, nil
+// AddColumn adds a column (e.g. "split_seq integer") to tableName
+// unless it is already there. Another process could be doing the same
+// thing at the same time, so losing that race isn't an error.
+func AddColumn(db *sql.DB, tableName, column string) error {
+	name := strings.Fields(column)[0]
+	exists, err := HasColumn(db, tableName, name)
+	if err != nil || exists {
+		return err
 	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, column))
 	if err != nil {
-		return parentNode, false, err
+		if exists, _ := HasColumn(db, tableName, name); exists {
+			return nil
+		}
+		return fmt.Errorf("could not add %s to %s: %v", name, tableName, err)
 	}
-	parentNode, err = FetchNodeByID(db, node.TableName, parentID)
-	return parentNode, true, err
+	return nil
 }
 
-func FetchAncestry(db *sql.DB, node Node) ([]Node, error) {
-	var ancestors []Node
-	thisAncestor := node
-	// Maybe to be safe I should count the number of ancestors, and give up if I hit a million or so?
-	for {
-		// log.Printf("Looking for ancestor of %d", thisAncestor.ID)
-		nextAncestor, exists, err := FetchParent(db, thisAncestor)
-		if !exists {
-			break
+// HasColumn says whether tableName has a column called columnName
+func HasColumn(db *sql.DB, tableName, columnName string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableName))
+	if err != nil {
+		return false, fmt.Errorf("could not get the columns of %s: %v", tableName, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
 		}
-		if err != nil {
-			return ancestors, fmt.Errorf("Could not fetch ancestor for %d from %s: %v", thisAncestor.ID, thisAncestor.TableName, err)
+		if name == columnName {
+			return true, nil
 		}
-		ancestors = append(ancestors, nextAncestor)
-		thisAncestor = nextAncestor
 	}
-	// All done, but it's the wrong way around.
-	var topDownAncestors []Node
-	for i := len(ancestors) - 1; i >= 0; i-- {
-		topDownAncestors = append(topDownAncestors, ancestors[i])
+	return false, rows.Err()
+}
+
+func FetchNodeByID(db *sql.DB, tableName string, nodeID tree.NodeID) (Node, error) {
+	var n Node
+	columns, err := selectColumns(db, tableName)
+	if err != nil {
+		return n, err
+	}
+	query := fmt.Sprintf("SELECT %s from %s WHERE ID = %d", columns, tableName, nodeID)
+	err = db.QueryRow(query).Scan(
+		&n.ID, &n.ExemplarValue, &n.DataQuantity, &n.Loss, &n.ContextK,
+		&n.InnerRegionPrefix, &n.InnerRegionNodeID, &n.OuterRegionNodeID, &n.WhenCreated,
+		&n.WhenChildrenPopulated, &n.HasChildren, &n.BeingAnalysed, &n.SplitSeq,
+		&n.Terminal, &n.TerminalReason,
+	)
+	n.TableName = tableName
+	if err != nil {
+		return n, fmt.Errorf("Could not retrieve node %d from %s: %v", nodeID, tableName, err)
 	}
-	return topDownAncestors, nil
+	return n, nil
 }
 
 func FetchNodes(db *sql.DB, tableName string) ([]Node, error) {
-	query := fmt.Sprintf("SELECT * FROM %s ORDER BY when_created", tableName)
+	columns, err := selectColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY id", columns, tableName)
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanNodes(rows, tableName)
+}
+
+// FetchAncestors returns nodeID and every node above it, without
+// reading the rest of the table
+func FetchAncestors(db *sql.DB, tableName string, nodeID tree.NodeID) ([]Node, error) {
+	columns, err := selectColumns(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+		WITH RECURSIVE ancestors(id) AS (
+			SELECT ?
+			UNION
+			SELECT parent.id FROM %s parent JOIN ancestors
+			ON parent.inner_region_node_id = ancestors.id OR parent.outer_region_node = ancestors.id
+		)
+		SELECT %s FROM %s WHERE id IN (SELECT id FROM ancestors) ORDER BY id`,
+		tableName, columns, tableName)
+	rows, err := db.Query(query, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return scanNodes(rows, tableName)
+}
 
+func scanNodes(rows *sql.Rows, tableName string) ([]Node, error) {
+	defer rows.Close()
 	var nodes []Node
 	for rows.Next() {
 		var n Node
 		err := rows.Scan(
 			&n.ID, &n.ExemplarValue, &n.DataQuantity, &n.Loss, &n.ContextK,
 			&n.InnerRegionPrefix, &n.InnerRegionNodeID, &n.OuterRegionNodeID, &n.WhenCreated,
-			&n.WhenChildrenPopulated, &n.HasChildren, &n.BeingAnalysed,
+			&n.WhenChildrenPopulated, &n.HasChildren, &n.BeingAnalysed, &n.SplitSeq,
+			&n.Terminal, &n.TerminalReason,
 		)
 		n.TableName = tableName
 		if err != nil {
@@ -102,80 +174,26 @@ func FetchNodes(db *sql.DB, tableName string) ([]Node, error) {
 		}
 		nodes = append(nodes, n)
 	}
-	return nodes, nil
+	return nodes, rows.Err()
 }
 
-// I now have three functions: FilterNodes (includeWithChildren=true), FilterNode (includeWithChildren=false)
-// and NodesAsOf. These do almost the same thing and I really need to clean it up. NodesAsOf will take
-// a moment in time and return what the tree structure would have looked like then
-//
-// I think we should be passing around a dictionary keyed on NodeID rather than Node arrays. To-do.
+// FetchNodesAsOf returns what the tree structure looked like at a
+// moment in time. It reads the whole table, so anything that wants
+// more than one snapshot should use FetchHistory instead.
 func FetchNodesAsOf(db *sql.DB, tableName string, timestamp time.Time) ([]Node, error) {
-	rawNodes, err := FetchNodes(db, tableName)
-	var nodes []Node
+	h, err := FetchHistory(db, tableName)
 	if err != nil {
-		return nodes, err
-	}
-	for _, node := range rawNodes {
-		if node.WhenCreated.After(timestamp) {
-			continue
-		}
-		if !node.HasChildren {
-			// Then it has no children, but it was created before the timestamp
-			// It's perfect as is
-			nodes = append(nodes, node)
-			continue
-		}
-		if node.WhenChildrenPopulated.Time.Before(timestamp) {
-			// It already had its children before cut-off
-			nodes = append(nodes, node)
-			continue
-		}
-		// It gained children *after* the cut-off. We need to make it
-		// appear as it was then.
-		node.HasChildren = false
-		node.WhenChildrenPopulated.Valid = false
-		node.OuterRegionNodeID.Valid = false
-		node.InnerRegionNodeID.Valid = false
-		node.InnerRegionPrefix.Valid = false
-		node.ContextK.Valid = false
-		nodes = append(nodes, node)
-	}
-	return nodes, nil
-}
-
-// Deprecated: Use FetchNodesAsOf instead
-func FilterNodes(nodes []Node, timestamp time.Time, includeWithChildren bool) []Node {
-	var filtered []Node
-	for _, node := range nodes {
-		if node.WhenCreated.Before(timestamp) &&
-			(!node.WhenChildrenPopulated.Valid ||
-				node.WhenChildrenPopulated.Time.After(timestamp) ||
-				(includeWithChildren && node.WhenChildrenPopulated.Time.Before(timestamp))) {
-			filtered = append(filtered, node)
-		}
+		return nil, err
 	}
-	return filtered
+	return h.NodesAt(h.SeqAsOf(timestamp))
 }
 
-func GetSignificantTimestamps(nodes []Node) []time.Time {
-	timestampMap := make(map[time.Time]bool)
-	for _, node := range nodes {
-		timestampMap[node.WhenCreated] = true
-		if node.WhenChildrenPopulated.Valid {
-			timestampMap[node.WhenChildrenPopulated.Time] = true
-		}
-	}
-
-	var timestamps []time.Time
-	for t := range timestampMap {
-		timestamps = append(timestamps, t)
+// FetchNodesAtSplit returns what the tree structure looked like right
+// after split number seq.
+func FetchNodesAtSplit(db *sql.DB, tableName string, seq int) ([]Node, error) {
+	h, err := FetchHistory(db, tableName)
+	if err != nil {
+		return nil, err
 	}
-
-	// Sort timestamps
-	sort.Slice(timestamps, func(i, j int) bool {
-		return timestamps[i].Before(timestamps[j])
-	})
-
-	return timestamps
+	return h.NodesAt(seq)
 }
@@ -0,0 +1,59 @@
+package node
+
+import (
+	"time"
+)
+
+// A Summary describes the leaves of a tree straight after a split.
+// Split 0 is the root on its own.
+type Summary struct {
+	Split            int
+	When             time.Time
+	SumLoss          float64
+	NodeCount        int
+	LeafCount        int
+	TrainingDataSize int
+}
+
+func (s Summary) AvgDataQuantity() float64 {
+	return float64(s.TrainingDataSize) / float64(s.LeafCount)
+}
+
+// add adds (sign = 1) or removes (sign = -1) a leaf
+func (s *Summary) add(n *Node, sign int) {
+	if n.Loss.Valid {
+		s.SumLoss += float64(sign) * n.Loss.Float64
+	}
+	if n.DataQuantity.Valid {
+		s.TrainingDataSize += sign * int(n.DataQuantity.Int64)
+		s.LeafCount += sign
+	}
+}
+
+// Summaries has one Summary for the root and then one for every split
+// up to and including lastSeq. Each split takes away one leaf and adds
+// two, so this takes time proportional to the number of splits, not
+// the square of it.
+func (h *History) Summaries(lastSeq int) []Summary {
+	var results []Summary
+	root, exists := h.Root()
+	if !exists {
+		return results
+	}
+	current := Summary{When: root.WhenCreated, NodeCount: 1}
+	current.add(root, 1)
+	results = append(results, current)
+	for _, s := range h.splits {
+		if s.Seq > lastSeq {
+			break
+		}
+		current.add(s.Parent, -1)
+		current.add(s.Inner, 1)
+		current.add(s.Outer, 1)
+		current.Split = s.Seq
+		current.When = s.When
+		current.NodeCount += 2
+		results = append(results, current)
+	}
+	return results
+}
@@ -0,0 +1,275 @@
+package node
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// A Tree is a snapshot of a nodes table, held in memory and keyed on
+// NodeID, with the parent links worked out once up-front. A child is
+// only part of the tree if it is in the snapshot, so a Tree built
+// from a History looks exactly like the model did at that point.
+type Tree struct {
+	nodes   map[tree.NodeID]*Node
+	parents map[tree.NodeID]tree.NodeID
+	depths  map[tree.NodeID]int
+}
+
+// NewTree builds a Tree out of a list of nodes (e.g. the result of
+// History.NodesAt). The nodes are copied.
+func NewTree(nodes []Node) *Tree {
+	t := &Tree{
+		nodes:   make(map[tree.NodeID]*Node, len(nodes)),
+		parents: make(map[tree.NodeID]tree.NodeID, len(nodes)),
+		depths:  make(map[tree.NodeID]int, len(nodes)),
+	}
+	for i := range nodes {
+		n := nodes[i]
+		t.nodes[n.ID] = &n
+	}
+	for id, n := range t.nodes {
+		for _, child := range []tree.NodeID{n.InnerRegionNodeID, n.OuterRegionNodeID} {
+			if _, exists := t.nodes[child]; exists {
+				t.parents[child] = id
+			}
+		}
+	}
+	// Depths are easiest to work out top-down
+	if _, exists := t.nodes[tree.RootNodeID]; exists {
+		t.walk(tree.RootNodeID, 0, func(n *Node, depth int) error {
+			t.depths[n.ID] = depth
+			return nil
+		})
+	}
+	return t
+}
+
+// FetchTree loads every node in the table, including ones that have
+// since been split.
+func FetchTree(db *sql.DB, tableName string) (*Tree, error) {
+	nodes, err := FetchNodes(db, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(nodes), nil
+}
+
+// FetchAncestorTree loads just enough of the table for
+// Ancestry(nodeID): the node itself and the nodes above it.
+func FetchAncestorTree(db *sql.DB, tableName string, nodeID tree.NodeID) (*Tree, error) {
+	nodes, err := FetchAncestors(db, tableName, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(nodes), nil
+}
+
+// EnsureChildIndexes indexes the child columns of a nodes table, so
+// that FetchAncestors can go up the tree without scanning all of it at
+// each level.
+func EnsureChildIndexes(db *sql.DB, tableName string) error {
+	for _, column := range []string{"inner_region_node_id", "outer_region_node"} {
+		_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s)", tableName, column, tableName, column))
+		if err != nil {
+			return fmt.Errorf("could not index %s on %s: %v", column, tableName, err)
+		}
+	}
+	return nil
+}
+
+// EnsureDepth adds a depth column to a nodes table that was created
+// before it existed, and fills it in for any node that doesn't have
+// one yet (which is every node, the first time). Nodes that train
+// creates after that get their depth when they are created.
+func EnsureDepth(db *sql.DB, tableName string) error {
+	if err := AddColumn(db, tableName, "depth integer"); err != nil {
+		return err
+	}
+	var missing int
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE depth IS NULL", tableName)
+	if err := db.QueryRow(query).Scan(&missing); err != nil {
+		return fmt.Errorf("could not check the depths in %s: %v", tableName, err)
+	}
+	if missing == 0 {
+		return nil
+	}
+
+	snapshot, err := FetchTree(db, tableName)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	update := fmt.Sprintf("UPDATE %s SET depth = ? WHERE id = ? AND depth IS NULL", tableName)
+	err = snapshot.Walk(func(n *Node, depth int) error {
+		if _, err := tx.Exec(update, depth, n.ID); err != nil {
+			return fmt.Errorf("could not set the depth of node %d: %v", n.ID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FetchTreeAsOf is FetchNodesAsOf, but returns a Tree
+func FetchTreeAsOf(db *sql.DB, tableName string, timestamp time.Time) (*Tree, error) {
+	nodes, err := FetchNodesAsOf(db, tableName, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return NewTree(nodes), nil
+}
+
+// Size is the number of nodes in the tree (not just leaves)
+func (t *Tree) Size() int {
+	return len(t.nodes)
+}
+
+func (t *Tree) Node(id tree.NodeID) (*Node, bool) {
+	n, exists := t.nodes[id]
+	return n, exists
+}
+
+func (t *Tree) Root() (*Node, bool) {
+	return t.Node(tree.RootNodeID)
+}
+
+// Parent returns the parent of a node, whether the node is the inner
+// child of that parent, and whether it has a parent at all (the root
+// doesn't).
+func (t *Tree) Parent(id tree.NodeID) (*Node, bool, bool) {
+	parentID, exists := t.parents[id]
+	if !exists {
+		return nil, false, false
+	}
+	parent := t.nodes[parentID]
+	return parent, parent.InnerRegionNodeID == id, true
+}
+
+// Depth is the number of splits between the root and this node (so
+// the root has depth 0). It's -1 for nodes that aren't reachable from
+// the root.
+func (t *Tree) Depth(id tree.NodeID) int {
+	depth, exists := t.depths[id]
+	if !exists {
+		return -1
+	}
+	return depth
+}
+
+// IsLeaf is true for nodes that don't have any children in this tree
+func (t *Tree) IsLeaf(id tree.NodeID) bool {
+	return len(t.Children(id)) == 0
+}
+
+// Children returns the inner child and then the outer child, skipping
+// any that aren't part of the tree.
+func (t *Tree) Children(id tree.NodeID) []*Node {
+	n, exists := t.nodes[id]
+	if !exists {
+		return nil
+	}
+	var children []*Node
+	for _, childID := range []tree.NodeID{n.InnerRegionNodeID, n.OuterRegionNodeID} {
+		if child, exists := t.nodes[childID]; exists {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// Ancestry is the path from the root down to (and including) the node.
+func (t *Tree) Ancestry(id tree.NodeID) ([]*Node, error) {
+	n, exists := t.nodes[id]
+	if !exists {
+		return nil, fmt.Errorf("node %d is not in the tree", id)
+	}
+	path := []*Node{n}
+	for {
+		parent, _, exists := t.Parent(n.ID)
+		if !exists {
+			break
+		}
+		if len(path) > len(t.nodes) {
+			return nil, fmt.Errorf("there is a cycle in the ancestry of node %d", id)
+		}
+		path = append(path, parent)
+		n = parent
+	}
+	// It's the wrong way around
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// Subtree is the node and all of its descendants, parents before
+// children.
+func (t *Tree) Subtree(id tree.NodeID) []*Node {
+	var result []*Node
+	if _, exists := t.nodes[id]; !exists {
+		return result
+	}
+	t.walk(id, t.Depth(id), func(n *Node, depth int) error {
+		result = append(result, n)
+		return nil
+	})
+	return result
+}
+
+// Leaves returns every leaf reachable from the root.
+func (t *Tree) Leaves() []*Node {
+	var leaves []*Node
+	t.Walk(func(n *Node, depth int) error {
+		if t.IsLeaf(n.ID) {
+			leaves = append(leaves, n)
+		}
+		return nil
+	})
+	return leaves
+}
+
+// Walk calls fn on every node reachable from the root, parents before
+// children and inner children before outer children. It stops at the
+// first error.
+func (t *Tree) Walk(fn func(n *Node, depth int) error) error {
+	if _, exists := t.nodes[tree.RootNodeID]; !exists {
+		return nil
+	}
+	return t.walk(tree.RootNodeID, 0, fn)
+}
+
+func (t *Tree) walk(id tree.NodeID, depth int, fn func(n *Node, depth int) error) error {
+	// Done with an explicit stack because trees can get very deep
+	type entry struct {
+		id    tree.NodeID
+		depth int
+	}
+	stack := []entry{{id, depth}}
+	visited := make(map[tree.NodeID]bool)
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[e.id] {
+			continue
+		}
+		visited[e.id] = true
+		n := t.nodes[e.id]
+		if err := fn(n, e.depth); err != nil {
+			return err
+		}
+		children := t.Children(e.id)
+		for i := len(children) - 1; i >= 0; i-- {
+			stack = append(stack, entry{children[i].ID, e.depth + 1})
+		}
+	}
+	return nil
+}
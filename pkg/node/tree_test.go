@@ -0,0 +1,128 @@
+package node
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/solresol/ultrametric-trees/pkg/tree"
+)
+
+// root (1) splits into 2 (inner) and 3 (outer); 3 splits into 4 and 5
+func sampleNodes() []Node {
+	return []Node{
+		{ID: 1, InnerRegionNodeID: 2, OuterRegionNodeID: 3, HasChildren: true},
+		{ID: 2, InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+		{ID: 3, InnerRegionNodeID: 4, OuterRegionNodeID: 5, HasChildren: true},
+		{ID: 4, InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+		{ID: 5, InnerRegionNodeID: tree.NoNodeID, OuterRegionNodeID: tree.NoNodeID},
+	}
+}
+
+func ids(nodes []*Node) []tree.NodeID {
+	result := make([]tree.NodeID, len(nodes))
+	for i, n := range nodes {
+		result[i] = n.ID
+	}
+	return result
+}
+
+func sameIDs(a, b []tree.NodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTreeStructure(t *testing.T) {
+	snapshot := NewTree(sampleNodes())
+
+	if snapshot.Size() != 5 {
+		t.Errorf("Size() = %d, want 5", snapshot.Size())
+	}
+	if got := ids(snapshot.Leaves()); !sameIDs(got, []tree.NodeID{2, 4, 5}) {
+		t.Errorf("Leaves() = %v", got)
+	}
+	if d := snapshot.Depth(4); d != 2 {
+		t.Errorf("Depth(4) = %d, want 2", d)
+	}
+	parent, isInner, exists := snapshot.Parent(4)
+	if !exists || parent.ID != 3 || !isInner {
+		t.Errorf("Parent(4) = %v, %v, %v", parent, isInner, exists)
+	}
+	if _, _, exists := snapshot.Parent(tree.RootNodeID); exists {
+		t.Errorf("the root shouldn't have a parent")
+	}
+	ancestry, err := snapshot.Ancestry(5)
+	if err != nil {
+		t.Fatalf("Ancestry(5): %v", err)
+	}
+	if got := ids(ancestry); !sameIDs(got, []tree.NodeID{1, 3, 5}) {
+		t.Errorf("Ancestry(5) = %v", got)
+	}
+	if got := ids(snapshot.Subtree(3)); !sameIDs(got, []tree.NodeID{3, 4, 5}) {
+		t.Errorf("Subtree(3) = %v", got)
+	}
+}
+
+func TestTreeIgnoresMissingChildren(t *testing.T) {
+	// A snapshot taken before node 3 was split
+	snapshot := NewTree(sampleNodes()[:3])
+	if !snapshot.IsLeaf(3) {
+		t.Errorf("node 3 should be a leaf when its children aren't in the snapshot")
+	}
+	if _, err := snapshot.Ancestry(4); err == nil {
+		t.Errorf("expected an error for a node that isn't in the snapshot")
+	}
+}
+
+func TestFetchAncestorTree(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	// The same shape as sampleNodes
+	_, err = db.Exec(`
+		CREATE TABLE nodes (id integer primary key, exemplar_value text, data_quantity integer,
+			loss float, contextk int, inner_region_prefix text, inner_region_node_id integer,
+			outer_region_node integer, when_created datetime default current_timestamp,
+			when_children_populated datetime, has_children bool default false,
+			being_analysed bool default false);
+		INSERT INTO nodes (id, inner_region_node_id, outer_region_node, has_children) VALUES
+			(1, 2, 3, true), (2, NULL, NULL, false), (3, 4, 5, true),
+			(4, NULL, NULL, false), (5, NULL, NULL, false);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating nodes: %v", err)
+	}
+	if err := EnsureChildIndexes(db, "nodes"); err != nil {
+		t.Fatalf("EnsureChildIndexes: %v", err)
+	}
+
+	ancestors, err := FetchAncestorTree(db, "nodes", 4)
+	if err != nil {
+		t.Fatalf("FetchAncestorTree(4): %v", err)
+	}
+	if ancestors.Size() != 3 {
+		t.Errorf("FetchAncestorTree(4) loaded %d nodes, want 3", ancestors.Size())
+	}
+	ancestry, err := ancestors.Ancestry(4)
+	if err != nil {
+		t.Fatalf("Ancestry(4): %v", err)
+	}
+	if got := ids(ancestry); !sameIDs(got, []tree.NodeID{1, 3, 4}) {
+		t.Errorf("Ancestry(4) = %v", got)
+	}
+
+	root, err := FetchAncestorTree(db, "nodes", tree.RootNodeID)
+	if err != nil || root.Size() != 1 {
+		t.Errorf("FetchAncestorTree(root) = %v, %v; want just the root", root, err)
+	}
+}
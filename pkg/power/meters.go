@@ -0,0 +1,180 @@
+package power
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONMeter reads net production from a JSON document served over
+// HTTP. Path says where the number is, e.g. "production.1.wNow" or
+// "$.sensors[0].value"; if MinusPath is given, the number there is
+// subtracted (for endpoints that report production and consumption
+// separately).
+type JSONMeter struct {
+	URL       string
+	Path      string
+	MinusPath string
+	Client    *http.Client
+}
+
+// NewEnvoy reads an Enphase Envoy's production.json
+func NewEnvoy(host string) *JSONMeter {
+	return &JSONMeter{
+		URL:       fmt.Sprintf("http://%s/production.json", host),
+		Path:      "production.1.wNow",
+		MinusPath: "consumption.0.wNow",
+	}
+}
+
+func (m *JSONMeter) NetWatts(ctx context.Context) (float64, error) {
+	client := m.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %v", m.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", m.URL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response body: %v", err)
+	}
+	return wattsFromJSON(body, m.Path, m.MinusPath)
+}
+
+func (m *JSONMeter) String() string {
+	return m.URL
+}
+
+// FileMeter reads net production from a file that something else
+// keeps up to date (e.g. a Home Assistant export). The file is either
+// just a number, or JSON with the number at Path.
+type FileMeter struct {
+	Name string
+	Path string
+}
+
+func (m *FileMeter) NetWatts(ctx context.Context) (float64, error) {
+	data, err := os.ReadFile(m.Name)
+	if err != nil {
+		return 0, err
+	}
+	return wattsFromOutput(data, m.Path)
+}
+
+func (m *FileMeter) String() string {
+	return m.Name
+}
+
+// CommandMeter runs a shell command that prints net production, either
+// as a number or as JSON with the number at Path.
+type CommandMeter struct {
+	Command string
+	Path    string
+	Timeout time.Duration
+}
+
+func (m *CommandMeter) NetWatts(ctx context.Context) (float64, error) {
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "sh", "-c", m.Command).Output()
+	if err != nil {
+		return 0, fmt.Errorf("%q failed: %v", m.Command, err)
+	}
+	return wattsFromOutput(output, m.Path)
+}
+
+func (m *CommandMeter) String() string {
+	return fmt.Sprintf("%q", m.Command)
+}
+
+func wattsFromOutput(data []byte, path string) (float64, error) {
+	if path != "" {
+		return wattsFromJSON(data, path, "")
+	}
+	text := strings.TrimSpace(string(data))
+	watts, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number of watts, got %q", text)
+	}
+	return watts, nil
+}
+
+func wattsFromJSON(data []byte, path, minusPath string) (float64, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return 0, fmt.Errorf("failed to parse JSON response: %v", err)
+	}
+	watts, err := lookupNumber(document, path)
+	if err != nil {
+		return 0, err
+	}
+	if minusPath == "" {
+		return watts, nil
+	}
+	minus, err := lookupNumber(document, minusPath)
+	if err != nil {
+		return 0, err
+	}
+	return watts - minus, nil
+}
+
+// lookupNumber follows a path like "a.b.1.c" (or "$.a.b[1].c")
+// through a decoded JSON document
+func lookupNumber(document interface{}, path string) (float64, error) {
+	normalised := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	normalised = strings.ReplaceAll(strings.ReplaceAll(normalised, "[", "."), "]", "")
+	current := document
+	if normalised != "" {
+		for _, step := range strings.Split(normalised, ".") {
+			switch value := current.(type) {
+			case map[string]interface{}:
+				next, exists := value[step]
+				if !exists {
+					return 0, fmt.Errorf("%s: there is no %q", path, step)
+				}
+				current = next
+			case []interface{}:
+				index, err := strconv.Atoi(step)
+				if err != nil || index < 0 || index >= len(value) {
+					return 0, fmt.Errorf("%s: no element %q in a list of %d", path, step, len(value))
+				}
+				current = value[index]
+			default:
+				return 0, fmt.Errorf("%s: can't look up %q in %v", path, step, value)
+			}
+		}
+	}
+	switch value := current.(type) {
+	case float64:
+		return value, nil
+	case string:
+		// Home Assistant reports states as strings
+		watts, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %q isn't a number", path, value)
+		}
+		return watts, nil
+	}
+	return 0, fmt.Errorf("%s: %v isn't a number", path, current)
+}
@@ -0,0 +1,132 @@
+package power
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Parse builds a policy from a description like
+//
+//	envoy:envoy.local or tariff:22:00-07:00
+//
+// The terms are
+//
+//	envoy:HOST              an Enphase Envoy's production.json
+//	json:URL#PATH[#MINUS]   a number in JSON served at URL
+//	file:NAME[#PATH]        a number (or JSON with a number at PATH) in a file
+//	command:COMMAND         a shell command that prints a number
+//	tariff:HH:MM-HH:MM      a time-of-day window
+//
+// joined by "and" and "or" ("and" binds more tightly; there are no
+// parentheses). A command is kept exactly as written, including "and"
+// and "or", up to an "and" or "or" that is followed by another term.
+// Meters allow training when there's a surplus, with the hysteresis
+// given by startAbove and stopBelow, so stopBelow can't be higher than
+// startAbove.
+func Parse(spec string, startAbove, stopBelow float64) (Policy, error) {
+	if stopBelow > startAbove {
+		return nil, fmt.Errorf("training would stop below %v watts but only start above %v watts; the stopping threshold can't be higher than the starting one", stopBelow, startAbove)
+	}
+	terms, operators := splitTerms(spec)
+	var alternatives Any
+	var required All
+	for i, term := range terms {
+		p, err := parseTerm(term, startAbove, stopBelow)
+		if err != nil {
+			return nil, err
+		}
+		required = append(required, p)
+		if i < len(operators) && operators[i] == "and" {
+			continue
+		}
+		if len(required) == 1 {
+			alternatives = append(alternatives, required[0])
+		} else {
+			alternatives = append(alternatives, required)
+		}
+		required = nil
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return alternatives, nil
+}
+
+var wordPattern = regexp.MustCompile(`\S+`)
+
+// splitTerms splits spec into its terms and the "and"s and "or"s
+// between them, leaving each term's text as it was
+func splitTerms(spec string) (terms, operators []string) {
+	words := wordPattern.FindAllStringIndex(spec, -1)
+	start := -1
+	command := false
+	for i, w := range words {
+		word := spec[w[0]:w[1]]
+		if word == "and" || word == "or" {
+			// Inside a command, these are only operators if another
+			// term follows them
+			if command && (i+1 == len(words) || !startsTerm(spec[words[i+1][0]:words[i+1][1]])) {
+				continue
+			}
+			if start < 0 {
+				terms = append(terms, "")
+			} else {
+				terms = append(terms, spec[start:words[i-1][1]])
+			}
+			operators = append(operators, word)
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = w[0]
+			command = strings.HasPrefix(word, "command:")
+		}
+	}
+	if start < 0 {
+		return append(terms, ""), operators
+	}
+	return append(terms, spec[start:words[len(words)-1][1]]), operators
+}
+
+// startsTerm says whether word looks like the beginning of a term
+func startsTerm(word string) bool {
+	kind, _, found := strings.Cut(word, ":")
+	switch kind {
+	case "envoy", "json", "file", "command", "tariff":
+		return found
+	}
+	return false
+}
+
+func parseTerm(term string, startAbove, stopBelow float64) (Policy, error) {
+	kind, arg, found := strings.Cut(strings.TrimSpace(term), ":")
+	if !found || arg == "" {
+		return nil, fmt.Errorf("expected something like envoy:HOST or tariff:22:00-07:00, got %q", term)
+	}
+	surplus := func(m Meter) (Policy, error) {
+		return NewSurplus(m, startAbove, stopBelow), nil
+	}
+	switch kind {
+	case "envoy":
+		return surplus(NewEnvoy(arg))
+	case "json":
+		parts := strings.Split(arg, "#")
+		if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+			return nil, fmt.Errorf("expected json:URL#PATH or json:URL#PATH#MINUSPATH, got %q", term)
+		}
+		m := &JSONMeter{URL: parts[0], Path: parts[1]}
+		if len(parts) == 3 {
+			m.MinusPath = parts[2]
+		}
+		return surplus(m)
+	case "file":
+		name, path, _ := strings.Cut(arg, "#")
+		return surplus(&FileMeter{Name: name, Path: path})
+	case "command":
+		return surplus(&CommandMeter{Command: arg})
+	case "tariff":
+		return ParseTariff(arg)
+	}
+	return nil, fmt.Errorf("unknown kind of power policy %q in %q", kind, term)
+}
@@ -0,0 +1,142 @@
+// Package power decides whether there is power to spare for training:
+// whether there's a solar surplus (according to an Enphase Envoy, or
+// any JSON endpoint, file or command that reports net production), or
+// whether it's an off-peak time of day, or some combination of these.
+package power
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Meter reports net power production in watts: positive when more
+// is being produced than consumed.
+type Meter interface {
+	NetWatts(ctx context.Context) (float64, error)
+	String() string
+}
+
+// A Decision is whether training should run, and why
+type Decision struct {
+	Allowed bool
+	Reason  string
+	// The net production, if a meter was read to decide
+	Watts    float64
+	HasWatts bool
+}
+
+// A Policy decides whether training should run now. Policies can keep
+// state between calls (e.g. for hysteresis), so each one should only be
+// used by one loop.
+type Policy interface {
+	Decide(ctx context.Context, now time.Time) (Decision, error)
+	String() string
+}
+
+// Surplus allows training while a meter shows a surplus. Training
+// starts once net production reaches StartAbove, and doesn't stop
+// until it drops below StopBelow; with StartAbove higher than
+// StopBelow, training doesn't flap on and off when production is
+// hovering around the threshold.
+type Surplus struct {
+	Meter      Meter
+	StartAbove float64
+	StopBelow  float64
+	running    bool
+}
+
+func NewSurplus(m Meter, startAbove, stopBelow float64) *Surplus {
+	return &Surplus{Meter: m, StartAbove: startAbove, StopBelow: stopBelow}
+}
+
+func (s *Surplus) Decide(ctx context.Context, now time.Time) (Decision, error) {
+	watts, err := s.Meter.NetWatts(ctx)
+	if err != nil {
+		return Decision{}, fmt.Errorf("%s: %v", s.Meter, err)
+	}
+	if s.running {
+		s.running = watts >= s.StopBelow
+	} else {
+		s.running = watts >= s.StartAbove
+	}
+	d := Decision{Allowed: s.running, Watts: watts, HasWatts: true}
+	if s.running {
+		d.Reason = fmt.Sprintf("net production from %s is %.2f watts", s.Meter, watts)
+	} else {
+		d.Reason = fmt.Sprintf("net production from %s is only %.2f watts", s.Meter, watts)
+	}
+	return d, nil
+}
+
+func (s *Surplus) String() string {
+	return s.Meter.String()
+}
+
+// Any allows training if any of its policies do. Every policy is
+// asked, so that they all keep their state up to date. A policy that
+// fails is ignored unless they all fail.
+type Any []Policy
+
+func (a Any) Decide(ctx context.Context, now time.Time) (Decision, error) {
+	return combine(ctx, now, a, true)
+}
+
+func (a Any) String() string {
+	return join(a, " or ")
+}
+
+// All allows training only if all of its policies do. If any of them
+// fails, so does All.
+type All []Policy
+
+func (a All) Decide(ctx context.Context, now time.Time) (Decision, error) {
+	return combine(ctx, now, a, false)
+}
+
+func (a All) String() string {
+	return join(a, " and ")
+}
+
+func combine(ctx context.Context, now time.Time, policies []Policy, any bool) (Decision, error) {
+	// For Any, it's allowed as soon as one says yes; for All, it's
+	// refused as soon as one says no
+	result := Decision{Allowed: !any}
+	var reasons, errs []string
+	for _, p := range policies {
+		d, err := p.Decide(ctx, now)
+		if err != nil {
+			if !any {
+				return Decision{}, err
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		if d.HasWatts && !result.HasWatts {
+			result.Watts = d.Watts
+			result.HasWatts = true
+		}
+		if d.Allowed == any {
+			result.Allowed = any
+		}
+		reasons = append(reasons, d.Reason)
+	}
+	if any && len(reasons) == 0 && len(errs) > 0 {
+		return Decision{}, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	if any {
+		result.Reason = strings.Join(reasons, " or ")
+	} else {
+		result.Reason = strings.Join(reasons, " and ")
+	}
+	return result, nil
+}
+
+func join(policies []Policy, separator string) string {
+	var names []string
+	for _, p := range policies {
+		names = append(names, p.String())
+	}
+	return strings.Join(names, separator)
+}
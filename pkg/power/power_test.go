@@ -0,0 +1,264 @@
+package power
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envoyStub serves production.json with whatever net production is
+// wanted
+type envoyStub struct {
+	production, consumption float64
+}
+
+func (s *envoyStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/production.json" {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintf(w, `{"production": [{"wNow": 0}, {"wNow": %f}], "consumption": [{"wNow": %f}, {"wNow": 1}]}`,
+		s.production, s.consumption)
+}
+
+func TestEnvoy(t *testing.T) {
+	stub := &envoyStub{production: 1500, consumption: 400}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	m := NewEnvoy(strings.TrimPrefix(server.URL, "http://"))
+	watts, err := m.NetWatts(context.Background())
+	if err != nil {
+		t.Fatalf("NetWatts: %v", err)
+	}
+	if watts != 1100 {
+		t.Errorf("NetWatts = %v, want 1100", watts)
+	}
+
+	m.URL = server.URL + "/missing"
+	if _, err := m.NetWatts(context.Background()); err == nil {
+		t.Error("NetWatts should fail when the endpoint is missing")
+	}
+}
+
+func TestJSONMeter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"entity_id": "sensor.grid", "attributes": {"readings": [{"value": "-250.5"}]}}`)
+	}))
+	defer server.Close()
+
+	p, err := Parse("json:"+server.URL+"#$.attributes.readings[0].value", 0, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	d, err := p.Decide(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("Decide: %v", err)
+	}
+	if d.Allowed || !d.HasWatts || d.Watts != -250.5 {
+		t.Errorf("Decide = %+v, want not allowed at -250.5 watts", d)
+	}
+
+	m := &JSONMeter{URL: server.URL, Path: "attributes.missing"}
+	if _, err := m.NetWatts(context.Background()); err == nil {
+		t.Error("NetWatts should fail when the path isn't there")
+	}
+}
+
+func TestFileAndCommandMeters(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "net")
+	if err := os.WriteFile(plain, []byte("42.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	structured := filepath.Join(dir, "net.json")
+	if err := os.WriteFile(structured, []byte(`{"net": {"watts": 17}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		meter Meter
+		want  float64
+	}{
+		{&FileMeter{Name: plain}, 42.5},
+		{&FileMeter{Name: structured, Path: "net.watts"}, 17},
+		{&CommandMeter{Command: "echo -12"}, -12},
+		{&CommandMeter{Command: "cat " + structured, Path: "net.watts"}, 17},
+	} {
+		watts, err := tt.meter.NetWatts(context.Background())
+		if err != nil {
+			t.Errorf("%s: %v", tt.meter, err)
+			continue
+		}
+		if watts != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.meter, watts, tt.want)
+		}
+	}
+	if _, err := (&CommandMeter{Command: "exit 1"}).NetWatts(context.Background()); err == nil {
+		t.Error("A failing command should be an error")
+	}
+}
+
+func TestHysteresis(t *testing.T) {
+	stub := &envoyStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	s := NewSurplus(NewEnvoy(strings.TrimPrefix(server.URL, "http://")), 200, -100)
+
+	// Starts above 200, keeps going until it's below -100
+	for _, step := range []struct {
+		net  float64
+		want bool
+	}{
+		{100, false},
+		{250, true},
+		{0, true},
+		{-50, true},
+		{-150, false},
+		{150, false},
+		{200, true},
+	} {
+		stub.production = step.net
+		d, err := s.Decide(context.Background(), time.Now())
+		if err != nil {
+			t.Fatalf("Decide: %v", err)
+		}
+		if d.Allowed != step.want {
+			t.Errorf("At %v watts: allowed = %v, want %v", step.net, d.Allowed, step.want)
+		}
+	}
+}
+
+func TestTariff(t *testing.T) {
+	offPeak, err := ParseTariff("22:00-07:00")
+	if err != nil {
+		t.Fatalf("ParseTariff: %v", err)
+	}
+	offPeak.Location = time.UTC
+	for hour, want := range map[int]bool{21: false, 22: true, 23: true, 0: true, 6: true, 7: false, 12: false} {
+		now := time.Date(2024, 1, 1, hour, 30, 0, 0, time.UTC)
+		if got := offPeak.contains(now); got != want {
+			t.Errorf("At %02d:30, contains = %v, want %v", hour, got, want)
+		}
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "07:00-07:00"} {
+		if _, err := ParseTariff(bad); err == nil {
+			t.Errorf("ParseTariff(%q) should fail", bad)
+		}
+	}
+}
+
+func TestComposition(t *testing.T) {
+	stub := &envoyStub{production: -500}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	p, err := Parse("envoy:"+host+" or tariff:22:00-07:00", 0, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	setUTC(p)
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	day := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if d, _ := p.Decide(context.Background(), night); !d.Allowed {
+		t.Errorf("No surplus, but off-peak: %+v", d)
+	}
+	if d, _ := p.Decide(context.Background(), day); d.Allowed {
+		t.Errorf("No surplus, and peak: %+v", d)
+	}
+	stub.production = 500
+	if d, _ := p.Decide(context.Background(), day); !d.Allowed || d.Watts != 500 {
+		t.Errorf("Surplus at peak: %+v", d)
+	}
+
+	// A broken meter doesn't stop the tariff from working
+	broken, err := Parse("json:"+server.URL+"/missing#x or tariff:22:00-07:00", 0, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	setUTC(broken)
+	if d, err := broken.Decide(context.Background(), night); err != nil || !d.Allowed {
+		t.Errorf("Broken meter or off-peak: %+v, %v", d, err)
+	}
+
+	both, err := Parse("envoy:"+host+" and tariff:22:00-07:00", 0, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	setUTC(both)
+	if d, _ := both.Decide(context.Background(), day); d.Allowed {
+		t.Errorf("Surplus at peak shouldn't be enough for and: %+v", d)
+	}
+	if d, _ := both.Decide(context.Background(), night); !d.Allowed {
+		t.Errorf("Surplus and off-peak: %+v", d)
+	}
+
+	for _, bad := range []string{"", "solar:x", "json:http://x", "tariff:soon"} {
+		if _, err := Parse(bad, 0, 0); err == nil {
+			t.Errorf("Parse(%q) should fail", bad)
+		}
+	}
+}
+
+// setUTC makes the tariffs in a policy use UTC, so the tests don't
+// depend on the local time zone
+func setUTC(p Policy) {
+	switch v := p.(type) {
+	case *Tariff:
+		v.Location = time.UTC
+	case Any:
+		for _, child := range v {
+			setUTC(child)
+		}
+	case All:
+		for _, child := range v {
+			setUTC(child)
+		}
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	p, err := Parse("command:test -f /tmp/x  &&  echo 5 or echo 6 and tariff:22:00-07:00 or command:echo 7 and", 0, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	alternatives, ok := p.(Any)
+	if !ok || len(alternatives) != 2 {
+		t.Fatalf("Parse = %#v, want two alternatives", p)
+	}
+	required, ok := alternatives[0].(All)
+	if !ok || len(required) != 2 {
+		t.Fatalf("First alternative = %#v, want a command and a tariff", alternatives[0])
+	}
+	if s, ok := required[0].(*Surplus); !ok || s.Meter.(*CommandMeter).Command != "test -f /tmp/x  &&  echo 5 or echo 6" {
+		t.Errorf("First command = %#v", required[0])
+	}
+	if _, ok := required[1].(*Tariff); !ok {
+		t.Errorf("Expected a tariff, got %#v", required[1])
+	}
+	if s, ok := alternatives[1].(*Surplus); !ok || s.Meter.(*CommandMeter).Command != "echo 7 and" {
+		t.Errorf("Second command = %#v", alternatives[1])
+	}
+
+	for _, bad := range []string{"envoy:x and", "or tariff:22:00-07:00", "envoy:x and foo"} {
+		if _, err := Parse(bad, 0, 0); err == nil {
+			t.Errorf("Parse(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseRejectsInvertedHysteresis(t *testing.T) {
+	if _, err := Parse("envoy:x", -100, 200); err == nil {
+		t.Error("Parse should fail when training would stop above where it starts")
+	}
+	if _, err := Parse("envoy:x", 200, 200); err != nil {
+		t.Errorf("Parse with equal thresholds: %v", err)
+	}
+}
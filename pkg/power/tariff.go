@@ -0,0 +1,59 @@
+package power
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tariff allows training during a window of each day, such as an
+// off-peak electricity tariff. The window can wrap past midnight
+// (22:00-07:00).
+type Tariff struct {
+	// Minutes after midnight
+	Start, End int
+	Location   *time.Location
+}
+
+// ParseTariff parses a window like "22:00-07:00", in local time
+func ParseTariff(window string) (*Tariff, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected a window like 22:00-07:00, got %q", window)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q in %q", part, window)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return nil, fmt.Errorf("the window %q is empty", window)
+	}
+	return &Tariff{Start: minutes[0], End: minutes[1], Location: time.Local}, nil
+}
+
+func (t *Tariff) contains(now time.Time) bool {
+	if t.Location != nil {
+		now = now.In(t.Location)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if t.Start < t.End {
+		return minute >= t.Start && minute < t.End
+	}
+	return minute >= t.Start || minute < t.End
+}
+
+func (t *Tariff) Decide(ctx context.Context, now time.Time) (Decision, error) {
+	if t.contains(now) {
+		return Decision{Allowed: true, Reason: fmt.Sprintf("it is within %s", t)}, nil
+	}
+	return Decision{Allowed: false, Reason: fmt.Sprintf("it is outside %s", t)}, nil
+}
+
+func (t *Tariff) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", t.Start/60, t.Start%60, t.End/60, t.End%60)
+}
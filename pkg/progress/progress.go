@@ -0,0 +1,342 @@
+// Package progress reports how far along a long-running program is.
+// On a terminal it redraws a single progress line; otherwise (e.g.
+// under cron or docker) it prints a line of JSON every so often, which
+// is easier for other programs to consume. The same status can also be
+// written to a table so that other tools can poll it.
+package progress
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the terminal line is redrawn
+	terminalInterval = 250 * time.Millisecond
+	// How often JSON is printed (and the status table updated) by default
+	DefaultInterval = 30 * time.Second
+
+	StatusTable = "progress_status"
+)
+
+type Config struct {
+	// Program is the name of the program (train, prepare...)
+	Program string
+	// Subject is what it is working on (e.g. the nodes table), to tell
+	// apart several runs of the same program on one database
+	Subject string
+	// Unit is what Done counts (splits, stories...)
+	Unit string
+	// Total is how many units there will be, or 0 if that isn't known
+	Total int64
+	// RatePer is the time unit that rates are given in
+	RatePer time.Duration
+	// Interval is how often to print JSON and update the status table
+	Interval time.Duration
+}
+
+// A Metric is an extra number to report alongside the progress
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Status is what gets printed as JSON and stored in the status table
+type Status struct {
+	Program    string             `json:"program"`
+	Subject    string             `json:"subject,omitempty"`
+	State      string             `json:"state"`
+	PID        int                `json:"pid"`
+	Started    time.Time          `json:"started"`
+	Updated    time.Time          `json:"updated"`
+	Done       int64              `json:"done"`
+	Total      int64              `json:"total,omitempty"`
+	Unit       string             `json:"unit"`
+	Rate       float64            `json:"rate"`
+	RatePer    string             `json:"rate_per"`
+	ETASeconds *float64           `json:"eta_seconds,omitempty"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+}
+
+type Reporter struct {
+	config   Config
+	out      io.Writer
+	terminal bool
+	now      func() time.Time
+	db       *sql.DB
+
+	mu          sync.Mutex
+	started     time.Time
+	done        int64
+	metrics     []Metric
+	lastDrawn   time.Time
+	lastEmitted time.Time
+	line        string
+}
+
+// New creates a Reporter that writes to standard output
+func New(config Config) *Reporter {
+	return newReporter(config, os.Stdout, IsTerminal(os.Stdout), time.Now)
+}
+
+func newReporter(config Config, out io.Writer, terminal bool, now func() time.Time) *Reporter {
+	if config.RatePer == 0 {
+		config.RatePer = time.Second
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultInterval
+	}
+	return &Reporter{
+		config:   config,
+		out:      out,
+		terminal: terminal,
+		now:      now,
+		started:  now(),
+	}
+}
+
+// IsTerminal is true if f is a terminal (rather than a file or a pipe)
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// RecordTo makes the reporter keep a row of the status table in db up
+// to date.
+func (r *Reporter) RecordTo(db *sql.DB) error {
+	if err := CreateStatusTable(db); err != nil {
+		return err
+	}
+	r.db = db
+	return nil
+}
+
+func CreateStatusTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			program text not null,
+			subject text not null,
+			state text not null,
+			pid integer,
+			started timestamp,
+			updated timestamp,
+			done integer,
+			total integer,
+			unit text,
+			rate float,
+			rate_per text,
+			eta_seconds float,
+			metrics text,
+			primary key (program, subject)
+		)`, StatusTable))
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", StatusTable, err)
+	}
+	return nil
+}
+
+func (r *Reporter) SetTotal(total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config.Total = total
+}
+
+// Update records that done units have been completed. It only
+// actually prints anything (or touches the database) every so often,
+// so it's fine to call it in a tight loop.
+func (r *Reporter) Update(done int64, metrics ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = done
+	if len(metrics) > 0 {
+		r.metrics = metrics
+	}
+	now := r.now()
+	if r.terminal && now.Sub(r.lastDrawn) >= terminalInterval {
+		r.draw(now)
+	}
+	if now.Sub(r.lastEmitted) >= r.config.Interval {
+		r.emit(now, "running")
+	}
+}
+
+// Finish prints the final status, whatever the time since the last one
+func (r *Reporter) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if r.terminal {
+		r.draw(now)
+		fmt.Fprintln(r.out)
+		r.line = ""
+	}
+	r.emit(now, "finished")
+}
+
+// Status is a snapshot of the progress so far
+func (r *Reporter) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status(r.now(), "running")
+}
+
+func (r *Reporter) status(now time.Time, state string) Status {
+	s := Status{
+		Program: r.config.Program,
+		Subject: r.config.Subject,
+		State:   state,
+		PID:     os.Getpid(),
+		Started: r.started,
+		Updated: now,
+		Done:    r.done,
+		Total:   r.config.Total,
+		Unit:    r.config.Unit,
+		RatePer: rateUnitName(r.config.RatePer),
+	}
+	elapsed := now.Sub(r.started)
+	if elapsed > 0 {
+		s.Rate = float64(r.done) / (float64(elapsed) / float64(r.config.RatePer))
+	}
+	if r.config.Total > 0 && r.done > 0 && r.done <= r.config.Total {
+		eta := elapsed.Seconds() * float64(r.config.Total-r.done) / float64(r.done)
+		s.ETASeconds = &eta
+	}
+	if len(r.metrics) > 0 {
+		s.Metrics = make(map[string]float64, len(r.metrics))
+		for _, m := range r.metrics {
+			s.Metrics[m.Name] = m.Value
+		}
+	}
+	return s
+}
+
+func rateUnitName(d time.Duration) string {
+	switch d {
+	case time.Second:
+		return "sec"
+	case time.Minute:
+		return "min"
+	case time.Hour:
+		return "hour"
+	}
+	return d.String()
+}
+
+// Line is the text of the terminal progress line
+func (s Status) Line() string {
+	var parts []string
+	if s.Total > 0 {
+		fraction := math.Min(float64(s.Done)/float64(s.Total), 1)
+		const width = 20
+		filled := int(fraction * width)
+		parts = append(parts, fmt.Sprintf("[%s%s] %5.1f%% %d/%d %s",
+			strings.Repeat("=", filled), strings.Repeat(" ", width-filled), 100*fraction, s.Done, s.Total, s.Unit))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d %s", s.Done, s.Unit))
+	}
+	parts = append(parts, fmt.Sprintf("%.2f %s/%s", s.Rate, s.Unit, s.RatePer))
+	if s.ETASeconds != nil {
+		parts = append(parts, fmt.Sprintf("ETA %v", time.Duration(*s.ETASeconds*float64(time.Second)).Round(time.Second)))
+	}
+	names := make([]string, 0, len(s.Metrics))
+	for name := range s.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, formatMetric(s.Metrics[name])))
+	}
+	return strings.Join(parts, "  ")
+}
+
+func formatMetric(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return fmt.Sprintf("%d", int64(v))
+	}
+	return fmt.Sprintf("%.3f", v)
+}
+
+func (r *Reporter) draw(now time.Time) {
+	r.line = r.status(now, "running").Line()
+	fmt.Fprintf(r.out, "\r\033[K%s", r.line)
+	r.lastDrawn = now
+}
+
+func (r *Reporter) emit(now time.Time, state string) {
+	r.lastEmitted = now
+	s := r.status(now, state)
+	if !r.terminal {
+		encoded, err := json.Marshal(s)
+		if err == nil {
+			fmt.Fprintln(r.out, string(encoded))
+		}
+	}
+	if r.db != nil {
+		// A failure here shouldn't stop the real work
+		if err := writeStatus(r.db, s); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not update %s: %v\n", StatusTable, err)
+		}
+	}
+}
+
+func writeStatus(db *sql.DB, s Status) error {
+	var metrics []byte
+	if s.Metrics != nil {
+		var err error
+		metrics, err = json.Marshal(s.Metrics)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(fmt.Sprintf(`
+		INSERT INTO %s (program, subject, state, pid, started, updated, done, total, unit, rate, rate_per, eta_seconds, metrics)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (program, subject) DO UPDATE SET
+			state = excluded.state, pid = excluded.pid, started = excluded.started,
+			updated = excluded.updated, done = excluded.done, total = excluded.total,
+			unit = excluded.unit, rate = excluded.rate, rate_per = excluded.rate_per,
+			eta_seconds = excluded.eta_seconds, metrics = excluded.metrics`, StatusTable),
+		s.Program, s.Subject, s.State, s.PID, s.Started.UTC(), s.Updated.UTC(), s.Done, s.Total,
+		s.Unit, s.Rate, s.RatePer, s.ETASeconds, string(metrics))
+	return err
+}
+
+// LogWriter wraps w (normally standard error) so that log messages
+// don't get tangled up with the progress line: the line is cleared
+// before each message and redrawn afterwards. Use it with
+// log.SetOutput.
+func (r *Reporter) LogWriter(w io.Writer) io.Writer {
+	if !r.terminal {
+		return w
+	}
+	return &logWriter{r: r, w: w}
+}
+
+type logWriter struct {
+	r *Reporter
+	w io.Writer
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.r.mu.Lock()
+	defer lw.r.mu.Unlock()
+	if lw.r.line != "" {
+		fmt.Fprint(lw.r.out, "\r\033[K")
+	}
+	n, err := lw.w.Write(p)
+	if lw.r.line != "" {
+		fmt.Fprint(lw.r.out, lw.r.line)
+	}
+	return n, err
+}
@@ -0,0 +1,113 @@
+package progress
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestJSONStatus(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	var out bytes.Buffer
+	r := newReporter(Config{Program: "prepare", Unit: "stories", Total: 100, Interval: time.Minute}, &out, false, clock.now)
+
+	// The first update is printed straight away, and then nothing more
+	// until the interval has gone by
+	clock.t = clock.t.Add(20 * time.Second)
+	r.Update(10)
+	clock.t = clock.t.Add(40 * time.Second)
+	r.Update(25, Metric{"new_records", 400})
+	clock.t = clock.t.Add(20 * time.Second)
+	r.Update(40)
+	clock.t = clock.t.Add(10 * time.Second)
+	r.Finish()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Got %d lines of output, want 3:\n%s", len(lines), out.String())
+	}
+	var s Status
+	if err := json.Unmarshal([]byte(lines[1]), &s); err != nil {
+		t.Fatalf("Could not parse %q: %v", lines[1], err)
+	}
+	if s.State != "running" || s.Done != 40 || s.Total != 100 {
+		t.Errorf("Got %+v", s)
+	}
+	// 40 stories in 80 seconds, and 60 to go
+	if s.Rate != 0.5 {
+		t.Errorf("Rate = %v, want 0.5", s.Rate)
+	}
+	if s.ETASeconds == nil || *s.ETASeconds != 120 {
+		t.Errorf("ETASeconds = %v, want 120", s.ETASeconds)
+	}
+	// The metrics carry over from the last update that had some
+	if s.Metrics["new_records"] != 400 {
+		t.Errorf("Metrics = %v", s.Metrics)
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &s); err != nil {
+		t.Fatalf("Could not parse %q: %v", lines[2], err)
+	}
+	if s.State != "finished" || s.Done != 40 {
+		t.Errorf("Got %+v", s)
+	}
+}
+
+func TestLine(t *testing.T) {
+	eta := 90.0
+	s := Status{Done: 5, Total: 10, Unit: "splits", Rate: 12, RatePer: "hour", ETASeconds: &eta,
+		Metrics: map[string]float64{"total_leaf_loss": 12.5, "splittable_leaves": 7}}
+	want := "[==========          ]  50.0% 5/10 splits  12.00 splits/hour  ETA 1m30s  splittable_leaves=7  total_leaf_loss=12.500"
+	if got := s.Line(); got != want {
+		t.Errorf("Line() = %q, want %q", got, want)
+	}
+
+	s = Status{Done: 5, Unit: "splits", Rate: 12, RatePer: "hour"}
+	if got := s.Line(); got != "5 splits  12.00 splits/hour" {
+		t.Errorf("Line() without a total = %q", got)
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	var out bytes.Buffer
+	r := newReporter(Config{Program: "train", Subject: "nodes", Unit: "splits", RatePer: time.Hour}, &out, true, clock.now)
+	if err := r.RecordTo(db); err != nil {
+		t.Fatalf("RecordTo: %v", err)
+	}
+	clock.t = clock.t.Add(time.Hour)
+	r.Update(3, Metric{"splittable_leaves", 4})
+	clock.t = clock.t.Add(time.Hour)
+	r.Update(6)
+	r.Finish()
+
+	if strings.Contains(out.String(), "{") {
+		t.Errorf("JSON was printed to a terminal: %q", out.String())
+	}
+
+	var count int
+	var state, ratePer, metrics string
+	var done int64
+	var rate float64
+	err = db.QueryRow("SELECT count(*), state, done, rate, rate_per, metrics FROM progress_status").Scan(&count, &state, &done, &rate, &ratePer, &metrics)
+	if err != nil {
+		t.Fatalf("Could not read progress_status: %v", err)
+	}
+	if count != 1 || state != "finished" || done != 6 || rate != 3 || ratePer != "hour" || metrics != `{"splittable_leaves":4}` {
+		t.Errorf("Got count=%d state=%s done=%d rate=%v rate_per=%s metrics=%s", count, state, done, rate, ratePer, metrics)
+	}
+}
@@ -0,0 +1,274 @@
+// Package provenance records how a model was trained: the
+// hyperparameters, the data and the version of the code, once for
+// every time train is started (or restarted) on it. This lives in the
+// training_runs table of the model database, next to the nodes.
+package provenance
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/solresol/ultrametric-trees/pkg/node"
+)
+
+const Table = "training_runs"
+
+// Runs recorded before train had --strategy all split the leaf with the
+// largest loss
+const legacyStrategy = "loss"
+
+// Run is one start (or resumption) of train on a nodes table
+type Run struct {
+	ID         int64     `json:"id"`
+	NodesTable string    `json:"nodes_table"`
+	Started    time.Time `json:"started"`
+	// The last split that had been made when this run started
+	StartSplit  int    `json:"start_split"`
+	Resumed     bool   `json:"resumed"`
+	Forced      bool   `json:"forced"`
+	Hostname    string `json:"hostname"`
+	CodeVersion string `json:"code_version"`
+	// The run identifier in the training events table
+	EventRun string `json:"event_run,omitempty"`
+
+	Database          string `json:"database"`
+	TrainingDataTable string `json:"training_data_table"`
+	TrainingDataRows  int64  `json:"training_data_rows"`
+	NodeBucketTable   string `json:"node_bucket_table"`
+
+	Seed                   int64 `json:"seed"`
+	ContextLength          int   `json:"context_length"`
+	ExemplarGuesses        int   `json:"exemplar_guesses"`
+	CostGuesses            int   `json:"cost_guesses"`
+	SplitCountTry          int   `json:"split_count_try"`
+	NumCirclesPerSplit     int   `json:"num_circles_per_split"`
+	NodeSplittingThreshold int   `json:"node_splitting_threshold"`
+	// How train chose which leaf to split next
+	Strategy string `json:"strategy"`
+
+	// Stopping rules (0 for none). The ones that mark leaves as
+	// terminal are part of what the tree is; the others only say when
+	// this run stopped.
+	MaxDepth               int     `json:"max_depth"`
+	MinImprovement         float64 `json:"min_improvement"`
+	MinRelativeImprovement float64 `json:"min_relative_improvement"`
+	Significance           float64 `json:"significance"`
+	SignificanceTrials     int     `json:"significance_trials"`
+	MaxNodes               int     `json:"max_nodes"`
+	MaxTimeSeconds         float64 `json:"max_time_seconds"`
+	// Nodes that would take more memory than this were streamed, and
+	// their splits estimated from samples (0 for no limit)
+	MaxMemory int64 `json:"max_memory"`
+}
+
+// ruleColumns are the columns for the stopping rules and --max-memory,
+// which runs recorded before they existed don't have
+var ruleColumns = []string{
+	"max_depth integer",
+	"min_improvement float",
+	"min_relative_improvement float",
+	"significance float",
+	"significance_trials integer",
+	"max_nodes integer",
+	"max_time_seconds float",
+	"max_memory integer",
+}
+
+// CodeVersion is the git commit the running program was built from,
+// as far as Go knows.
+func CodeVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		if info.Main.Version != "" {
+			return info.Main.Version
+		}
+		return "unknown"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// Conflicts lists the ways that r was trained differently from
+// previous. Resuming with a conflict means that the model is no longer
+// the product of one set of hyperparameters.
+func (r Run) Conflicts(previous Run) []string {
+	var result []string
+	check := func(name string, before, now interface{}) {
+		if before != now {
+			result = append(result, fmt.Sprintf("%s was %v, now %v", name, before, now))
+		}
+	}
+	check("training-data", previous.TrainingDataTable, r.TrainingDataTable)
+	check("node-bucket", previous.NodeBucketTable, r.NodeBucketTable)
+	check("seed", previous.Seed, r.Seed)
+	check("context-length", previous.ContextLength, r.ContextLength)
+	check("exemplar-guesses", previous.ExemplarGuesses, r.ExemplarGuesses)
+	check("cost-guesses", previous.CostGuesses, r.CostGuesses)
+	check("split-count-try", previous.SplitCountTry, r.SplitCountTry)
+	check("num-circles-per-split", previous.NumCirclesPerSplit, r.NumCirclesPerSplit)
+	check("node-splitting-threshold", previous.NodeSplittingThreshold, r.NodeSplittingThreshold)
+	check("strategy", previous.Strategy, r.Strategy)
+	// Leaves that were marked as terminal under other rules would stay
+	// that way
+	check("max-depth", previous.MaxDepth, r.MaxDepth)
+	check("min-improvement", previous.MinImprovement, r.MinImprovement)
+	check("min-relative-improvement", previous.MinRelativeImprovement, r.MinRelativeImprovement)
+	check("significance", previous.Significance, r.Significance)
+	if r.Significance > 0 {
+		check("significance-trials", previous.SignificanceTrials, r.SignificanceTrials)
+	}
+	return result
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id integer primary key autoincrement,
+			nodes_table text not null,
+			started timestamp not null,
+			start_split integer,
+			resumed bool,
+			forced bool,
+			hostname text,
+			code_version text,
+			event_run text,
+			database_path text,
+			training_data_table text,
+			training_data_rows integer,
+			node_bucket_table text,
+			seed integer,
+			context_length integer,
+			exemplar_guesses integer,
+			cost_guesses integer,
+			split_count_try integer,
+			num_circles_per_split integer,
+			node_splitting_threshold integer,
+			strategy text
+		)`, Table))
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", Table, err)
+	}
+	// The table may have been created before there were strategies or
+	// stopping rules
+	for _, column := range append([]string{"strategy text"}, ruleColumns...) {
+		if err := node.AddColumn(db, Table, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record stores r, and sets its ID
+func Record(db *sql.DB, r *Run) error {
+	if err := CreateTable(db); err != nil {
+		return err
+	}
+	err := db.QueryRow(fmt.Sprintf(`
+		INSERT INTO %s (nodes_table, started, start_split, resumed, forced, hostname, code_version, event_run,
+			database_path, training_data_table, training_data_rows, node_bucket_table,
+			seed, context_length, exemplar_guesses, cost_guesses, split_count_try,
+			num_circles_per_split, node_splitting_threshold, strategy,
+			max_depth, min_improvement, min_relative_improvement, significance, significance_trials,
+			max_nodes, max_time_seconds, max_memory)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`, Table),
+		r.NodesTable, r.Started.UTC(), r.StartSplit, r.Resumed, r.Forced, r.Hostname, r.CodeVersion, r.EventRun,
+		r.Database, r.TrainingDataTable, r.TrainingDataRows, r.NodeBucketTable,
+		r.Seed, r.ContextLength, r.ExemplarGuesses, r.CostGuesses, r.SplitCountTry,
+		r.NumCirclesPerSplit, r.NodeSplittingThreshold, r.Strategy,
+		r.MaxDepth, r.MinImprovement, r.MinRelativeImprovement, r.Significance, r.SignificanceTrials,
+		r.MaxNodes, r.MaxTimeSeconds, r.MaxMemory).Scan(&r.ID)
+	if err != nil {
+		return fmt.Errorf("could not record the training run: %v", err)
+	}
+	return nil
+}
+
+// Fetch returns the runs that trained nodesTable, oldest first. Models
+// trained before training_runs existed have none.
+func Fetch(db *sql.DB, nodesTable string) ([]Run, error) {
+	var exists bool
+	err := db.QueryRow("SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?", Table).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("could not check for %s: %v", Table, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	hasStrategy, err := node.HasColumn(db, Table, "strategy")
+	if err != nil {
+		return nil, err
+	}
+	strategy := fmt.Sprintf("'%s'", legacyStrategy)
+	if hasStrategy {
+		strategy = fmt.Sprintf("coalesce(strategy, '%s')", legacyStrategy)
+	}
+	// Runs from before the stopping rules had none
+	hasRules, err := node.HasColumn(db, Table, "max_depth")
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]string, len(ruleColumns))
+	for i, column := range ruleColumns {
+		rules[i] = "0"
+		if hasRules {
+			rules[i] = fmt.Sprintf("coalesce(%s, 0)", strings.Fields(column)[0])
+		}
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, nodes_table, started, start_split, resumed, forced, hostname, code_version, event_run,
+			database_path, training_data_table, training_data_rows, node_bucket_table,
+			seed, context_length, exemplar_guesses, cost_guesses, split_count_try,
+			num_circles_per_split, node_splitting_threshold, %s, %s
+		FROM %s
+		WHERE nodes_table = ?
+		ORDER BY id`, strategy, strings.Join(rules, ", "), Table), nodesTable)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", Table, err)
+	}
+	defer rows.Close()
+	var result []Run
+	for rows.Next() {
+		var r Run
+		var eventRun sql.NullString
+		err := rows.Scan(&r.ID, &r.NodesTable, &r.Started, &r.StartSplit, &r.Resumed, &r.Forced,
+			&r.Hostname, &r.CodeVersion, &eventRun,
+			&r.Database, &r.TrainingDataTable, &r.TrainingDataRows, &r.NodeBucketTable,
+			&r.Seed, &r.ContextLength, &r.ExemplarGuesses, &r.CostGuesses, &r.SplitCountTry,
+			&r.NumCirclesPerSplit, &r.NodeSplittingThreshold, &r.Strategy,
+			&r.MaxDepth, &r.MinImprovement, &r.MinRelativeImprovement, &r.Significance, &r.SignificanceTrials,
+			&r.MaxNodes, &r.MaxTimeSeconds, &r.MaxMemory)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", Table, err)
+		}
+		r.EventRun = eventRun.String
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// Latest is the most recent run on nodesTable, or nil if there isn't one
+func Latest(db *sql.DB, nodesTable string) (*Run, error) {
+	runs, err := Fetch(db, nodesTable)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[len(runs)-1], nil
+}
@@ -0,0 +1,109 @@
+package provenance
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func sampleRun() Run {
+	return Run{
+		NodesTable:             "nodes",
+		Started:                time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Hostname:               "careful10000",
+		CodeVersion:            "abc123",
+		Database:               "slm-w2.sqlite",
+		TrainingDataTable:      "training_data",
+		TrainingDataRows:       1000,
+		NodeBucketTable:        "node_bucket",
+		Seed:                   1,
+		ContextLength:          16,
+		ExemplarGuesses:        1000,
+		CostGuesses:            1000,
+		SplitCountTry:          100,
+		NumCirclesPerSplit:     10,
+		NodeSplittingThreshold: 1,
+		Strategy:               "loss",
+		MaxDepth:               20,
+		MinRelativeImprovement: 0.01,
+		Significance:           0.05,
+		SignificanceTrials:     19,
+		MaxTimeSeconds:         3600,
+		MaxMemory:              1 << 30,
+	}
+}
+
+func TestRecordAndFetch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	// Nothing recorded yet, and no table
+	latest, err := Latest(db, "nodes")
+	if err != nil || latest != nil {
+		t.Fatalf("Latest on an empty database = %v, %v", latest, err)
+	}
+
+	first := sampleRun()
+	second := sampleRun()
+	second.Resumed = true
+	second.StartSplit = 30
+	second.EventRun = "run2"
+	other := sampleRun()
+	other.NodesTable = "model2"
+	for _, r := range []*Run{&first, &other, &second} {
+		if err := Record(db, r); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	runs, err := Fetch(db, "nodes")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("Got %d runs, want 2", len(runs))
+	}
+	for i, want := range []Run{first, second} {
+		runs[i].Started = runs[i].Started.UTC()
+		if !reflect.DeepEqual(runs[i], want) {
+			t.Errorf("Run %d = %+v, want %+v", i, runs[i], want)
+		}
+	}
+	latest, err = Latest(db, "nodes")
+	if err != nil || latest == nil || latest.ID != second.ID {
+		t.Errorf("Latest = %v, %v, want run %d", latest, err, second.ID)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	previous := sampleRun()
+	now := sampleRun()
+	// These can change from one run to the next
+	now.Hostname = "elsewhere"
+	now.CodeVersion = "def456"
+	now.Started = now.Started.Add(time.Hour)
+	// So can the rules that only say when a run stops
+	now.MaxNodes = 5000
+	now.MaxTimeSeconds = 60
+	now.MaxMemory = 0
+	if conflicts := now.Conflicts(previous); len(conflicts) != 0 {
+		t.Errorf("Unexpected conflicts: %v", conflicts)
+	}
+
+	now.Seed = 2
+	now.ContextLength = 8
+	now.Strategy = "breadth-first"
+	now.MaxDepth = 10
+	now.Significance = 0.01
+	want := []string{"seed was 1, now 2", "context-length was 16, now 8", "strategy was loss, now breadth-first",
+		"max-depth was 20, now 10", "significance was 0.05, now 0.01"}
+	if conflicts := now.Conflicts(previous); !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("Conflicts = %v, want %v", conflicts, want)
+	}
+}
@@ -0,0 +1,186 @@
+// Package sketch has the fixed-size summaries that train uses to
+// look for splits in nodes that are too big to load into memory: a
+// reservoir (a uniform sample of a stream), a count-min sketch
+// (approximate counts of the things in a stream) and a bottom-k
+// sample (a uniform sample of the distinct things in a stream).
+// Each of them sees every item once, in whatever order the items
+// arrive, and never uses more memory than it was created with. Their
+// randomness all comes from the rand.Rand they are given, so a seeded
+// training run is repeatable.
+package sketch
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+)
+
+// Reservoir keeps a uniform random sample of up to Size items from
+// everything it has been offered (Vitter's algorithm R)
+type Reservoir[T any] struct {
+	items []T
+	size  int
+	seen  int
+	rng   *rand.Rand
+}
+
+func NewReservoir[T any](size int, rng *rand.Rand) *Reservoir[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &Reservoir[T]{size: size, rng: rng}
+}
+
+func (r *Reservoir[T]) Add(item T) {
+	r.seen++
+	if len(r.items) < r.size {
+		r.items = append(r.items, item)
+		return
+	}
+	if i := r.rng.Intn(r.seen); i < r.size {
+		r.items[i] = item
+	}
+}
+
+// Items is the sample. It is only uniform once everything has been
+// added.
+func (r *Reservoir[T]) Items() []T {
+	return r.items
+}
+
+// Seen is how many items have been offered
+func (r *Reservoir[T]) Seen() int {
+	return r.seen
+}
+
+// CountMin estimates how often each string has been added. An
+// estimate is never too low, and is too high by at most
+// e/width of the total count with probability 1 - e^-depth.
+type CountMin struct {
+	width  int
+	counts [][]uint32
+	seeds  []uint64
+	total  int
+}
+
+func NewCountMin(width, depth int, rng *rand.Rand) *CountMin {
+	if width < 1 {
+		width = 1
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	c := &CountMin{width: width}
+	for i := 0; i < depth; i++ {
+		c.counts = append(c.counts, make([]uint32, width))
+		c.seeds = append(c.seeds, rng.Uint64())
+	}
+	return c
+}
+
+// CountMinBytes is the memory that NewCountMin(width, depth) uses
+func CountMinBytes(width, depth int) int {
+	return width * depth * 4
+}
+
+func (c *CountMin) Add(key string) {
+	c.total++
+	for i, seed := range c.seeds {
+		cell := &c.counts[i][hash(seed, key)%uint64(c.width)]
+		if *cell < math.MaxUint32 {
+			*cell++
+		}
+	}
+}
+
+// Estimate is at least the number of times key has been added
+func (c *CountMin) Estimate(key string) int {
+	estimate := uint32(math.MaxUint32)
+	for i, seed := range c.seeds {
+		estimate = min(estimate, c.counts[i][hash(seed, key)%uint64(c.width)])
+	}
+	return int(estimate)
+}
+
+// Total is the number of times anything has been added
+func (c *CountMin) Total() int {
+	return c.total
+}
+
+// BottomK keeps a uniform random sample of up to k of the distinct
+// strings that it has been given, however often each one turns up:
+// the ones with the k smallest hashes.
+type BottomK struct {
+	k      int
+	seed   uint64
+	heap   hashHeap
+	member map[string]bool
+}
+
+func NewBottomK(k int, rng *rand.Rand) *BottomK {
+	if k < 1 {
+		k = 1
+	}
+	return &BottomK{k: k, seed: rng.Uint64(), member: map[string]bool{}}
+}
+
+func (b *BottomK) Add(key string) {
+	if b.member[key] {
+		return
+	}
+	h := hash(b.seed, key)
+	if len(b.heap) == b.k {
+		if h >= b.heap[0].hash {
+			return
+		}
+		evicted := heap.Pop(&b.heap).(hashed)
+		delete(b.member, evicted.key)
+	}
+	heap.Push(&b.heap, hashed{hash: h, key: key})
+	b.member[key] = true
+}
+
+// Keys is the sample, in no particular order
+func (b *BottomK) Keys() []string {
+	keys := make([]string, len(b.heap))
+	for i, h := range b.heap {
+		keys[i] = h.key
+	}
+	return keys
+}
+
+// hash is FNV-1a, started from seed, with a final mix so that similar
+// keys (1.2.3 and 1.2.4) end up far apart
+func hash(seed uint64, key string) uint64 {
+	h := 14695981039346656037 ^ seed
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+type hashed struct {
+	hash uint64
+	key  string
+}
+
+// hashHeap is a max-heap, so that the largest of the k smallest
+// hashes is the one at the top
+type hashHeap []hashed
+
+func (h hashHeap) Len() int           { return len(h) }
+func (h hashHeap) Less(i, j int) bool { return h[i].hash > h[j].hash }
+func (h hashHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x any)        { *h = append(*h, x.(hashed)) }
+func (h *hashHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
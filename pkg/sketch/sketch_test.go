@@ -0,0 +1,109 @@
+package sketch
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestReservoirIsUniform(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const items, size, trials = 20, 5, 20000
+	picked := make([]int, items)
+	for trial := 0; trial < trials; trial++ {
+		r := NewReservoir[int](size, rng)
+		for i := 0; i < items; i++ {
+			r.Add(i)
+		}
+		if len(r.Items()) != size || r.Seen() != items {
+			t.Fatalf("Reservoir has %d items after seeing %d", len(r.Items()), r.Seen())
+		}
+		for _, i := range r.Items() {
+			picked[i]++
+		}
+	}
+	// Each item should be in a quarter of the samples
+	expected := trials * size / items
+	for i, n := range picked {
+		if n < expected*9/10 || n > expected*11/10 {
+			t.Errorf("Item %d was sampled %d times, expected about %d", i, n, expected)
+		}
+	}
+
+	small := NewReservoir[string](10, rng)
+	small.Add("only")
+	if len(small.Items()) != 1 {
+		t.Errorf("A reservoir that has seen 1 item holds %d", len(small.Items()))
+	}
+}
+
+func TestCountMinNeverUnderestimates(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	c := NewCountMin(200, 4, rng)
+	truth := map[string]int{}
+	for i := 0; i < 5000; i++ {
+		// A few common keys and a long tail
+		key := fmt.Sprintf("%d.%d", i%3, rng.Intn(1+i%500))
+		c.Add(key)
+		truth[key]++
+	}
+	if c.Total() != 5000 {
+		t.Errorf("Total = %d, want 5000", c.Total())
+	}
+	for key, n := range truth {
+		estimate := c.Estimate(key)
+		if estimate < n {
+			t.Errorf("Estimate(%s) = %d, but it was added %d times", key, estimate, n)
+		}
+		// e/width of the total, with a little slack
+		if estimate > n+5000*3/200 {
+			t.Errorf("Estimate(%s) = %d is far above %d", key, estimate, n)
+		}
+	}
+	if c.Estimate("never added") > 5000*3/200 {
+		t.Errorf("Estimate of a missing key is %d", c.Estimate("never added"))
+	}
+}
+
+func TestBottomKIsAUniformSampleOfDistinctKeys(t *testing.T) {
+	const distinct, k, trials = 30, 6, 5000
+	picked := map[string]int{}
+	for trial := 0; trial < trials; trial++ {
+		b := NewBottomK(k, rand.New(rand.NewSource(int64(trial))))
+		for i := 0; i < 600; i++ {
+			// Key 0 turns up far more often than the others, which
+			// mustn't make it any more likely to be sampled
+			key := 0
+			if i%2 == 0 {
+				key = (i / 2) % distinct
+			}
+			b.Add(fmt.Sprint(key))
+		}
+		keys := b.Keys()
+		if len(keys) != k {
+			t.Fatalf("BottomK kept %d keys, want %d", len(keys), k)
+		}
+		seen := map[string]bool{}
+		for _, key := range keys {
+			if seen[key] {
+				t.Fatalf("BottomK kept %s twice", key)
+			}
+			seen[key] = true
+			picked[key]++
+		}
+	}
+	expected := trials * k / distinct
+	for key, n := range picked {
+		if n < expected*8/10 || n > expected*12/10 {
+			t.Errorf("Key %s was sampled %d times, expected about %d", key, n, expected)
+		}
+	}
+
+	few := NewBottomK(10, rand.New(rand.NewSource(1)))
+	for _, key := range []string{"a", "b", "a"} {
+		few.Add(key)
+	}
+	if len(few.Keys()) != 2 {
+		t.Errorf("BottomK of 2 distinct keys kept %v", few.Keys())
+	}
+}
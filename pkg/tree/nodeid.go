@@ -0,0 +1,39 @@
+package tree
+
+import (
+	"database/sql/driver"
+	"fmt"
+)
+
+// NodeID identifies a row in a nodes table.
+type NodeID int
+
+const RootNodeID NodeID = 1
+const NoNodeID NodeID = -1
+
+// Valid is false for NoNodeID (and anything else that couldn't be a
+// row ID in the nodes table).
+func (id NodeID) Valid() bool {
+	return id > 0
+}
+
+// Scan implements sql.Scanner. NULL becomes NoNodeID.
+func (id *NodeID) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*id = NoNodeID
+	case int64:
+		*id = NodeID(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a NodeID", value)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer. NoNodeID is stored as NULL.
+func (id NodeID) Value() (driver.Value, error) {
+	if !id.Valid() {
+		return nil, nil
+	}
+	return int64(id), nil
+}
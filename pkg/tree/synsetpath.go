@@ -0,0 +1,141 @@
+package tree
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Synsetpath is a path through the synset hierarchy, like
+// 1.3.4.1.72. The zero value (no components at all) is the "empty"
+// path, which is how a NULL in the database comes back. Nothing valid
+// can be empty: ParseSynsetpath refuses to create one.
+type Synsetpath struct {
+	Path []int
+}
+
+func ParseSynsetpath(s string) (Synsetpath, error) {
+	parts := strings.Split(s, ".")
+	path := make([]int, len(parts))
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return Synsetpath{}, fmt.Errorf("invalid synsetpath: %s", s)
+		}
+		if num < 0 {
+			return Synsetpath{}, fmt.Errorf("negative number not allowed in synsetpath: %s", s)
+		}
+		path[i] = num
+	}
+	return Synsetpath{Path: path}, nil
+}
+
+func (sp Synsetpath) String() string {
+	parts := make([]string, len(sp.Path))
+	for i, num := range sp.Path {
+		parts[i] = strconv.Itoa(num)
+	}
+	return strings.Join(parts, ".")
+}
+
+// IsEmpty is true for the zero Synsetpath (e.g. a NULL column)
+func (sp Synsetpath) IsEmpty() bool {
+	return len(sp.Path) == 0
+}
+
+func (sp Synsetpath) Equal(other Synsetpath) bool {
+	if len(sp.Path) != len(other.Path) {
+		return false
+	}
+	for i := range sp.Path {
+		if sp.Path[i] != other.Path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CommonPrefixLen is the number of components (from the left) that
+// the two paths have in common. 1.2.3 and 1.2.4.5 have 2 in common;
+// 1.2 and 1.23 have 1.
+func (sp Synsetpath) CommonPrefixLen(other Synsetpath) int {
+	n := 0
+	for n < len(sp.Path) && n < len(other.Path) && sp.Path[n] == other.Path[n] {
+		n++
+	}
+	return n
+}
+
+// IsPrefixOf is true if other starts with every component of sp (so
+// a path is a prefix of itself). The comparison is component-wise:
+// 1.2 is a prefix of 1.2.3 but not of 1.23. The empty path is not a
+// prefix of anything.
+func (sp Synsetpath) IsPrefixOf(other Synsetpath) bool {
+	if sp.IsEmpty() || len(sp.Path) > len(other.Path) {
+		return false
+	}
+	return sp.CommonPrefixLen(other) == len(sp.Path)
+}
+
+// Contains says whether other is inside the region (circle) sp. This
+// is the definition that training uses to decide which rows go to the
+// inner node of a split, so anything that needs to route a context
+// through the tree (inference, verify, ...) must use this and nothing
+// else, or the two will disagree about which leaf a row belongs to.
+// A region contains itself and everything below it, compared
+// component-wise: 1.2 contains 1.2.3 but not 1.23.4.
+func (sp Synsetpath) Contains(other Synsetpath) bool {
+	return sp.IsPrefixOf(other)
+}
+
+// Truncate returns the first n components of the path (or the whole
+// path if it's shorter than that). The result doesn't share storage
+// with sp.
+func (sp Synsetpath) Truncate(n int) Synsetpath {
+	if n < 0 {
+		n = 0
+	}
+	if n > len(sp.Path) {
+		n = len(sp.Path)
+	}
+	path := make([]int, n)
+	copy(path, sp.Path[:n])
+	return Synsetpath{Path: path}
+}
+
+// Scan implements sql.Scanner. NULL becomes the empty path.
+func (sp *Synsetpath) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		*sp = Synsetpath{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	default:
+		return fmt.Errorf("cannot scan %T into a Synsetpath", value)
+	}
+	if s == "" {
+		*sp = Synsetpath{}
+		return nil
+	}
+	parsed, err := ParseSynsetpath(s)
+	if err != nil {
+		return err
+	}
+	*sp = parsed
+	return nil
+}
+
+// Value implements driver.Valuer. The empty path is stored as NULL.
+func (sp Synsetpath) Value() (driver.Value, error) {
+	if sp.IsEmpty() {
+		return nil, nil
+	}
+	return sp.String(), nil
+}
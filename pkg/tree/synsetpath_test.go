@@ -0,0 +1,128 @@
+package tree
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func mustParse(t *testing.T, s string) Synsetpath {
+	t.Helper()
+	sp, err := ParseSynsetpath(s)
+	if err != nil {
+		t.Fatalf("ParseSynsetpath(%q) returned unexpected error: %v", s, err)
+	}
+	return sp
+}
+
+func TestIsPrefixOf(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		path     string
+		expected bool
+	}{
+		{"1.2", "1.2.3", true},
+		{"1.2", "1.2", true},
+		{"1.2", "1.23", false},
+		{"1.2", "1.23.4", false},
+		{"1.2.3", "1.2", false},
+		{"2", "1.2", false},
+	}
+
+	for _, tt := range tests {
+		got := mustParse(t, tt.prefix).IsPrefixOf(mustParse(t, tt.path))
+		if got != tt.expected {
+			t.Errorf("%s.IsPrefixOf(%s) = %v, want %v", tt.prefix, tt.path, got, tt.expected)
+		}
+	}
+
+	if (Synsetpath{}).IsPrefixOf(mustParse(t, "1.2")) {
+		t.Errorf("The empty path should not be a prefix of anything")
+	}
+}
+
+func TestContains(t *testing.T) {
+	region := mustParse(t, "1.2")
+	if !region.Contains(mustParse(t, "1.2.3")) {
+		t.Errorf("1.2 should contain 1.2.3")
+	}
+	if region.Contains(mustParse(t, "1.23.4")) {
+		t.Errorf("1.2 should not contain 1.23.4")
+	}
+	if mustParse(t, "1.2.3").Contains(region) {
+		t.Errorf("1.2.3 should not contain 1.2")
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.2.3", "1.2.4.5", 2},
+		{"1.2", "1.23", 1},
+		{"1.2.3", "1.2.3", 3},
+		{"4", "1.2.3", 0},
+	}
+
+	for _, tt := range tests {
+		got := mustParse(t, tt.a).CommonPrefixLen(mustParse(t, tt.b))
+		if got != tt.expected {
+			t.Errorf("%s.CommonPrefixLen(%s) = %d, want %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	sp := mustParse(t, "1.2.3.4")
+	if got := sp.Truncate(2).String(); got != "1.2" {
+		t.Errorf("Truncate(2) = %s, want 1.2", got)
+	}
+	if got := sp.Truncate(10).String(); got != "1.2.3.4" {
+		t.Errorf("Truncate(10) = %s, want 1.2.3.4", got)
+	}
+	truncated := sp.Truncate(2)
+	truncated.Path[0] = 99
+	if sp.Path[0] != 1 {
+		t.Errorf("Truncate shares storage with the original path")
+	}
+}
+
+func TestDatabaseRoundTrip(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE nodes (id INTEGER PRIMARY KEY, prefix TEXT, child INTEGER)`)
+	if err != nil {
+		t.Fatalf("Error creating test table: %v", err)
+	}
+
+	want := mustParse(t, "1.3.4.1.72")
+	_, err = db.Exec("INSERT INTO nodes (id, prefix, child) VALUES (?, ?, ?), (?, ?, ?)",
+		NodeID(1), want, NodeID(2),
+		NodeID(2), Synsetpath{}, NoNodeID)
+	if err != nil {
+		t.Fatalf("Error inserting rows: %v", err)
+	}
+
+	var prefix Synsetpath
+	var child NodeID
+	if err := db.QueryRow("SELECT prefix, child FROM nodes WHERE id = ?", RootNodeID).Scan(&prefix, &child); err != nil {
+		t.Fatalf("Error scanning row 1: %v", err)
+	}
+	if !reflect.DeepEqual(prefix, want) || child != 2 {
+		t.Errorf("Got (%s, %d), want (%s, 2)", prefix, child, want)
+	}
+
+	if err := db.QueryRow("SELECT prefix, child FROM nodes WHERE id = 2").Scan(&prefix, &child); err != nil {
+		t.Fatalf("Error scanning row 2: %v", err)
+	}
+	if !prefix.IsEmpty() || child != NoNodeID {
+		t.Errorf("NULLs came back as (%v, %d), want the empty path and NoNodeID", prefix, child)
+	}
+}